@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,6 +26,86 @@ type Config struct {
 
 	ClaudeAllowedTools string
 	ClaudeWorkingDir   string
+	ClaudeConfigDir    string // the CLI's state dir (session transcripts live in projects/)
+
+	// Server-private files (chat uploads, terminal recordings) of users of
+	// the shared workspace; per-user workspaces keep them inside themselves
+	DataDir string
+
+	// Directories besides ClaudeWorkingDir that chat sessions may run in
+	WorkspaceExtraRoots []string
+
+	// Give every user their own <ClaudeWorkingDir>/<username> workspace, and
+	// run their processes as UID/GID WorkspaceUIDBase+n (0 = as the server's user)
+	WorkspacePerUser bool
+	WorkspaceUIDBase int
+
+	// Start terminals and Claude processes in their own Linux mount/PID/network
+	// namespaces, with each user's processes sharing one cgroup v2 group
+	// limited to the Sandbox* values (0 = unlimited; admins can override them
+	// per user). SandboxNetwork lets terminals use the host network; Claude
+	// always does, as the CLI has to reach the API.
+	SandboxEnabled    bool
+	SandboxCgroupRoot string
+	SandboxNetwork    bool
+	SandboxMemoryMB   int64
+	SandboxCPUPercent int
+	SandboxPids       int64
+	SandboxUID        int // unprivileged UID/GID sandboxed processes without their own UID run as
+
+	// Sample each terminal's process tree this often (0 = off) and kill
+	// shells over these limits (0 = unlimited)
+	TerminalSampleInterval time.Duration
+	TerminalMaxMemoryMB    int64
+	TerminalMaxCPUPercent  float64
+	TerminalMaxProcesses   int
+
+	// Close shells with no client attached and no output for this long (0 = never)
+	TerminalIdleTimeout time.Duration
+
+	// Host shells in a terminal daemon listening on this Unix socket, so they
+	// survive server restarts ("" = shells are the server's children).
+	// TerminalDaemonSpawn starts the daemon if none is listening yet.
+	TerminalDaemonSocket string
+	TerminalDaemonSpawn  bool
+
+	// Longest a read-only terminal share may be valid, and whether shares
+	// may admit viewers who aren't signed in
+	TerminalShareMaxTTL    time.Duration
+	TerminalShareAnonymous bool
+
+	// Concurrent Claude CLI processes (0 = unlimited)
+	ClaudeMaxProcesses        int
+	ClaudeMaxProcessesPerUser int
+
+	// Keep one CLI process per session alive between messages (0 = one process per message)
+	ClaudeProcessIdleTimeout time.Duration
+	// Idle live processes kept in total and per user; the oldest are reaped
+	// first (0 = unlimited)
+	ClaudeMaxIdleProcesses        int
+	ClaudeMaxIdleProcessesPerUser int
+
+	// Interactive tool-permission prompts relayed to the chat UI
+	ClaudePermissionPrompt  bool
+	ClaudePermissionTimeout time.Duration
+	InternalURL             string // base URL the Claude CLI uses to reach this backend
+	// Let sessions use the bypassPermissions mode, which runs every tool unasked
+	ClaudeAllowBypassPermissions bool
+
+	// Background one-shot Claude calls that title and summarize chats ("" model = disabled)
+	ClaudeTitleModel string
+
+	// Claude usage quotas per user (0 = unlimited)
+	UsageDailyTokens    int64
+	UsageMonthlyTokens  int64
+	UsageDailyCostUSD   float64
+	UsageMonthlyCostUSD float64
+
+	// Chat attachment uploads
+	AttachmentMaxBytes int64
+
+	// How long deleted chat sessions stay restorable (0 = until the trash is emptied)
+	SessionTrashRetention time.Duration
 
 	RedisURL       string
 	AllowedOrigins []string
@@ -52,9 +133,55 @@ func Load() *Config {
 
 		ClaudeAllowedTools: getEnv("CLAUDE_ALLOWED_TOOLS", "Read,Edit,Write,Bash,Glob,Grep"),
 		ClaudeWorkingDir:   getEnv("CLAUDE_WORKING_DIR", defaultWorkingDir()),
+		ClaudeConfigDir:    getEnv("CLAUDE_CONFIG_DIR", defaultClaudeConfigDir()),
+		DataDir:            getEnv("DATA_DIR", defaultDataDir()),
+
+		WorkspaceExtraRoots: parseList(getEnv("WORKSPACE_EXTRA_ROOTS", "")),
+		WorkspacePerUser:    getEnv("WORKSPACE_PER_USER", "false") == "true",
+		WorkspaceUIDBase:    int(parseInt64(getEnv("WORKSPACE_UID_BASE", "0"))),
+
+		SandboxEnabled:    getEnv("SANDBOX_ENABLED", "false") == "true",
+		SandboxCgroupRoot: getEnv("SANDBOX_CGROUP_ROOT", "/sys/fs/cgroup/nebulide"),
+		SandboxNetwork:    getEnv("SANDBOX_NETWORK", "false") == "true",
+		SandboxMemoryMB:   parseInt64(getEnv("SANDBOX_MEMORY_MB", "2048")),
+		SandboxCPUPercent: int(parseInt64(getEnv("SANDBOX_CPU_PERCENT", "200"))),
+		SandboxPids:       parseInt64(getEnv("SANDBOX_PIDS", "512")),
+		SandboxUID:        int(parseInt64(getEnv("SANDBOX_UID", "1000"))),
+
+		TerminalSampleInterval: parseDuration(getEnv("TERMINAL_SAMPLE_INTERVAL", "5s")),
+		TerminalMaxMemoryMB:    parseInt64(getEnv("TERMINAL_MAX_MEMORY_MB", "0")),
+		TerminalMaxCPUPercent:  parseFloat(getEnv("TERMINAL_MAX_CPU_PERCENT", "0")),
+		TerminalMaxProcesses:   int(parseInt64(getEnv("TERMINAL_MAX_PROCESSES", "0"))),
+		TerminalIdleTimeout:    parseDuration(getEnv("TERMINAL_IDLE_TIMEOUT", "24h")),
+		TerminalDaemonSocket:   getEnv("TERMINAL_DAEMON_SOCKET", ""),
+		TerminalDaemonSpawn:    getEnv("TERMINAL_DAEMON_SPAWN", "true") == "true",
+		TerminalShareMaxTTL:    parseDuration(getEnv("TERMINAL_SHARE_MAX_TTL", "24h")),
+		TerminalShareAnonymous: getEnv("TERMINAL_SHARE_ANONYMOUS", "false") == "true",
+
+		ClaudeMaxProcesses:            int(parseInt64(getEnv("CLAUDE_MAX_PROCESSES", "4"))),
+		ClaudeMaxProcessesPerUser:     int(parseInt64(getEnv("CLAUDE_MAX_PROCESSES_PER_USER", "2"))),
+		ClaudeProcessIdleTimeout:      parseDuration(getEnv("CLAUDE_PROCESS_IDLE_TIMEOUT", "0")),
+		ClaudeMaxIdleProcesses:        int(parseInt64(getEnv("CLAUDE_MAX_IDLE_PROCESSES", "8"))),
+		ClaudeMaxIdleProcessesPerUser: int(parseInt64(getEnv("CLAUDE_MAX_IDLE_PROCESSES_PER_USER", "2"))),
+
+		ClaudePermissionPrompt:       getEnv("CLAUDE_PERMISSION_PROMPT", "true") == "true",
+		ClaudePermissionTimeout:      parseDuration(getEnv("CLAUDE_PERMISSION_TIMEOUT", "10m")),
+		InternalURL:                  getEnv("INTERNAL_URL", "http://127.0.0.1:"+getEnv("PORT", "8080")),
+		ClaudeAllowBypassPermissions: getEnv("CLAUDE_ALLOW_BYPASS_PERMISSIONS", "false") == "true",
+
+		ClaudeTitleModel: getEnv("CLAUDE_TITLE_MODEL", "haiku"),
+
+		UsageDailyTokens:    parseInt64(getEnv("USAGE_DAILY_TOKENS", "0")),
+		UsageMonthlyTokens:  parseInt64(getEnv("USAGE_MONTHLY_TOKENS", "0")),
+		UsageDailyCostUSD:   parseFloat(getEnv("USAGE_DAILY_COST_USD", "0")),
+		UsageMonthlyCostUSD: parseFloat(getEnv("USAGE_MONTHLY_COST_USD", "0")),
+
+		AttachmentMaxBytes: parseInt64(getEnv("ATTACHMENT_MAX_SIZE_MB", "20")) * 1024 * 1024,
+
+		SessionTrashRetention: parseDuration(getEnv("SESSION_TRASH_RETENTION", "720h")),
 
 		RedisURL:       getEnv("REDIS_URL", "localhost:6379"),
-		AllowedOrigins: parseOrigins(getEnv("ALLOWED_ORIGINS", defaultOrigins())),
+		AllowedOrigins: parseList(getEnv("ALLOWED_ORIGINS", defaultOrigins())),
 
 		AdminUsername: getEnv("ADMIN_USERNAME", "admin"),
 		AdminPassword: getEnv("ADMIN_PASSWORD", ""),
@@ -99,6 +226,24 @@ func defaultWorkingDir() string {
 	return "/home/nebulide/workspace"
 }
 
+// defaultClaudeConfigDir mirrors the CLI's own default, ~/.claude.
+func defaultClaudeConfigDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".claude"
+	}
+	return filepath.Join(home, ".claude")
+}
+
+// defaultDataDir is ~/.nebulide.
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".nebulide"
+	}
+	return filepath.Join(home, ".nebulide")
+}
+
 func getEnv(key, fallback string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
@@ -114,6 +259,22 @@ func parseDuration(s string) time.Duration {
 	return d
 }
 
+func parseInt64(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func parseFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
 func defaultOrigins() string {
 	if os.Getenv("GIN_MODE") != "release" {
 		return "https://nebulide.ru,http://localhost:5173,http://localhost:8080"
@@ -121,14 +282,14 @@ func defaultOrigins() string {
 	return "https://nebulide.ru"
 }
 
-func parseOrigins(s string) []string {
+func parseList(s string) []string {
 	parts := strings.Split(s, ",")
-	origins := make([]string, 0, len(parts))
+	items := make([]string, 0, len(parts))
 	for _, p := range parts {
 		p = strings.TrimSpace(p)
 		if p != "" {
-			origins = append(origins, p)
+			items = append(items, p)
 		}
 	}
-	return origins
+	return items
 }
@@ -16,7 +16,8 @@ var DB *gorm.DB
 func Connect(cfg *config.Config) {
 	var err error
 	DB, err = gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Warn),
+		Logger:         logger.Default.LogMode(logger.Warn),
+		TranslateError: true, // constraint violations as gorm.ErrDuplicatedKey etc.
 	})
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
@@ -15,9 +15,44 @@ func Migrate() {
 		&models.RefreshToken{},
 		&models.Invite{},
 		&models.WorkspaceSession{},
+		&models.UsageRecord{},
 	)
 	if err != nil {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
+	createSearchIndexes()
+	for _, stmt := range UniqueIndexes {
+		if err := DB.Exec(stmt).Error; err != nil {
+			log.Printf("Failed to create unique index, resolve the duplicates and restart: %v", err)
+		}
+	}
 	fmt.Println("Migrations completed")
 }
+
+// UniqueIndexes are the partial unique indexes struct tags can't express, in
+// SQL that SQLite (tests) understands as well. A CLI session is linked to one
+// chat at most, which keeps concurrent adoptions from both succeeding.
+var UniqueIndexes = []string{
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_sessions_claude_session_id ON chat_sessions (claude_session_id) WHERE claude_session_id <> ''`,
+}
+
+// SearchConfig is the text search configuration used by the full-text indexes.
+// "simple" (no stemming) works for any language; queries must use the same
+// configuration for PostgreSQL to pick the indexes.
+const SearchConfig = "simple"
+
+// createSearchIndexes adds GIN indexes for full-text search over message
+// content and session titles (GET /api/search/messages), and for the tag
+// filter of GET /api/sessions.
+func createSearchIndexes() {
+	stmts := []string{
+		`CREATE INDEX IF NOT EXISTS idx_messages_content_fts ON messages USING GIN (to_tsvector('` + SearchConfig + `', content))`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_sessions_title_fts ON chat_sessions USING GIN (to_tsvector('` + SearchConfig + `', title))`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_sessions_tags ON chat_sessions USING GIN (tags)`,
+	}
+	for _, stmt := range stmts {
+		if err := DB.Exec(stmt).Error; err != nil {
+			log.Fatalf("Failed to create search index: %v", err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"nebulide/config"
+	"nebulide/database"
+	"nebulide/models"
+	"nebulide/services"
+)
+
+type AdminHandler struct {
+	cfg    *config.Config
+	claude *services.ClaudeService
+}
+
+func NewAdminHandler(cfg *config.Config, claude *services.ClaudeService) *AdminHandler {
+	return &AdminHandler{cfg: cfg, claude: claude}
+}
+
+// requireAdmin aborts with 404/403 unless the authenticated user is an admin.
+func requireAdmin(c *gin.Context) bool {
+	userID, _ := c.Get("user_id")
+
+	var user models.User
+	if err := database.DB.First(&user, "id = ?", userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return false
+	}
+	if !user.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		return false
+	}
+	return true
+}
+
+// ClaudeProcesses returns running and waiting Claude processes and scheduler limits (admin only).
+func (h *AdminHandler) ClaudeProcesses(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"scheduler": h.claude.SchedulerStats(),
+		"processes": h.claude.Processes(),
+	})
+}
+
+// SandboxDefaults are the sandbox limits of users without overrides.
+func SandboxDefaults(cfg *config.Config) services.SandboxLimits {
+	return services.SandboxLimits{
+		MemoryMB:   cfg.SandboxMemoryMB,
+		CPUPercent: cfg.SandboxCPUPercent,
+		Pids:       cfg.SandboxPids,
+	}
+}
+
+// UserSandbox returns a user's sandbox limit overrides and the limits in effect (admin only).
+func (h *AdminHandler) UserSandbox(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, h.sandboxResponse(&user))
+}
+
+// UpdateUserSandbox replaces a user's sandbox limit overrides; null fields
+// fall back to the server defaults. The limits apply from the user's next
+// terminal or Claude process on (admin only).
+func (h *AdminHandler) UpdateUserSandbox(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var req models.SandboxLimits
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if (req.MemoryMB != nil && *req.MemoryMB < 0) || (req.CPUPercent != nil && *req.CPUPercent < 0) || (req.Pids != nil && *req.Pids < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limits can't be negative"})
+		return
+	}
+
+	err := database.DB.Model(&user).Updates(map[string]any{
+		"sandbox_memory_mb":   req.MemoryMB,
+		"sandbox_cpu_percent": req.CPUPercent,
+		"sandbox_pids":        req.Pids,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update sandbox limits"})
+		return
+	}
+	user.Sandbox = req
+	c.JSON(http.StatusOK, h.sandboxResponse(&user))
+}
+
+func (h *AdminHandler) sandboxResponse(user *models.User) gin.H {
+	defaults := SandboxDefaults(h.cfg)
+	return gin.H{
+		"enabled":   h.cfg.SandboxEnabled,
+		"defaults":  defaults,
+		"overrides": user.Sandbox,
+		"effective": defaults.With(user.Sandbox),
+	}
+}
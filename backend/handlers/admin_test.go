@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"nebulide/middleware"
+	"nebulide/models"
+	"nebulide/services"
+	"nebulide/testutil"
+)
+
+func setupAdminTestRouter() (*gin.Engine, *testutil.TestContext) {
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	cfg.SandboxMemoryMB = 1024
+	cfg.SandboxCPUPercent = 100
+	cfg.SandboxPids = 256
+	handler := NewAdminHandler(cfg, nil)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	protected := r.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	{
+		protected.GET("/admin/users/:id/sandbox", handler.UserSandbox)
+		protected.PUT("/admin/users/:id/sandbox", handler.UpdateUserSandbox)
+	}
+
+	return r, &testutil.TestContext{DB: db, Cfg: cfg}
+}
+
+type sandboxResponse struct {
+	Defaults  services.SandboxLimits `json:"defaults"`
+	Overrides models.SandboxLimits   `json:"overrides"`
+	Effective services.SandboxLimits `json:"effective"`
+}
+
+func TestAdmin_UserSandbox_RequiresAdmin(t *testing.T) {
+	router, tc := setupAdminTestRouter()
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/admin/users/"+user.ID.String()+"/sandbox", bytes.NewBufferString(`{"memory_mb":0}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAdmin_UpdateUserSandbox(t *testing.T) {
+	router, tc := setupAdminTestRouter()
+	admin := testutil.CreateTestUser(tc.DB)
+	tc.DB.Model(&admin).Update("is_admin", true)
+	token := testutil.GenerateTestToken(tc.Cfg, admin.ID, admin.Username, false)
+	user := models.User{Username: "worker", PasswordHash: "x"}
+	require.NoError(t, tc.DB.Create(&user).Error)
+	url := "/api/admin/users/" + user.ID.String() + "/sandbox"
+
+	send := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Lift the memory cap and tighten pids; CPU keeps the default.
+	w := send("PUT", `{"memory_mb":0,"pids":64}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = send("GET", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp sandboxResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, services.SandboxLimits{MemoryMB: 1024, CPUPercent: 100, Pids: 256}, resp.Defaults)
+	assert.Equal(t, services.SandboxLimits{MemoryMB: 0, CPUPercent: 100, Pids: 64}, resp.Effective)
+	assert.Nil(t, resp.Overrides.CPUPercent)
+
+	// Null clears an override again.
+	w = send("PUT", `{"memory_mb":null,"pids":64}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stored models.User
+	require.NoError(t, tc.DB.First(&stored, "id = ?", user.ID).Error)
+	assert.Nil(t, stored.Sandbox.MemoryMB)
+	require.NotNil(t, stored.Sandbox.Pids)
+	assert.Equal(t, int64(64), *stored.Sandbox.Pids)
+
+	w = send("PUT", `{"cpu_percent":-5}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
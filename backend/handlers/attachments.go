@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nebulide/config"
+	"nebulide/database"
+	"nebulide/models"
+	"nebulide/services"
+)
+
+const maxAttachmentsPerMessage = 10
+
+// Upload types Claude can read: images and PDFs (sniffed, not trusted from the client).
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+type AttachmentsHandler struct {
+	cfg        *config.Config
+	workspaces *services.WorkspaceManager
+}
+
+func NewAttachmentsHandler(cfg *config.Config, workspaces *services.WorkspaceManager) *AttachmentsHandler {
+	return &AttachmentsHandler{cfg: cfg, workspaces: workspaces}
+}
+
+// attachmentRef is how a chat message points at an attachment: an upload ID
+// from POST /api/sessions/:id/attachments, or a workspace file path.
+type attachmentRef struct {
+	ID   string `json:"id,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// makeUploadDir creates the directory of one upload, private to its owner.
+func makeUploadDir(ws *services.Workspace, sessionID uuid.UUID, id string) (string, error) {
+	dir := filepath.Join(ws.AttachmentsDir(sessionID), id)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// attachmentPath is the absolute path of an attachment, as handed to Claude.
+// It is never sent to clients.
+func attachmentPath(ws *services.Workspace, sessionID uuid.UUID, att models.Attachment) string {
+	if att.Kind == "upload" {
+		return filepath.Join(ws.AttachmentsDir(sessionID), att.ID, att.Name)
+	}
+	return filepath.Join(ws.Dir, att.Path)
+}
+
+// Upload stores a file for a later chat message (multipart field "file").
+func (h *AttachmentsHandler) Upload(c *gin.Context) {
+	session, ok := ownedSession(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.cfg.AttachmentMaxBytes+1024*1024)
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": h.tooLargeMessage()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File required"})
+		return
+	}
+	if fileHeader.Size > h.cfg.AttachmentMaxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": h.tooLargeMessage()})
+		return
+	}
+
+	src, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer src.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(src, head)
+	mimeType := http.DetectContentType(head[:n])
+	if !allowedAttachmentTypes[mimeType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported file type (images and PDFs only)"})
+		return
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return
+	}
+
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+
+	id := uuid.New()
+	dir, err := makeUploadDir(ws, session.ID, id.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return
+	}
+
+	name := sanitizeAttachmentName(fileHeader.Filename)
+	dstPath := filepath.Join(dir, name)
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return
+	}
+	size, err := io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		os.RemoveAll(dir)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return
+	}
+	if err := ws.Own(ws.AttachmentsDir(session.ID)); err != nil {
+		log.Printf("[Attachments] failed to hand upload to %s: %v", ws.Username, err)
+	}
+
+	c.JSON(http.StatusCreated, models.Attachment{
+		ID:       id.String(),
+		Kind:     "upload",
+		Name:     name,
+		MimeType: mimeType,
+		Size:     size,
+	})
+}
+
+// Download serves an uploaded attachment (e.g. to render images in history).
+func (h *AttachmentsHandler) Download(c *gin.Context) {
+	session, ok := ownedSession(c)
+	if !ok {
+		return
+	}
+
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	att, err := findUpload(ws, session.ID, c.Param("attachmentId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	c.Header("Content-Type", att.MimeType)
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, att.Name))
+	c.File(attachmentPath(ws, session.ID, *att))
+}
+
+func (h *AttachmentsHandler) tooLargeMessage() string {
+	return fmt.Sprintf("File too large (max %dMB)", h.cfg.AttachmentMaxBytes/(1024*1024))
+}
+
+// ownedSession loads the :id session if it belongs to the caller, or writes a 404.
+func ownedSession(c *gin.Context) (*models.ChatSession, bool) {
+	userID, _ := c.Get("user_id")
+
+	var session models.ChatSession
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return nil, false
+	}
+	return &session, true
+}
+
+// resolveAttachments turns the refs of a chat message into attachments,
+// checking that uploads exist and workspace paths stay inside the workspace.
+func resolveAttachments(ws *services.Workspace, sessionID uuid.UUID, refs []attachmentRef) ([]models.Attachment, error) {
+	if len(refs) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("too many attachments (max %d)", maxAttachmentsPerMessage)
+	}
+
+	attachments := make([]models.Attachment, 0, len(refs))
+	for _, ref := range refs {
+		switch {
+		case ref.ID != "":
+			att, err := findUpload(ws, sessionID, ref.ID)
+			if err != nil {
+				return nil, fmt.Errorf("attachment %s not found", ref.ID)
+			}
+			attachments = append(attachments, *att)
+		case ref.Path != "":
+			fullPath, err := workspacePath(ws.Dir, ref.Path)
+			if err != nil {
+				return nil, fmt.Errorf("access denied: %s", ref.Path)
+			}
+			info, err := os.Stat(fullPath)
+			if err != nil || !info.Mode().IsRegular() {
+				return nil, fmt.Errorf("file not found: %s", ref.Path)
+			}
+			rel, err := filepath.Rel(ws.Dir, fullPath)
+			if err != nil {
+				return nil, fmt.Errorf("access denied: %s", ref.Path)
+			}
+			attachments = append(attachments, models.Attachment{
+				Kind: "file",
+				Name: filepath.Base(fullPath),
+				Size: info.Size(),
+				Path: filepath.ToSlash(rel),
+			})
+		default:
+			return nil, errors.New("attachment needs an id or a path")
+		}
+	}
+	return attachments, nil
+}
+
+// findUpload locates an upload by ID. Each upload has its own directory
+// holding a single file, so no metadata store is needed.
+func findUpload(ws *services.Workspace, sessionID uuid.UUID, id string) (*models.Attachment, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(ws.AttachmentsDir(sessionID), parsed.String())
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		return &models.Attachment{
+			ID:       parsed.String(),
+			Kind:     "upload",
+			Name:     entry.Name(),
+			MimeType: detectFileType(path),
+			Size:     info.Size(),
+		}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func detectFileType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n])
+}
+
+// sanitizeAttachmentName keeps the client's file name readable but safe to
+// use as a path component and inside a Content-Disposition header.
+func sanitizeAttachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '"' || r == '/' || r == '\\' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[len(runes)-100:])
+	}
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+		name = "attachment" + name
+	}
+	return name
+}
+
+// copyUploads copies a message's uploads into another session's attachments
+// directory (for forks). Workspace file references are shared, not copied.
+func copyUploads(ws *services.Workspace, from, to uuid.UUID, attachments []models.Attachment) error {
+	for _, att := range attachments {
+		if att.Kind != "upload" {
+			continue
+		}
+		dstDir, err := makeUploadDir(ws, to, att.ID)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(attachmentPath(ws, from, att), filepath.Join(dstDir, att.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// attachmentPrompt appends the attachment list to the user's text so the CLI
+// knows which files to open with its Read tool.
+func attachmentPrompt(ws *services.Workspace, sessionID uuid.UUID, content string, attachments []models.Attachment) string {
+	if len(attachments) == 0 {
+		return content
+	}
+
+	var b strings.Builder
+	b.WriteString(content)
+	if content != "" {
+		b.WriteString("\n\n")
+	}
+	b.WriteString("Attached files (open them with the Read tool):")
+	for _, att := range attachments {
+		b.WriteString("\n- " + attachmentPath(ws, sessionID, att))
+		if att.MimeType != "" {
+			b.WriteString(" (" + att.MimeType + ")")
+		}
+	}
+	return b.String()
+}
+
+// MigrateAttachments moves uploads out of <working dir>/.attachments, the
+// shared tree they used to live in, into their owners' attachment
+// directories, and drops the absolute server paths older messages were
+// stored with. Safe to run on every start.
+func MigrateAttachments(cfg *config.Config, workspaces *services.WorkspaceManager) {
+	legacy := filepath.Join(cfg.ClaudeWorkingDir, ".attachments")
+	entries, _ := os.ReadDir(legacy)
+	for _, entry := range entries {
+		sessionID, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		var session models.ChatSession
+		if err := database.DB.Unscoped().First(&session, "id = ?", sessionID).Error; err != nil {
+			continue
+		}
+		ws, err := workspaces.For(session.UserID)
+		if err != nil {
+			log.Printf("[Attachments] failed to open workspace of user %s: %v", session.UserID, err)
+			continue
+		}
+		dst := ws.AttachmentsDir(sessionID)
+		if _, err := os.Lstat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			log.Printf("[Attachments] failed to move uploads of session %s: %v", sessionID, err)
+			continue
+		}
+		if err := os.Rename(filepath.Join(legacy, entry.Name()), dst); err != nil {
+			log.Printf("[Attachments] failed to move uploads of session %s: %v", sessionID, err)
+			continue
+		}
+		if err := ws.Own(dst); err != nil {
+			log.Printf("[Attachments] failed to hand uploads to %s: %v", ws.Username, err)
+		}
+	}
+	os.Remove(legacy) // only once empty
+
+	var messages []models.Message
+	database.DB.Where("attachments IS NOT NULL").FindInBatches(&messages, 200, func(tx *gorm.DB, _ int) error {
+		for _, m := range messages {
+			changed := false
+			for i, att := range m.Attachments {
+				if !filepath.IsAbs(att.Path) {
+					continue
+				}
+				m.Attachments[i].Path = ""
+				if att.Kind == "file" {
+					if rel, ok := legacyFilePath(workspaces, m.SessionID, att.Path); ok {
+						m.Attachments[i].Path = rel
+					}
+				}
+				changed = true
+			}
+			if changed {
+				database.DB.Model(&models.Message{}).Where("id = ?", m.ID).Update("attachments", m.Attachments)
+			}
+		}
+		return nil
+	})
+}
+
+// legacyFilePath turns the absolute path of a workspace file attached to a
+// message into one relative to the session owner's workspace.
+func legacyFilePath(workspaces *services.WorkspaceManager, sessionID uuid.UUID, path string) (string, bool) {
+	var session models.ChatSession
+	if err := database.DB.Unscoped().First(&session, "id = ?", sessionID).Error; err != nil {
+		return "", false
+	}
+	ws, err := workspaces.For(session.UserID)
+	if err != nil || !services.IsWithinDir(ws.Dir, path) {
+		return "", false
+	}
+	rel, err := filepath.Rel(ws.Dir, path)
+	return filepath.ToSlash(rel), err == nil
+}
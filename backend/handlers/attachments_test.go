@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"nebulide/config"
+	"nebulide/database"
+	"nebulide/middleware"
+	"nebulide/models"
+	"nebulide/services"
+	"nebulide/testutil"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+type attachmentsTestEnv struct {
+	Router    *gin.Engine
+	Token     string
+	Cfg       *config.Config
+	Workspace *services.Workspace
+	Session   models.ChatSession
+}
+
+func setupAttachmentsTest(t *testing.T) *attachmentsTestEnv {
+	t.Helper()
+
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	cfg.ClaudeWorkingDir = t.TempDir()
+	cfg.DataDir = t.TempDir()
+	cfg.AttachmentMaxBytes = 1024
+
+	user := testutil.CreateTestUser(db)
+	token := testutil.GenerateTestToken(cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{UserID: user.ID, Title: "Chat", WorkingDirectory: cfg.ClaudeWorkingDir}
+	require.NoError(t, db.Create(&session).Error)
+
+	workspaces := testWorkspaces(cfg)
+	ws, err := workspaces.For(user.ID)
+	require.NoError(t, err)
+	handler := NewAttachmentsHandler(cfg, workspaces)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	protected := r.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	{
+		protected.POST("/sessions/:id/attachments", handler.Upload)
+		protected.GET("/sessions/:id/attachments/:attachmentId", handler.Download)
+	}
+
+	return &attachmentsTestEnv{Router: r, Token: token, Cfg: cfg, Workspace: ws, Session: session}
+}
+
+func (e *attachmentsTestEnv) upload(name string, content []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", name)
+	part.Write(content)
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/sessions/"+e.Session.ID.String()+"/attachments", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+e.Token)
+	e.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAttachments_UploadImage(t *testing.T) {
+	env := setupAttachmentsTest(t)
+
+	w := env.upload("../../screen shot.png", pngHeader)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var att models.Attachment
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &att))
+	assert.Equal(t, "upload", att.Kind)
+	assert.Equal(t, "screen shot.png", att.Name)
+	assert.Equal(t, "image/png", att.MimeType)
+	assert.NotContains(t, w.Body.String(), `"path"`, "server paths stay on the server")
+
+	// Uploads to the shared workspace are kept out of it, where other users'
+	// file browsers can't reach them.
+	path := attachmentPath(env.Workspace, env.Session.ID, att)
+	assert.True(t, strings.HasPrefix(path, env.Cfg.DataDir+string(filepath.Separator)), path)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, pngHeader, data)
+
+	// The upload can be referenced from a chat message by ID.
+	resolved, err := resolveAttachments(env.Workspace, env.Session.ID, []attachmentRef{{ID: att.ID}})
+	require.NoError(t, err)
+	assert.Equal(t, []models.Attachment{att}, resolved)
+}
+
+func TestAttachments_RejectsUnsupportedType(t *testing.T) {
+	env := setupAttachmentsTest(t)
+
+	w := env.upload("notes.png", []byte("just some text"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestAttachments_RejectsTooLarge(t *testing.T) {
+	env := setupAttachmentsTest(t)
+
+	w := env.upload("big.png", append(pngHeader, make([]byte, 2048)...))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestAttachments_OtherUsersSessionNotFound(t *testing.T) {
+	env := setupAttachmentsTest(t)
+
+	other := models.User{Username: "other", PasswordHash: "x"}
+	require.NoError(t, database.DB.Create(&other).Error)
+	env.Token = testutil.GenerateTestToken(env.Cfg, other.ID, other.Username, false)
+
+	w := env.upload("a.png", pngHeader)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAttachments_ResolveWorkspaceFiles(t *testing.T) {
+	env := setupAttachmentsTest(t)
+	require.NoError(t, os.WriteFile(filepath.Join(env.Cfg.ClaudeWorkingDir, "main.go"), []byte("package main"), 0644))
+
+	resolved, err := resolveAttachments(env.Workspace, env.Session.ID, []attachmentRef{{Path: filepath.Join(env.Cfg.ClaudeWorkingDir, "main.go")}})
+	require.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.Equal(t, "file", resolved[0].Kind)
+	assert.Equal(t, "main.go", resolved[0].Path, "stored relative to the workspace")
+
+	_, err = resolveAttachments(env.Workspace, env.Session.ID, []attachmentRef{{Path: "../../etc/passwd"}})
+	assert.Error(t, err)
+
+	_, err = resolveAttachments(env.Workspace, env.Session.ID, []attachmentRef{{Path: "missing.txt"}})
+	assert.Error(t, err)
+
+	_, err = resolveAttachments(env.Workspace, env.Session.ID, []attachmentRef{{ID: "../../x"}})
+	assert.Error(t, err)
+}
+
+func TestAttachmentPrompt(t *testing.T) {
+	env := setupAttachmentsTest(t)
+	ws, sessionID := env.Workspace, env.Session.ID
+	prompt := attachmentPrompt(ws, sessionID, "What is this?", []models.Attachment{
+		{ID: "1", Kind: "upload", Name: "a.png", MimeType: "image/png"},
+		{Kind: "file", Path: "src/main.go"},
+	})
+	assert.Equal(t, "What is this?\n\nAttached files (open them with the Read tool):\n"+
+		"- "+filepath.Join(ws.AttachmentsDir(sessionID), "1", "a.png")+" (image/png)\n"+
+		"- "+filepath.Join(env.Cfg.ClaudeWorkingDir, "src", "main.go"), prompt)
+
+	assert.Equal(t, "plain", attachmentPrompt(ws, sessionID, "plain", nil))
+}
+
+func TestAttachments_PerUserUploadsStayInTheWorkspace(t *testing.T) {
+	env := setupPerUserTest(t, 0)
+	ws, err := env.Workspaces.For(env.Alice.ID)
+	require.NoError(t, err)
+	session := models.ChatSession{UserID: env.Alice.ID, Title: "Chat"}
+	require.NoError(t, database.DB.Create(&session).Error)
+
+	assert.Equal(t, filepath.Join(ws.Dir, ".attachments", session.ID.String()), ws.AttachmentsDir(session.ID))
+}
+
+func TestMigrateAttachments(t *testing.T) {
+	env := setupAttachmentsTest(t)
+	legacy := filepath.Join(env.Cfg.ClaudeWorkingDir, ".attachments", env.Session.ID.String(), "0b4c4f5e-7c1f-4f43-9f0e-1c1b1e6f8a10")
+	require.NoError(t, os.MkdirAll(legacy, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(legacy, "a.png"), pngHeader, 0600))
+	msg := models.Message{SessionID: env.Session.ID, Role: "user", Content: "look", Attachments: []models.Attachment{
+		{ID: "0b4c4f5e-7c1f-4f43-9f0e-1c1b1e6f8a10", Kind: "upload", Name: "a.png", Path: filepath.Join(legacy, "a.png")},
+		{Kind: "file", Name: "main.go", Path: filepath.Join(env.Cfg.ClaudeWorkingDir, "src", "main.go")},
+	}}
+	require.NoError(t, database.DB.Create(&msg).Error)
+
+	MigrateAttachments(env.Cfg, testWorkspaces(env.Cfg))
+	MigrateAttachments(env.Cfg, testWorkspaces(env.Cfg)) // and again: nothing left to do
+
+	assert.NoDirExists(t, filepath.Join(env.Cfg.ClaudeWorkingDir, ".attachments"))
+	att, err := findUpload(env.Workspace, env.Session.ID, "0b4c4f5e-7c1f-4f43-9f0e-1c1b1e6f8a10")
+	require.NoError(t, err)
+	assert.Equal(t, "a.png", att.Name)
+
+	var migrated models.Message
+	require.NoError(t, database.DB.First(&migrated, "id = ?", msg.ID).Error)
+	assert.Empty(t, migrated.Attachments[0].Path)
+	assert.Equal(t, "src/main.go", migrated.Attachments[1].Path)
+}
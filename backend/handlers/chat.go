@@ -1,15 +1,25 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"gorm.io/datatypes"
 
 	"nebulide/config"
 	"nebulide/database"
@@ -18,16 +28,46 @@ import (
 	"nebulide/utils"
 )
 
+// How long the background title/summary call may take.
+const titleJobTimeout = 2 * time.Minute
+
 type ChatHandler struct {
-	cfg      *config.Config
-	claude   *services.ClaudeService
-	upgrader websocket.Upgrader
+	cfg        *config.Config
+	claude     *services.ClaudeService
+	usage      *services.UsageService
+	streams    *services.ChatStreamHub
+	queue      *services.ChatQueue
+	perms      *services.PermissionBroker // nil disables interactive permission prompts
+	titles     *services.SessionTitler    // nil disables AI-generated titles and summaries
+	workspaces *services.WorkspaceManager
+	upgrader   websocket.Upgrader
+
+	// active marks sessions with a run in progress (or starting). It decides
+	// whether a new prompt runs now or goes to the queue.
+	active map[string]bool
+	runMu  sync.Mutex
 }
 
-func NewChatHandler(cfg *config.Config, claude *services.ClaudeService) *ChatHandler {
+func NewChatHandler(
+	cfg *config.Config,
+	claude *services.ClaudeService,
+	usage *services.UsageService,
+	streams *services.ChatStreamHub,
+	queue *services.ChatQueue,
+	perms *services.PermissionBroker,
+	titles *services.SessionTitler,
+	workspaces *services.WorkspaceManager,
+) *ChatHandler {
 	return &ChatHandler{
-		cfg:    cfg,
-		claude: claude,
+		cfg:        cfg,
+		claude:     claude,
+		usage:      usage,
+		streams:    streams,
+		queue:      queue,
+		perms:      perms,
+		titles:     titles,
+		workspaces: workspaces,
+		active:     make(map[string]bool),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -37,15 +77,133 @@ func NewChatHandler(cfg *config.Config, claude *services.ClaudeService) *ChatHan
 }
 
 type chatMessage struct {
-	Type    string `json:"type"`    // "message" | "cancel"
-	Content string `json:"content"` // user message text
+	Type      string  `json:"type"`                 // "message" | "cancel" | "resume" | "queue_list" | "queue_move" | "queue_remove" | "queue_clear" | "permission_response"
+	Content   string  `json:"content"`              // user message text; permission_response: optional deny reason
+	LastSeq   *uint64 `json:"last_seq,omitempty"`   // resume: last sequence number the client has seen
+	ID        string  `json:"id,omitempty"`         // queue_move / queue_remove: queued prompt ID
+	Position  *int    `json:"position,omitempty"`   // queue_move: new 0-based position
+	RequestID string  `json:"request_id,omitempty"` // permission_response: the permission_request being answered
+	Decision  string  `json:"decision,omitempty"`   // permission_response: "allow_once" | "allow_always" | "deny"
+
+	Attachments []attachmentRef `json:"attachments,omitempty"` // message: uploads / workspace files sent with the text
 }
 
 type chatResponse struct {
-	Type      string          `json:"type"`                 // "stream" | "complete" | "error" | "thinking"
+	Type      string          `json:"type"` // "stream" | "complete" | "error" | "user_message" | "status" | "resync" | "queue" | "waiting" | "permission_request" | "permission_resolved" | "session_updated"
+	Seq       uint64          `json:"seq,omitempty"`
 	Data      json.RawMessage `json:"data,omitempty"`
 	SessionID string          `json:"session_id,omitempty"`
 	Message   string          `json:"message,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	Running   *bool           `json:"running,omitempty"`
+	Position  int             `json:"position,omitempty"` // waiting: 1-based place in the process queue
+	LastSeq   *uint64         `json:"last_seq,omitempty"`
+	RequestID string          `json:"request_id,omitempty"` // permission_request / permission_resolved
+	ToolName  string          `json:"tool_name,omitempty"`  // permission_request: tool Claude wants to use (input in Data)
+	Decision  string          `json:"decision,omitempty"`   // permission_resolved: the user's answer
+	Title     string          `json:"title,omitempty"`      // session_updated
+	Summary   string          `json:"summary,omitempty"`    // session_updated
+
+	Attachments []models.Attachment `json:"attachments,omitempty"` // user_message
+}
+
+const (
+	// What may wait to be sent to one chat client: room for a full replay
+	// of the session's stream plus the live tail. A client further behind
+	// is disconnected and catches up by resuming from its last seq.
+	chatConnMaxQueue     = 16 * 1024 * 1024
+	chatConnWriteTimeout = 10 * time.Second
+)
+
+var errChatConnClosed = errors.New("chat connection closed")
+
+// chatConn queues writes to a chat WebSocket: the read loop and the
+// session's ChatStream (run goroutine) both write to it, and neither may
+// be held up by a slow or half-open client. Its own goroutine sends the
+// queue in order.
+type chatConn struct {
+	conn *websocket.Conn
+	wake chan struct{}
+
+	mu      sync.Mutex
+	queue   [][]byte
+	queued  int  // bytes in queue
+	closing bool // no more writes; the goroutine closes conn once the queue is sent
+}
+
+func newChatConn(conn *websocket.Conn) *chatConn {
+	w := &chatConn{conn: conn, wake: make(chan struct{}, 1)}
+	go w.run()
+	return w
+}
+
+// Write queues a message. It fails, and the client is disconnected, when
+// too much is already waiting for it.
+func (w *chatConn) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	if w.closing {
+		w.mu.Unlock()
+		return 0, errChatConnClosed
+	}
+	if w.queued+len(p) > chatConnMaxQueue {
+		w.closing = true
+		w.queue, w.queued = nil, 0
+		w.mu.Unlock()
+		log.Printf("[Chat] client fell too far behind, disconnecting (remote=%s)", w.conn.RemoteAddr())
+		w.conn.Close() // unblocks a write in progress
+		w.signal()
+		return 0, errChatConnClosed
+	}
+	w.queue = append(w.queue, bytes.Clone(p))
+	w.queued += len(p)
+	w.mu.Unlock()
+	w.signal()
+	return len(p), nil
+}
+
+// Close stops taking writes; what is queued is still sent before the
+// connection closes. It doesn't block.
+func (w *chatConn) Close() error {
+	w.mu.Lock()
+	w.closing = true
+	w.mu.Unlock()
+	w.signal()
+	return nil
+}
+
+func (w *chatConn) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *chatConn) run() {
+	defer w.conn.Close()
+	for range w.wake {
+		for {
+			w.mu.Lock()
+			batch, closing := w.queue, w.closing
+			w.queue, w.queued = nil, 0
+			w.mu.Unlock()
+			if len(batch) == 0 {
+				if closing {
+					return
+				}
+				break
+			}
+			for _, p := range batch {
+				w.conn.SetWriteDeadline(time.Now().Add(chatConnWriteTimeout))
+				if err := w.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+					w.mu.Lock()
+					w.closing = true
+					w.queue, w.queued = nil, 0
+					w.mu.Unlock()
+					return
+				}
+			}
+		}
+	}
 }
 
 func (h *ChatHandler) HandleWebSocket(c *gin.Context) {
@@ -76,10 +234,38 @@ func (h *ChatHandler) HandleWebSocket(c *gin.Context) {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
-	defer conn.Close()
-
 	sessionKey := sessionID + ":" + claims.UserID.String()
 
+	// Attach to the session's event stream. Runs outlive the WebSocket, so a
+	// reconnecting client passes ?last_seq= to replay what it missed.
+	writer := newChatConn(conn)
+	defer writer.Close()
+	stream := h.streams.Get(sessionKey)
+	if s := c.Query("last_seq"); s != "" {
+		lastSeq, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			h.sendError(writer, "Invalid last_seq")
+			return
+		}
+		h.resume(writer, stream, lastSeq)
+	} else {
+		stream.AttachLive(writer, writer)
+		h.sendStatus(writer, stream)
+	}
+	defer stream.Detach(writer)
+
+	// Prompts queued before a backend restart have no run to drain them — kick one off.
+	h.runMu.Lock()
+	idle := !h.active[sessionKey]
+	if idle {
+		h.active[sessionKey] = true
+	}
+	h.runMu.Unlock()
+	if idle {
+		h.runNext(stream, session.ID, sessionKey, claims.UserID)
+	}
+	h.sendQueue(writer, sessionKey)
+
 	for {
 		_, raw, err := conn.ReadMessage()
 		if err != nil {
@@ -91,108 +277,464 @@ func (h *ChatHandler) HandleWebSocket(c *gin.Context) {
 
 		var msg chatMessage
 		if err := json.Unmarshal(raw, &msg); err != nil {
-			h.sendError(conn, "Invalid message format")
+			h.sendError(writer, "Invalid message format")
 			continue
 		}
 
 		switch msg.Type {
 		case "message":
-			h.handleMessage(conn, &session, sessionKey, msg.Content, claims.UserID)
+			ws, err := h.workspaces.For(claims.UserID)
+			if err != nil {
+				log.Printf("[Chat] failed to open workspace of user %s: %v", claims.UserID, err)
+				h.sendError(writer, "Failed to open workspace")
+				continue
+			}
+			attachments, err := resolveAttachments(ws, session.ID, msg.Attachments)
+			if err != nil {
+				h.sendError(writer, err.Error())
+				continue
+			}
+			h.handleMessage(writer, stream, session.ID, sessionKey, msg.Content, attachments, claims.UserID)
 		case "cancel":
 			h.claude.Cancel(sessionKey)
+		case "queue_list", "queue_move", "queue_remove", "queue_clear":
+			h.handleQueueCommand(writer, stream, sessionKey, msg)
+		case "permission_response":
+			h.handlePermissionResponse(writer, stream, session.ID, sessionKey, msg)
+		case "resume":
+			if msg.LastSeq == nil {
+				h.sendError(writer, "last_seq required")
+				continue
+			}
+			stream.Detach(writer)
+			h.resume(writer, stream, *msg.LastSeq)
 		default:
-			h.sendError(conn, "Unknown message type")
+			h.sendError(writer, "Unknown message type")
 		}
 	}
 }
 
+// resume re-attaches a client that has seen events up to lastSeq. If the missed
+// events are no longer buffered, the client is told to reload history first.
+func (h *ChatHandler) resume(w *chatConn, stream *services.ChatStream, lastSeq uint64) {
+	if !stream.Attach(w, w, lastSeq) {
+		data, _ := json.Marshal(chatResponse{Type: "resync"})
+		w.Write(data)
+	}
+	h.sendStatus(w, stream)
+}
+
+func (h *ChatHandler) sendStatus(w io.Writer, stream *services.ChatStream) {
+	running, lastSeq := stream.Status()
+	data, _ := json.Marshal(chatResponse{Type: "status", Running: &running, LastSeq: &lastSeq})
+	w.Write(data)
+}
+
+// publish sends a response to every client attached to the session, numbered
+// and buffered for replay.
+func (h *ChatHandler) publish(stream *services.ChatStream, resp chatResponse) {
+	stream.Publish(func(seq uint64) []byte {
+		resp.Seq = seq
+		data, _ := json.Marshal(resp)
+		return data
+	})
+}
+
+// handleMessage starts a run for the prompt, or queues it behind the run in progress.
 func (h *ChatHandler) handleMessage(
-	conn *websocket.Conn,
-	session *models.ChatSession,
+	w io.Writer,
+	stream *services.ChatStream,
+	sessionID uuid.UUID,
 	sessionKey string,
 	content string,
+	attachments []models.Attachment,
 	userID uuid.UUID,
 ) {
-	if h.claude.IsRunning(sessionKey) {
-		h.sendError(conn, "Claude is already processing a message")
+	ctx := context.Background()
+
+	h.runMu.Lock()
+	if h.active[sessionKey] {
+		_, err := h.queue.Push(ctx, sessionKey, content, attachments)
+		h.runMu.Unlock()
+		if errors.Is(err, services.ErrQueueFull) {
+			h.sendError(w, fmt.Sprintf("Queue is full (max %d prompts)", services.ChatQueueMaxLen))
+			return
+		}
+		if err != nil {
+			log.Printf("[Chat] failed to queue prompt (key=%s): %v", sessionKey, err)
+			h.sendError(w, "Failed to queue message")
+			return
+		}
+		h.publishQueue(stream, sessionKey)
 		return
 	}
+	h.active[sessionKey] = true
+	h.runMu.Unlock()
+
+	if !h.startRun(stream, sessionID, sessionKey, content, attachments, userID) {
+		h.runNext(stream, sessionID, sessionKey, userID)
+	}
+}
+
+// startRun saves the user message and launches Claude in the background.
+// When the run ends it hands over to runNext. Returns false if the run
+// could not be started (the error has been published to the session).
+func (h *ChatHandler) startRun(
+	stream *services.ChatStream,
+	sessionID uuid.UUID,
+	sessionKey string,
+	content string,
+	attachments []models.Attachment,
+	userID uuid.UUID,
+) bool {
+	// Load the session fresh: another device or a previous run may have
+	// advanced the Claude session ID or title since the socket connected.
+	var session models.ChatSession
+	if err := database.DB.First(&session, "id = ?", sessionID).Error; err != nil {
+		h.publish(stream, chatResponse{Type: "error", Message: "Session not found"})
+		return false
+	}
+
+	ws, err := h.workspaces.For(userID)
+	if err != nil {
+		log.Printf("[Chat] failed to open workspace of user %s: %v", userID, err)
+		h.publish(stream, chatResponse{Type: "error", Message: "Failed to open workspace"})
+		return false
+	}
+	// Sessions saved before working directories were validated (or before
+	// per-user workspaces) may point anywhere.
+	workingDir, err := resolveWorkingDir(ws, session.WorkingDirectory)
+	if err != nil {
+		h.publish(stream, chatResponse{Type: "error", Message: "Cannot start Claude: " + err.Error()})
+		return false
+	}
+	session.WorkingDirectory = workingDir
+
+	if err := h.usage.CheckQuota(userID); err != nil {
+		if errors.Is(err, services.ErrQuotaExceeded) {
+			h.publish(stream, chatResponse{Type: "error", Message: "Cannot start Claude: " + err.Error()})
+		} else {
+			log.Printf("[Chat] quota check failed for user %s: %v", userID, err)
+			h.publish(stream, chatResponse{Type: "error", Message: "Failed to check usage quota"})
+		}
+		return false
+	}
 
 	// Save user message
 	userMsg := models.Message{
-		SessionID: session.ID,
-		Role:      "user",
-		Content:   content,
+		SessionID:   session.ID,
+		Role:        "user",
+		Content:     content,
+		Attachments: attachments,
 	}
 	database.DB.Create(&userMsg)
 
 	// Update session timestamp
-	database.DB.Model(session).Update("updated_at", time.Now())
+	database.DB.Model(&session).Update("updated_at", time.Now())
 
-	ctx := context.Background()
+	stream.BeginRun()
+	h.publish(stream, chatResponse{Type: "user_message", Content: content, Attachments: attachments})
 
 	go func() {
-		var fullResponse string
-
-		newSessionID, err := h.claude.SendMessage(
-			ctx,
-			sessionKey,
-			content,
-			session.WorkingDirectory,
-			session.ClaudeSessionID,
-			func(line string) {
-				fullResponse += line + "\n"
-				resp := chatResponse{
-					Type: "stream",
-					Data: json.RawMessage(line),
-				}
-				data, _ := json.Marshal(resp)
-				conn.WriteMessage(websocket.TextMessage, data)
-			},
-		)
+		h.runClaude(stream, &session, ws, sessionKey, attachmentPrompt(ws, session.ID, content, attachments), userID)
+		stream.EndRun()
+		h.runNext(stream, sessionID, sessionKey, userID)
+	}()
+	return true
+}
 
-		if err != nil {
-			h.sendError(conn, "Claude error: "+err.Error())
+// runNext starts the next queued prompt, or marks the session idle when the queue is empty.
+func (h *ChatHandler) runNext(stream *services.ChatStream, sessionID uuid.UUID, sessionKey string, userID uuid.UUID) {
+	ctx := context.Background()
+	for {
+		// Pop under runMu so a prompt queued concurrently is either popped here
+		// or sees the session idle and starts itself — never stranded.
+		h.runMu.Lock()
+		next, err := h.queue.Pop(ctx, sessionKey)
+		if err != nil || next == nil {
+			if err != nil {
+				log.Printf("[Chat] failed to pop queue (key=%s): %v", sessionKey, err)
+			}
+			delete(h.active, sessionKey)
+			h.runMu.Unlock()
 			return
 		}
+		h.runMu.Unlock()
 
-		// Update claude session ID
-		if newSessionID != "" && session.ClaudeSessionID != newSessionID {
-			session.ClaudeSessionID = newSessionID
-			database.DB.Model(session).Update("claude_session_id", newSessionID)
+		h.publishQueue(stream, sessionKey)
+		if h.startRun(stream, sessionID, sessionKey, next.Content, next.Attachments, userID) {
+			return
 		}
+	}
+}
 
-		// Save assistant message
-		assistantMsg := models.Message{
-			SessionID: session.ID,
-			Role:      "assistant",
-			Content:   fullResponse,
+// runClaude executes one prompt and persists its outcome.
+func (h *ChatHandler) runClaude(
+	stream *services.ChatStream,
+	session *models.ChatSession,
+	ws *services.Workspace,
+	sessionKey string,
+	content string,
+	userID uuid.UUID,
+) {
+	var permission *services.PermissionPrompt
+	if h.perms != nil {
+		token := h.perms.OpenRun(sessionKey, func(req services.PermissionRequest) {
+			h.publish(stream, chatResponse{
+				Type:      "permission_request",
+				RequestID: req.ID,
+				ToolName:  req.ToolName,
+				Data:      req.Input,
+			})
+		})
+		defer h.perms.CloseRun(token)
+		permission = &services.PermissionPrompt{
+			URL:     h.cfg.InternalURL + "/internal/mcp/permissions/" + token,
+			Timeout: h.perms.Timeout(),
 		}
-		database.DB.Create(&assistantMsg)
+	}
 
-		// Auto-generate title from first message
-		if session.Title == "New Chat" {
-			title := content
-			if len(title) > 50 {
-				title = title[:50] + "..."
-			}
-			database.DB.Model(session).Update("title", title)
+	options := claudeOptions(session)
+	if err := checkPermissionMode(h.cfg, options.PermissionMode); err != nil {
+		// Picked while the server still allowed it: fall back to asking.
+		log.Printf("[Chat] %v, running session %s in the default mode", err, session.ID)
+		options.PermissionMode = ""
+	}
+
+	transcript, err := h.claude.SendMessage(context.Background(), services.ClaudeRequest{
+		UserID:          userID.String(),
+		SessionKey:      sessionKey,
+		Message:         content,
+		WorkingDir:      session.WorkingDirectory,
+		AddDirs:         extraDirs(ws, session),
+		ClaudeSessionID: session.ClaudeSessionID,
+		Options:         options,
+		OnLine: func(line string, _ []services.ClaudeEvent) {
+			h.publish(stream, chatResponse{
+				Type: "stream",
+				Data: json.RawMessage(line),
+			})
+		},
+		OnQueued: func(position int) {
+			h.publish(stream, chatResponse{Type: "waiting", Position: position})
+		},
+		Permission: permission,
+		Workspace:  ws,
+	})
+
+	if err != nil {
+		h.recordUsage(userID, session.ID, nil, transcript)
+		h.publish(stream, chatResponse{Type: "error", Message: "Claude error: " + err.Error()})
+		return
+	}
+
+	// Update claude session ID
+	newSessionID := transcript.SessionID
+	if newSessionID != "" && session.ClaudeSessionID != newSessionID {
+		session.ClaudeSessionID = newSessionID
+		database.DB.Model(session).Update("claude_session_id", newSessionID)
+	}
+
+	// Save assistant message: final text, tool calls and token usage
+	assistantMsg := models.Message{
+		SessionID:  session.ID,
+		Role:       "assistant",
+		Content:    transcript.Text(),
+		TokensUsed: transcript.Usage().Total(),
+	}
+	if len(transcript.ToolCalls) > 0 {
+		if toolUse, err := json.Marshal(transcript.ToolCalls); err == nil {
+			assistantMsg.ToolUse = datatypes.JSON(toolUse)
 		}
+	}
+	database.DB.Create(&assistantMsg)
+	h.recordUsage(userID, session.ID, &assistantMsg.ID, transcript)
+
+	// Placeholder title from the first message until Claude names the chat
+	if session.Title == "New Chat" {
+		database.DB.Model(session).Update("title", services.TruncateTitle(content, 50))
+	}
+
+	h.publish(stream, chatResponse{
+		Type:      "complete",
+		SessionID: newSessionID,
+	})
+
+	if h.titles != nil {
+		go h.updateTitle(stream, session.ID)
+	}
+}
+
+// updateTitle refreshes the session's summary (and title, after the first
+// exchange) and tells attached clients about it.
+func (h *ChatHandler) updateTitle(stream *services.ChatStream, sessionID uuid.UUID) {
+	ctx, cancel := context.WithTimeout(context.Background(), titleJobTimeout)
+	defer cancel()
 
-		complete := chatResponse{
-			Type:      "complete",
-			SessionID: newSessionID,
+	session, err := h.titles.Update(ctx, sessionID)
+	if err != nil {
+		log.Printf("[Chat] failed to update title/summary of %s: %v", sessionID, err)
+		return
+	}
+	if session != nil {
+		h.publish(stream, chatResponse{Type: "session_updated", Title: session.Title, Summary: session.Summary})
+	}
+}
+
+// extraDirs lists directories outside the session's working directory that
+// Claude needs: the session's attachments, once anything has been uploaded.
+func extraDirs(ws *services.Workspace, session *models.ChatSession) []string {
+	dir := ws.AttachmentsDir(session.ID)
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	return []string{dir}
+}
+
+// handlePermissionResponse answers a pending permission_request. "allow_always"
+// also adds the tool to the session's allow-list so later runs don't ask again.
+func (h *ChatHandler) handlePermissionResponse(
+	w io.Writer,
+	stream *services.ChatStream,
+	sessionID uuid.UUID,
+	sessionKey string,
+	msg chatMessage,
+) {
+	if h.perms == nil {
+		h.sendError(w, "Permission prompts are disabled")
+		return
+	}
+
+	decision := services.PermissionDecision{Behavior: services.PermissionAllow}
+	switch msg.Decision {
+	case "allow_once":
+	case "allow_always":
+		decision.Always = true
+	case "deny":
+		decision.Behavior = services.PermissionDeny
+		decision.Message = msg.Content
+	default:
+		h.sendError(w, "decision must be allow_once, allow_always or deny")
+		return
+	}
+
+	toolName, err := h.perms.Answer(sessionKey, msg.RequestID, decision)
+	if err != nil {
+		h.sendError(w, "Permission request not found or already answered")
+		return
+	}
+
+	if decision.Always {
+		if err := h.allowToolForSession(sessionID, toolName); err != nil {
+			log.Printf("[Chat] failed to persist allowed tool %s for session %s: %v", toolName, sessionID, err)
+			h.sendError(w, "Allowed once; failed to remember the decision: "+err.Error())
 		}
-		data, _ := json.Marshal(complete)
-		conn.WriteMessage(websocket.TextMessage, data)
-	}()
+	}
+
+	// Let every attached device dismiss the prompt.
+	h.publish(stream, chatResponse{Type: "permission_resolved", RequestID: msg.RequestID, ToolName: toolName, Decision: msg.Decision})
+}
+
+// allowToolForSession appends a tool to the session's allow-list. A session
+// still on the server default gets the default list plus the new tool.
+func (h *ChatHandler) allowToolForSession(sessionID uuid.UUID, toolName string) error {
+	var session models.ChatSession
+	if err := database.DB.First(&session, "id = ?", sessionID).Error; err != nil {
+		return err
+	}
+
+	allowed := []string(session.AllowedTools)
+	if allowed == nil {
+		allowed = trimToolRules(strings.Split(h.cfg.ClaudeAllowedTools, ","))
+	}
+	if slices.Contains(allowed, toolName) {
+		return nil
+	}
+	session.AllowedTools = datatypes.JSONSlice[string](append(allowed, toolName))
+	if err := claudeOptions(&session).Validate(); err != nil {
+		return err
+	}
+	return database.DB.Model(&session).Update("allowed_tools", session.AllowedTools).Error
+}
+
+// handleQueueCommand applies a queue_* message from the client and broadcasts the new queue.
+func (h *ChatHandler) handleQueueCommand(w io.Writer, stream *services.ChatStream, sessionKey string, msg chatMessage) {
+	ctx := context.Background()
+
+	var err error
+	switch msg.Type {
+	case "queue_list":
+		h.sendQueue(w, sessionKey)
+		return
+	case "queue_move":
+		if msg.Position == nil {
+			h.sendError(w, "position required")
+			return
+		}
+		err = h.queue.Move(ctx, sessionKey, msg.ID, *msg.Position)
+	case "queue_remove":
+		err = h.queue.Remove(ctx, sessionKey, msg.ID)
+	case "queue_clear":
+		err = h.queue.Clear(ctx, sessionKey)
+	}
+
+	if errors.Is(err, services.ErrQueueItemNotFound) {
+		h.sendError(w, "Queued message not found")
+		return
+	}
+	if err != nil {
+		log.Printf("[Chat] queue %s failed (key=%s): %v", msg.Type, sessionKey, err)
+		h.sendError(w, "Failed to update queue")
+		return
+	}
+	h.publishQueue(stream, sessionKey)
+}
+
+func (h *ChatHandler) queueResponse(sessionKey string) (chatResponse, error) {
+	items, err := h.queue.List(context.Background(), sessionKey)
+	if err != nil {
+		return chatResponse{}, err
+	}
+	data, _ := json.Marshal(items)
+	return chatResponse{Type: "queue", Data: data}, nil
+}
+
+// publishQueue broadcasts the current queue to every device attached to the session.
+func (h *ChatHandler) publishQueue(stream *services.ChatStream, sessionKey string) {
+	resp, err := h.queueResponse(sessionKey)
+	if err != nil {
+		log.Printf("[Chat] failed to list queue (key=%s): %v", sessionKey, err)
+		return
+	}
+	h.publish(stream, resp)
+}
+
+func (h *ChatHandler) sendQueue(w io.Writer, sessionKey string) {
+	resp, err := h.queueResponse(sessionKey)
+	if err != nil {
+		h.sendError(w, "Failed to load queue")
+		return
+	}
+	data, _ := json.Marshal(resp)
+	w.Write(data)
+}
+
+// recordUsage writes the run's result event to the usage ledger, if the run got that far.
+func (h *ChatHandler) recordUsage(userID, sessionID uuid.UUID, messageID *uuid.UUID, transcript *services.Transcript) {
+	if transcript == nil || transcript.Result == nil {
+		return
+	}
+	if err := h.usage.Record(userID, sessionID, messageID, transcript.Result); err != nil {
+		log.Printf("[Chat] failed to record usage for session %s: %v", sessionID, err)
+	}
 }
 
-func (h *ChatHandler) sendError(conn *websocket.Conn, msg string) {
+// sendError reports an error to a single connection (not published to the session).
+func (h *ChatHandler) sendError(w io.Writer, msg string) {
 	resp := chatResponse{
 		Type:    "error",
 		Message: msg,
 	}
 	data, _ := json.Marshal(resp)
-	conn.WriteMessage(websocket.TextMessage, data)
+	w.Write(data)
 }
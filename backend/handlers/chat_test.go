@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChatConn_SlowClientDoesNotBlockWriters(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		conns <- conn
+	}))
+	defer server.Close()
+
+	// The client never reads.
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer client.Close()
+	writer := newChatConn(<-conns)
+
+	msg := []byte(strings.Repeat("x", 64*1024))
+	done := make(chan error, 1)
+	go func() {
+		for sent := 0; sent < 4*chatConnMaxQueue; sent += len(msg) {
+			if _, err := writer.Write(msg); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, errChatConnClosed, "the client was dropped once too far behind")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write blocked on a client that doesn't read")
+	}
+	_, err = writer.Write([]byte("more"))
+	assert.ErrorIs(t, err, errChatConnClosed)
+}
+
+func TestChatConn_CloseSendsWhatIsQueued(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		conns <- conn
+	}))
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer client.Close()
+	writer := newChatConn(<-conns)
+	writer.Write([]byte(`{"type":"error","message":"Invalid last_seq"}`))
+	writer.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"error","message":"Invalid last_seq"}`, string(data))
+	_, _, err = client.ReadMessage()
+	assert.Error(t, err, "then the connection closes")
+}
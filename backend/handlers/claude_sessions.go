@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+
+	"nebulide/database"
+	"nebulide/models"
+	"nebulide/services"
+)
+
+var errAlreadyAdopted = errors.New("claude session already linked to a chat")
+
+// CLISessions lists Claude CLI sessions run inside the workspace (e.g. from
+// the web terminal) that no chat session is linked to yet.
+func (h *SessionsHandler) CLISessions(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	sessions, err := ws.History().ListSessions(ws.Dir)
+	if err != nil {
+		log.Printf("[Sessions] failed to list Claude CLI sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list Claude sessions"})
+		return
+	}
+
+	ids := make([]string, len(sessions))
+	for i, s := range sessions {
+		ids[i] = s.SessionID
+	}
+	linked := map[string]bool{}
+	if len(ids) > 0 {
+		var found []string
+		// Trashed chats still own their transcript until purged.
+		database.DB.Unscoped().Model(&models.ChatSession{}).
+			Where("claude_session_id IN ?", ids).
+			Pluck("claude_session_id", &found)
+		for _, id := range found {
+			linked[id] = true
+		}
+	}
+
+	unlinked := []services.CLISession{}
+	for _, s := range sessions {
+		if !linked[s.SessionID] {
+			unlinked = append(unlinked, s)
+		}
+	}
+	c.JSON(http.StatusOK, unlinked)
+}
+
+type adoptSessionRequest struct {
+	Title string `json:"title"`
+}
+
+// AdoptCLISession creates a chat session linked to a CLI session, with its
+// conversation backfilled from the transcript. The transcript is used in
+// place, so chatting continues the very same Claude session.
+func (h *SessionsHandler) AdoptCLISession(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var req adoptSessionRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	history := ws.History()
+
+	cli, err := history.FindSession(ws.Dir, c.Param("sessionId"))
+	if errors.Is(err, services.ErrTranscriptNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Claude session not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("[Sessions] failed to look up Claude CLI session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read Claude sessions"})
+		return
+	}
+
+	lines, err := history.ReadTranscript(cli.WorkingDir, cli.SessionID)
+	if err != nil {
+		log.Printf("[Sessions] failed to read Claude transcript %s: %v", cli.SessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read Claude transcript"})
+		return
+	}
+	turns := services.ParseTranscript(lines)
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = cli.Title
+	}
+	title = services.TruncateTitle(title, 50)
+	if title == "" {
+		title = "New Chat"
+	}
+
+	session := models.ChatSession{
+		ID:               uuid.New(),
+		UserID:           userID.(uuid.UUID),
+		Title:            title,
+		ClaudeSessionID:  cli.SessionID,
+		WorkingDirectory: cli.WorkingDir,
+	}
+	if len(turns) > 0 && !turns[0].Timestamp.IsZero() {
+		session.CreatedAt = turns[0].Timestamp
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// The unique index on claude_session_id also covers trashed chats.
+		if err := tx.Create(&session).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return errAlreadyAdopted
+			}
+			return err
+		}
+		for _, turn := range turns {
+			msg := models.Message{
+				SessionID: session.ID,
+				Role:      turn.Role,
+				Content:   turn.Content,
+				CreatedAt: turn.Timestamp,
+			}
+			if msg.CreatedAt.IsZero() {
+				msg.CreatedAt = cli.UpdatedAt
+			}
+			if len(turn.ToolCalls) > 0 {
+				if toolUse, err := json.Marshal(turn.ToolCalls); err == nil {
+					msg.ToolUse = datatypes.JSON(toolUse)
+				}
+			}
+			if err := tx.Create(&msg).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errAlreadyAdopted) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This Claude session is already linked to a chat"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import Claude session"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
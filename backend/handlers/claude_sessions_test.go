@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"nebulide/database"
+	"nebulide/models"
+	"nebulide/services"
+)
+
+func TestCLISessions_ListAndAdopt(t *testing.T) {
+	env := setupExportTest(t)
+	cwd := env.Cfg.ClaudeWorkingDir
+	transcript := `{"type":"user","sessionId":"cli-1","cwd":"` + cwd + `","timestamp":"2026-01-02T03:04:05Z","message":{"role":"user","content":"list the files"}}` + "\n" +
+		`{"type":"assistant","sessionId":"cli-1","cwd":"` + cwd + `","timestamp":"2026-01-02T03:04:09Z","message":{"role":"assistant","content":[{"type":"text","text":"Here they are"}]}}` + "\n"
+	require.NoError(t, os.MkdirAll(env.History.ProjectDir(cwd), 0755))
+	require.NoError(t, os.WriteFile(env.History.TranscriptPath(cwd, "cli-1"), []byte(transcript), 0600))
+
+	w := env.do("GET", "/api/claude-sessions", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var listed []services.CLISession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, "list the files", listed[0].Title)
+
+	w = env.do("POST", "/api/claude-sessions/cli-1/adopt", nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var adopted models.ChatSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &adopted))
+	assert.Equal(t, "cli-1", adopted.ClaudeSessionID)
+	assert.Equal(t, cwd, adopted.WorkingDirectory)
+
+	var messages []models.Message
+	database.DB.Where("session_id = ?", adopted.ID).Order("created_at ASC").Find(&messages)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "Here they are", messages[1].Content)
+
+	// Linked sessions drop out of the list and can't be adopted twice.
+	w = env.do("GET", "/api/claude-sessions", nil)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	w = env.do("POST", "/api/claude-sessions/cli-1/adopt", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	// Also while the chat is in the trash.
+	require.NoError(t, database.DB.Delete(&adopted).Error)
+	w = env.do("POST", "/api/claude-sessions/cli-1/adopt", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var count int64
+	database.DB.Unscoped().Model(&models.ChatSession{}).Where("claude_session_id = ?", "cli-1").Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	w = env.do("POST", "/api/claude-sessions/missing/adopt", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,506 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+
+	"nebulide/database"
+	"nebulide/models"
+	"nebulide/services"
+)
+
+const (
+	bundleFormat  = "nebulide.session"
+	bundleVersion = 1
+
+	maxImportBytes = 50 * 1024 * 1024
+)
+
+// sessionBundle is the lossless JSON export of a chat session. Uploaded
+// attachment files are not embedded; their metadata is kept with each message.
+type sessionBundle struct {
+	Format     string          `json:"format"`
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Session    bundleSession   `json:"session"`
+	Messages   []bundleMessage `json:"messages"`
+
+	// Raw lines of the Claude CLI transcript, so an import can resume the
+	// conversation with its full context.
+	ClaudeTranscript []json.RawMessage `json:"claude_transcript,omitempty"`
+}
+
+type bundleSession struct {
+	Title              string    `json:"title"`
+	Summary            string    `json:"summary,omitempty"`
+	Tags               []string  `json:"tags,omitempty"`
+	WorkingDirectory   string    `json:"working_directory"`
+	Model              string    `json:"model,omitempty"`
+	PermissionMode     string    `json:"permission_mode,omitempty"`
+	AllowedTools       []string  `json:"allowed_tools,omitempty"`
+	DisallowedTools    []string  `json:"disallowed_tools,omitempty"`
+	MaxTurns           int       `json:"max_turns,omitempty"`
+	AppendSystemPrompt string    `json:"append_system_prompt,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+type bundleMessage struct {
+	Role        string              `json:"role"`
+	Content     string              `json:"content"`
+	ToolUse     json.RawMessage     `json:"tool_use,omitempty"`
+	TokensUsed  int                 `json:"tokens_used,omitempty"`
+	Attachments []models.Attachment `json:"attachments,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+}
+
+// Export downloads a session as ?format=markdown (default), json (a bundle
+// that Import accepts) or jsonl (a Claude CLI transcript).
+func (h *SessionsHandler) Export(c *gin.Context) {
+	session, ok := ownedSession(c)
+	if !ok {
+		return
+	}
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	history := ws.History()
+
+	var messages []models.Message
+	database.DB.Where("session_id = ?", session.ID).
+		Order("created_at ASC").
+		Find(&messages)
+
+	name := exportFileName(session.Title)
+	switch format := c.DefaultQuery("format", "markdown"); format {
+	case "markdown", "md":
+		c.Header("Content-Disposition", `attachment; filename="`+name+`.md"`)
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(renderMarkdown(session, messages)))
+
+	case "json":
+		bundle := newSessionBundle(session, messages)
+		lines, err := h.transcriptLines(history, session, messages)
+		if err != nil {
+			log.Printf("[Sessions] failed to read Claude transcript of %s: %v", session.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read Claude transcript"})
+			return
+		}
+		for _, line := range lines {
+			bundle.ClaudeTranscript = append(bundle.ClaudeTranscript, line)
+		}
+		data, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export session"})
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+
+	case "jsonl":
+		lines, err := h.transcriptLines(history, session, messages)
+		if err != nil {
+			log.Printf("[Sessions] failed to read Claude transcript of %s: %v", session.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read Claude transcript"})
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+		c.Data(http.StatusOK, "application/x-ndjson", append(bytes.Join(lines, []byte("\n")), '\n'))
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown export format %q (markdown, json or jsonl)", format)})
+	}
+}
+
+// transcriptLines returns the session's CLI transcript, or one rebuilt from
+// the stored messages when the CLI never ran or its file is gone.
+func (h *SessionsHandler) transcriptLines(history *services.ClaudeHistory, session *models.ChatSession, messages []models.Message) ([][]byte, error) {
+	if session.ClaudeSessionID != "" {
+		lines, err := history.ReadTranscript(session.WorkingDirectory, session.ClaudeSessionID)
+		if err == nil {
+			return lines, nil
+		}
+		if !errors.Is(err, services.ErrTranscriptNotFound) {
+			return nil, err
+		}
+	}
+
+	sessionID := session.ClaudeSessionID
+	if sessionID == "" {
+		sessionID = session.ID.String()
+	}
+	turns := make([]services.TranscriptTurn, 0, len(messages))
+	for _, m := range messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			continue
+		}
+		turns = append(turns, services.TranscriptTurn{
+			Role:      m.Role,
+			Content:   m.Content,
+			ToolCalls: toolCalls(m),
+			Timestamp: m.CreatedAt,
+		})
+	}
+	return services.BuildTranscript(sessionID, session.WorkingDirectory, turns), nil
+}
+
+// Import creates a new session owned by the caller from a JSON bundle
+// produced by Export, or from a Claude CLI transcript with ?format=jsonl.
+func (h *SessionsHandler) Import(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	history := ws.History()
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Import too large (max %dMB)", maxImportBytes/(1024*1024))})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	var bundle sessionBundle
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		if err := json.Unmarshal(body, &bundle); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON bundle"})
+			return
+		}
+		if bundle.Format != bundleFormat || bundle.Version < 1 || bundle.Version > bundleVersion {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported bundle format or version"})
+			return
+		}
+	case "jsonl":
+		bundle = bundleFromTranscript(body)
+		if len(bundle.Messages) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Transcript contains no conversation"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown import format %q (json or jsonl)", format)})
+		return
+	}
+	if title := strings.TrimSpace(c.Query("title")); title != "" {
+		bundle.Session.Title = title
+	}
+
+	session := models.ChatSession{
+		ID:                 uuid.New(),
+		UserID:             userID.(uuid.UUID),
+		Title:              importTitle(&bundle),
+		Summary:            bundle.Session.Summary,
+		WorkingDirectory:   importWorkingDir(ws, bundle.Session.WorkingDirectory),
+		Model:              bundle.Session.Model,
+		PermissionMode:     bundle.Session.PermissionMode,
+		AllowedTools:       datatypes.JSONSlice[string](trimToolRules(bundle.Session.AllowedTools)),
+		DisallowedTools:    datatypes.JSONSlice[string](trimToolRules(bundle.Session.DisallowedTools)),
+		MaxTurns:           bundle.Session.MaxTurns,
+		AppendSystemPrompt: bundle.Session.AppendSystemPrompt,
+	}
+	if err := claudeOptions(&session).Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkPermissionMode(h.cfg, session.PermissionMode); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tags, err := normalizeTags(bundle.Session.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	session.Tags = tags
+	for _, m := range bundle.Messages {
+		if m.Role != "user" && m.Role != "assistant" && m.Role != "system" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid message role %q", m.Role)})
+			return
+		}
+	}
+
+	if session.Summary != "" && len(bundle.Messages) > 0 {
+		summarizedAt := bundle.Messages[len(bundle.Messages)-1].CreatedAt
+		session.SummarizedAt = &summarizedAt
+	}
+
+	if len(bundle.ClaudeTranscript) > 0 {
+		lines := make([][]byte, len(bundle.ClaudeTranscript))
+		for i, line := range bundle.ClaudeTranscript {
+			lines[i] = line
+		}
+		newID, err := history.WriteTranscript(session.WorkingDirectory, lines)
+		if err != nil {
+			log.Printf("[Sessions] failed to write imported Claude transcript: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import Claude transcript"})
+			return
+		}
+		session.ClaudeSessionID = newID
+		if err := ws.Own(history.TranscriptPath(session.WorkingDirectory, newID)); err != nil {
+			log.Printf("[Sessions] failed to hand imported transcript to %s: %v", ws.Username, err)
+		}
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		for _, m := range bundle.Messages {
+			msg := models.Message{
+				SessionID:   session.ID,
+				Role:        m.Role,
+				Content:     m.Content,
+				TokensUsed:  m.TokensUsed,
+				CreatedAt:   m.CreatedAt,
+				Attachments: m.Attachments,
+			}
+			if len(m.ToolUse) > 0 && string(m.ToolUse) != "null" {
+				msg.ToolUse = datatypes.JSON(m.ToolUse)
+			}
+			if err := tx.Create(&msg).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if session.ClaudeSessionID != "" {
+			os.Remove(history.TranscriptPath(session.WorkingDirectory, session.ClaudeSessionID))
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import session"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// importWorkingDir keeps the exported working directory when it is a valid
+// one in the importing user's workspace, and falls back to the workspace
+// itself otherwise.
+func importWorkingDir(ws *services.Workspace, dir string) string {
+	if resolved, err := resolveWorkingDir(ws, dir); err == nil {
+		return resolved
+	}
+	return ws.Dir
+}
+
+func newSessionBundle(session *models.ChatSession, messages []models.Message) *sessionBundle {
+	bundle := &sessionBundle{
+		Format:     bundleFormat,
+		Version:    bundleVersion,
+		ExportedAt: time.Now().UTC(),
+		Session: bundleSession{
+			Title:              session.Title,
+			Summary:            session.Summary,
+			Tags:               session.Tags,
+			WorkingDirectory:   session.WorkingDirectory,
+			Model:              session.Model,
+			PermissionMode:     session.PermissionMode,
+			AllowedTools:       session.AllowedTools,
+			DisallowedTools:    session.DisallowedTools,
+			MaxTurns:           session.MaxTurns,
+			AppendSystemPrompt: session.AppendSystemPrompt,
+			CreatedAt:          session.CreatedAt,
+		},
+		Messages: make([]bundleMessage, 0, len(messages)),
+	}
+	for _, m := range messages {
+		bundle.Messages = append(bundle.Messages, bundleMessage{
+			Role:        m.Role,
+			Content:     m.Content,
+			ToolUse:     json.RawMessage(m.ToolUse),
+			TokensUsed:  m.TokensUsed,
+			Attachments: m.Attachments,
+			CreatedAt:   m.CreatedAt,
+		})
+	}
+	return bundle
+}
+
+// bundleFromTranscript rebuilds the chat messages of a CLI transcript and
+// keeps the transcript itself, so the imported session resumes with context.
+func bundleFromTranscript(data []byte) sessionBundle {
+	var bundle sessionBundle
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || !json.Valid(line) {
+			continue
+		}
+		lines = append(lines, line)
+		bundle.ClaudeTranscript = append(bundle.ClaudeTranscript, line)
+	}
+
+	now := time.Now()
+	for _, turn := range services.ParseTranscript(lines) {
+		msg := bundleMessage{Role: turn.Role, Content: turn.Content, CreatedAt: turn.Timestamp}
+		if msg.CreatedAt.IsZero() {
+			msg.CreatedAt = now
+		}
+		if len(turn.ToolCalls) > 0 {
+			msg.ToolUse, _ = json.Marshal(turn.ToolCalls)
+		}
+		bundle.Messages = append(bundle.Messages, msg)
+	}
+	return bundle
+}
+
+// importTitle uses the bundle's title, or the start of the first prompt.
+func importTitle(bundle *sessionBundle) string {
+	title := strings.TrimSpace(bundle.Session.Title)
+	if title == "" {
+		for _, m := range bundle.Messages {
+			if m.Role == "user" {
+				title = strings.Join(strings.Fields(m.Content), " ")
+				break
+			}
+		}
+	}
+	if title == "" {
+		return "Imported Chat"
+	}
+	if utf8.RuneCountInString(title) > 255 {
+		title = string([]rune(title)[:255])
+	}
+	return title
+}
+
+func toolCalls(m models.Message) []services.ToolCall {
+	if len(m.ToolUse) == 0 {
+		return nil
+	}
+	var calls []services.ToolCall
+	json.Unmarshal(m.ToolUse, &calls)
+	return calls
+}
+
+// renderMarkdown formats a session as a readable transcript; tool calls are
+// collapsed into <details> blocks so the conversation stays skimmable.
+func renderMarkdown(session *models.ChatSession, messages []models.Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", session.Title)
+	fmt.Fprintf(&b, "- Created: %s\n", session.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Working directory: `%s`\n", session.WorkingDirectory)
+	if session.Model != "" {
+		fmt.Fprintf(&b, "- Model: %s\n", session.Model)
+	}
+	fmt.Fprintf(&b, "- Messages: %d\n", len(messages))
+
+	for _, m := range messages {
+		role := m.Role
+		switch m.Role {
+		case "user":
+			role = "User"
+		case "assistant":
+			role = "Assistant"
+		case "system":
+			role = "System"
+		}
+		fmt.Fprintf(&b, "\n---\n\n## %s · %s\n\n", role, m.CreatedAt.UTC().Format("2006-01-02 15:04:05 UTC"))
+
+		if content := strings.TrimSpace(m.Content); content != "" {
+			b.WriteString(content + "\n")
+		}
+		for _, att := range m.Attachments {
+			fmt.Fprintf(&b, "\n> Attachment: `%s`", att.Name)
+			if att.MimeType != "" {
+				fmt.Fprintf(&b, " (%s)", att.MimeType)
+			}
+			b.WriteString("\n")
+		}
+		for _, call := range toolCalls(m) {
+			summary := "Tool: " + call.Name
+			if call.IsError {
+				summary += " (error)"
+			}
+			fmt.Fprintf(&b, "\n<details>\n<summary>%s</summary>\n\n", summary)
+			if len(call.Input) > 0 {
+				b.WriteString("Input:\n\n" + codeBlock("json", prettyJSON(call.Input)))
+			}
+			if len(call.Output) > 0 {
+				b.WriteString("\nOutput:\n\n" + codeBlock("", toolOutputText(call.Output)))
+			}
+			b.WriteString("\n</details>\n")
+		}
+	}
+	return b.String()
+}
+
+var backtickRun = regexp.MustCompile("`{3,}")
+
+// codeBlock fences text with more backticks than any run inside it.
+func codeBlock(lang, text string) string {
+	fence := "```"
+	for _, run := range backtickRun.FindAllString(text, -1) {
+		if len(run) >= len(fence) {
+			fence = strings.Repeat("`", len(run)+1)
+		}
+	}
+	return fence + lang + "\n" + strings.TrimRight(text, "\n") + "\n" + fence + "\n"
+}
+
+func prettyJSON(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if json.Indent(&buf, raw, "", "  ") != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
+
+// toolOutputText unwraps tool results, which are a string or a list of
+// content blocks, to their text.
+func toolOutputText(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &blocks) == nil {
+		var parts []string
+		for _, b := range blocks {
+			if b.Type == "text" {
+				parts = append(parts, b.Text)
+			} else {
+				parts = append(parts, "["+b.Type+"]")
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return prettyJSON(raw)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportFileName turns a session title into a safe download file name.
+func exportFileName(title string) string {
+	name := strings.Trim(unsafeFileChars.ReplaceAllString(title, "-"), "-.")
+	if len(name) > 80 {
+		name = strings.TrimRight(name[:80], "-.")
+	}
+	if name == "" {
+		return "chat"
+	}
+	return name
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+
+	"nebulide/config"
+	"nebulide/database"
+	"nebulide/middleware"
+	"nebulide/models"
+	"nebulide/services"
+	"nebulide/testutil"
+)
+
+type exportTestEnv struct {
+	Router  *gin.Engine
+	Token   string
+	Cfg     *config.Config
+	History *services.ClaudeHistory
+	Session models.ChatSession
+}
+
+func setupExportTest(t *testing.T) *exportTestEnv {
+	t.Helper()
+
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	cfg.ClaudeWorkingDir = t.TempDir()
+	cfg.ClaudeConfigDir = t.TempDir()
+	history := services.NewClaudeHistory(cfg.ClaudeConfigDir)
+	handler := NewSessionsHandler(cfg, testWorkspaces(cfg), nil, testTrash(cfg))
+
+	user := testutil.CreateTestUser(db)
+	token := testutil.GenerateTestToken(cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{UserID: user.ID, Title: "Fix the build", WorkingDirectory: cfg.ClaudeWorkingDir, Model: "sonnet"}
+	require.NoError(t, db.Create(&session).Error)
+
+	base := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	toolUse := `[{"id":"t1","name":"Bash","input":{"command":"go build"},"output":"ok"}]`
+	for i, m := range []models.Message{
+		{Role: "user", Content: "Why does the build fail?"},
+		{Role: "assistant", Content: "It passes now.", ToolUse: datatypes.JSON(toolUse), TokensUsed: 42},
+	} {
+		m.SessionID = session.ID
+		m.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, db.Create(&m).Error)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	protected := r.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	{
+		protected.GET("/sessions/:id/export", handler.Export)
+		protected.POST("/sessions/import", handler.Import)
+		protected.GET("/claude-sessions", handler.CLISessions)
+		protected.POST("/claude-sessions/:sessionId/adopt", handler.AdoptCLISession)
+	}
+
+	return &exportTestEnv{Router: r, Token: token, Cfg: cfg, History: history, Session: session}
+}
+
+func (e *exportTestEnv) do(method, url string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+e.Token)
+	e.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestExport_Markdown(t *testing.T) {
+	env := setupExportTest(t)
+
+	w := env.do("GET", "/api/sessions/"+env.Session.ID.String()+"/export", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), `filename="Fix-the-build.md"`)
+
+	md := w.Body.String()
+	assert.True(t, strings.HasPrefix(md, "# Fix the build\n"))
+	assert.Contains(t, md, "Why does the build fail?")
+	assert.Contains(t, md, "<summary>Tool: Bash</summary>")
+	assert.Contains(t, md, "```json\n{\n  \"command\": \"go build\"\n}\n```")
+}
+
+func TestExport_JSONRoundTrip(t *testing.T) {
+	env := setupExportTest(t)
+
+	w := env.do("GET", "/api/sessions/"+env.Session.ID.String()+"/export?format=json", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var bundle sessionBundle
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &bundle))
+	assert.Equal(t, bundleFormat, bundle.Format)
+	require.Len(t, bundle.Messages, 2)
+	// No CLI transcript on disk: one is rebuilt from the messages.
+	assert.Len(t, bundle.ClaudeTranscript, 3)
+
+	w = env.do("POST", "/api/sessions/import", w.Body.Bytes())
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var imported models.ChatSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &imported))
+	assert.NotEqual(t, env.Session.ID, imported.ID)
+	assert.Equal(t, "Fix the build", imported.Title)
+	assert.Equal(t, "sonnet", imported.Model)
+	assert.Equal(t, env.Cfg.ClaudeWorkingDir, imported.WorkingDirectory)
+	require.NotEmpty(t, imported.ClaudeSessionID)
+	_, err := os.Stat(env.History.TranscriptPath(imported.WorkingDirectory, imported.ClaudeSessionID))
+	assert.NoError(t, err)
+
+	var messages []models.Message
+	database.DB.Where("session_id = ?", imported.ID).Order("created_at ASC").Find(&messages)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "It passes now.", messages[1].Content)
+	assert.Equal(t, 42, messages[1].TokensUsed)
+	assert.Equal(t, bundle.Messages[1].CreatedAt.Unix(), messages[1].CreatedAt.Unix())
+	assert.JSONEq(t, string(bundle.Messages[1].ToolUse), string(messages[1].ToolUse))
+}
+
+func TestImport_ClaudeJSONL(t *testing.T) {
+	env := setupExportTest(t)
+
+	w := env.do("GET", "/api/sessions/"+env.Session.ID.String()+"/export?format=jsonl", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = env.do("POST", "/api/sessions/import?format=jsonl", w.Body.Bytes())
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var imported models.ChatSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &imported))
+	assert.Equal(t, "Why does the build fail?", imported.Title)
+	assert.NotEmpty(t, imported.ClaudeSessionID)
+}
+
+func TestImport_RejectsInvalidBundles(t *testing.T) {
+	env := setupExportTest(t)
+
+	w := env.do("POST", "/api/sessions/import", []byte(`{"format":"other","version":1}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = env.do("POST", "/api/sessions/import", []byte(`{"format":"nebulide.session","version":1,"session":{"permission_mode":"yolo"}}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = env.do("POST", "/api/sessions/import", []byte(`{"format":"nebulide.session","version":1,"session":{"permission_mode":"bypassPermissions"}}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = env.do("POST", "/api/sessions/import?format=jsonl", []byte("not json\n"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCodeBlockFence(t *testing.T) {
+	assert.Equal(t, "````\nuse ``` here\n````\n", codeBlock("", "use ``` here"))
+}
@@ -3,22 +3,26 @@ package handlers
 import (
 	"fmt"
 	"io/fs"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
 	"nebulide/config"
+	"nebulide/services"
 )
 
 type FilesHandler struct {
-	cfg *config.Config
+	cfg        *config.Config
+	workspaces *services.WorkspaceManager
 }
 
-func NewFilesHandler(cfg *config.Config) *FilesHandler {
-	return &FilesHandler{cfg: cfg}
+func NewFilesHandler(cfg *config.Config, workspaces *services.WorkspaceManager) *FilesHandler {
+	return &FilesHandler{cfg: cfg, workspaces: workspaces}
 }
 
 type FileInfo struct {
@@ -44,28 +48,32 @@ type renameRequest struct {
 }
 
 func (h *FilesHandler) List(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
 	requestedPath := c.Query("path")
 	if requestedPath == "" {
-		requestedPath = h.cfg.ClaudeWorkingDir
+		requestedPath = ws.Dir
 	}
 
-	fullPath, err := h.safePath(requestedPath)
-	if err != nil {
+	fullPath, err := h.safePath(ws, requestedPath)
+	if err != nil && !hasParentRef(requestedPath) {
 		// Path may be from a different OS — fallback to configured working dir
-		requestedPath = h.cfg.ClaudeWorkingDir
-		fullPath, err = h.safePath(requestedPath)
-		if err != nil {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-			return
-		}
+		requestedPath = ws.Dir
+		fullPath, err = h.safePath(ws, requestedPath)
+	}
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
 	}
 
 	entries, err := os.ReadDir(fullPath)
 	if err != nil {
 		// Directory doesn't exist — fallback to configured working dir
-		if requestedPath != h.cfg.ClaudeWorkingDir {
-			requestedPath = h.cfg.ClaudeWorkingDir
-			fullPath, _ = h.safePath(requestedPath)
+		if requestedPath != ws.Dir {
+			requestedPath = ws.Dir
+			fullPath, _ = h.safePath(ws, requestedPath)
 			os.MkdirAll(fullPath, 0755)
 			entries, err = os.ReadDir(fullPath)
 		}
@@ -101,13 +109,17 @@ func (h *FilesHandler) List(c *gin.Context) {
 }
 
 func (h *FilesHandler) Read(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
 	requestedPath := c.Query("path")
 	if requestedPath == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Path required"})
 		return
 	}
 
-	fullPath, err := h.safePath(requestedPath)
+	fullPath, err := h.safePath(ws, requestedPath)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
@@ -139,13 +151,17 @@ func (h *FilesHandler) Read(c *gin.Context) {
 }
 
 func (h *FilesHandler) Write(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
 	var req writeFileRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 
-	fullPath, err := h.safePath(req.Path)
+	fullPath, err := h.safePath(ws, req.Path)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
@@ -161,18 +177,25 @@ func (h *FilesHandler) Write(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write file"})
 		return
 	}
+	if err := ws.Own(fullPath); err != nil {
+		log.Printf("[Files] failed to hand %s to %s: %v", fullPath, ws.Username, err)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "File saved", "path": req.Path})
 }
 
 func (h *FilesHandler) Delete(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
 	requestedPath := c.Query("path")
 	if requestedPath == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Path required"})
 		return
 	}
 
-	fullPath, err := h.safePath(requestedPath)
+	fullPath, err := h.safePath(ws, requestedPath)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
@@ -187,13 +210,17 @@ func (h *FilesHandler) Delete(c *gin.Context) {
 }
 
 func (h *FilesHandler) Mkdir(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
 	var req mkdirRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 
-	fullPath, err := h.safePath(req.Path)
+	fullPath, err := h.safePath(ws, req.Path)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
@@ -203,24 +230,31 @@ func (h *FilesHandler) Mkdir(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
 		return
 	}
+	if err := ws.Own(fullPath); err != nil {
+		log.Printf("[Files] failed to hand %s to %s: %v", fullPath, ws.Username, err)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Directory created", "path": req.Path})
 }
 
 func (h *FilesHandler) Rename(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
 	var req renameRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 
-	fullOldPath, err := h.safePath(req.OldPath)
+	fullOldPath, err := h.safePath(ws, req.OldPath)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
 	}
 
-	fullNewPath, err := h.safePath(req.NewPath)
+	fullNewPath, err := h.safePath(ws, req.NewPath)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
@@ -246,13 +280,17 @@ func (h *FilesHandler) Rename(c *gin.Context) {
 
 // ReadRaw serves binary files with proper Content-Type (for PDF/DOCX preview in iframe)
 func (h *FilesHandler) ReadRaw(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
 	requestedPath := c.Query("path")
 	if requestedPath == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Path required"})
 		return
 	}
 
-	fullPath, err := h.safePath(requestedPath)
+	fullPath, err := h.safePath(ws, requestedPath)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
@@ -292,14 +330,27 @@ func (h *FilesHandler) ReadRaw(c *gin.Context) {
 	c.File(fullPath)
 }
 
-// safePath ensures the requested path is within the allowed working directory
-func (h *FilesHandler) safePath(requestedPath string) (string, error) {
+// safePath ensures the requested path is within the user's workspace
+func (h *FilesHandler) safePath(ws *services.Workspace, requestedPath string) (string, error) {
+	return workspacePath(ws.Dir, requestedPath)
+}
+
+// hasParentRef reports whether path climbs up with "..", in either OS's
+// separators: that is an attempt to leave the workspace, not a stale path.
+func hasParentRef(path string) bool {
+	parts := strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' })
+	return slices.Contains(parts, "..")
+}
+
+// workspacePath resolves requestedPath (absolute, or relative to base) and
+// rejects anything outside base.
+func workspacePath(base, requestedPath string) (string, error) {
 	// Clean and resolve the path
 	cleaned := filepath.Clean(requestedPath)
 
 	// If it's a relative path, join with working dir
 	if !filepath.IsAbs(cleaned) {
-		cleaned = filepath.Join(h.cfg.ClaudeWorkingDir, cleaned)
+		cleaned = filepath.Join(base, cleaned)
 	}
 
 	// Resolve to absolute
@@ -309,14 +360,39 @@ func (h *FilesHandler) safePath(requestedPath string) (string, error) {
 	}
 
 	// Ensure it's within allowed directory
-	allowedBase, err := filepath.Abs(h.cfg.ClaudeWorkingDir)
+	allowedBase, err := filepath.Abs(base)
 	if err != nil {
 		return "", err
 	}
 
-	if !strings.HasPrefix(absPath, allowedBase) {
+	// A plain prefix check would let base "/ws/alice" through to "/ws/alice2".
+	if !services.IsWithinDir(allowedBase, absPath) {
 		return "", fs.ErrPermission
 	}
 
+	// Same check with symlinks resolved, so a link can't lead outside either.
+	if realBase, err := filepath.EvalSymlinks(allowedBase); err == nil {
+		if !services.IsWithinDir(realBase, resolveExisting(absPath)) {
+			return "", fs.ErrPermission
+		}
+	}
+
 	return absPath, nil
 }
+
+// resolveExisting resolves symlinks in the longest existing prefix of path
+// and appends the rest unchanged.
+func resolveExisting(path string) string {
+	rest := ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest)
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
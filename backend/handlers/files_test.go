@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -39,7 +40,7 @@ func setupFilesTest(t *testing.T) *filesTestEnv {
 	user := testutil.CreateTestUser(db)
 	token := testutil.GenerateTestToken(cfg, user.ID, user.Username, false)
 
-	handler := NewFilesHandler(cfg)
+	handler := NewFilesHandler(cfg, testWorkspaces(cfg))
 
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
@@ -318,9 +319,48 @@ func TestFiles_PathTraversal_DeleteOutsideWorkDir(t *testing.T) {
 func TestFiles_PathTraversal_ListOutsideWorkDir(t *testing.T) {
 	env := setupFilesTest(t)
 
-	traversalPath := filepath.Join(env.WorkDir, "..")
+	w := env.doRequest("GET", "/api/files?path="+env.WorkDir+"/..", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, "Listing outside working dir should be blocked")
 
-	w := env.doRequest("GET", "/api/files?path="+traversalPath, nil)
+	// A path outside it without "..", e.g. from another machine, gets the
+	// working dir instead: never the directory asked for.
+	w = env.doRequest("GET", "/api/files?path="+filepath.Dir(env.WorkDir), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Path string `json:"path"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, env.WorkDir, resp.Path)
+}
 
-	assert.Equal(t, http.StatusForbidden, w.Code, "Listing outside working dir should be blocked")
+func TestFiles_List_ForeignPathFallsBackToWorkDir(t *testing.T) {
+	env := setupFilesTest(t)
+	os.WriteFile(filepath.Join(env.WorkDir, "main.go"), []byte("package main"), 0644)
+
+	for _, path := range []string{`C:\Users\dev\project`, "/Users/dev/project"} {
+		w := env.doRequest("GET", "/api/files?path="+url.QueryEscape(path), nil)
+
+		require.Equal(t, http.StatusOK, w.Code, path)
+		var resp struct {
+			Path  string     `json:"path"`
+			Files []FileInfo `json:"files"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, env.WorkDir, resp.Path, path)
+		require.Len(t, resp.Files, 1, path)
+		assert.Equal(t, "main.go", resp.Files[0].Name)
+	}
+}
+
+func TestFiles_PathTraversal_SiblingWithSamePrefix(t *testing.T) {
+	env := setupFilesTest(t)
+
+	sibling := env.WorkDir + "2"
+	require.NoError(t, os.Mkdir(sibling, 0755))
+	t.Cleanup(func() { os.RemoveAll(sibling) })
+	require.NoError(t, os.WriteFile(filepath.Join(sibling, "secret.txt"), []byte("secret"), 0644))
+
+	w := env.doRequest("GET", "/api/files/read?path="+filepath.Join(sibling, "secret.txt"), nil)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, "A directory sharing the workspace's name prefix is outside it")
 }
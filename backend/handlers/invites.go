@@ -144,6 +144,11 @@ func (h *InviteHandler) Register(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Username must be 3-50 characters"})
 		return
 	}
+	// Usernames name per-user workspace directories.
+	if !services.IsSafeUsername(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username may only contain letters, digits, '.', '_' and '-'"})
+		return
+	}
 
 	// Hash password before transaction (expensive, don't hold lock)
 	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
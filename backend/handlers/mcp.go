@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"nebulide/services"
+)
+
+// PermissionMCPHandler is a minimal MCP server (streamable HTTP, JSON responses only)
+// exposing a single tool the Claude CLI calls via --permission-prompt-tool.
+// It is reachable from loopback only; the path token identifies the run.
+type PermissionMCPHandler struct {
+	broker *services.PermissionBroker
+}
+
+func NewPermissionMCPHandler(broker *services.PermissionBroker) *PermissionMCPHandler {
+	return &PermissionMCPHandler{broker: broker}
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+const (
+	rpcMethodNotFound  = -32601
+	rpcInvalidParams   = -32602
+	mcpProtocolVersion = "2025-03-26"
+)
+
+type permissionToolArgs struct {
+	ToolName  string          `json:"tool_name"`
+	Input     json.RawMessage `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+}
+
+// Handle serves POST /internal/mcp/permissions/:token.
+func (h *PermissionMCPHandler) Handle(c *gin.Context) {
+	if !isLoopback(c.Request.RemoteAddr) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+
+	var req rpcRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON-RPC request"})
+		return
+	}
+
+	// Notifications (no id) need no response body.
+	if len(req.ID) == 0 {
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	resp := rpcResponse{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(req.Params, &params)
+		version := params.ProtocolVersion
+		if version == "" {
+			version = mcpProtocolVersion
+		}
+		resp.Result = gin.H{
+			"protocolVersion": version,
+			"capabilities":    gin.H{"tools": gin.H{}},
+			"serverInfo":      gin.H{"name": "nebulide", "version": "1.0.0"},
+		}
+	case "ping":
+		resp.Result = gin.H{}
+	case "tools/list":
+		resp.Result = gin.H{"tools": []gin.H{{
+			"name":        services.PermissionToolName,
+			"description": "Ask the Nebulide user whether Claude may use a tool",
+			"inputSchema": gin.H{
+				"type": "object",
+				"properties": gin.H{
+					"tool_name":   gin.H{"type": "string"},
+					"input":       gin.H{"type": "object"},
+					"tool_use_id": gin.H{"type": "string"},
+				},
+				"required": []string{"tool_name", "input"},
+			},
+		}}}
+	case "tools/call":
+		result, rpcErr := h.callTool(c, req.Params)
+		resp.Result, resp.Error = result, rpcErr
+	default:
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *PermissionMCPHandler) callTool(c *gin.Context, raw json.RawMessage) (any, *rpcError) {
+	var params struct {
+		Name      string             `json:"name"`
+		Arguments permissionToolArgs `json:"arguments"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil || params.Name != services.PermissionToolName {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Unknown tool"}
+	}
+	args := params.Arguments
+
+	decision, err := h.broker.Request(c.Request.Context(), c.Param("token"), args.ToolName, args.Input, args.ToolUseID)
+	if errors.Is(err, services.ErrUnknownPermissionRun) {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Unknown permission token"}
+	}
+	if err != nil {
+		log.Printf("[Permissions] request for %s aborted: %v", args.ToolName, err)
+		decision = services.PermissionDecision{Behavior: services.PermissionDeny, Message: "Permission request aborted"}
+	}
+
+	// The CLI expects the decision as JSON text in the tool result.
+	var payload gin.H
+	if decision.Behavior == services.PermissionAllow {
+		input := args.Input
+		if len(input) == 0 {
+			input = json.RawMessage("{}")
+		}
+		payload = gin.H{"behavior": "allow", "updatedInput": input}
+	} else {
+		message := decision.Message
+		if message == "" {
+			message = "The user denied permission to use " + args.ToolName
+		}
+		payload = gin.H{"behavior": "deny", "message": message}
+	}
+	text, _ := json.Marshal(payload)
+
+	return gin.H{"content": []gin.H{{"type": "text", "text": string(text)}}}, nil
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
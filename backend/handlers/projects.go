@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"nebulide/services"
+)
+
+// userWorkspace looks up the workspace of the authenticated user, answering
+// the request itself when that fails.
+func userWorkspace(c *gin.Context, workspaces *services.WorkspaceManager) (*services.Workspace, bool) {
+	userID, _ := c.Get("user_id")
+	ws, err := workspaces.For(userID.(uuid.UUID))
+	if err != nil {
+		log.Printf("[Workspace] failed to open workspace of user %v: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open workspace"})
+		return nil, false
+	}
+	return ws, true
+}
+
+// resolveWorkingDir validates a session working directory against the
+// workspace roots, with the same containment rules as FilesHandler.safePath
+// plus symlink resolution. An empty dir means the workspace itself.
+func resolveWorkingDir(ws *services.Workspace, dir string) (string, error) {
+	if dir == "" {
+		return ws.Dir, nil
+	}
+	return services.ResolveWorkingDir(ws.Roots, dir)
+}
+
+// workingDirError tells the client why a requested working directory was
+// rejected and where sessions may run instead.
+func workingDirError(c *gin.Context, ws *services.Workspace, err error) {
+	if errors.Is(err, services.ErrWorkingDirOutside) ||
+		errors.Is(err, services.ErrWorkingDirNotFound) ||
+		errors.Is(err, services.ErrWorkingDirNotDir) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "allowed_roots": ws.Roots})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid working directory"})
+}
+
+// Projects lists the directories a chat session can be started in: each
+// workspace root and its top-level folders.
+func (h *SessionsHandler) Projects(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"default":  ws.Dir,
+		"projects": services.ListProjects(ws.Roots),
+	})
+}
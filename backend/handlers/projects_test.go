@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"nebulide/config"
+	"nebulide/database"
+	"nebulide/middleware"
+	"nebulide/models"
+	"nebulide/services"
+	"nebulide/testutil"
+)
+
+type perUserTestEnv struct {
+	Router     *gin.Engine
+	Cfg        *config.Config
+	Workspaces *services.WorkspaceManager
+	Alice, Bob models.User
+}
+
+func setupPerUserTest(t *testing.T, uidBase int) *perUserTestEnv {
+	t.Helper()
+
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	cfg.ClaudeWorkingDir = t.TempDir()
+	cfg.WorkspacePerUser = true
+	cfg.WorkspaceUIDBase = uidBase
+	workspaces := testWorkspaces(cfg)
+
+	alice := models.User{Username: "alice", PasswordHash: "x"}
+	bob := models.User{Username: "bob", PasswordHash: "x"}
+	require.NoError(t, db.Create(&alice).Error)
+	require.NoError(t, db.Create(&bob).Error)
+
+	files := NewFilesHandler(cfg, workspaces)
+	sessions := NewSessionsHandler(cfg, workspaces, nil, testTrash(cfg))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	protected := r.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	{
+		protected.GET("/files", files.List)
+		protected.GET("/files/read", files.Read)
+		protected.PUT("/files/write", files.Write)
+		protected.POST("/sessions", sessions.Create)
+		protected.GET("/projects", sessions.Projects)
+	}
+
+	return &perUserTestEnv{Router: r, Cfg: cfg, Workspaces: workspaces, Alice: alice, Bob: bob}
+}
+
+func (e *perUserTestEnv) do(user models.User, method, url string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, _ := http.NewRequest(method, url, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testutil.GenerateTestToken(e.Cfg, user.ID, user.Username, false))
+	w := httptest.NewRecorder()
+	e.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestWorkspaces_PerUserFilesAreConfined(t *testing.T) {
+	env := setupPerUserTest(t, 0)
+	aliceDir := filepath.Join(env.Cfg.ClaudeWorkingDir, "alice")
+	bobDir := filepath.Join(env.Cfg.ClaudeWorkingDir, "bob")
+
+	w := env.do(env.Alice, "PUT", "/api/files/write", map[string]string{"path": "app/main.go", "content": "package main"})
+	require.Equal(t, http.StatusOK, w.Code)
+	data, err := os.ReadFile(filepath.Join(aliceDir, "app", "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(data))
+
+	// Bob's default listing is his own, empty workspace.
+	w = env.do(env.Bob, "GET", "/api/files", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "app")
+
+	w = env.do(env.Bob, "GET", "/api/files/read?path="+filepath.Join(aliceDir, "app", "main.go"), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = env.do(env.Bob, "GET", "/api/files/read?path=../alice/app/main.go", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Nor can a symlink planted in his workspace lead there.
+	require.NoError(t, os.Symlink(aliceDir, filepath.Join(bobDir, "peek")))
+	w = env.do(env.Bob, "GET", "/api/files/read?path=peek/app/main.go", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestWorkspaces_ExistingFoldersAreRefused(t *testing.T) {
+	env := setupPerUserTest(t, 0)
+	// A project folder under the shared base that happens to be named
+	// like a user.
+	project := filepath.Join(env.Cfg.ClaudeWorkingDir, "alice")
+	require.NoError(t, os.MkdirAll(project, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(project, "notes.txt"), []byte("notes"), 0644))
+
+	_, err := env.Workspaces.For(env.Alice.ID)
+	assert.ErrorIs(t, err, services.ErrWorkspaceTaken)
+	assert.Equal(t, http.StatusInternalServerError, env.do(env.Alice, "GET", "/api/files", nil).Code)
+
+	// Workspaces the server created are recognized as theirs later on.
+	bob, err := env.Workspaces.For(env.Bob.ID)
+	require.NoError(t, err)
+	again, err := env.Workspaces.For(env.Bob.ID)
+	require.NoError(t, err)
+	assert.Equal(t, bob.Dir, again.Dir)
+}
+
+func TestWorkspaces_PerUserSessionDirectories(t *testing.T) {
+	env := setupPerUserTest(t, 0)
+	aliceDir := filepath.Join(env.Cfg.ClaudeWorkingDir, "alice")
+	_, err := env.Workspaces.For(env.Alice.ID)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(aliceDir, "web"), 0755))
+
+	w := env.do(env.Alice, "POST", "/api/sessions", map[string]string{})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created models.ChatSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, aliceDir, created.WorkingDirectory)
+
+	w = env.do(env.Bob, "POST", "/api/sessions", map[string]string{"working_directory": filepath.Join(aliceDir, "web")})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "outside your workspace")
+
+	w = env.do(env.Alice, "GET", "/api/projects", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Default  string             `json:"default"`
+		Projects []services.Project `json:"projects"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, aliceDir, resp.Default)
+	require.Len(t, resp.Projects, 2)
+	assert.Equal(t, filepath.Join(aliceDir, "web"), resp.Projects[1].Path)
+}
+
+func TestWorkspaces_EnvironmentHidesServerSecrets(t *testing.T) {
+	env := setupPerUserTest(t, 0)
+	t.Setenv("JWT_SECRET", "server-only")
+	t.Setenv("ANTHROPIC_API_KEY", "sk-ant-test")
+
+	ws, err := env.Workspaces.For(env.Alice.ID)
+	require.NoError(t, err)
+	vars := strings.Join(ws.Environ(), "\n")
+	assert.NotContains(t, vars, "JWT_SECRET")
+	assert.Contains(t, vars, "ANTHROPIC_API_KEY=sk-ant-test")
+	assert.Contains(t, vars, "HOME="+ws.Dir)
+	assert.Contains(t, vars, "CLAUDE_CONFIG_DIR="+filepath.Join(ws.Dir, ".claude"))
+}
+
+func TestWorkspaces_CodeServerIsAdminOnly(t *testing.T) {
+	env := setupPerUserTest(t, 0)
+	r := gin.New()
+	code := r.Group("/code")
+	code.Use(CodeServerAuthMiddleware(env.Cfg.JWTSecret), CodeServerAdminOnly())
+	code.Any("/*path", func(c *gin.Context) { c.String(http.StatusOK, "code-server") })
+	get := func(user models.User) int {
+		req, _ := http.NewRequest("GET", "/code/?token="+testutil.GenerateTestToken(env.Cfg, user.ID, user.Username, false), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, get(env.Alice))
+	require.NoError(t, database.DB.Model(&env.Alice).Update("is_admin", true).Error)
+	assert.Equal(t, http.StatusOK, get(env.Alice))
+}
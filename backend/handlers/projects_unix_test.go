@@ -0,0 +1,88 @@
+//go:build !windows
+
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"nebulide/services"
+)
+
+func TestWorkspaces_IsolatedUsersGetTheirOwnUID(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching UIDs needs root")
+	}
+	env := setupPerUserTest(t, 61000)
+
+	alice, err := env.Workspaces.For(env.Alice.ID)
+	require.NoError(t, err)
+	bob, err := env.Workspaces.For(env.Bob.ID)
+	require.NoError(t, err)
+	again, err := env.Workspaces.For(env.Alice.ID)
+	require.NoError(t, err)
+
+	assert.Equal(t, 61000, alice.UID)
+	assert.Equal(t, 61001, bob.UID)
+	assert.Equal(t, alice.UID, again.UID, "UIDs are allocated once")
+
+	info, err := os.Stat(alice.Dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	assert.Equal(t, uint32(61000), info.Sys().(*syscall.Stat_t).Uid)
+
+	// Files the server writes for a user are handed over to them.
+	w := env.do(env.Alice, "PUT", "/api/files/write", map[string]string{"path": "src/a.txt", "content": "a"})
+	require.Equal(t, http.StatusOK, w.Code)
+	for _, p := range []string{"src", "src/a.txt"} {
+		info, err := os.Stat(filepath.Join(alice.Dir, p))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(61000), info.Sys().(*syscall.Stat_t).Uid, p)
+	}
+
+	// Processes run as the user and can't look into other workspaces.
+	cmd := exec.Command("sh", "-c", "id -u; ls "+bob.Dir)
+	cmd.SysProcAttr = alice.SysProcAttr()
+	out, err := cmd.CombinedOutput()
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "61000\n"), string(out))
+	assert.Contains(t, string(out), "Permission denied")
+}
+
+func TestWorkspaces_ExistingFoldersAreNotTakenOver(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching UIDs needs root")
+	}
+	env := setupPerUserTest(t, 61000)
+	// A project folder and a file under the shared base that happen to be
+	// named like users.
+	project := filepath.Join(env.Cfg.ClaudeWorkingDir, "alice")
+	require.NoError(t, os.MkdirAll(filepath.Join(project, "src"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(env.Cfg.ClaudeWorkingDir, "bob"), []byte("notes"), 0644))
+
+	_, err := env.Workspaces.For(env.Alice.ID)
+	assert.ErrorIs(t, err, services.ErrWorkspaceTaken)
+	_, err = env.Workspaces.For(env.Bob.ID)
+	assert.ErrorIs(t, err, services.ErrWorkspaceTaken)
+	for _, p := range []string{project, filepath.Join(project, "src")} {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), p)
+		assert.Equal(t, uint32(0), info.Sys().(*syscall.Stat_t).Uid, p)
+	}
+	assert.Equal(t, http.StatusInternalServerError, env.do(env.Alice, "GET", "/api/files", nil).Code)
+
+	// Once an admin has handed the folder over, it is Alice's workspace.
+	require.NoError(t, os.Chown(project, 61000, 61000))
+	ws, err := env.Workspaces.For(env.Alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, project, ws.Dir)
+}
@@ -77,6 +77,19 @@ func CodeServerAuthMiddleware(jwtSecret string) gin.HandlerFunc {
 	}
 }
 
+// CodeServerAdminOnly restricts the /code/* proxy to admins. code-server runs
+// as one OS user over the whole workspace base, so with per-user workspaces
+// anyone else could read and write every user's files through it.
+func CodeServerAdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requireAdmin(c) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 // headRecorder captures status + headers for HEAD→GET conversion, discarding the body.
 type headRecorder struct {
 	header http.Header
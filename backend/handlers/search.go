@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"nebulide/config"
+	"nebulide/database"
+)
+
+const (
+	maxSearchQueryLen  = 200
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+
+	// ts_headline wraps matches in these control characters (stripped from the
+	// text beforehand); they become <mark> tags after HTML-escaping.
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+var headlineOptions = `StartSel="` + highlightStart + `", StopSel="` + highlightStop + `"` +
+	", MaxWords=35, MinWords=12, MaxFragments=2, FragmentDelimiter=\" … \""
+
+type SearchHandler struct {
+	cfg *config.Config
+}
+
+func NewSearchHandler(cfg *config.Config) *SearchHandler {
+	return &SearchHandler{cfg: cfg}
+}
+
+// SessionHit is a session whose title matches the query.
+type SessionHit struct {
+	SessionID uuid.UUID `json:"session_id"`
+	Title     string    `json:"title"`
+	Highlight string    `json:"highlight"`
+	Rank      float64   `json:"rank"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// MessageHit is a message whose content matches the query.
+type MessageHit struct {
+	MessageID    uuid.UUID `json:"message_id"`
+	SessionID    uuid.UUID `json:"session_id"`
+	SessionTitle string    `json:"session_title"`
+	Role         string    `json:"role"`
+	Snippet      string    `json:"snippet"`
+	Rank         float64   `json:"rank"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Messages runs a full-text search over the caller's chat history.
+// ?q= accepts web-search syntax ("quoted phrases", -exclusions, OR);
+// ?limit= and ?offset= page through message hits, best match first.
+// Snippets are HTML-escaped with matches wrapped in <mark>.
+func (h *SearchHandler) Messages(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter q is required"})
+		return
+	}
+	if utf8.RuneCountInString(q) > maxSearchQueryLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query too long"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit <= 0 || limit > maxSearchLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxSearchLimit)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+		return
+	}
+
+	cfgName := database.SearchConfig
+
+	messages := []MessageHit{}
+	err = database.DB.Raw(`
+		SELECT m.id AS message_id, m.session_id, s.title AS session_title, m.role, m.created_at,
+		       ts_rank(to_tsvector('`+cfgName+`', m.content), q.query) AS rank,
+		       ts_headline('`+cfgName+`', translate(m.content, chr(2) || chr(3), ''), q.query, ?) AS snippet
+		FROM messages m
+		JOIN chat_sessions s ON s.id = m.session_id,
+		     websearch_to_tsquery('`+cfgName+`', ?) AS q(query)
+		WHERE s.user_id = ? AND s.deleted_at IS NULL AND to_tsvector('`+cfgName+`', m.content) @@ q.query
+		ORDER BY rank DESC, m.created_at DESC
+		LIMIT ? OFFSET ?`,
+		headlineOptions, q, userID, limit, offset,
+	).Scan(&messages).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+
+	// Title hits are few and only listed with the first page.
+	sessions := []SessionHit{}
+	if offset == 0 {
+		err = database.DB.Raw(`
+			SELECT s.id AS session_id, s.title, s.updated_at,
+			       ts_rank(to_tsvector('`+cfgName+`', s.title), q.query) AS rank,
+			       ts_headline('`+cfgName+`', translate(s.title, chr(2) || chr(3), ''), q.query, ?) AS highlight
+			FROM chat_sessions s,
+			     websearch_to_tsquery('`+cfgName+`', ?) AS q(query)
+			WHERE s.user_id = ? AND s.deleted_at IS NULL AND to_tsvector('`+cfgName+`', s.title) @@ q.query
+			ORDER BY rank DESC, s.updated_at DESC
+			LIMIT ?`,
+			headlineOptions, q, userID, maxSearchLimit,
+		).Scan(&sessions).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+	}
+
+	for i := range messages {
+		messages[i].Snippet = highlightHTML(messages[i].Snippet)
+	}
+	for i := range sessions {
+		sessions[i].Highlight = highlightHTML(sessions[i].Highlight)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":    q,
+		"sessions": sessions,
+		"messages": messages,
+		"limit":    limit,
+		"offset":   offset,
+	})
+}
+
+// highlightHTML escapes a ts_headline result and turns its match markers into
+// <mark> tags, so message content can never inject markup into the page.
+func highlightHTML(headline string) string {
+	escaped := html.EscapeString(headline)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"nebulide/middleware"
+	"nebulide/testutil"
+)
+
+func TestSearch_ValidatesQuery(t *testing.T) {
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	user := testutil.CreateTestUser(db)
+	token := testutil.GenerateTestToken(cfg, user.ID, user.Username, false)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	protected := r.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	protected.GET("/search/messages", NewSearchHandler(cfg).Messages)
+
+	for _, query := range []string{
+		"",
+		"q=",
+		"q=" + strings.Repeat("a", maxSearchQueryLen+1),
+		"q=test&limit=0",
+		"q=test&limit=51",
+		"q=test&offset=-1",
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/search/messages?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "query %q", query)
+	}
+}
+
+func TestSearch_HighlightEscapesContent(t *testing.T) {
+	got := highlightHTML("use <script>" + highlightStart + "alert" + highlightStop + "</script> & more")
+	assert.Equal(t, "use &lt;script&gt;<mark>alert</mark>&lt;/script&gt; &amp; more", got)
+}
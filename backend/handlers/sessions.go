@@ -1,38 +1,405 @@
 package handlers
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
 
 	"nebulide/config"
 	"nebulide/database"
 	"nebulide/models"
+	"nebulide/services"
+)
+
+const (
+	defaultSessionPageSize = 50
+	maxSessionPageSize     = 200
+
+	maxTagsPerSession = 20
+	maxTagLength      = 50
 )
 
 type SessionsHandler struct {
-	cfg *config.Config
+	cfg        *config.Config
+	workspaces *services.WorkspaceManager
+	titles     *services.SessionTitler // nil when AI titles are disabled
+	trash      *services.SessionTrash
 }
 
-func NewSessionsHandler(cfg *config.Config) *SessionsHandler {
-	return &SessionsHandler{cfg: cfg}
+func NewSessionsHandler(
+	cfg *config.Config,
+	workspaces *services.WorkspaceManager,
+	titles *services.SessionTitler,
+	trash *services.SessionTrash,
+) *SessionsHandler {
+	return &SessionsHandler{cfg: cfg, workspaces: workspaces, titles: titles, trash: trash}
 }
 
 type createSessionRequest struct {
 	Title            string `json:"title"`
 	WorkingDirectory string `json:"working_directory"`
+
+	// Organization; nil leaves the current value unchanged on update
+	Pinned   *bool     `json:"pinned"`
+	Archived *bool     `json:"archived"`
+	Tags     *[]string `json:"tags"`
+
+	// Claude CLI settings; nil leaves the current value unchanged on update
+	Model              *string   `json:"model"`
+	PermissionMode     *string   `json:"permission_mode"`
+	AllowedTools       *[]string `json:"allowed_tools"` // [] resets to the server-wide CLAUDE_ALLOWED_TOOLS
+	DisallowedTools    *[]string `json:"disallowed_tools"`
+	MaxTurns           *int      `json:"max_turns"`
+	AppendSystemPrompt *string   `json:"append_system_prompt"`
+}
+
+// applyClaudeSettings copies the CLI settings present in req onto session
+// and validates the result.
+func (req *createSessionRequest) applyClaudeSettings(cfg *config.Config, session *models.ChatSession) error {
+	if req.Model != nil {
+		session.Model = strings.TrimSpace(*req.Model)
+	}
+	if req.PermissionMode != nil {
+		if err := checkPermissionMode(cfg, *req.PermissionMode); err != nil {
+			return err
+		}
+		session.PermissionMode = *req.PermissionMode
+	}
+	if req.AllowedTools != nil {
+		session.AllowedTools = datatypes.JSONSlice[string](trimToolRules(*req.AllowedTools))
+	}
+	if req.DisallowedTools != nil {
+		session.DisallowedTools = datatypes.JSONSlice[string](trimToolRules(*req.DisallowedTools))
+	}
+	if req.MaxTurns != nil {
+		session.MaxTurns = *req.MaxTurns
+	}
+	if req.AppendSystemPrompt != nil {
+		session.AppendSystemPrompt = *req.AppendSystemPrompt
+	}
+	return claudeOptions(session).Validate()
+}
+
+// changes returns the columns req sets, with their new values in session.
+func (req *createSessionRequest) changes(session *models.ChatSession) map[string]any {
+	changes := map[string]any{}
+	if req.Title != "" {
+		changes["title"] = session.Title
+		changes["title_locked"] = session.TitleLocked
+	}
+	if req.WorkingDirectory != "" {
+		changes["working_directory"] = session.WorkingDirectory
+	}
+	if req.Pinned != nil {
+		changes["pinned"] = session.Pinned
+	}
+	if req.Archived != nil {
+		changes["archived"] = session.Archived
+	}
+	if req.Tags != nil {
+		changes["tags"] = session.Tags
+	}
+	if req.Model != nil {
+		changes["model"] = session.Model
+	}
+	if req.PermissionMode != nil {
+		changes["permission_mode"] = session.PermissionMode
+	}
+	if req.AllowedTools != nil {
+		changes["allowed_tools"] = session.AllowedTools
+	}
+	if req.DisallowedTools != nil {
+		changes["disallowed_tools"] = session.DisallowedTools
+	}
+	if req.MaxTurns != nil {
+		changes["max_turns"] = session.MaxTurns
+	}
+	if req.AppendSystemPrompt != nil {
+		changes["append_system_prompt"] = session.AppendSystemPrompt
+	}
+	return changes
+}
+
+// checkPermissionMode rejects the bypassPermissions mode unless the server
+// allows it.
+func checkPermissionMode(cfg *config.Config, mode string) error {
+	if mode == "bypassPermissions" && !cfg.ClaudeAllowBypassPermissions {
+		return errors.New("permission mode bypassPermissions is disabled on this server")
+	}
+	return nil
+}
+
+// applyOrganization copies the pinned/archived flags and tags present in req onto session.
+func (req *createSessionRequest) applyOrganization(session *models.ChatSession) error {
+	if req.Pinned != nil {
+		session.Pinned = *req.Pinned
+	}
+	if req.Archived != nil {
+		session.Archived = *req.Archived
+	}
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return err
+		}
+		session.Tags = datatypes.JSONSlice[string](tags)
+	}
+	return nil
+}
+
+// normalizeTags trims tags and drops blanks and case-insensitive duplicates
+// (the first spelling wins); an empty list is stored as NULL.
+func normalizeTags(tags []string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(tag), " ")
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is too long (max %d characters)", tag, maxTagLength)
+		}
+		seen[strings.ToLower(tag)] = true
+		out = append(out, tag)
+	}
+	if len(out) > maxTagsPerSession {
+		return nil, fmt.Errorf("too many tags (max %d)", maxTagsPerSession)
+	}
+	return out, nil
 }
 
+// trimToolRules drops blank entries; an empty list is stored as NULL.
+func trimToolRules(rules []string) []string {
+	var out []string
+	for _, r := range rules {
+		if r = strings.TrimSpace(r); r != "" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// claudeOptions converts a session's stored CLI settings for ClaudeService.
+func claudeOptions(session *models.ChatSession) services.ClaudeOptions {
+	return services.ClaudeOptions{
+		Model:              session.Model,
+		PermissionMode:     session.PermissionMode,
+		AllowedTools:       session.AllowedTools,
+		DisallowedTools:    session.DisallowedTools,
+		MaxTurns:           session.MaxTurns,
+		AppendSystemPrompt: session.AppendSystemPrompt,
+	}
+}
+
+// sessionCursor is the position after the last session of a page. Pinned
+// sessions always come first, then the sort column, with the ID as tie-breaker.
+type sessionCursor struct {
+	Pinned bool   `json:"p"`
+	Value  string `json:"v"`
+	ID     string `json:"id"`
+}
+
+var sessionSortColumns = map[string]bool{"updated_at": true, "created_at": true, "title": true}
+
+// List returns a page of the caller's sessions, pinned first. Filters:
+// ?tag= (repeatable, all must match), ?archived=false|true|all (default
+// false), ?pinned=, ?working_directory=, ?from= / ?to= (RFC 3339 or
+// YYYY-MM-DD, on updated_at). ?sort=updated_at|created_at|title with
+// ?order=desc|asc; ?limit= and ?cursor= (the previous page's next_cursor).
 func (h *SessionsHandler) List(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	query := database.DB.Where("user_id = ?", userID)
+
+	switch c.DefaultQuery("archived", "false") {
+	case "false":
+		query = query.Where("archived = ?", false)
+	case "true":
+		query = query.Where("archived = ?", true)
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "archived must be true, false or all"})
+		return
+	}
+	if v := c.Query("pinned"); v != "" {
+		pinned, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "pinned must be true or false"})
+			return
+		}
+		query = query.Where("pinned = ?", pinned)
+	}
+	for _, tag := range c.QueryArray("tag") {
+		query = query.Where(datatypes.JSONArrayQuery("tags").Contains(strings.TrimSpace(tag)))
+	}
+	if dir := c.Query("working_directory"); dir != "" {
+		query = query.Where("working_directory IN ?", []string{dir, filepath.Clean(dir)})
+	}
+	if v := c.Query("from"); v != "" {
+		from, err := parseDateParam(v, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time or YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("updated_at >= ?", from)
+	}
+	if v := c.Query("to"); v != "" {
+		to, err := parseDateParam(v, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time or YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("updated_at < ?", to)
+	}
+
+	sortCol := c.DefaultQuery("sort", "updated_at")
+	if !sessionSortColumns[sortCol] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be updated_at, created_at or title"})
+		return
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSessionPageSize)))
+	if err != nil || limit <= 0 || limit > maxSessionPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxSessionPageSize)})
+		return
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		cursor, value, err := decodeSessionCursor(v, sortCol)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		op := "<"
+		if order == "asc" {
+			op = ">"
+		}
+		query = query.Where(
+			"pinned < ? OR (pinned = ? AND ("+sortCol+" "+op+" ? OR ("+sortCol+" = ? AND id "+op+" ?)))",
+			cursor.Pinned, cursor.Pinned, value, value, cursor.ID,
+		)
+	}
+
+	sessions := []models.ChatSession{}
+	if err := query.
+		Order("pinned DESC, " + sortCol + " " + order + ", id " + order).
+		Limit(limit + 1).
+		Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
+
+	var next string
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+		next = encodeSessionCursor(&sessions[limit-1], sortCol)
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "next_cursor": next})
+}
 
-	var sessions []models.ChatSession
-	database.DB.Where("user_id = ?", userID).
-		Order("updated_at DESC").
-		Find(&sessions)
+func encodeSessionCursor(s *models.ChatSession, sortCol string) string {
+	cursor := sessionCursor{Pinned: s.Pinned, ID: s.ID.String()}
+	switch sortCol {
+	case "updated_at":
+		cursor.Value = s.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	case "created_at":
+		cursor.Value = s.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "title":
+		cursor.Value = s.Title
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
 
-	c.JSON(http.StatusOK, sessions)
+// decodeSessionCursor returns the cursor and its sort value as a query argument.
+func decodeSessionCursor(encoded, sortCol string) (*sessionCursor, any, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cursor sessionCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, nil, err
+	}
+	if _, err := uuid.Parse(cursor.ID); err != nil {
+		return nil, nil, err
+	}
+	if sortCol == "title" {
+		return &cursor, cursor.Value, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, cursor.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cursor, t, nil
+}
+
+// parseDateParam accepts RFC 3339 or a plain date; a plain date used as an
+// exclusive upper bound means the end of that day.
+func parseDateParam(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// Tags lists the tags used on the caller's sessions with how often each is used.
+func (h *SessionsHandler) Tags(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var rows []datatypes.JSONSlice[string]
+	database.DB.Model(&models.ChatSession{}).
+		Where("user_id = ? AND tags IS NOT NULL", userID).
+		Pluck("tags", &rows)
+
+	counts := map[string]int{}
+	for _, tags := range rows {
+		for _, tag := range tags {
+			counts[tag]++
+		}
+	}
+	type tagCount struct {
+		Tag   string `json:"tag"`
+		Count int    `json:"count"`
+	}
+	result := make([]tagCount, 0, len(counts))
+	for tag, n := range counts {
+		result = append(result, tagCount{Tag: tag, Count: n})
+	}
+	slices.SortFunc(result, func(a, b tagCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Tag, b.Tag)
+	})
+	c.JSON(http.StatusOK, result)
 }
 
 func (h *SessionsHandler) Create(c *gin.Context) {
@@ -43,17 +410,34 @@ func (h *SessionsHandler) Create(c *gin.Context) {
 
 	userID, _ := c.Get("user_id")
 
+	// A title chosen by the user is kept; otherwise Claude names the chat.
+	titleLocked := req.Title != "" && req.Title != "New Chat"
 	if req.Title == "" {
 		req.Title = "New Chat"
 	}
-	if req.WorkingDirectory == "" {
-		req.WorkingDirectory = h.cfg.ClaudeWorkingDir
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	workingDir, err := resolveWorkingDir(ws, req.WorkingDirectory)
+	if err != nil {
+		workingDirError(c, ws, err)
+		return
 	}
 
 	session := models.ChatSession{
 		UserID:           userID.(uuid.UUID),
 		Title:            req.Title,
-		WorkingDirectory: req.WorkingDirectory,
+		TitleLocked:      titleLocked,
+		WorkingDirectory: workingDir,
+	}
+	if err := req.applyClaudeSettings(h.cfg, &session); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.applyOrganization(&session); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	if err := database.DB.Create(&session).Error; err != nil {
@@ -64,19 +448,38 @@ func (h *SessionsHandler) Create(c *gin.Context) {
 	c.JSON(http.StatusCreated, session)
 }
 
+// Delete moves a session to the trash, stopping its queued and running
+// prompts. With ?permanent=true the session (trashed or not) and its
+// messages are purged right away.
 func (h *SessionsHandler) Delete(c *gin.Context) {
 	sessionID := c.Param("id")
 	userID, _ := c.Get("user_id")
 
-	result := database.DB.Where("id = ? AND user_id = ?", sessionID, userID).
-		Delete(&models.ChatSession{})
-
-	if result.RowsAffected == 0 {
+	permanent := c.Query("permanent") == "true"
+	query := database.DB
+	if permanent {
+		query = query.Unscoped()
+	}
+	var session models.ChatSession
+	if err := query.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Session deleted"})
+	if permanent {
+		if err := h.trash.Purge(session); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete session"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Session deleted permanently"})
+		return
+	}
+
+	if err := h.trash.Trash(&session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session moved to trash", "purge_at": h.trash.PurgeAt(&session)})
 }
 
 func (h *SessionsHandler) Messages(c *gin.Context) {
@@ -115,11 +518,228 @@ func (h *SessionsHandler) Update(c *gin.Context) {
 
 	if req.Title != "" {
 		session.Title = req.Title
+		session.TitleLocked = true
 	}
 	if req.WorkingDirectory != "" {
-		session.WorkingDirectory = req.WorkingDirectory
+		ws, ok := userWorkspace(c, h.workspaces)
+		if !ok {
+			return
+		}
+		workingDir, err := resolveWorkingDir(ws, req.WorkingDirectory)
+		if err != nil {
+			workingDirError(c, ws, err)
+			return
+		}
+		session.WorkingDirectory = workingDir
+	}
+	if err := req.applyClaudeSettings(h.cfg, &session); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.applyOrganization(&session); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	database.DB.Save(&session)
+	// Only write what the request changes: a run or the titler may have
+	// updated other columns since the session was read.
+	if err := database.DB.Model(&session).Updates(req.changes(&session)).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+	database.DB.First(&session, "id = ?", session.ID)
 	c.JSON(http.StatusOK, session)
 }
+
+// answeredPrompts counts the user messages Claude answered. A prompt whose
+// run failed has no reply and, as it may not have reached the CLI either, is
+// left out of the count of transcript prompts.
+func answeredPrompts(messages []models.Message) int {
+	answered := 0
+	pending := false
+	for _, m := range messages {
+		switch m.Role {
+		case "user":
+			pending = true
+		case "assistant":
+			if pending {
+				answered++
+				pending = false
+			}
+		}
+	}
+	return answered
+}
+
+type forkSessionRequest struct {
+	MessageID string `json:"message_id"` // fork point; empty = the whole history
+	Title     string `json:"title"`
+}
+
+// Fork creates a new session with this session's history up to a message and
+// a forked copy of its Claude session, so another approach can be explored
+// without touching the original thread. Forking at a user message branches
+// just before it, so that prompt can be sent differently.
+func (h *SessionsHandler) Fork(c *gin.Context) {
+	sessionID := c.Param("id")
+	userID, _ := c.Get("user_id")
+
+	var req forkSessionRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	var source models.ChatSession
+	if err := database.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&source).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	var messages []models.Message
+	database.DB.Where("session_id = ?", source.ID).
+		Order("created_at ASC").
+		Find(&messages)
+
+	kept := messages
+	var forkPoint *uuid.UUID
+	if req.MessageID != "" {
+		idx := slices.IndexFunc(messages, func(m models.Message) bool { return m.ID.String() == req.MessageID })
+		if idx < 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+		forkPoint = &messages[idx].ID
+		if messages[idx].Role == "user" {
+			kept = messages[:idx]
+		} else {
+			kept = messages[:idx+1]
+		}
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = source.Title + " (fork)"
+	}
+
+	fork := models.ChatSession{
+		ID:                  uuid.New(),
+		UserID:              source.UserID,
+		Title:               title,
+		TitleLocked:         req.Title != "" || source.TitleLocked,
+		WorkingDirectory:    source.WorkingDirectory,
+		Tags:                source.Tags,
+		ForkedFromID:        &source.ID,
+		ForkedFromMessageID: forkPoint,
+		Model:               source.Model,
+		PermissionMode:      source.PermissionMode,
+		AllowedTools:        source.AllowedTools,
+		DisallowedTools:     source.DisallowedTools,
+		MaxTurns:            source.MaxTurns,
+		AppendSystemPrompt:  source.AppendSystemPrompt,
+	}
+
+	// The summary carries over if it doesn't cover messages past the fork point.
+	if source.SummarizedAt != nil && len(kept) > 0 && !source.SummarizedAt.After(kept[len(kept)-1].CreatedAt) {
+		fork.Summary = source.Summary
+		fork.SummarizedAt = source.SummarizedAt
+	}
+
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	history := ws.History()
+
+	// Fork the CLI transcript: one prompt per answered user message we keep.
+	if source.ClaudeSessionID != "" {
+		keepPrompts := -1
+		if req.MessageID != "" {
+			keepPrompts = answeredPrompts(kept)
+		}
+		if keepPrompts != 0 {
+			newID, err := history.Fork(source.WorkingDirectory, source.ClaudeSessionID, keepPrompts)
+			if errors.Is(err, services.ErrTranscriptNotFound) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Claude transcript for this session not found; cannot fork its context"})
+				return
+			}
+			if err != nil {
+				log.Printf("[Sessions] failed to fork Claude session %s: %v", source.ClaudeSessionID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fork Claude session"})
+				return
+			}
+			fork.ClaudeSessionID = newID
+			if err := ws.Own(history.TranscriptPath(fork.WorkingDirectory, newID)); err != nil {
+				log.Printf("[Sessions] failed to hand forked transcript to %s: %v", ws.Username, err)
+			}
+		}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&fork).Error; err != nil {
+			return err
+		}
+		for _, m := range kept {
+			if err := copyUploads(ws, source.ID, fork.ID, m.Attachments); err != nil {
+				log.Printf("[Sessions] failed to copy uploads to fork %s: %v", fork.ID, err)
+			}
+			copied := models.Message{
+				SessionID:   fork.ID,
+				Role:        m.Role,
+				Content:     m.Content,
+				ToolUse:     m.ToolUse,
+				TokensUsed:  m.TokensUsed,
+				CreatedAt:   m.CreatedAt,
+				Attachments: m.Attachments,
+			}
+			if err := tx.Create(&copied).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if fork.ClaudeSessionID != "" {
+			os.Remove(history.TranscriptPath(fork.WorkingDirectory, fork.ClaudeSessionID))
+		}
+		os.RemoveAll(ws.AttachmentsDir(fork.ID))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fork session"})
+		return
+	}
+	if err := ws.Own(ws.AttachmentsDir(fork.ID)); err != nil {
+		log.Printf("[Sessions] failed to hand fork attachments to %s: %v", ws.Username, err)
+	}
+
+	c.JSON(http.StatusCreated, fork)
+}
+
+// RegenerateTitle asks Claude for a new title based on the whole conversation.
+// It also undoes a manual rename: later exchanges may update the title again.
+func (h *SessionsHandler) RegenerateTitle(c *gin.Context) {
+	session, ok := ownedSession(c)
+	if !ok {
+		return
+	}
+	if h.titles == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI-generated titles are disabled"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), titleJobTimeout)
+	defer cancel()
+
+	updated, err := h.titles.Regenerate(ctx, session.ID)
+	switch {
+	case errors.Is(err, services.ErrNothingToSummarize):
+		c.JSON(http.StatusConflict, gin.H{"error": "Session has no messages yet"})
+	case errors.Is(err, services.ErrQuotaExceeded):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case err != nil:
+		log.Printf("[Sessions] failed to regenerate title of %s: %v", session.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to generate a title"})
+	default:
+		c.JSON(http.StatusOK, updated)
+	}
+}
@@ -2,25 +2,55 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 
+	"nebulide/config"
+	"nebulide/database"
 	"nebulide/middleware"
 	"nebulide/models"
+	"nebulide/services"
 	"nebulide/testutil"
 )
 
-func setupSessionsTestRouter() (*gin.Engine, *testutil.TestContext) {
+func testTrash(cfg *config.Config) *services.SessionTrash {
+	return services.NewSessionTrash(database.DB, nil, nil, nil, 24*time.Hour, RemoveSessionFiles(testWorkspaces(cfg)))
+}
+
+func testWorkspaces(cfg *config.Config) *services.WorkspaceManager {
+	return services.NewWorkspaceManager(database.DB, services.WorkspaceOptions{
+		Base:            cfg.ClaudeWorkingDir,
+		ExtraRoots:      cfg.WorkspaceExtraRoots,
+		ClaudeConfigDir: cfg.ClaudeConfigDir,
+		DataDir:         cfg.DataDir,
+		PerUser:         cfg.WorkspacePerUser,
+		UIDBase:         cfg.WorkspaceUIDBase,
+	})
+}
+
+// setupSessionsTestRouter builds the sessions API; configure adjusts the
+// config before the handler is created.
+func setupSessionsTestRouter(configure ...func(cfg *config.Config)) (*gin.Engine, *testutil.TestContext) {
 	db := testutil.SetupTestDB()
 	cfg := testutil.TestConfig()
-	handler := NewSessionsHandler(cfg)
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	handler := NewSessionsHandler(cfg, testWorkspaces(cfg), nil, testTrash(cfg))
 
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
@@ -33,19 +63,29 @@ func setupSessionsTestRouter() (*gin.Engine, *testutil.TestContext) {
 		protected.PUT("/sessions/:id", handler.Update)
 		protected.DELETE("/sessions/:id", handler.Delete)
 		protected.GET("/sessions/:id/messages", handler.Messages)
+		protected.GET("/sessions/trash", handler.Trash)
+		protected.DELETE("/sessions/trash", handler.EmptyTrash)
+		protected.POST("/sessions/:id/restore", handler.Restore)
+		protected.GET("/projects", handler.Projects)
 	}
 
 	return r, &testutil.TestContext{DB: db, Cfg: cfg}
 }
 
+func withWorkDir(dir string) func(cfg *config.Config) {
+	return func(cfg *config.Config) { cfg.ClaudeWorkingDir = dir }
+}
+
 func TestSessions_Create(t *testing.T) {
-	router, tc := setupSessionsTestRouter()
+	router, tc := setupSessionsTestRouter(withWorkDir(t.TempDir()))
+	project := filepath.Join(tc.Cfg.ClaudeWorkingDir, "project")
+	require.NoError(t, os.Mkdir(project, 0755))
 	user := testutil.CreateTestUser(tc.DB)
 	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
 
 	body, _ := json.Marshal(map[string]string{
 		"title":             "Test Session",
-		"working_directory": "/home/user/project",
+		"working_directory": project,
 	})
 
 	w := httptest.NewRecorder()
@@ -61,7 +101,7 @@ func TestSessions_Create(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, "Test Session", resp["title"])
-	assert.Equal(t, "/home/user/project", resp["working_directory"])
+	assert.Equal(t, project, resp["working_directory"])
 	assert.NotEmpty(t, resp["id"])
 	assert.Equal(t, user.ID.String(), resp["user_id"])
 }
@@ -135,9 +175,12 @@ func TestSessions_List(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code)
 
-	var sessions []map[string]interface{}
-	err := json.Unmarshal(w.Body.Bytes(), &sessions)
+	var page struct {
+		Sessions []map[string]interface{} `json:"sessions"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &page)
 	require.NoError(t, err)
+	sessions := page.Sessions
 
 	assert.Len(t, sessions, 3, "Should return all 3 sessions")
 }
@@ -173,9 +216,12 @@ func TestSessions_List_OnlyReturnsOwnSessions(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code)
 
-	var sessions []map[string]interface{}
-	err := json.Unmarshal(w.Body.Bytes(), &sessions)
+	var page struct {
+		Sessions []map[string]interface{} `json:"sessions"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &page)
 	require.NoError(t, err)
+	sessions := page.Sessions
 
 	assert.Len(t, sessions, 1, "Should only return own sessions")
 	assert.Equal(t, "My Session", sessions[0]["title"])
@@ -334,7 +380,8 @@ func TestSessions_Messages_CannotAccessOtherUsersSession(t *testing.T) {
 }
 
 func TestSessions_Update(t *testing.T) {
-	router, tc := setupSessionsTestRouter()
+	router, tc := setupSessionsTestRouter(withWorkDir(t.TempDir()))
+	require.NoError(t, os.Mkdir(filepath.Join(tc.Cfg.ClaudeWorkingDir, "new"), 0755))
 	user := testutil.CreateTestUser(tc.DB)
 	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
 
@@ -342,13 +389,13 @@ func TestSessions_Update(t *testing.T) {
 		ID:               uuid.New(),
 		UserID:           user.ID,
 		Title:            "Old Title",
-		WorkingDirectory: "/old/path",
+		WorkingDirectory: tc.Cfg.ClaudeWorkingDir,
 	}
 	tc.DB.Create(&session)
 
 	body, _ := json.Marshal(map[string]string{
 		"title":             "New Title",
-		"working_directory": "/new/path",
+		"working_directory": "new",
 	})
 
 	w := httptest.NewRecorder()
@@ -364,7 +411,100 @@ func TestSessions_Update(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, "New Title", resp["title"])
-	assert.Equal(t, "/new/path", resp["working_directory"])
+	assert.Equal(t, filepath.Join(tc.Cfg.ClaudeWorkingDir, "new"), resp["working_directory"],
+		"Relative working directories resolve against the workspace")
+}
+
+func TestSessions_Create_RejectsWorkingDirOutsideWorkspace(t *testing.T) {
+	parent := t.TempDir()
+	router, tc := setupSessionsTestRouter(withWorkDir(filepath.Join(parent, "alice")))
+	require.NoError(t, os.Mkdir(tc.Cfg.ClaudeWorkingDir, 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(parent, "alice2"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tc.Cfg.ClaudeWorkingDir, "notes.txt"), []byte("hi"), 0644))
+	require.NoError(t, os.Symlink("/", filepath.Join(tc.Cfg.ClaudeWorkingDir, "escape")))
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	cases := []struct {
+		dir  string
+		want string
+	}{
+		{"/", "outside your workspace"},
+		{"../alice2", "outside your workspace"},
+		{filepath.Join(parent, "alice2"), "outside your workspace"},
+		{"escape", "outside your workspace"},
+		{"missing", "does not exist"},
+		{"notes.txt", "not a directory"},
+	}
+	for _, tt := range cases {
+		body, _ := json.Marshal(map[string]string{"working_directory": tt.dir})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/sessions", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.dir)
+		assert.Contains(t, w.Body.String(), tt.want, tt.dir)
+	}
+
+	var count int64
+	tc.DB.Model(&models.ChatSession{}).Where("user_id = ?", user.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestSessions_Update_RejectsWorkingDirOutsideWorkspace(t *testing.T) {
+	router, tc := setupSessionsTestRouter(withWorkDir(t.TempDir()))
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{UserID: user.ID, Title: "Chat", WorkingDirectory: tc.Cfg.ClaudeWorkingDir}
+	tc.DB.Create(&session)
+
+	body, _ := json.Marshal(map[string]string{"working_directory": "/etc"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var stored models.ChatSession
+	tc.DB.First(&stored, "id = ?", session.ID)
+	assert.Equal(t, tc.Cfg.ClaudeWorkingDir, stored.WorkingDirectory)
+}
+
+func TestSessions_Projects(t *testing.T) {
+	router, tc := setupSessionsTestRouter(withWorkDir(t.TempDir()))
+	for _, dir := range []string{"web", "api/.git", ".hidden"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(tc.Cfg.ClaudeWorkingDir, dir), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(tc.Cfg.ClaudeWorkingDir, "README.md"), []byte("#"), 0644))
+	require.NoError(t, os.Symlink("/", filepath.Join(tc.Cfg.ClaudeWorkingDir, "root")))
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Default  string             `json:"default"`
+		Projects []services.Project `json:"projects"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, tc.Cfg.ClaudeWorkingDir, resp.Default)
+
+	var names []string
+	for _, p := range resp.Projects {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{filepath.Base(tc.Cfg.ClaudeWorkingDir), "api", "web"}, names)
+	assert.True(t, resp.Projects[1].Git)
+	assert.False(t, resp.Projects[2].Git)
 }
 
 func TestSessions_RequiresAuth(t *testing.T) {
@@ -389,3 +529,637 @@ func TestSessions_RequiresAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestSessions_Update_ClaudeSettings(t *testing.T) {
+	router, tc := setupSessionsTestRouter()
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{
+		ID:               uuid.New(),
+		UserID:           user.ID,
+		Title:            "Configured",
+		WorkingDirectory: "/workspace",
+	}
+	tc.DB.Create(&session)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":                "sonnet",
+		"permission_mode":      "acceptEdits",
+		"allowed_tools":        []string{"Read", "Bash(git diff:*)"},
+		"disallowed_tools":     []string{"WebFetch"},
+		"max_turns":            10,
+		"append_system_prompt": "Answer in Russian.",
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stored models.ChatSession
+	require.NoError(t, tc.DB.First(&stored, "id = ?", session.ID).Error)
+	assert.Equal(t, "Configured", stored.Title, "Title untouched when absent")
+	assert.Equal(t, "sonnet", stored.Model)
+	assert.Equal(t, "acceptEdits", stored.PermissionMode)
+	assert.Equal(t, []string{"Read", "Bash(git diff:*)"}, []string(stored.AllowedTools))
+	assert.Equal(t, []string{"WebFetch"}, []string(stored.DisallowedTools))
+	assert.Equal(t, 10, stored.MaxTurns)
+	assert.Equal(t, "Answer in Russian.", stored.AppendSystemPrompt)
+
+	args := claudeOptions(&stored).Args("Read,Write")
+	assert.Equal(t, []string{
+		"--model", "sonnet",
+		"--permission-mode", "acceptEdits",
+		"--allowedTools", "Read,Bash(git diff:*)",
+		"--disallowedTools", "WebFetch",
+		"--max-turns", "10",
+		"--append-system-prompt", "Answer in Russian.",
+	}, args)
+}
+
+func TestSessions_Update_RejectsInvalidClaudeSettings(t *testing.T) {
+	router, tc := setupSessionsTestRouter()
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{
+		ID:               uuid.New(),
+		UserID:           user.ID,
+		Title:            "Configured",
+		WorkingDirectory: "/workspace",
+	}
+	tc.DB.Create(&session)
+
+	cases := []map[string]interface{}{
+		{"permission_mode": "yolo"},
+		{"permission_mode": "bypassPermissions"}, // off unless the server allows it
+		{"model": "sonnet --dangerously-skip-permissions"},
+		{"allowed_tools": []string{"Read,Write"}},
+		{"max_turns": -1},
+	}
+
+	for _, payload := range cases {
+		body, _ := json.Marshal(payload)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, "payload %v should be rejected", payload)
+	}
+}
+
+func TestSessions_Update_BypassPermissionsWhenAllowed(t *testing.T) {
+	router, tc := setupSessionsTestRouter(func(cfg *config.Config) { cfg.ClaudeAllowBypassPermissions = true })
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+	session := models.ChatSession{UserID: user.ID, Title: "Configured", WorkingDirectory: "/workspace"}
+	tc.DB.Create(&session)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), bytes.NewBufferString(`{"permission_mode":"bypassPermissions"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stored models.ChatSession
+	require.NoError(t, tc.DB.First(&stored, "id = ?", session.ID).Error)
+	assert.Equal(t, "bypassPermissions", stored.PermissionMode)
+}
+
+func TestSessions_Fork(t *testing.T) {
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	cfg.ClaudeWorkingDir = t.TempDir()
+	cfg.ClaudeConfigDir = t.TempDir()
+	history := services.NewClaudeHistory(cfg.ClaudeConfigDir)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	protected := router.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	protected.POST("/sessions/:id/fork", NewSessionsHandler(cfg, testWorkspaces(cfg), nil, testTrash(cfg)).Fork)
+
+	user := testutil.CreateTestUser(db)
+	token := testutil.GenerateTestToken(cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{UserID: user.ID, Title: "Original", WorkingDirectory: cfg.ClaudeWorkingDir, ClaudeSessionID: "orig", Model: "sonnet"}
+	require.NoError(t, db.Create(&session).Error)
+
+	base := time.Now().Add(-time.Hour)
+	var msgs []models.Message
+	for i, m := range []struct{ role, content string }{
+		{"user", "first"}, {"assistant", "one"}, {"user", "second"}, {"assistant", "two"},
+	} {
+		msg := models.Message{SessionID: session.ID, Role: m.role, Content: m.content, CreatedAt: base.Add(time.Duration(i) * time.Minute)}
+		require.NoError(t, db.Create(&msg).Error)
+		msgs = append(msgs, msg)
+	}
+
+	transcript := `{"type":"user","sessionId":"orig","message":{"role":"user","content":"first"}}` + "\n" +
+		`{"type":"assistant","sessionId":"orig","message":{"role":"assistant","content":[{"type":"text","text":"one"}]}}` + "\n" +
+		`{"type":"user","sessionId":"orig","message":{"role":"user","content":"second"}}` + "\n"
+	require.NoError(t, os.MkdirAll(history.ProjectDir(cfg.ClaudeWorkingDir), 0755))
+	require.NoError(t, os.WriteFile(history.TranscriptPath(cfg.ClaudeWorkingDir, "orig"), []byte(transcript), 0600))
+
+	fork := func(messageID string) (*httptest.ResponseRecorder, models.ChatSession) {
+		body, _ := json.Marshal(map[string]string{"message_id": messageID})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/sessions/"+session.ID.String()+"/fork", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		var created models.ChatSession
+		json.Unmarshal(w.Body.Bytes(), &created)
+		return w, created
+	}
+
+	// Forking at the second user message branches before it.
+	w, created := fork(msgs[2].ID.String())
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, "Original (fork)", created.Title)
+	assert.Equal(t, "sonnet", created.Model)
+	assert.Equal(t, session.ID, *created.ForkedFromID)
+	assert.NotEmpty(t, created.ClaudeSessionID)
+	assert.NotEqual(t, "orig", created.ClaudeSessionID)
+
+	var copied []models.Message
+	db.Where("session_id = ?", created.ID).Order("created_at ASC").Find(&copied)
+	require.Len(t, copied, 2)
+	assert.Equal(t, "first", copied[0].Content)
+	assert.Equal(t, "one", copied[1].Content)
+
+	data, err := os.ReadFile(history.TranscriptPath(cfg.ClaudeWorkingDir, created.ClaudeSessionID))
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	// Without a message ID the whole history is copied.
+	w, created = fork("")
+	require.Equal(t, http.StatusCreated, w.Code)
+	var count int64
+	db.Model(&models.Message{}).Where("session_id = ?", created.ID).Count(&count)
+	assert.Equal(t, int64(4), count)
+
+	w, _ = fork(uuid.NewString())
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSessions_Fork_SkipsFailedRuns(t *testing.T) {
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	cfg.ClaudeWorkingDir = t.TempDir()
+	cfg.ClaudeConfigDir = t.TempDir()
+	history := services.NewClaudeHistory(cfg.ClaudeConfigDir)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	protected := router.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	protected.POST("/sessions/:id/fork", NewSessionsHandler(cfg, testWorkspaces(cfg), nil, testTrash(cfg)).Fork)
+
+	user := testutil.CreateTestUser(db)
+	token := testutil.GenerateTestToken(cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{UserID: user.ID, Title: "Original", WorkingDirectory: cfg.ClaudeWorkingDir, ClaudeSessionID: "orig"}
+	require.NoError(t, db.Create(&session).Error)
+
+	// The run of "broken" failed before reaching the CLI: no reply, and
+	// nothing in the transcript.
+	base := time.Now().Add(-time.Hour)
+	var msgs []models.Message
+	for i, m := range []struct{ role, content string }{
+		{"user", "first"}, {"assistant", "one"}, {"user", "broken"}, {"user", "second"}, {"assistant", "two"}, {"user", "third"},
+	} {
+		msg := models.Message{SessionID: session.ID, Role: m.role, Content: m.content, CreatedAt: base.Add(time.Duration(i) * time.Minute)}
+		require.NoError(t, db.Create(&msg).Error)
+		msgs = append(msgs, msg)
+	}
+
+	transcript := `{"type":"user","sessionId":"orig","message":{"role":"user","content":"first"}}` + "\n" +
+		`{"type":"assistant","sessionId":"orig","message":{"role":"assistant","content":[{"type":"text","text":"one"}]}}` + "\n" +
+		`{"type":"user","sessionId":"orig","message":{"role":"user","content":"second"}}` + "\n" +
+		`{"type":"assistant","sessionId":"orig","message":{"role":"assistant","content":[{"type":"text","text":"two"}]}}` + "\n" +
+		`{"type":"user","sessionId":"orig","message":{"role":"user","content":"third"}}` + "\n"
+	require.NoError(t, os.MkdirAll(history.ProjectDir(cfg.ClaudeWorkingDir), 0755))
+	require.NoError(t, os.WriteFile(history.TranscriptPath(cfg.ClaudeWorkingDir, "orig"), []byte(transcript), 0600))
+
+	// Forking at "third" keeps both answered prompts of the transcript.
+	body, _ := json.Marshal(map[string]string{"message_id": msgs[5].ID.String()})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/sessions/"+session.ID.String()+"/fork", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created models.ChatSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	data, err := os.ReadFile(history.TranscriptPath(cfg.ClaudeWorkingDir, created.ClaudeSessionID))
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), "\n"))
+	assert.Contains(t, string(data), `"text":"two"`)
+	assert.NotContains(t, string(data), `"content":"third"`)
+}
+
+// fakeTitleClaude puts a `claude` on PATH that answers with the JSON in the returned file.
+func fakeTitleClaude(t *testing.T) (reply string) {
+	t.Helper()
+	dir := t.TempDir()
+	reply = dir + "/reply.txt"
+	script := `#!/bin/sh
+printf '{"type":"result","subtype":"success","is_error":false,"result":%s,"usage":{"input_tokens":10,"output_tokens":5}}' "$(cat ` + reply + `)"
+`
+	require.NoError(t, os.WriteFile(dir+"/claude", []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return reply
+}
+
+func setTitleReply(t *testing.T, path, title, summary string) {
+	inner, _ := json.Marshal(map[string]string{"title": title, "summary": summary})
+	outer, _ := json.Marshal(string(inner))
+	require.NoError(t, os.WriteFile(path, outer, 0644))
+}
+
+func TestSessions_AutoTitleAndRegenerate(t *testing.T) {
+	reply := fakeTitleClaude(t)
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	titles := services.NewSessionTitler(db, services.NewClaudeService("Read", services.NewProcessScheduler(0, 0), services.LiveOptions{}),
+		services.NewUsageService(db, services.UsageQuota{}), testWorkspaces(cfg), "haiku")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	handler := NewSessionsHandler(cfg, testWorkspaces(cfg), titles, testTrash(cfg))
+	protected := router.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	protected.PUT("/sessions/:id", handler.Update)
+	protected.POST("/sessions/:id/title/regenerate", handler.RegenerateTitle)
+
+	user := testutil.CreateTestUser(db)
+	token := testutil.GenerateTestToken(cfg, user.ID, user.Username, false)
+	session := models.ChatSession{UserID: user.ID, Title: "Почему падает сборка?"}
+	require.NoError(t, db.Create(&session).Error)
+
+	base := time.Now().Add(-time.Hour)
+	addMessages := func(offset int, contents ...string) {
+		for i, content := range contents {
+			role := "user"
+			if i%2 == 1 {
+				role = "assistant"
+			}
+			msg := models.Message{SessionID: session.ID, Role: role, Content: content, CreatedAt: base.Add(time.Duration(offset+i) * time.Minute)}
+			require.NoError(t, db.Create(&msg).Error)
+		}
+	}
+
+	// First exchange: title and summary.
+	addMessages(0, "Почему падает сборка?", "Не хватало импорта.")
+	setTitleReply(t, reply, "Исправление сборки", "Добавлен импорт.")
+	updated, err := titles.Update(context.Background(), session.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Исправление сборки", updated.Title)
+	assert.Equal(t, "Добавлен импорт.", updated.Summary)
+	require.NotNil(t, updated.SummarizedAt)
+
+	// Later exchanges only update the running summary.
+	addMessages(2, "А тесты?", "Тоже зелёные.")
+	setTitleReply(t, reply, "Другое", "Сборка и тесты исправлены.")
+	updated, err = titles.Update(context.Background(), session.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Исправление сборки", updated.Title)
+	assert.Equal(t, "Сборка и тесты исправлены.", updated.Summary)
+
+	// Nothing new to summarize.
+	updated, err = titles.Update(context.Background(), session.ID)
+	require.NoError(t, err)
+	assert.Nil(t, updated)
+
+	var runs int64
+	db.Model(&models.UsageRecord{}).Where("session_id = ?", session.ID).Count(&runs)
+	assert.Equal(t, int64(2), runs)
+
+	// A manual rename locks the title; regenerating unlocks it.
+	body, _ := json.Marshal(map[string]string{"title": "Мой чат"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var renamed models.ChatSession
+	json.Unmarshal(w.Body.Bytes(), &renamed)
+	assert.True(t, renamed.TitleLocked)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/sessions/"+session.ID.String()+"/title/regenerate", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var regenerated models.ChatSession
+	json.Unmarshal(w.Body.Bytes(), &regenerated)
+	assert.Equal(t, "Другое", regenerated.Title)
+	assert.False(t, regenerated.TitleLocked)
+}
+
+func TestSessions_ListFiltersAndPagination(t *testing.T) {
+	router, tc := setupSessionsTestRouter()
+	handler := NewSessionsHandler(tc.Cfg, testWorkspaces(tc.Cfg), nil, testTrash(tc.Cfg))
+	router.GET("/api/sessions/tags", middleware.AuthRequired(tc.Cfg.JWTSecret), handler.Tags)
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	create := func(title string, day int, pinned, archived bool, tags ...string) models.ChatSession {
+		s := models.ChatSession{
+			UserID:           user.ID,
+			Title:            title,
+			WorkingDirectory: "/workspace",
+			Pinned:           pinned,
+			Archived:         archived,
+			Tags:             tags,
+			CreatedAt:        base.AddDate(0, 0, day),
+			UpdatedAt:        base.AddDate(0, 0, day),
+		}
+		require.NoError(t, tc.DB.Create(&s).Error)
+		return s
+	}
+	a := create("Alpha", 0, false, false, "work")
+	b := create("Bravo", 1, true, false, "work", "go")
+	c := create("Charlie", 2, false, false)
+	d := create("Delta", 3, false, false, "go")
+	create("Echo", 4, false, true, "work")
+
+	list := func(query string) ([]models.ChatSession, string, int) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/sessions"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		var page struct {
+			Sessions   []models.ChatSession `json:"sessions"`
+			NextCursor string               `json:"next_cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page.Sessions, page.NextCursor, w.Code
+	}
+	titles := func(sessions []models.ChatSession) []string {
+		var out []string
+		for _, s := range sessions {
+			out = append(out, s.Title)
+		}
+		return out
+	}
+
+	// Pinned first, then most recently updated; archived hidden by default.
+	sessions, next, code := list("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"Bravo", "Delta", "Charlie", "Alpha"}, titles(sessions))
+	assert.Empty(t, next)
+
+	// Walking pages yields the same order.
+	var walked []models.ChatSession
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		page, next, code := list("?limit=3&cursor=" + cursor)
+		require.Equal(t, http.StatusOK, code)
+		walked = append(walked, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"Bravo", "Delta", "Charlie", "Alpha"}, titles(walked))
+
+	page, next, _ := list("?sort=title&order=asc&limit=2")
+	assert.Equal(t, []string{"Bravo", "Alpha"}, titles(page))
+	page, _, _ = list("?sort=title&order=asc&limit=2&cursor=" + next)
+	assert.Equal(t, []string{"Charlie", "Delta"}, titles(page))
+
+	sessions, _, _ = list("?tag=work")
+	assert.Equal(t, []string{b.Title, a.Title}, titles(sessions))
+	sessions, _, _ = list("?tag=work&tag=go")
+	assert.Equal(t, []string{b.Title}, titles(sessions))
+	sessions, _, _ = list("?archived=true")
+	assert.Equal(t, []string{"Echo"}, titles(sessions))
+	sessions, _, _ = list("?archived=all&pinned=false&from=2026-03-03&to=2026-03-04")
+	assert.Equal(t, []string{d.Title, c.Title}, titles(sessions))
+
+	_, _, code = list("?sort=owner")
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, _, code = list("?cursor=garbage")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/sessions/tags", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	assert.JSONEq(t, `[{"tag":"work","count":3},{"tag":"go","count":2}]`, w.Body.String())
+}
+
+func TestSessions_UpdateOrganization(t *testing.T) {
+	router, tc := setupSessionsTestRouter()
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+	session := models.ChatSession{UserID: user.ID, Title: "Chat"}
+	require.NoError(t, tc.DB.Create(&session).Error)
+
+	update := func(body string) (*httptest.ResponseRecorder, models.ChatSession) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		var updated models.ChatSession
+		json.Unmarshal(w.Body.Bytes(), &updated)
+		return w, updated
+	}
+
+	w, updated := update(`{"pinned":true,"archived":true,"tags":[" Work ","work","  infra  team ",""]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, updated.Pinned)
+	assert.True(t, updated.Archived)
+	assert.Equal(t, []string{"Work", "infra team"}, []string(updated.Tags))
+
+	// Omitted fields stay as they are.
+	_, updated = update(`{"archived":false}`)
+	assert.True(t, updated.Pinned)
+	assert.False(t, updated.Archived)
+	assert.Len(t, updated.Tags, 2)
+
+	w, _ = update(`{"tags":["` + strings.Repeat("x", 51) + `"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSessions_Update_KeepsConcurrentChanges(t *testing.T) {
+	router, tc := setupSessionsTestRouter()
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+	session := models.ChatSession{UserID: user.ID, Title: "Chat"}
+	require.NoError(t, tc.DB.Create(&session).Error)
+
+	// A run and the titler write to the session right after the handler read it.
+	var once sync.Once
+	require.NoError(t, tc.DB.Callback().Query().After("gorm:query").Register("test:concurrent_run", func(db *gorm.DB) {
+		if db.Statement.Table != "chat_sessions" {
+			return
+		}
+		once.Do(func() {
+			db.Session(&gorm.Session{NewDB: true}).Model(&models.ChatSession{}).Where("id = ?", session.ID).
+				Updates(map[string]any{"claude_session_id": "cli-1", "summary": "Talked about tests"})
+		})
+	}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), strings.NewReader(`{"pinned":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var stored models.ChatSession
+	require.NoError(t, tc.DB.First(&stored, "id = ?", session.ID).Error)
+	assert.True(t, stored.Pinned)
+	assert.Equal(t, "cli-1", stored.ClaudeSessionID)
+	assert.Equal(t, "Talked about tests", stored.Summary)
+	assert.Equal(t, "Chat", stored.Title)
+
+	// A request that changes nothing writes nothing.
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/api/sessions/"+session.ID.String(), strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestSessions_TrashAndRestore(t *testing.T) {
+	router, tc := setupSessionsTestRouter()
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	do := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	session := models.ChatSession{UserID: user.ID, Title: "Trash Me"}
+	require.NoError(t, tc.DB.Create(&session).Error)
+	require.NoError(t, tc.DB.Create(&models.Message{SessionID: session.ID, Role: "user", Content: "hi"}).Error)
+	id := session.ID.String()
+
+	require.Equal(t, http.StatusOK, do("DELETE", "/api/sessions/"+id).Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/sessions/"+id+"/messages").Code)
+
+	w := do("GET", "/api/sessions/trash")
+	require.Equal(t, http.StatusOK, w.Code)
+	var trashed []trashedSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trashed))
+	require.Len(t, trashed, 1)
+	assert.Equal(t, session.ID, trashed[0].ID)
+	require.NotNil(t, trashed[0].PurgeAt)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), *trashed[0].PurgeAt, time.Minute)
+
+	require.Equal(t, http.StatusOK, do("POST", "/api/sessions/"+id+"/restore").Code)
+	assert.Equal(t, http.StatusOK, do("GET", "/api/sessions/"+id+"/messages").Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/api/sessions/"+id+"/restore").Code)
+
+	// Trash again, then empty the trash: session and messages are gone for good.
+	require.Equal(t, http.StatusOK, do("DELETE", "/api/sessions/"+id).Code)
+	w = do("DELETE", "/api/sessions/trash")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"purged":1}`, w.Body.String())
+
+	var sessions, messages int64
+	tc.DB.Unscoped().Model(&models.ChatSession{}).Where("id = ?", session.ID).Count(&sessions)
+	tc.DB.Model(&models.Message{}).Where("session_id = ?", session.ID).Count(&messages)
+	assert.Zero(t, sessions)
+	assert.Zero(t, messages)
+}
+
+func TestSessions_DeletePermanently(t *testing.T) {
+	dataDir := t.TempDir()
+	router, tc := setupSessionsTestRouter(withWorkDir(t.TempDir()), func(cfg *config.Config) { cfg.DataDir = dataDir })
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	session := models.ChatSession{UserID: user.ID, Title: "Gone"}
+	require.NoError(t, tc.DB.Create(&session).Error)
+	require.NoError(t, tc.DB.Create(&models.Message{SessionID: session.ID, Role: "user", Content: "hi"}).Error)
+	ws, err := testWorkspaces(tc.Cfg).For(user.ID)
+	require.NoError(t, err)
+	uploads := ws.AttachmentsDir(session.ID)
+	require.NoError(t, os.MkdirAll(uploads, 0755))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/api/sessions/"+session.ID.String()+"?permanent=true", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var messages int64
+	tc.DB.Model(&models.Message{}).Where("session_id = ?", session.ID).Count(&messages)
+	assert.Zero(t, messages)
+	assert.NoDirExists(t, uploads)
+}
+
+// closeRecorder is a chat client that records being disconnected.
+type closeRecorder struct{ closed bool }
+
+func (c *closeRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (c *closeRecorder) Close() error                { c.closed = true; return nil }
+
+func TestSessionTrash_DisconnectsClients(t *testing.T) {
+	db := testutil.SetupTestDB()
+	streams := services.NewChatStreamHub()
+	trash := services.NewSessionTrash(db, nil, nil, streams, time.Hour, nil)
+	user := testutil.CreateTestUser(db)
+
+	for _, permanent := range []bool{false, true} {
+		session := models.ChatSession{UserID: user.ID, Title: "chat"}
+		require.NoError(t, db.Create(&session).Error)
+		key := session.ID.String() + ":" + user.ID.String()
+		stream := streams.Get(key)
+		client := &closeRecorder{}
+		stream.AttachLive(client, client)
+
+		if permanent {
+			require.NoError(t, trash.Purge(session))
+		} else {
+			require.NoError(t, trash.Trash(&session))
+		}
+		assert.True(t, client.closed)
+		assert.NotSame(t, stream, streams.Get(key), "the stream was released")
+	}
+}
+
+func TestSessionTrash_PurgeExpired(t *testing.T) {
+	db := testutil.SetupTestDB()
+	trash := services.NewSessionTrash(db, nil, nil, nil, time.Hour, nil)
+	user := testutil.CreateTestUser(db)
+
+	expired := models.ChatSession{UserID: user.ID, Title: "old"}
+	recent := models.ChatSession{UserID: user.ID, Title: "recent"}
+	require.NoError(t, db.Create(&expired).Error)
+	require.NoError(t, db.Create(&recent).Error)
+	require.NoError(t, db.Create(&models.Message{SessionID: expired.ID, Role: "user", Content: "x"}).Error)
+	require.NoError(t, trash.Trash(&expired))
+	require.NoError(t, trash.Trash(&recent))
+	db.Unscoped().Model(&expired).Update("deleted_at", time.Now().Add(-2*time.Hour))
+
+	n, err := trash.PurgeExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var remaining []models.ChatSession
+	db.Unscoped().Where("user_id = ?", user.ID).Find(&remaining)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, "recent", remaining[0].Title)
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"nebulide/config"
@@ -18,18 +21,23 @@ import (
 const (
 	wsPingInterval = 30 * time.Second
 	wsPongTimeout  = 45 * time.Second
+	wsWriteTimeout = 10 * time.Second // a client this stuck is dropped
+
+	maxTerminalLabel = 100
 )
 
 type TerminalHandler struct {
-	cfg      *config.Config
-	terminal *services.TerminalService
-	upgrader websocket.Upgrader
+	cfg        *config.Config
+	terminal   *services.TerminalService
+	workspaces *services.WorkspaceManager
+	upgrader   websocket.Upgrader
 }
 
-func NewTerminalHandler(cfg *config.Config, terminal *services.TerminalService) *TerminalHandler {
+func NewTerminalHandler(cfg *config.Config, terminal *services.TerminalService, workspaces *services.WorkspaceManager) *TerminalHandler {
 	return &TerminalHandler{
-		cfg:      cfg,
-		terminal: terminal,
+		cfg:        cfg,
+		terminal:   terminal,
+		workspaces: workspaces,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -55,6 +63,7 @@ type wsWriter struct {
 func (w *wsWriter) Write(p []byte) (int, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
 	err := w.conn.WriteMessage(websocket.BinaryMessage, p)
 	if err != nil {
 		return 0, err
@@ -62,6 +71,100 @@ func (w *wsWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// WriteJSON sends a control message (status, notice) as a text frame.
+func (w *wsWriter) WriteJSON(v any) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return w.conn.WriteJSON(v)
+}
+
+// List returns the caller's shells with their latest resource usage.
+func (h *TerminalHandler) List(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	c.JSON(http.StatusOK, gin.H{
+		"terminals": h.terminal.List(userID.(uuid.UUID)),
+	})
+}
+
+// Metrics returns the number of shells and clients and how much output was
+// dropped for clients too slow to keep up (admin only).
+func (h *TerminalHandler) Metrics(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	c.JSON(http.StatusOK, h.terminal.Stats())
+}
+
+// Rename sets the label of one of the caller's shells.
+func (h *TerminalHandler) Rename(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	label := strings.TrimSpace(req.Label)
+	if utf8.RuneCountInString(label) > maxTerminalLabel {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Label too long"})
+		return
+	}
+
+	info, ok := h.terminal.SetLabel(userID.(uuid.UUID), c.Param("instanceId"), label)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Terminal not found"})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// Delete kills one of the caller's shells and everything running in it.
+func (h *TerminalHandler) Delete(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	if !h.terminal.Kill(userID.(uuid.UUID), c.Param("instanceId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Terminal not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Terminal closed"})
+}
+
+// keepTerminalConn pings the client to detect dead connections (and keep
+// proxies from timing out) and closes the connection when the shell exits.
+func keepTerminalConn(conn *websocket.Conn, termSession *services.TerminalSession, sessionKey string) {
+	// Ping/pong keepalive — detect dead clients, prevent proxy timeouts.
+	// WriteControl is concurrency-safe (doesn't conflict with pumpOutput writes).
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			case <-termSession.Done:
+				return
+			}
+		}
+	}()
+
+	// Close WS when shell exits (e.g. Ctrl+D / exit) so frontend gets onclose and reconnects
+	go func() {
+		<-termSession.Done
+		log.Printf("[Terminal] shell exited, closing WS key=%s", sessionKey)
+		conn.Close()
+	}()
+}
+
 func (h *TerminalHandler) HandleWebSocket(c *gin.Context) {
 	token := c.Query("token")
 	if token == "" {
@@ -79,7 +182,14 @@ func (h *TerminalHandler) HandleWebSocket(c *gin.Context) {
 	if instanceID == "" {
 		instanceID = "default"
 	}
-	sessionKey := "term:" + claims.UserID.String() + ":" + instanceID
+	sessionKey := services.TerminalKey(claims.UserID, instanceID)
+
+	ws, err := h.workspaces.For(claims.UserID)
+	if err != nil {
+		log.Printf("[Terminal] failed to open workspace: %v (key=%s)", err, sessionKey)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open workspace"})
+		return
+	}
 
 	log.Printf("[Terminal] NEW WS connection: remote=%s instanceId=%q sessionKey=%s",
 		c.Request.RemoteAddr, instanceID, sessionKey)
@@ -97,7 +207,7 @@ func (h *TerminalHandler) HandleWebSocket(c *gin.Context) {
 	// Reuse existing shell or create new one.
 	// Shell lives independently of WebSocket — survives reconnections.
 	log.Printf("[Terminal] calling GetOrCreate key=%s", sessionKey)
-	termSession, err := h.terminal.GetOrCreate(sessionKey, h.cfg.ClaudeWorkingDir)
+	termSession, err := h.terminal.GetOrCreate(sessionKey, ws)
 	if err != nil {
 		log.Printf("[Terminal] failed to create session: %v (key=%s)", err, sessionKey)
 		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"error","message":"Failed to create terminal"}`))
@@ -111,35 +221,11 @@ func (h *TerminalHandler) HandleWebSocket(c *gin.Context) {
 	log.Printf("[Terminal] calling AddWriter key=%s", sessionKey)
 	termSession.AddWriter(writer, conn)
 	log.Printf("[Terminal] AddWriter done key=%s", sessionKey)
+	if status, ok := termSession.Status(); ok {
+		writer.WriteJSON(status)
+	}
 
-	// Ping/pong keepalive — detect dead clients, prevent proxy timeouts.
-	// WriteControl is concurrency-safe (doesn't conflict with pumpOutput writes).
-	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
-		return nil
-	})
-	go func() {
-		ticker := time.NewTicker(wsPingInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
-					return
-				}
-			case <-termSession.Done:
-				return
-			}
-		}
-	}()
-
-	// Close WS when shell exits (e.g. Ctrl+D / exit) so frontend gets onclose and reconnects
-	go func() {
-		<-termSession.Done
-		log.Printf("[Terminal] shell exited, closing WS key=%s", sessionKey)
-		conn.Close()
-	}()
+	keepTerminalConn(conn, termSession, sessionKey)
 
 	// WS → PTY (stdin + control messages)
 	log.Printf("[Terminal] WS→PTY loop START key=%s", sessionKey)
@@ -152,7 +238,7 @@ func (h *TerminalHandler) HandleWebSocket(c *gin.Context) {
 
 		if msgType == websocket.BinaryMessage {
 			// Raw terminal input
-			termSession.Pty.Write(raw)
+			termSession.Write(raw)
 			continue
 		}
 
@@ -165,7 +251,7 @@ func (h *TerminalHandler) HandleWebSocket(c *gin.Context) {
 
 		switch msg.Type {
 		case "input":
-			termSession.Pty.Write([]byte(msg.Data))
+			termSession.Write([]byte(msg.Data))
 		case "resize":
 			log.Printf("[Terminal] resize rows=%d cols=%d key=%s", msg.Rows, msg.Cols, sessionKey)
 			h.terminal.Resize(sessionKey, msg.Rows, msg.Cols)
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"nebulide/services"
+	"nebulide/utils"
+)
+
+const (
+	maxPlaybackSpeed     = 16
+	defaultPlaybackIdle  = 2 * time.Second
+	playbackWriteTimeout = 10 * time.Second
+)
+
+// SetRecording starts or stops recording one of the caller's shells. What
+// they type is only recorded when asked for with "input".
+func (h *TerminalHandler) SetRecording(c *gin.Context) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+		Input   bool `json:"input"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+
+	var info services.RecordingInfo
+	var err error
+	if req.Enabled {
+		info, err = h.terminal.StartRecording(ws, c.Param("instanceId"), req.Input)
+	} else {
+		info, err = h.terminal.StopRecording(ws, c.Param("instanceId"))
+	}
+	switch {
+	case errors.Is(err, services.ErrTerminalNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Terminal not found"})
+	case errors.Is(err, services.ErrNotRecording):
+		c.JSON(http.StatusConflict, gin.H{"error": "Terminal is not being recorded"})
+	case err != nil:
+		log.Printf("[Terminal] recording failed: %v (user=%s)", err, ws.Username)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record terminal"})
+	default:
+		c.JSON(http.StatusOK, info)
+	}
+}
+
+// Recordings lists the caller's terminal recordings, newest first.
+func (h *TerminalHandler) Recordings(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	recordings, err := h.terminal.Recordings(ws)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list recordings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recordings": recordings})
+}
+
+// DownloadRecording serves one of the caller's recordings as an asciicast file.
+func (h *TerminalHandler) DownloadRecording(c *gin.Context) {
+	ws, ok := userWorkspace(c, h.workspaces)
+	if !ok {
+		return
+	}
+	path, ok := recordingPath(c, ws)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-asciicast")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, c.Param("name")))
+	c.File(path)
+}
+
+// recordingPath resolves the recording named in the URL, answering the
+// request itself when there is no such recording.
+func recordingPath(c *gin.Context, ws *services.Workspace) (string, bool) {
+	path, err := ws.RecordingPath(c.Param("name"))
+	if errors.Is(err, services.ErrInvalidRecording) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recording name"})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return "", false
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return "", false
+	}
+	return path, true
+}
+
+// PlayRecording streams one of the caller's recordings over a WebSocket at
+// its recorded pace: a {"type":"header"} message with the terminal size,
+// output as binary frames (like a live terminal), resizes as
+// {"type":"resize"} and a final {"type":"end"}. Query parameters: speed
+// (a factor up to 16, default 1) and idle_limit in seconds (longer pauses
+// are shortened to it, default 2, 0 = keep them).
+func (h *TerminalHandler) PlayRecording(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token required"})
+		return
+	}
+
+	claims, err := utils.ParseToken(h.cfg.JWTSecret, token)
+	if err != nil || claims.Partial {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	speed := 1.0
+	if v := c.Query("speed"); v != "" {
+		speed, err = strconv.ParseFloat(v, 64)
+		if err != nil || speed <= 0 || speed > maxPlaybackSpeed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("speed must be between 0 and %d", maxPlaybackSpeed)})
+			return
+		}
+	}
+	idleLimit := defaultPlaybackIdle
+	if v := c.Query("idle_limit"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || seconds < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid idle_limit"})
+			return
+		}
+		idleLimit = time.Duration(seconds * float64(time.Second))
+	}
+
+	ws, err := h.workspaces.For(claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open workspace"})
+		return
+	}
+	path, ok := recordingPath(c, ws)
+	if !ok {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+	defer f.Close()
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("[Terminal] WS upgrade error: %v (recording=%s)", err, c.Param("name"))
+		return
+	}
+	defer conn.Close()
+
+	// Stop when the client goes away; it sends nothing else.
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(msgType int, data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(playbackWriteTimeout))
+		return conn.WriteMessage(msgType, data)
+	}
+	writeJSON := func(v any) error {
+		conn.SetWriteDeadline(time.Now().Add(playbackWriteTimeout))
+		return conn.WriteJSON(v)
+	}
+	err = services.PlayCast(ctx, f, speed, idleLimit,
+		func(header services.CastHeader) error {
+			return writeJSON(gin.H{"type": "header", "cols": header.Width, "rows": header.Height, "title": header.Title, "timestamp": header.Timestamp})
+		},
+		func(event services.CastEvent) error {
+			switch event.Code {
+			case "o":
+				return write(websocket.BinaryMessage, []byte(event.Data))
+			case "r":
+				var cols, rows int
+				if _, err := fmt.Sscanf(event.Data, "%dx%d", &cols, &rows); err != nil {
+					return nil
+				}
+				return writeJSON(gin.H{"type": "resize", "cols": cols, "rows": rows})
+			}
+			return nil // input is already echoed in the output
+		})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[Terminal] playback stopped: %v (recording=%s)", err, c.Param("name"))
+			writeJSON(gin.H{"type": "error", "message": "Playback failed"})
+		}
+		return
+	}
+	writeJSON(gin.H{"type": "end"})
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"nebulide/services"
+	"nebulide/utils"
+)
+
+const defaultShareTTL = time.Hour
+
+// CreateShare mints a read-only share link for one of the caller's shells.
+func (h *TerminalHandler) CreateShare(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var req struct {
+		TTLMinutes int  `json:"ttl_minutes"`
+		Anonymous  bool `json:"anonymous"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	ttl := defaultShareTTL
+	if req.TTLMinutes != 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+	}
+	if ttl <= 0 || ttl > h.cfg.TerminalShareMaxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ttl_minutes must be between 1 and %d", int(h.cfg.TerminalShareMaxTTL.Minutes()))})
+		return
+	}
+	if req.Anonymous && !h.cfg.TerminalShareAnonymous {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Anonymous sharing is disabled"})
+		return
+	}
+
+	share, err := h.terminal.ShareTerminal(userID.(uuid.UUID), c.Param("instanceId"), ttl, req.Anonymous)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Terminal not found"})
+		return
+	}
+	c.JSON(http.StatusCreated, share)
+}
+
+// Shares lists the live shares of one of the caller's shells and who is
+// watching through them.
+func (h *TerminalHandler) Shares(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	shares, err := h.terminal.Shares(userID.(uuid.UUID), c.Param("instanceId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Terminal not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// RevokeShare invalidates a share and disconnects its viewers.
+func (h *TerminalHandler) RevokeShare(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	if !h.terminal.RevokeShare(userID.(uuid.UUID), c.Param("instanceId"), c.Param("shareId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Share revoked"})
+}
+
+// ViewShare attaches a viewer to a shared shell. Output flows as on the
+// owner's connection; anything the viewer sends (input, resize) is ignored.
+// The usual ?token= is optional when the share admits anonymous viewers.
+func (h *TerminalHandler) ViewShare(c *gin.Context) {
+	viewer := services.TerminalViewer{RemoteAddr: c.ClientIP()}
+	if token := c.Query("token"); token != "" {
+		claims, err := utils.ParseToken(h.cfg.JWTSecret, token)
+		if err != nil || claims.Partial {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		viewer.UserID = &claims.UserID
+		viewer.Username = claims.Username
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("[Terminal] WS upgrade error: %v (shared view)", err)
+		return
+	}
+	defer conn.Close()
+
+	writer := &wsWriter{conn: conn}
+	termSession, detach, err := h.terminal.ViewShare(c.Param("share"), viewer, writer, conn)
+	if err != nil {
+		message := "Share link is invalid or has expired"
+		if errors.Is(err, services.ErrShareNeedsLogin) {
+			message = "Sign in to view this terminal"
+		}
+		writer.WriteJSON(gin.H{"type": "error", "message": message})
+		return
+	}
+	defer detach()
+	log.Printf("[Terminal] viewer joined shared terminal: user=%q remote=%s", viewer.Username, viewer.RemoteAddr)
+
+	writer.WriteJSON(services.TerminalNotice{Type: "notice", Message: "Read-only view: your input is not sent"})
+	if status, ok := termSession.Status(); ok {
+		writer.WriteJSON(status)
+	}
+	keepTerminalConn(conn, termSession, "shared")
+
+	// Drain (and drop) whatever the viewer sends; this also processes pongs.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	log.Printf("[Terminal] viewer left shared terminal: user=%q remote=%s", viewer.Username, viewer.RemoteAddr)
+}
@@ -0,0 +1,442 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"nebulide/config"
+	"nebulide/middleware"
+	"nebulide/models"
+	"nebulide/services"
+	"nebulide/testutil"
+)
+
+type terminalTestEnv struct {
+	Router     *gin.Engine
+	Server     *httptest.Server
+	Cfg        *config.Config
+	DB         *gorm.DB
+	Terminals  *services.TerminalService
+	Workspaces *services.WorkspaceManager
+	User       models.User
+	Token      string
+	Other      models.User
+	OtherToken string
+}
+
+func setupTerminalTest(t *testing.T) *terminalTestEnv {
+	t.Helper()
+
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	cfg.ClaudeWorkingDir = t.TempDir()
+	cfg.DataDir = t.TempDir()
+	cfg.TerminalShareMaxTTL = time.Hour
+	terminals := services.NewTerminalService(services.TerminalOptions{})
+	workspaces := testWorkspaces(cfg)
+	handler := NewTerminalHandler(cfg, terminals, workspaces)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	protected := r.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	{
+		protected.GET("/terminals", handler.List)
+		protected.GET("/terminals/recordings", handler.Recordings)
+		protected.GET("/terminals/recordings/:name", handler.DownloadRecording)
+		protected.PATCH("/terminals/:instanceId", handler.Rename)
+		protected.DELETE("/terminals/:instanceId", handler.Delete)
+		protected.PUT("/terminals/:instanceId/recording", handler.SetRecording)
+		protected.GET("/terminals/:instanceId/shares", handler.Shares)
+		protected.POST("/terminals/:instanceId/shares", handler.CreateShare)
+		protected.DELETE("/terminals/:instanceId/shares/:shareId", handler.RevokeShare)
+		protected.GET("/admin/terminals", handler.Metrics)
+	}
+	r.GET("/ws/terminal/recordings/:name", handler.PlayRecording)
+	r.GET("/ws/terminal/shared/:share", handler.ViewShare)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	user := testutil.CreateTestUser(db)
+	other := models.User{Username: "other", PasswordHash: "x"}
+	require.NoError(t, db.Create(&other).Error)
+
+	return &terminalTestEnv{
+		Router:     r,
+		Server:     server,
+		Cfg:        cfg,
+		DB:         db,
+		Terminals:  terminals,
+		Workspaces: workspaces,
+		User:       user,
+		Token:      testutil.GenerateTestToken(cfg, user.ID, user.Username, false),
+		Other:      other,
+		OtherToken: testutil.GenerateTestToken(cfg, other.ID, other.Username, false),
+	}
+}
+
+func (e *terminalTestEnv) do(token, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	e.Router.ServeHTTP(w, req)
+	return w
+}
+
+// shell starts one of the user's shells, closed when the test ends.
+func (e *terminalTestEnv) shell(t *testing.T, instanceID string) *services.TerminalSession {
+	t.Helper()
+	ws, err := e.Workspaces.For(e.User.ID)
+	require.NoError(t, err)
+	session, err := e.Terminals.Create(services.TerminalKey(e.User.ID, instanceID), ws)
+	require.NoError(t, err)
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// recordingsDir is where the user's recordings end up.
+func (e *terminalTestEnv) recordingsDir(t *testing.T) string {
+	t.Helper()
+	ws, err := e.Workspaces.For(e.User.ID)
+	require.NoError(t, err)
+	return ws.RecordingsDir()
+}
+
+// record records the shell "main" running `echo recorded-42` with the given
+// SetRecording body, and returns the finished recording.
+func (e *terminalTestEnv) record(t *testing.T, body string) services.RecordingInfo {
+	t.Helper()
+	session := e.shell(t, "main")
+	w := e.do(e.Token, "PUT", "/api/terminals/main/recording", body)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var started services.RecordingInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &started))
+
+	require.NoError(t, e.Terminals.Resize(services.TerminalKey(e.User.ID, "main"), 30, 100))
+	_, err := session.Write([]byte("echo recorded-$((6*7))\n"))
+	require.NoError(t, err)
+	path := filepath.Join(e.recordingsDir(t), started.Name)
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(path)
+		return strings.Contains(string(data), "recorded-42")
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.Equal(t, http.StatusOK, e.do(e.Token, "PUT", "/api/terminals/main/recording", `{"enabled":false}`).Code)
+	return started
+}
+
+func (e *terminalTestEnv) wsURL(path string) string {
+	return "ws" + strings.TrimPrefix(e.Server.URL, "http") + path
+}
+
+func TestTerminals_RenameAndList(t *testing.T) {
+	env := setupTerminalTest(t)
+	instanceID := "term-1@ws:default"
+	env.shell(t, instanceID)
+
+	w := env.do(env.Token, "PATCH", "/api/terminals/"+url.PathEscape(instanceID), `{"label":"  build watcher "}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = env.do(env.Token, "GET", "/api/terminals", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Terminals []services.TerminalInfo `json:"terminals"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Terminals, 1)
+	assert.Equal(t, instanceID, resp.Terminals[0].InstanceID)
+	assert.Equal(t, "build watcher", resp.Terminals[0].Label)
+	assert.True(t, resp.Terminals[0].Alive)
+	assert.Positive(t, resp.Terminals[0].PID)
+}
+
+func TestTerminals_OtherUsersCantReachTerminal(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+
+	assert.JSONEq(t, `{"terminals":[]}`, env.do(env.OtherToken, "GET", "/api/terminals", "").Body.String())
+	assert.Equal(t, http.StatusNotFound, env.do(env.OtherToken, "PATCH", "/api/terminals/main", `{"label":"x"}`).Code)
+	assert.Equal(t, http.StatusNotFound, env.do(env.OtherToken, "DELETE", "/api/terminals/main", "").Code)
+	assert.Equal(t, http.StatusNotFound, env.do(env.OtherToken, "PUT", "/api/terminals/main/recording", `{"enabled":true}`).Code)
+	assert.Equal(t, http.StatusNotFound, env.do(env.OtherToken, "POST", "/api/terminals/main/shares", `{}`).Code)
+}
+
+func TestTerminals_Delete(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+
+	assert.Equal(t, http.StatusOK, env.do(env.Token, "DELETE", "/api/terminals/main", "").Code)
+	assert.JSONEq(t, `{"terminals":[]}`, env.do(env.Token, "GET", "/api/terminals", "").Body.String())
+	assert.Equal(t, http.StatusNotFound, env.do(env.Token, "DELETE", "/api/terminals/main", "").Code)
+}
+
+func TestTerminals_AdminMetrics(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+
+	assert.Equal(t, http.StatusForbidden, env.do(env.Token, "GET", "/api/admin/terminals", "").Code)
+	require.NoError(t, env.DB.Model(&env.User).Update("is_admin", true).Error)
+	w := env.do(env.Token, "GET", "/api/admin/terminals", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var metrics services.TerminalServiceStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metrics))
+	assert.Equal(t, services.TerminalServiceStats{Sessions: 1}, metrics)
+}
+
+func TestTerminals_SetRecording_Errors(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+
+	assert.Equal(t, http.StatusNotFound, env.do(env.Token, "PUT", "/api/terminals/nope/recording", `{"enabled":true}`).Code)
+	assert.Equal(t, http.StatusConflict, env.do(env.Token, "PUT", "/api/terminals/main/recording", `{"enabled":false}`).Code)
+	assert.Equal(t, http.StatusBadRequest, env.do(env.Token, "PUT", "/api/terminals/main/recording", `not json`).Code)
+}
+
+func TestTerminals_RecordingIsListedAndActive(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+
+	w := env.do(env.Token, "PUT", "/api/terminals/main/recording", `{"enabled":true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var started services.RecordingInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &started))
+	assert.True(t, started.Active)
+	assert.Equal(t, "main", started.Title)
+	assert.Contains(t, env.do(env.Token, "GET", "/api/terminals", "").Body.String(), `"recording":"`+started.Name+`"`)
+
+	require.Equal(t, http.StatusOK, env.do(env.Token, "PUT", "/api/terminals/main/recording", `{"enabled":false}`).Code)
+	w = env.do(env.Token, "GET", "/api/terminals/recordings", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Recordings []services.RecordingInfo `json:"recordings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Recordings, 1)
+	assert.Equal(t, started.Name, list.Recordings[0].Name)
+	assert.False(t, list.Recordings[0].Active)
+	assert.Positive(t, list.Recordings[0].Size)
+}
+
+func TestTerminals_RecordingsStayOutOfSharedWorkspace(t *testing.T) {
+	env := setupTerminalTest(t)
+	started := env.record(t, `{"enabled":true}`)
+
+	path := filepath.Join(env.recordingsDir(t), started.Name)
+	assert.True(t, strings.HasPrefix(path, env.Cfg.DataDir), path)
+	assert.NoDirExists(t, filepath.Join(env.Cfg.ClaudeWorkingDir, ".terminal-recordings"))
+}
+
+func TestTerminals_RecordInputOnlyOnRequest(t *testing.T) {
+	env := setupTerminalTest(t)
+	started := env.record(t, `{"enabled":true}`)
+	data, err := os.ReadFile(filepath.Join(env.recordingsDir(t), started.Name))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), `,"i",`)
+
+	env = setupTerminalTest(t)
+	started = env.record(t, `{"enabled":true,"input":true}`)
+	data, err = os.ReadFile(filepath.Join(env.recordingsDir(t), started.Name))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `,"i",`)
+}
+
+func TestTerminals_DownloadRecording(t *testing.T) {
+	env := setupTerminalTest(t)
+	started := env.record(t, `{"enabled":true}`)
+
+	w := env.do(env.Token, "GET", "/api/terminals/recordings/"+started.Name, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-asciicast", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"version":2`)
+	assert.Equal(t, http.StatusBadRequest, env.do(env.Token, "GET", "/api/terminals/recordings/notes.txt", "").Code)
+	assert.Equal(t, http.StatusNotFound, env.do(env.Token, "GET", "/api/terminals/recordings/missing.cast", "").Code)
+
+	// Other users' recordings are out of reach.
+	assert.Equal(t, http.StatusNotFound, env.do(env.OtherToken, "GET", "/api/terminals/recordings/"+started.Name, "").Code)
+	assert.JSONEq(t, `{"recordings":[]}`, env.do(env.OtherToken, "GET", "/api/terminals/recordings", "").Body.String())
+}
+
+func TestTerminals_PlayRecording(t *testing.T) {
+	env := setupTerminalTest(t)
+	started := env.record(t, `{"enabled":true}`)
+
+	wsURL := env.wsURL("/ws/terminal/recordings/" + started.Name + "?speed=16&idle_limit=0.1&token=" + env.Token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var header map[string]any
+	require.NoError(t, conn.ReadJSON(&header))
+	assert.Equal(t, "header", header["type"])
+	var output strings.Builder
+	var resized, ended bool
+	for !ended {
+		msgType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		if msgType == websocket.BinaryMessage {
+			output.Write(data)
+			continue
+		}
+		var msg map[string]any
+		require.NoError(t, json.Unmarshal(data, &msg))
+		switch msg["type"] {
+		case "resize":
+			resized = msg["cols"] == float64(100) && msg["rows"] == float64(30)
+		case "end":
+			ended = true
+		}
+	}
+	assert.True(t, resized)
+	assert.Contains(t, output.String(), "recorded-42")
+
+	_, _, err = websocket.DefaultDialer.Dial(strings.Replace(wsURL, env.Token, env.OtherToken, 1), nil)
+	assert.Error(t, err)
+}
+
+// createShare shares the shell "main" and returns the share.
+func (e *terminalTestEnv) createShare(t *testing.T) services.TerminalShare {
+	t.Helper()
+	w := e.do(e.Token, "POST", "/api/terminals/main/shares", `{"ttl_minutes":30}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var share services.TerminalShare
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &share))
+	return share
+}
+
+// shareError dials a share link and returns the error message it answers with.
+func (e *terminalTestEnv) shareError(t *testing.T, url string) string {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	var msg map[string]string
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, "error", msg["type"])
+	return msg["message"]
+}
+
+// shareViewer is a viewer connected to a share link, collecting its output.
+type shareViewer struct {
+	conn   *websocket.Conn
+	closed chan struct{}
+
+	mu     sync.Mutex
+	output strings.Builder
+}
+
+func (e *terminalTestEnv) viewShare(t *testing.T, share services.TerminalShare) *shareViewer {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(e.wsURL("/ws/terminal/shared/"+share.Token+"?token="+e.OtherToken), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	v := &shareViewer{conn: conn, closed: make(chan struct{})}
+	go func() {
+		defer close(v.closed)
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msgType == websocket.BinaryMessage {
+				v.mu.Lock()
+				v.output.Write(data)
+				v.mu.Unlock()
+			}
+		}
+	}()
+	return v
+}
+
+func (v *shareViewer) seen(s string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return strings.Contains(v.output.String(), s)
+}
+
+func TestTerminals_CreateShare_Validation(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+
+	assert.Equal(t, http.StatusBadRequest, env.do(env.Token, "POST", "/api/terminals/main/shares", `{"anonymous":true}`).Code)
+	assert.Equal(t, http.StatusBadRequest, env.do(env.Token, "POST", "/api/terminals/main/shares", `{"ttl_minutes":120}`).Code)
+	share := env.createShare(t)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), share.ExpiresAt, time.Minute)
+}
+
+func TestTerminals_ViewShare_NeedsSignInAndValidLink(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+	share := env.createShare(t)
+
+	assert.Contains(t, env.shareError(t, env.wsURL("/ws/terminal/shared/"+share.Token)), "Sign in")
+	assert.Contains(t, env.shareError(t, env.wsURL("/ws/terminal/shared/bogus?token="+env.OtherToken)), "invalid")
+}
+
+func TestTerminals_ViewShare_IsReadOnly(t *testing.T) {
+	env := setupTerminalTest(t)
+	session := env.shell(t, "main")
+	viewer := env.viewShare(t, env.createShare(t))
+
+	_, err := session.Write([]byte("echo shared-$((2+3))\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return viewer.seen("shared-5") }, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, viewer.conn.WriteMessage(websocket.BinaryMessage, []byte("echo viewer-$((4+4))\n")))
+	require.NoError(t, viewer.conn.WriteJSON(map[string]any{"type": "input", "data": "echo viewer-$((4+4))\n"}))
+	time.Sleep(200 * time.Millisecond)
+	_, err = session.Write([]byte("echo owner-$((1+1))\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return viewer.seen("owner-2") }, 5*time.Second, 20*time.Millisecond)
+	assert.False(t, viewer.seen("viewer-8"))
+}
+
+func TestTerminals_Shares_ListViewers(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+	share := env.createShare(t)
+	env.viewShare(t, share)
+
+	var listed struct {
+		Shares []services.TerminalShare `json:"shares"`
+	}
+	require.Eventually(t, func() bool {
+		w := env.do(env.Token, "GET", "/api/terminals/main/shares", "")
+		return w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &listed) == nil &&
+			len(listed.Shares) == 1 && len(listed.Shares[0].Viewers) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "other", listed.Shares[0].Viewers[0].Username)
+}
+
+func TestTerminals_RevokeShare(t *testing.T) {
+	env := setupTerminalTest(t)
+	env.shell(t, "main")
+	share := env.createShare(t)
+	viewer := env.viewShare(t, share)
+
+	// Revoking disconnects the viewer and kills the link.
+	assert.Equal(t, http.StatusNotFound, env.do(env.OtherToken, "DELETE", "/api/terminals/main/shares/"+share.ID, "").Code)
+	assert.Equal(t, http.StatusOK, env.do(env.Token, "DELETE", "/api/terminals/main/shares/"+share.ID, "").Code)
+	select {
+	case <-viewer.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("viewer still connected")
+	}
+	assert.Contains(t, env.shareError(t, env.wsURL("/ws/terminal/shared/"+share.Token+"?token="+env.OtherToken)), "invalid")
+	assert.JSONEq(t, `{"shares":[]}`, env.do(env.Token, "GET", "/api/terminals/main/shares", "").Body.String())
+}
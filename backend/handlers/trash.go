@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nebulide/database"
+	"nebulide/models"
+	"nebulide/services"
+)
+
+type trashedSession struct {
+	models.ChatSession
+	PurgeAt *time.Time `json:"purge_at"` // nil = kept until the trash is emptied
+}
+
+// Trash lists the caller's deleted sessions, most recently deleted first.
+func (h *SessionsHandler) Trash(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var sessions []models.ChatSession
+	database.DB.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at DESC").
+		Find(&sessions)
+
+	result := make([]trashedSession, len(sessions))
+	for i := range sessions {
+		result[i] = trashedSession{ChatSession: sessions[i], PurgeAt: h.trash.PurgeAt(&sessions[i])}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Restore takes a session back out of the trash.
+func (h *SessionsHandler) Restore(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found in trash"})
+		return
+	}
+	session, err := h.trash.Restore(id, userID.(uuid.UUID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found in trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore session"})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// EmptyTrash purges all of the caller's trashed sessions now.
+func (h *SessionsHandler) EmptyTrash(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var sessions []models.ChatSession
+	database.DB.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Find(&sessions)
+
+	if err := h.trash.Purge(sessions...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to empty trash"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": len(sessions)})
+}
+
+// RemoveSessionFiles deletes what a purged session owns on disk.
+func RemoveSessionFiles(workspaces *services.WorkspaceManager) func(models.ChatSession) {
+	return func(session models.ChatSession) {
+		ws, err := workspaces.For(session.UserID)
+		if err != nil {
+			log.Printf("[Trash] failed to open workspace of user %s: %v", session.UserID, err)
+			return
+		}
+		os.RemoveAll(ws.AttachmentsDir(session.ID))
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"nebulide/config"
+	"nebulide/services"
+)
+
+type UsageHandler struct {
+	cfg   *config.Config
+	usage *services.UsageService
+}
+
+func NewUsageHandler(cfg *config.Config, usage *services.UsageService) *UsageHandler {
+	return &UsageHandler{cfg: cfg, usage: usage}
+}
+
+// Summary returns the caller's usage: today, this month, quotas,
+// per-session and per-day breakdown over the last ?days= days (default 30).
+func (h *UsageHandler) Summary(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	uid := userID.(uuid.UUID)
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 || days > 366 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 366"})
+		return
+	}
+
+	now := time.Now().UTC()
+	today := services.DayStart(now)
+	month := services.MonthStart(now)
+	from := today.AddDate(0, 0, -(days - 1))
+	to := now.Add(time.Second)
+
+	todayTotals, err := h.usage.Totals(uid, today, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+	monthTotals, err := h.usage.Totals(uid, month, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+	bySession, err := h.usage.BySession(uid, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+	byDay, err := h.usage.ByDay(uid, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+
+	q := h.usage.Quota()
+	c.JSON(http.StatusOK, gin.H{
+		"today": todayTotals,
+		"month": monthTotals,
+		"quota": gin.H{
+			"daily_tokens":     q.DailyTokens,
+			"monthly_tokens":   q.MonthlyTokens,
+			"daily_cost_usd":   q.DailyCostUSD,
+			"monthly_cost_usd": q.MonthlyCostUSD,
+		},
+		"sessions": bySession,
+		"days":     byDay,
+	})
+}
+
+// AdminReport returns per-user usage in [?from, ?to) (YYYY-MM-DD, UTC; defaults to current month,
+// at most 366 days). Admin only.
+func (h *UsageHandler) AdminReport(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	now := time.Now().UTC()
+	from := services.MonthStart(now)
+	to := now.Add(time.Second)
+
+	if s := c.Query("from"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+			return
+		}
+		from = t
+	}
+	if s := c.Query("to"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+			return
+		}
+		to = t
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+	if to.After(from.AddDate(0, 0, 366)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The range must not exceed 366 days"})
+		return
+	}
+
+	users, err := h.usage.ByUser(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":  from.Format("2006-01-02"),
+		"to":    to.Format("2006-01-02"),
+		"users": users,
+	})
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"nebulide/middleware"
+	"nebulide/services"
+	"nebulide/testutil"
+)
+
+func setupUsageTestRouter(quota services.UsageQuota) (*gin.Engine, *testutil.TestContext, *services.UsageService) {
+	db := testutil.SetupTestDB()
+	cfg := testutil.TestConfig()
+	usage := services.NewUsageService(db, quota)
+	handler := NewUsageHandler(cfg, usage)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	protected := r.Group("/api")
+	protected.Use(middleware.AuthRequired(cfg.JWTSecret))
+	{
+		protected.GET("/usage", handler.Summary)
+		protected.GET("/admin/usage", handler.AdminReport)
+	}
+
+	return r, &testutil.TestContext{DB: db, Cfg: cfg}, usage
+}
+
+func testRunResult(input, output int, cost float64) *services.RunResult {
+	return &services.RunResult{
+		Subtype:    "success",
+		CostUSD:    cost,
+		DurationMs: 1000,
+		Usage:      services.Usage{InputTokens: input, OutputTokens: output},
+	}
+}
+
+func TestUsage_Summary(t *testing.T) {
+	router, tc, usage := setupUsageTestRouter(services.UsageQuota{DailyTokens: 1000})
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	sessionA, sessionB := uuid.New(), uuid.New()
+	require.NoError(t, usage.Record(user.ID, sessionA, nil, testRunResult(100, 50, 0.01)))
+	require.NoError(t, usage.Record(user.ID, sessionA, nil, testRunResult(10, 5, 0.001)))
+	require.NoError(t, usage.Record(user.ID, sessionB, nil, testRunResult(200, 100, 0.02)))
+	// Another user's usage must not leak into the summary
+	require.NoError(t, usage.Record(uuid.New(), sessionA, nil, testRunResult(999, 999, 9)))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Today    services.UsageTotals    `json:"today"`
+		Month    services.UsageTotals    `json:"month"`
+		Quota    map[string]float64      `json:"quota"`
+		Sessions []services.SessionUsage `json:"sessions"`
+		Days     []services.DailyUsage   `json:"days"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	assert.Equal(t, int64(3), resp.Today.Runs)
+	assert.Equal(t, int64(310), resp.Today.InputTokens)
+	assert.Equal(t, int64(155), resp.Today.OutputTokens)
+	assert.InDelta(t, 0.031, resp.Today.CostUSD, 1e-9)
+	assert.Equal(t, float64(1000), resp.Quota["daily_tokens"])
+
+	require.Len(t, resp.Sessions, 2)
+	assert.Equal(t, sessionB, resp.Sessions[0].SessionID, "Most expensive session first")
+	require.Len(t, resp.Days, 1)
+	assert.Equal(t, int64(3), resp.Days[0].Runs)
+}
+
+func TestUsage_CheckQuota(t *testing.T) {
+	_, tc, usage := setupUsageTestRouter(services.UsageQuota{DailyTokens: 500})
+	user := testutil.CreateTestUser(tc.DB)
+
+	require.NoError(t, usage.CheckQuota(user.ID))
+
+	require.NoError(t, usage.Record(user.ID, uuid.New(), nil, testRunResult(300, 100, 0)))
+	assert.NoError(t, usage.CheckQuota(user.ID), "Below the daily limit")
+
+	require.NoError(t, usage.Record(user.ID, uuid.New(), nil, testRunResult(100, 0, 0)))
+	err := usage.CheckQuota(user.ID)
+	assert.True(t, errors.Is(err, services.ErrQuotaExceeded), "Daily limit reached")
+}
+
+func TestUsage_AdminReport_RequiresAdmin(t *testing.T) {
+	router, tc, _ := setupUsageTestRouter(services.UsageQuota{})
+	user := testutil.CreateTestUser(tc.DB)
+	token := testutil.GenerateTestToken(tc.Cfg, user.ID, user.Username, false)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/admin/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestUsage_AdminReport(t *testing.T) {
+	router, tc, usage := setupUsageTestRouter(services.UsageQuota{})
+	admin := testutil.CreateTestUser(tc.DB)
+	tc.DB.Model(&admin).Update("is_admin", true)
+	token := testutil.GenerateTestToken(tc.Cfg, admin.ID, admin.Username, false)
+
+	require.NoError(t, usage.Record(admin.ID, uuid.New(), nil, testRunResult(100, 100, 0.5)))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/admin/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Users []services.UserUsage `json:"users"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Users, 1)
+	assert.Equal(t, admin.Username, resp.Users[0].Username)
+	assert.Equal(t, int64(200), resp.Users[0].Tokens())
+}
+
+func TestUsage_AdminReport_RejectsBadRanges(t *testing.T) {
+	router, tc, _ := setupUsageTestRouter(services.UsageQuota{})
+	admin := testutil.CreateTestUser(tc.DB)
+	tc.DB.Model(&admin).Update("is_admin", true)
+	token := testutil.GenerateTestToken(tc.Cfg, admin.ID, admin.Username, false)
+	get := func(query string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/admin/usage?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, get("from=2024-03-01&to=2024-02-01"), "inverted")
+	assert.Equal(t, http.StatusBadRequest, get("from=2024-03-01&to=2024-03-01"), "empty")
+	assert.Equal(t, http.StatusBadRequest, get("from=2000-01-01&to=2024-01-01"), "too long")
+	assert.Equal(t, http.StatusBadRequest, get("from=2999-01-01"), "starts after the default end")
+	assert.Equal(t, http.StatusOK, get("from=2024-01-01&to=2025-01-01"), "366 days")
+	assert.Equal(t, http.StatusOK, get("from=2024-03-01&to=2024-03-02"))
+}
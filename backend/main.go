@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -18,6 +19,15 @@ import (
 )
 
 func main() {
+	// Sandboxed processes start as a re-exec of this binary (see services.Sandbox)
+	if len(os.Args) > 1 && os.Args[1] == services.SandboxInitArg {
+		services.RunSandboxInit()
+	}
+	// Shells that outlive the server are held by a daemon run from this binary
+	if len(os.Args) > 2 && os.Args[1] == services.TerminalDaemonArg {
+		services.RunTerminalDaemon(os.Args[2])
+	}
+
 	cfg := config.Load()
 
 	// Database
@@ -35,19 +45,93 @@ func main() {
 	seedAdminUser(cfg)
 
 	// Services
-	claudeService := services.NewClaudeService(cfg.ClaudeAllowedTools)
-	terminalService := services.NewTerminalService()
+	scheduler := services.NewProcessScheduler(cfg.ClaudeMaxProcesses, cfg.ClaudeMaxProcessesPerUser)
+	claudeService := services.NewClaudeService(cfg.ClaudeAllowedTools, scheduler, services.LiveOptions{
+		IdleTimeout:    cfg.ClaudeProcessIdleTimeout,
+		MaxIdle:        cfg.ClaudeMaxIdleProcesses,
+		MaxIdlePerUser: cfg.ClaudeMaxIdleProcessesPerUser,
+	})
+	var terminalDaemon *services.TerminalDaemonClient
+	if cfg.TerminalDaemonSocket != "" {
+		var err error
+		terminalDaemon, err = services.ConnectTerminalDaemon(cfg.TerminalDaemonSocket, cfg.TerminalDaemonSpawn)
+		if err != nil {
+			log.Fatalf("Failed to connect to terminal daemon: %v", err)
+		}
+	}
+	terminalService := services.NewTerminalService(services.TerminalOptions{
+		SampleInterval: cfg.TerminalSampleInterval,
+		Limits: services.TerminalLimits{
+			MemoryMB:   cfg.TerminalMaxMemoryMB,
+			CPUPercent: cfg.TerminalMaxCPUPercent,
+			Processes:  cfg.TerminalMaxProcesses,
+		},
+		IdleTimeout: cfg.TerminalIdleTimeout,
+		Daemon:      terminalDaemon,
+	})
+	if err := terminalService.Restore(); err != nil {
+		log.Printf("Failed to restore terminals: %v", err)
+	}
+	go terminalService.Run(context.Background())
+	var sandbox *services.Sandbox
+	if cfg.SandboxEnabled {
+		var err error
+		sandbox, err = services.NewSandbox(services.SandboxOptions{
+			CgroupRoot: cfg.SandboxCgroupRoot,
+			Network:    cfg.SandboxNetwork,
+			Defaults:   handlers.SandboxDefaults(cfg),
+			UID:        cfg.SandboxUID,
+			GID:        cfg.SandboxUID,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up sandbox: %v", err)
+		}
+	}
+	workspaces := services.NewWorkspaceManager(database.DB, services.WorkspaceOptions{
+		Base:            cfg.ClaudeWorkingDir,
+		ExtraRoots:      cfg.WorkspaceExtraRoots,
+		ClaudeConfigDir: cfg.ClaudeConfigDir,
+		DataDir:         cfg.DataDir,
+		PerUser:         cfg.WorkspacePerUser,
+		UIDBase:         cfg.WorkspaceUIDBase,
+		Sandbox:         sandbox,
+	})
+	handlers.MigrateAttachments(cfg, workspaces)
+	workspaces.MigrateRecordings()
+	chatStreams := services.NewChatStreamHub()
+	go chatStreams.Run(context.Background())
+	var permissionBroker *services.PermissionBroker
+	if cfg.ClaudePermissionPrompt {
+		permissionBroker = services.NewPermissionBroker(cfg.ClaudePermissionTimeout)
+	}
+	usageService := services.NewUsageService(database.DB, services.UsageQuota{
+		DailyTokens:    cfg.UsageDailyTokens,
+		MonthlyTokens:  cfg.UsageMonthlyTokens,
+		DailyCostUSD:   cfg.UsageDailyCostUSD,
+		MonthlyCostUSD: cfg.UsageMonthlyCostUSD,
+	})
+	var sessionTitler *services.SessionTitler
+	if cfg.ClaudeTitleModel != "" {
+		sessionTitler = services.NewSessionTitler(database.DB, claudeService, usageService, workspaces, cfg.ClaudeTitleModel)
+	}
 
 	// Handlers
 	lockout := services.NewLoginLockout(database.RDB)
+	chatQueue := services.NewChatQueue(database.RDB)
+	sessionTrash := services.NewSessionTrash(database.DB, claudeService, chatQueue, chatStreams, cfg.SessionTrashRetention, handlers.RemoveSessionFiles(workspaces))
+	go sessionTrash.Run(context.Background())
 	authHandler := handlers.NewAuthHandler(cfg, lockout)
-	sessionsHandler := handlers.NewSessionsHandler(cfg)
-	chatHandler := handlers.NewChatHandler(cfg, claudeService)
-	terminalHandler := handlers.NewTerminalHandler(cfg, terminalService)
-	filesHandler := handlers.NewFilesHandler(cfg)
+	sessionsHandler := handlers.NewSessionsHandler(cfg, workspaces, sessionTitler, sessionTrash)
+	chatHandler := handlers.NewChatHandler(cfg, claudeService, usageService, chatStreams, chatQueue, permissionBroker, sessionTitler, workspaces)
+	terminalHandler := handlers.NewTerminalHandler(cfg, terminalService, workspaces)
+	filesHandler := handlers.NewFilesHandler(cfg, workspaces)
+	attachmentsHandler := handlers.NewAttachmentsHandler(cfg, workspaces)
 	inviteHandler := handlers.NewInviteHandler(cfg, lockout)
 	workspaceSessionsHandler := handlers.NewWorkspaceSessionsHandler(cfg)
 	syncHandler := handlers.NewSyncHandler(cfg)
+	usageHandler := handlers.NewUsageHandler(cfg, usageService)
+	searchHandler := handlers.NewSearchHandler(cfg)
+	adminHandler := handlers.NewAdminHandler(cfg, claudeService)
 
 	// Router
 	r := gin.Default()
@@ -91,10 +175,41 @@ func main() {
 
 		// Sessions
 		protected.GET("/sessions", sessionsHandler.List)
+		protected.GET("/sessions/tags", sessionsHandler.Tags)
+		protected.GET("/sessions/trash", sessionsHandler.Trash)
+		protected.DELETE("/sessions/trash", sessionsHandler.EmptyTrash)
+		protected.POST("/sessions/:id/restore", sessionsHandler.Restore)
 		protected.POST("/sessions", sessionsHandler.Create)
 		protected.PUT("/sessions/:id", sessionsHandler.Update)
 		protected.DELETE("/sessions/:id", sessionsHandler.Delete)
 		protected.GET("/sessions/:id/messages", sessionsHandler.Messages)
+		protected.POST("/sessions/:id/fork", sessionsHandler.Fork)
+		protected.POST("/sessions/:id/title/regenerate", sessionsHandler.RegenerateTitle)
+		protected.GET("/sessions/:id/export", sessionsHandler.Export)
+		protected.POST("/sessions/import", sessionsHandler.Import)
+		protected.GET("/claude-sessions", sessionsHandler.CLISessions)
+		protected.POST("/claude-sessions/:sessionId/adopt", sessionsHandler.AdoptCLISession)
+		protected.GET("/projects", sessionsHandler.Projects)
+		protected.POST("/sessions/:id/attachments", attachmentsHandler.Upload)
+		protected.GET("/sessions/:id/attachments/:attachmentId", attachmentsHandler.Download)
+
+		// Terminals
+		protected.GET("/terminals", terminalHandler.List)
+		protected.GET("/terminals/recordings", terminalHandler.Recordings)
+		protected.GET("/terminals/recordings/:name", terminalHandler.DownloadRecording)
+		protected.PUT("/terminals/:instanceId/recording", terminalHandler.SetRecording)
+		protected.GET("/terminals/:instanceId/shares", terminalHandler.Shares)
+		protected.POST("/terminals/:instanceId/shares", terminalHandler.CreateShare)
+		protected.DELETE("/terminals/:instanceId/shares/:shareId", terminalHandler.RevokeShare)
+		protected.PATCH("/terminals/:instanceId", terminalHandler.Rename)
+		protected.DELETE("/terminals/:instanceId", terminalHandler.Delete)
+
+		// Search
+		protected.GET("/search/messages", searchHandler.Messages)
+
+		// Usage
+		protected.GET("/usage", usageHandler.Summary)
+		protected.GET("/admin/usage", usageHandler.AdminReport)
 
 		// Workspace sessions
 		protected.GET("/workspace-sessions/latest", workspaceSessionsHandler.Latest)
@@ -108,6 +223,14 @@ func main() {
 		protected.GET("/admin/invites", inviteHandler.ListInvites)
 		protected.DELETE("/admin/invites/:id", inviteHandler.DeleteInvite)
 
+		// Admin metrics
+		protected.GET("/admin/claude/processes", adminHandler.ClaudeProcesses)
+		protected.GET("/admin/terminals", terminalHandler.Metrics)
+
+		// Admin sandbox limits
+		protected.GET("/admin/users/:id/sandbox", adminHandler.UserSandbox)
+		protected.PUT("/admin/users/:id/sandbox", adminHandler.UpdateUserSandbox)
+
 		// Files
 		protected.GET("/files", filesHandler.List)
 		protected.GET("/files/read", filesHandler.Read)
@@ -118,14 +241,26 @@ func main() {
 		protected.POST("/files/rename", filesHandler.Rename)
 	}
 
+	// Claude CLI permission prompts (loopback only, run token in path)
+	if permissionBroker != nil {
+		permissionMCPHandler := handlers.NewPermissionMCPHandler(permissionBroker)
+		r.POST("/internal/mcp/permissions/:token", permissionMCPHandler.Handle)
+	}
+
 	// WebSocket routes (auth via query param)
 	r.GET("/ws/chat/:id", chatHandler.HandleWebSocket)
 	r.GET("/ws/terminal", terminalHandler.HandleWebSocket)
+	r.GET("/ws/terminal/recordings/:name", terminalHandler.PlayRecording)
+	r.GET("/ws/terminal/shared/:share", terminalHandler.ViewShare)
 	r.GET("/ws/sync", syncHandler.HandleWebSocket)
 
 	// Code-server reverse proxy (auth via ?token= query param or cookie)
 	codeGroup := r.Group("/code")
 	codeGroup.Use(handlers.CodeServerAuthMiddleware(cfg.JWTSecret))
+	if cfg.WorkspacePerUser {
+		// code-server sees every user's workspace under the base.
+		codeGroup.Use(handlers.CodeServerAdminOnly())
+	}
 	codeGroup.Any("/*path", handlers.CodeServerProxy())
 
 	// Serve frontend static files
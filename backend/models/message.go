@@ -17,9 +17,22 @@ type Message struct {
 	TokensUsed int            `gorm:"default:0" json:"tokens_used"`
 	CreatedAt  time.Time      `json:"created_at"`
 
+	Attachments datatypes.JSONSlice[Attachment] `gorm:"type:jsonb" json:"attachments,omitempty"`
+
 	Session ChatSession `gorm:"foreignKey:SessionID" json:"-"`
 }
 
+// Attachment is a file sent along with a user message: an upload stored in the
+// session's attachments directory, or a reference to an existing workspace file.
+type Attachment struct {
+	ID       string `json:"id,omitempty"` // upload ID; empty for workspace files
+	Kind     string `json:"kind"`         // "upload" | "file"
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type,omitempty"`
+	Size     int64  `json:"size"`
+	Path     string `json:"path,omitempty"` // workspace files: path relative to the workspace
+}
+
 func (m *Message) BeforeCreate(tx *gorm.DB) error {
 	if m.ID == uuid.Nil {
 		m.ID = uuid.New()
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
@@ -13,8 +14,32 @@ type ChatSession struct {
 	Title            string    `gorm:"size:255;default:'New Chat'" json:"title"`
 	ClaudeSessionID  string    `gorm:"size:255" json:"claude_session_id"`
 	WorkingDirectory string    `gorm:"size:500" json:"working_directory"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+
+	// Organization in the session list
+	Pinned   bool                        `gorm:"default:false" json:"pinned"`
+	Archived bool                        `gorm:"default:false;index" json:"archived"`
+	Tags     datatypes.JSONSlice[string] `gorm:"type:jsonb" json:"tags"`
+
+	// Kept up to date in the background after each exchange (see services.SessionTitler)
+	Summary      string     `gorm:"type:text" json:"summary"`
+	SummarizedAt *time.Time `json:"summarized_at,omitempty"`           // created_at of the last message the summary covers
+	TitleLocked  bool       `gorm:"default:false" json:"title_locked"` // renamed by the user; no automatic titles
+
+	// Set on sessions created by forking another session
+	ForkedFromID        *uuid.UUID `gorm:"type:uuid;index" json:"forked_from_id,omitempty"`
+	ForkedFromMessageID *uuid.UUID `gorm:"type:uuid" json:"forked_from_message_id,omitempty"`
+
+	// Claude CLI settings for this session (empty = CLI / server defaults)
+	Model              string                      `gorm:"size:100" json:"model"`
+	PermissionMode     string                      `gorm:"size:30" json:"permission_mode"`
+	AllowedTools       datatypes.JSONSlice[string] `gorm:"type:jsonb" json:"allowed_tools"`
+	DisallowedTools    datatypes.JSONSlice[string] `gorm:"type:jsonb" json:"disallowed_tools"`
+	MaxTurns           int                         `gorm:"default:0" json:"max_turns"`
+	AppendSystemPrompt string                      `gorm:"type:text" json:"append_system_prompt"`
+
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"` // set while the session is in the trash
 
 	User     User      `gorm:"foreignKey:UserID" json:"-"`
 	Messages []Message `gorm:"foreignKey:SessionID" json:"messages,omitempty"`
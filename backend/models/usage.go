@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UsageRecord is one ledger entry per Claude run, taken from the CLI's result event.
+type UsageRecord struct {
+	ID                  uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID              uuid.UUID  `gorm:"type:uuid;not null;index:idx_usage_user_created" json:"user_id"`
+	SessionID           uuid.UUID  `gorm:"type:uuid;not null;index" json:"session_id"`
+	MessageID           *uuid.UUID `gorm:"type:uuid" json:"message_id,omitempty"`
+	InputTokens         int        `gorm:"default:0" json:"input_tokens"`
+	OutputTokens        int        `gorm:"default:0" json:"output_tokens"`
+	CacheCreationTokens int        `gorm:"default:0" json:"cache_creation_tokens"`
+	CacheReadTokens     int        `gorm:"default:0" json:"cache_read_tokens"`
+	CostUSD             float64    `gorm:"default:0" json:"cost_usd"`
+	DurationMs          int64      `gorm:"default:0" json:"duration_ms"`
+	CreatedAt           time.Time  `gorm:"index:idx_usage_user_created" json:"created_at"`
+}
+
+func (u *UsageRecord) BeforeCreate(tx *gorm.DB) error {
+	if u.ID == uuid.Nil {
+		u.ID = uuid.New()
+	}
+	return nil
+}
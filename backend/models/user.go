@@ -8,14 +8,25 @@ import (
 )
 
 type User struct {
-	ID           uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	Username     string    `gorm:"uniqueIndex;size:50;not null" json:"username"`
-	PasswordHash string    `gorm:"size:255;not null" json:"-"`
-	TOTPSecret   string    `gorm:"size:64;not null" json:"-"`
-	TOTPEnabled  bool      `gorm:"default:false" json:"totp_enabled"`
-	IsAdmin      bool      `gorm:"default:false" json:"is_admin"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           uuid.UUID     `gorm:"type:uuid;primaryKey" json:"id"`
+	Username     string        `gorm:"uniqueIndex;size:50;not null" json:"username"`
+	PasswordHash string        `gorm:"size:255;not null" json:"-"`
+	TOTPSecret   string        `gorm:"size:64;not null" json:"-"`
+	TOTPEnabled  bool          `gorm:"default:false" json:"totp_enabled"`
+	IsAdmin      bool          `gorm:"default:false" json:"is_admin"`
+	UnixUID      *int          `gorm:"uniqueIndex" json:"-"` // UID/GID the user's processes run as (per-user workspaces)
+	WorkspaceDir string        `gorm:"size:1024" json:"-"`   // per-user workspace the server created (or was handed) for the user
+	Sandbox      SandboxLimits `gorm:"embedded;embeddedPrefix:sandbox_" json:"-"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+// SandboxLimits overrides the server's sandbox limits for one user
+// (nil = server default, 0 = unlimited).
+type SandboxLimits struct {
+	MemoryMB   *int64 `json:"memory_mb"`
+	CPUPercent *int   `json:"cpu_percent"`
+	Pids       *int64 `json:"pids"`
 }
 
 func (u *User) BeforeCreate(tx *gorm.DB) error {
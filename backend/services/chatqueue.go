@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"nebulide/models"
+)
+
+const (
+	chatQueueKeyPrefix = "chatqueue:"
+	chatQueueTTL       = 7 * 24 * time.Hour // abandoned queues expire
+	ChatQueueMaxLen    = 20
+)
+
+var (
+	ErrQueueFull         = errors.New("queue is full")
+	ErrQueueItemNotFound = errors.New("queued prompt not found")
+)
+
+// QueuedPrompt is a user message waiting for the session's current Claude run to finish.
+type QueuedPrompt struct {
+	ID          string              `json:"id"`
+	Content     string              `json:"content"`
+	Attachments []models.Attachment `json:"attachments,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+}
+
+// ChatQueue is a per-session FIFO of prompts, persisted in Redis as a list
+// so queued follow-ups survive backend restarts.
+type ChatQueue struct {
+	rdb *redis.Client
+}
+
+func NewChatQueue(rdb *redis.Client) *ChatQueue {
+	return &ChatQueue{rdb: rdb}
+}
+
+func chatQueueKey(sessionKey string) string {
+	return chatQueueKeyPrefix + sessionKey
+}
+
+// pushScript appends ARGV[1] to the list unless it already holds ARGV[2]
+// items, in one step so concurrent pushes can't both slip under the cap.
+// Returns the new length, or -1 when the queue is full.
+var pushScript = redis.NewScript(`
+local n = redis.call("LLEN", KEYS[1])
+if n >= tonumber(ARGV[2]) then
+	return -1
+end
+redis.call("RPUSH", KEYS[1], ARGV[1])
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+return n + 1
+`)
+
+// Push appends a prompt to the end of the session's queue.
+func (q *ChatQueue) Push(ctx context.Context, sessionKey, content string, attachments []models.Attachment) (*QueuedPrompt, error) {
+	item := &QueuedPrompt{ID: uuid.NewString(), Content: content, Attachments: attachments, CreatedAt: time.Now()}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := pushScript.Run(ctx, q.rdb, []string{chatQueueKey(sessionKey)},
+		data, ChatQueueMaxLen, int(chatQueueTTL.Seconds())).Int()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, ErrQueueFull
+	}
+	return item, nil
+}
+
+// Pop removes and returns the head of the queue, or nil if the queue is empty.
+func (q *ChatQueue) Pop(ctx context.Context, sessionKey string) (*QueuedPrompt, error) {
+	data, err := q.rdb.LPop(ctx, chatQueueKey(sessionKey)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var item QueuedPrompt
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, fmt.Errorf("corrupt queue entry: %w", err)
+	}
+	return &item, nil
+}
+
+// List returns the queued prompts in execution order.
+func (q *ChatQueue) List(ctx context.Context, sessionKey string) ([]QueuedPrompt, error) {
+	raw, err := q.rdb.LRange(ctx, chatQueueKey(sessionKey), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeQueue(raw), nil
+}
+
+// Remove drops a queued prompt by ID.
+func (q *ChatQueue) Remove(ctx context.Context, sessionKey, id string) error {
+	return q.update(ctx, sessionKey, func(items []QueuedPrompt) ([]QueuedPrompt, error) {
+		i := indexOfPrompt(items, id)
+		if i < 0 {
+			return nil, ErrQueueItemNotFound
+		}
+		return append(items[:i], items[i+1:]...), nil
+	})
+}
+
+// Move places a queued prompt at the given 0-based position (clamped to the queue bounds).
+func (q *ChatQueue) Move(ctx context.Context, sessionKey, id string, position int) error {
+	return q.update(ctx, sessionKey, func(items []QueuedPrompt) ([]QueuedPrompt, error) {
+		i := indexOfPrompt(items, id)
+		if i < 0 {
+			return nil, ErrQueueItemNotFound
+		}
+		item := items[i]
+		items = append(items[:i], items[i+1:]...)
+		if position < 0 {
+			position = 0
+		}
+		if position > len(items) {
+			position = len(items)
+		}
+		items = append(items[:position], append([]QueuedPrompt{item}, items[position:]...)...)
+		return items, nil
+	})
+}
+
+// Clear drops every queued prompt of a session.
+func (q *ChatQueue) Clear(ctx context.Context, sessionKey string) error {
+	return q.rdb.Del(ctx, chatQueueKey(sessionKey)).Err()
+}
+
+// update rewrites the whole list with optimistic locking, so a concurrent
+// Pop by the run goroutine can't be lost or duplicated.
+func (q *ChatQueue) update(ctx context.Context, sessionKey string, fn func([]QueuedPrompt) ([]QueuedPrompt, error)) error {
+	key := chatQueueKey(sessionKey)
+
+	txf := func(tx *redis.Tx) error {
+		raw, err := tx.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		items, err := fn(decodeQueue(raw))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			for _, item := range items {
+				data, _ := json.Marshal(item)
+				pipe.RPush(ctx, key, data)
+			}
+			if len(items) > 0 {
+				pipe.Expire(ctx, key, chatQueueTTL)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		err := q.rdb.Watch(ctx, txf, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return redis.TxFailedErr
+}
+
+func decodeQueue(raw []string) []QueuedPrompt {
+	items := make([]QueuedPrompt, 0, len(raw))
+	for _, r := range raw {
+		var item QueuedPrompt
+		if err := json.Unmarshal([]byte(r), &item); err == nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func indexOfPrompt(items []QueuedPrompt, id string) int {
+	for i, item := range items {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
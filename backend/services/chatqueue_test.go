@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestChatQueue(t *testing.T) (*ChatQueue, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewChatQueue(rdb), mr
+}
+
+func queuedContents(t *testing.T, q *ChatQueue, key string) []string {
+	t.Helper()
+	items, err := q.List(context.Background(), key)
+	require.NoError(t, err)
+	contents := []string{}
+	for _, item := range items {
+		contents = append(contents, item.Content)
+	}
+	return contents
+}
+
+func TestChatQueue_PushAndPopInOrder(t *testing.T) {
+	q, mr := newTestChatQueue(t)
+	ctx := context.Background()
+
+	first, err := q.Push(ctx, "s1", "first", nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, first.ID)
+	_, err = q.Push(ctx, "s1", "second", nil)
+	require.NoError(t, err)
+	_, err = q.Push(ctx, "s2", "other session", nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"first", "second"}, queuedContents(t, q, "s1"))
+	assert.Equal(t, chatQueueTTL, mr.TTL(chatQueueKey("s1")))
+
+	item, err := q.Pop(ctx, "s1")
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, item.ID)
+	assert.Equal(t, "first", item.Content)
+	item, err = q.Pop(ctx, "s1")
+	require.NoError(t, err)
+	assert.Equal(t, "second", item.Content)
+	item, err = q.Pop(ctx, "s1")
+	require.NoError(t, err)
+	assert.Nil(t, item)
+	assert.Equal(t, []string{"other session"}, queuedContents(t, q, "s2"))
+}
+
+func TestChatQueue_PushRefusesPastTheCap(t *testing.T) {
+	q, _ := newTestChatQueue(t)
+	ctx := context.Background()
+
+	for i := 0; i < ChatQueueMaxLen; i++ {
+		_, err := q.Push(ctx, "s1", fmt.Sprint(i), nil)
+		require.NoError(t, err)
+	}
+	_, err := q.Push(ctx, "s1", "one too many", nil)
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.Len(t, queuedContents(t, q, "s1"), ChatQueueMaxLen)
+
+	// Popping makes room again.
+	_, err = q.Pop(ctx, "s1")
+	require.NoError(t, err)
+	_, err = q.Push(ctx, "s1", "fits", nil)
+	assert.NoError(t, err)
+}
+
+func TestChatQueue_ConcurrentPushesStayUnderTheCap(t *testing.T) {
+	q, _ := newTestChatQueue(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 3*ChatQueueMaxLen; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := q.Push(ctx, "s1", "prompt", nil); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			} else {
+				assert.ErrorIs(t, err, ErrQueueFull)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, ChatQueueMaxLen, accepted)
+	assert.Len(t, queuedContents(t, q, "s1"), ChatQueueMaxLen)
+}
+
+func TestChatQueue_RestoredAfterRestart(t *testing.T) {
+	q, mr := newTestChatQueue(t)
+	ctx := context.Background()
+	_, err := q.Push(ctx, "s1", "first", nil)
+	require.NoError(t, err)
+	second, err := q.Push(ctx, "s1", "second", nil)
+	require.NoError(t, err)
+	require.NoError(t, q.Move(ctx, "s1", second.ID, 0))
+
+	// A new backend process finds the queue as it was left.
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	restored := NewChatQueue(rdb)
+	assert.Equal(t, []string{"second", "first"}, queuedContents(t, restored, "s1"))
+	item, err := restored.Pop(ctx, "s1")
+	require.NoError(t, err)
+	assert.Equal(t, second.ID, item.ID)
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// ── ChatStream: numbered, replayable event log of a chat session's Claude runs ──
+//
+// Like the terminal's multiWriter, a ChatStream outlives WebSocket connections:
+// the run goroutine publishes into it, every attached connection receives the
+// live tail, and a reconnecting client replays whatever it missed by sequence number.
+
+const (
+	chatStreamMaxEvents = 10000
+	chatStreamMaxBytes  = 8 * 1024 * 1024 // per stream, oldest events dropped first
+
+	// Streams nobody is attached to and with no run in progress are dropped
+	// after this long; a client reconnecting later reloads history instead.
+	chatStreamIdleTimeout = 30 * time.Minute
+	chatStreamSweepPeriod = 5 * time.Minute
+)
+
+type chatStreamEntry struct {
+	seq  uint64
+	data []byte
+}
+
+type ChatStream struct {
+	mu       sync.Mutex
+	lastSeq  uint64
+	runStart uint64 // seq of the first event of the current (or last) run
+	running  bool
+	events   []chatStreamEntry
+	size     int
+	writers  map[io.Writer]io.Closer
+	lastUsed time.Time // last run event or (de)attachment
+}
+
+func newChatStream() *ChatStream {
+	return &ChatStream{writers: make(map[io.Writer]io.Closer), lastUsed: time.Now()}
+}
+
+// BeginRun marks the start of a new Claude run. Events of the previous run are
+// dropped: by now they are persisted as messages and reloadable over REST.
+func (cs *ChatStream) BeginRun() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.events = nil
+	cs.size = 0
+	cs.runStart = cs.lastSeq + 1
+	cs.running = true
+}
+
+// EndRun marks the current run as finished. Its events stay buffered until the next run.
+func (cs *ChatStream) EndRun() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.running = false
+	cs.lastUsed = time.Now()
+}
+
+// Publish assigns the next sequence number, lets encode build the wire payload
+// for it, buffers the payload and broadcasts it to all attached writers.
+// Dead writers are removed automatically. Writers must not block: the run's
+// output waits on every Write.
+func (cs *ChatStream) Publish(encode func(seq uint64) []byte) uint64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.lastSeq++
+	cs.lastUsed = time.Now()
+	data := encode(cs.lastSeq)
+
+	cs.events = append(cs.events, chatStreamEntry{seq: cs.lastSeq, data: data})
+	cs.size += len(data)
+	for len(cs.events) > chatStreamMaxEvents || (cs.size > chatStreamMaxBytes && len(cs.events) > 1) {
+		cs.size -= len(cs.events[0].data)
+		cs.events = cs.events[1:]
+	}
+
+	for w, closer := range cs.writers {
+		if _, err := w.Write(data); err != nil {
+			closer.Close()
+			delete(cs.writers, w)
+		}
+	}
+	return cs.lastSeq
+}
+
+// Attach registers a writer and first replays every buffered event with seq > afterSeq.
+// It returns false if some of the requested events were already dropped from the
+// buffer, in which case the client should reload history before trusting the tail.
+func (cs *ChatStream) Attach(w io.Writer, closer io.Closer, afterSeq uint64) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	// afterSeq > lastSeq means the client saw a previous backend process's stream.
+	complete := afterSeq == cs.lastSeq ||
+		(afterSeq < cs.lastSeq && len(cs.events) > 0 && cs.events[0].seq <= afterSeq+1)
+	cs.replayLocked(w, afterSeq)
+	cs.writers[w] = closer
+	return complete
+}
+
+// AttachLive registers a writer for a client that has no sequence number yet:
+// it replays the run in progress (if any) and then follows the live tail.
+func (cs *ChatStream) AttachLive(w io.Writer, closer io.Closer) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.running {
+		cs.replayLocked(w, cs.runStart-1)
+	}
+	cs.writers[w] = closer
+}
+
+func (cs *ChatStream) replayLocked(w io.Writer, afterSeq uint64) {
+	for _, e := range cs.events {
+		if e.seq > afterSeq {
+			w.Write(e.data)
+		}
+	}
+}
+
+// Detach unregisters a writer (called when the WebSocket disconnects).
+func (cs *ChatStream) Detach(w io.Writer) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.writers, w)
+	cs.lastUsed = time.Now()
+}
+
+// Status returns whether a run is in progress and the last assigned sequence number.
+func (cs *ChatStream) Status() (running bool, lastSeq uint64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.running, cs.lastSeq
+}
+
+// ── ChatStreamHub: one ChatStream per chat session ──
+
+type ChatStreamHub struct {
+	mu      sync.Mutex
+	streams map[string]*ChatStream
+}
+
+func NewChatStreamHub() *ChatStreamHub {
+	return &ChatStreamHub{streams: make(map[string]*ChatStream)}
+}
+
+// Get returns the stream for a session, creating it on first use.
+func (h *ChatStreamHub) Get(key string) *ChatStream {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cs, ok := h.streams[key]
+	if !ok {
+		cs = newChatStream()
+		h.streams[key] = cs
+	}
+	// Keep it from being evicted before the caller attaches.
+	cs.mu.Lock()
+	cs.lastUsed = time.Now()
+	cs.mu.Unlock()
+	return cs
+}
+
+// EvictIdle drops the streams with no writers and no run in progress that
+// haven't been used for idle. Returns how many there were.
+func (h *ChatStreamHub) EvictIdle(idle time.Duration) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cutoff := time.Now().Add(-idle)
+	evicted := 0
+	for key, cs := range h.streams {
+		cs.mu.Lock()
+		if !cs.running && len(cs.writers) == 0 && cs.lastUsed.Before(cutoff) {
+			delete(h.streams, key)
+			evicted++
+		}
+		cs.mu.Unlock()
+	}
+	return evicted
+}
+
+// Run evicts idle streams periodically until ctx is done.
+func (h *ChatStreamHub) Run(ctx context.Context) {
+	ticker := time.NewTicker(chatStreamSweepPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.EvictIdle(chatStreamIdleTimeout)
+		}
+	}
+}
+
+// Remove drops a session's stream, closing every attached writer.
+func (h *ChatStreamHub) Remove(key string) {
+	h.mu.Lock()
+	cs, ok := h.streams[key]
+	delete(h.streams, key)
+	h.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for w, closer := range cs.writers {
+		closer.Close()
+		delete(cs.writers, w)
+	}
+}
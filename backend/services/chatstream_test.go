@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingWriter collects every payload written to it.
+type recordingWriter struct {
+	payloads []string
+	fail     bool
+	closed   bool
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("broken pipe")
+	}
+	w.payloads = append(w.payloads, string(bytes.Clone(p)))
+	return len(p), nil
+}
+
+func (w *recordingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func publishN(cs *ChatStream, n int) {
+	for i := 0; i < n; i++ {
+		cs.Publish(func(seq uint64) []byte { return []byte(fmt.Sprintf("e%d", seq)) })
+	}
+}
+
+func TestChatStream_AttachReplaysMissedEvents(t *testing.T) {
+	cs := newChatStream()
+	cs.BeginRun()
+	publishN(cs, 5)
+
+	w := &recordingWriter{}
+	complete := cs.Attach(w, w, 3)
+
+	assert.True(t, complete)
+	assert.Equal(t, []string{"e4", "e5"}, w.payloads)
+
+	publishN(cs, 1)
+	assert.Equal(t, []string{"e4", "e5", "e6"}, w.payloads, "Live tail follows replay")
+}
+
+func TestChatStream_AttachLiveReplaysOnlyRunningRun(t *testing.T) {
+	cs := newChatStream()
+	cs.BeginRun()
+	publishN(cs, 2)
+	cs.EndRun()
+
+	idle := &recordingWriter{}
+	cs.AttachLive(idle, idle)
+	assert.Empty(t, idle.payloads, "Finished run is already persisted, nothing to replay")
+
+	cs.BeginRun()
+	publishN(cs, 2)
+
+	late := &recordingWriter{}
+	cs.AttachLive(late, late)
+	assert.Equal(t, []string{"e3", "e4"}, late.payloads)
+}
+
+func TestChatStream_AttachReportsGap(t *testing.T) {
+	cs := newChatStream()
+	cs.BeginRun()
+	publishN(cs, 3)
+	cs.EndRun()
+	cs.BeginRun() // drops e1..e3
+	publishN(cs, 2)
+
+	w := &recordingWriter{}
+	assert.False(t, cs.Attach(w, w, 1), "Events 2-3 are gone")
+	assert.Equal(t, []string{"e4", "e5"}, w.payloads)
+
+	w2 := &recordingWriter{}
+	assert.True(t, cs.Attach(w2, w2, 3))
+
+	w3 := &recordingWriter{}
+	assert.False(t, cs.Attach(w3, w3, 42), "Sequence from a previous backend process")
+}
+
+func TestChatStream_DeadWritersRemoved(t *testing.T) {
+	cs := newChatStream()
+	w := &recordingWriter{fail: true}
+	cs.AttachLive(w, w)
+
+	publishN(cs, 1)
+
+	assert.True(t, w.closed)
+	assert.Empty(t, cs.writers)
+}
+
+func TestChatStreamHub_EvictsIdleStreams(t *testing.T) {
+	h := NewChatStreamHub()
+	idle := h.Get("idle")
+	attached := h.Get("attached")
+	w := &recordingWriter{}
+	attached.AttachLive(w, w)
+	running := h.Get("running")
+	running.BeginRun()
+	fresh := h.Get("fresh")
+	for _, cs := range []*ChatStream{idle, attached, running} {
+		cs.lastUsed = time.Now().Add(-time.Hour)
+	}
+
+	assert.Equal(t, 1, h.EvictIdle(time.Minute))
+	assert.NotSame(t, idle, h.Get("idle"), "evicted streams are recreated empty")
+	assert.Same(t, attached, h.Get("attached"))
+	assert.Same(t, running, h.Get("running"))
+	assert.Same(t, fresh, h.Get("fresh"))
+	assert.False(t, w.closed)
+}
@@ -2,94 +2,220 @@ package services
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"os"
 	"os/exec"
+	"sort"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type ClaudeService struct {
 	allowedTools string
-	processes    map[string]*ClaudeProcess
+	scheduler    *ProcessScheduler
+	processes    map[string]*ClaudeProcess // runs in progress (or waiting for a slot)
 	mu           sync.RWMutex
+
+	// live.IdleTimeout > 0 keeps one stream-json CLI process per session
+	// alive between turns (see claude_live.go); 0 spawns a process per message.
+	liveOpts LiveOptions
+	live     map[string]*liveProcess
+}
+
+// LiveOptions configures the CLI processes kept alive between turns.
+type LiveOptions struct {
+	IdleTimeout    time.Duration // reap a process idle this long (0 = no live processes)
+	MaxIdle        int           // idle processes kept in total, the oldest are reaped first (0 = unlimited)
+	MaxIdlePerUser int           // idle processes kept per user (0 = unlimited)
 }
 
 type ClaudeProcess struct {
-	cmd    *exec.Cmd
-	cancel context.CancelFunc
+	cmd       *exec.Cmd // nil while waiting for a process slot
+	cancel    context.CancelFunc
+	userID    string
+	startedAt time.Time
 }
 
-type ClaudeEvent struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data,omitempty"`
+// ClaudeRequest describes one prompt to run through the Claude Code CLI.
+type ClaudeRequest struct {
+	UserID          string
+	SessionKey      string // identifies the run for Cancel / IsRunning
+	Message         string
+	WorkingDir      string
+	AddDirs         []string // extra directories the CLI may access (--add-dir)
+	ClaudeSessionID string   // resumed with --resume when set
+	Options         ClaudeOptions
+	OnLine          StreamCallback
+	OnQueued        func(position int) // called while waiting for a free process slot
+	Permission      *PermissionPrompt  // relay permission prompts to the user when set
+	Workspace       *Workspace         // run as the workspace's user, with its environment (nil = the server's)
 }
 
-type StreamCallback func(line string)
+// PermissionPrompt points the CLI at the backend's MCP permission tool for one run.
+type PermissionPrompt struct {
+	URL     string        // MCP endpoint including the run token
+	Timeout time.Duration // how long the CLI waits for the tool call
+}
+
+// MCP server and tool names the CLI calls for permission prompts.
+const (
+	permissionServerName = "nebulide"
+	PermissionToolName   = "approve_tool"
+)
+
+// Args returns the CLI flags that register the permission MCP server from
+// the config file at configPath (see writeConfig).
+func (p *PermissionPrompt) Args(configPath string) []string {
+	return []string{
+		"--mcp-config", configPath,
+		"--permission-prompt-tool", "mcp__" + permissionServerName + "__" + PermissionToolName,
+	}
+}
 
-func NewClaudeService(allowedTools string) *ClaudeService {
+// writeConfig writes the MCP config to a new file only uid/gid (-1 = the
+// server's user) can read and returns its path. The URL carries the run
+// token, which would be readable by every local user in the CLI's argv.
+func (p *PermissionPrompt) writeConfig(uid, gid int) (string, error) {
+	mcpConfig, _ := json.Marshal(map[string]any{
+		"mcpServers": map[string]any{
+			permissionServerName: map[string]string{"type": "http", "url": p.URL},
+		},
+	})
+	f, err := os.CreateTemp("", "nebulide-mcp-*.json") // created 0600
+	if err != nil {
+		return "", err
+	}
+	path := f.Name()
+	if uid >= 0 {
+		err = f.Chown(uid, gid)
+	}
+	if err == nil {
+		_, err = f.Write(mcpConfig)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// ProcessInfo describes a tracked run (for admin metrics).
+type ProcessInfo struct {
+	SessionKey string    `json:"session_key"`
+	UserID     string    `json:"user_id"`
+	State      string    `json:"state"` // "running" | "waiting" | "idle"
+	PID        int       `json:"pid,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// StreamCallback receives every raw stdout line together with the typed events
+// decoded from it (empty for lines that carry nothing we track).
+type StreamCallback func(line string, events []ClaudeEvent)
+
+func NewClaudeService(allowedTools string, scheduler *ProcessScheduler, live LiveOptions) *ClaudeService {
 	return &ClaudeService{
 		allowedTools: allowedTools,
+		scheduler:    scheduler,
 		processes:    make(map[string]*ClaudeProcess),
+		liveOpts:     live,
+		live:         make(map[string]*liveProcess),
 	}
 }
 
-// SendMessage spawns a Claude Code CLI subprocess and streams output via callback
-func (s *ClaudeService) SendMessage(
-	ctx context.Context,
-	sessionKey string,
-	message string,
-	workingDir string,
-	claudeSessionID string,
-	onLine StreamCallback,
-) (string, error) {
+// SendMessage waits for a process slot, spawns a Claude Code CLI subprocess
+// and streams output via req.OnLine. The returned transcript holds everything
+// decoded so far, even when err != nil.
+func (s *ClaudeService) SendMessage(ctx context.Context, req ClaudeRequest) (*Transcript, error) {
+	transcript := NewTranscript()
+	sessionKey := req.SessionKey
+
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Track the run before scheduling so Cancel also aborts a queued run.
+	proc := &ClaudeProcess{cancel: cancel, userID: req.UserID, startedAt: time.Now()}
+	s.mu.Lock()
+	s.processes[sessionKey] = proc
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.processes, sessionKey)
+		s.mu.Unlock()
+	}()
+
+	release, err := s.scheduler.Acquire(cmdCtx, req.UserID, sessionKey, req.OnQueued)
+	if err != nil {
+		cancel()
+		return transcript, err
+	}
+	defer release()
+
+	if s.liveOpts.IdleTimeout > 0 {
+		return s.sendLive(ctx, cmdCtx, req, proc, transcript)
+	}
+
 	// Build command args
 	args := []string{
-		"-p", message,
+		"-p", req.Message,
 		"--output-format", "stream-json",
 		"--verbose",
 	}
 
-	if claudeSessionID != "" {
-		args = append(args, "--resume", claudeSessionID)
+	if req.ClaudeSessionID != "" {
+		args = append(args, "--resume", req.ClaudeSessionID)
 	}
 
-	if s.allowedTools != "" {
-		args = append(args, "--allowedTools", s.allowedTools)
+	args = append(args, s.settingsArgs(req)...)
+	mcpArgs, removeConfig, err := permissionArgs(req)
+	if err != nil {
+		cancel()
+		return transcript, err
 	}
+	defer removeConfig()
+	args = append(args, mcpArgs...)
 
-	cmdCtx, cancel := context.WithCancel(ctx)
 	cmd := exec.CommandContext(cmdCtx, "claude", args...)
-	cmd.Dir = workingDir
+	cmd.Dir = req.WorkingDir
+	cmd.Env = processEnv(req)
+	cmd.SysProcAttr = processAttr(req)
+	started, err := sandboxCommand(cmd, req)
+	if err != nil {
+		cancel()
+		return transcript, fmt.Errorf("failed to sandbox claude: %w", err)
+	}
+	defer started()
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		cancel()
-		return "", fmt.Errorf("failed to get stdout pipe: %w", err)
+		return transcript, fmt.Errorf("failed to get stdout pipe: %w", err)
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		cancel()
-		return "", fmt.Errorf("failed to get stderr pipe: %w", err)
+		return transcript, fmt.Errorf("failed to get stderr pipe: %w", err)
 	}
 
-	// Track process
-	s.mu.Lock()
-	s.processes[sessionKey] = &ClaudeProcess{cmd: cmd, cancel: cancel}
-	s.mu.Unlock()
-
-	defer func() {
-		s.mu.Lock()
-		delete(s.processes, sessionKey)
-		s.mu.Unlock()
-	}()
-
 	if err := cmd.Start(); err != nil {
 		cancel()
-		return "", fmt.Errorf("failed to start claude: %w", err)
+		return transcript, fmt.Errorf("failed to start claude: %w", err)
 	}
 
+	s.mu.Lock()
+	proc.cmd = cmd
+	proc.startedAt = time.Now()
+	s.mu.Unlock()
+
 	// Read stderr in background for error reporting
 	var stderrOutput string
 	go func() {
@@ -100,7 +226,6 @@ func (s *ClaudeService) SendMessage(
 	}()
 
 	// Stream stdout line by line
-	var lastSessionID string
 	scanner := bufio.NewScanner(stdout)
 	// Increase scanner buffer for large responses
 	scanner.Buffer(make([]byte, 0, 1024*1024), 1024*1024)
@@ -111,35 +236,157 @@ func (s *ClaudeService) SendMessage(
 			continue
 		}
 
-		// Try to extract session_id from the output
-		var event map[string]interface{}
-		if err := json.Unmarshal([]byte(line), &event); err == nil {
-			if sid, ok := event["session_id"].(string); ok && sid != "" {
-				lastSessionID = sid
-			}
+		events, err := ParseStreamLine([]byte(line))
+		if err != nil {
+			log.Printf("[Claude] unparsable stream line (key=%s): %v", sessionKey, err)
+		}
+		for _, ev := range events {
+			transcript.Add(ev)
 		}
 
-		onLine(line)
+		req.OnLine(line, events)
 	}
 
 	if err := cmd.Wait(); err != nil {
 		if ctx.Err() != nil {
-			return lastSessionID, ctx.Err()
+			return transcript, ctx.Err()
 		}
-		return lastSessionID, fmt.Errorf("claude exited with error: %w, stderr: %s", err, stderrOutput)
+		return transcript, fmt.Errorf("claude exited with error: %w, stderr: %s", err, stderrOutput)
+	}
+
+	return transcript, nil
+}
+
+// Complete runs a single prompt with all tools (and MCP servers) turned off
+// and returns the result event (answer text, usage and cost). Meant for cheap
+// background jobs. The prompt may carry user content, so the CLI still runs
+// as the workspace's user and in its sandbox, like SendMessage; it runs in a
+// temp directory so these throwaway sessions never show up next to the
+// workspace's own sessions.
+func (s *ClaudeService) Complete(ctx context.Context, ws *Workspace, prompt, model string) (*RunResult, error) {
+	userID := ws.UserID.String()
+	release, err := s.scheduler.Acquire(ctx, userID, "complete:"+userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	args := []string{"-p", prompt, "--output-format", "json", "--max-turns", "1", "--tools", "", "--strict-mcp-config"}
+	if model != "" {
+		args = append(args, "--model", model)
+	}
+
+	req := ClaudeRequest{UserID: userID, Workspace: ws}
+	cmd := exec.CommandContext(ctx, "claude", args...)
+	cmd.Dir = os.TempDir()
+	cmd.Env = processEnv(req)
+	cmd.SysProcAttr = processAttr(req)
+	started, err := sandboxCommand(cmd, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sandbox claude: %w", err)
+	}
+	defer started()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("claude exited with error: %w, stderr: %s", err, stderr.String())
+	}
+
+	// --output-format json prints just the final result event.
+	events, err := ParseStreamLine(bytes.TrimSpace(out))
+	if err != nil || len(events) == 0 || events[0].Result == nil {
+		return nil, fmt.Errorf("unexpected claude output: %.200s", out)
+	}
+	res := events[0].Result
+	if res.IsError {
+		return res, fmt.Errorf("claude returned an error: %s", res.Text)
+	}
+	return res, nil
+}
+
+// settingsArgs are the per-session flags shared by one-shot and live processes.
+func (s *ClaudeService) settingsArgs(req ClaudeRequest) []string {
+	args := req.Options.Args(s.allowedTools)
+	for _, dir := range req.AddDirs {
+		args = append(args, "--add-dir", dir)
+	}
+	return args
+}
+
+// permissionArgs writes the run's MCP config for the user the CLI runs as
+// and returns the flags pointing the CLI at it, plus a func removing the
+// file once the CLI has exited. Without a permission prompt both are no-ops.
+func permissionArgs(req ClaudeRequest) ([]string, func(), error) {
+	if req.Permission == nil {
+		return nil, func() {}, nil
 	}
+	uid, gid := -1, -1
+	if req.Workspace != nil {
+		uid, gid = req.Workspace.ProcessOwner()
+	}
+	path, err := req.Permission.writeConfig(uid, gid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write MCP config: %w", err)
+	}
+	return req.Permission.Args(path), func() { os.Remove(path) }, nil
+}
+
+// processEnv returns the CLI environment (nil = inherit the backend's).
+func processEnv(req ClaudeRequest) []string {
+	env := os.Environ()
+	if req.Workspace != nil {
+		env = req.Workspace.Environ()
+	}
+	if req.Permission != nil {
+		// Give the user the full prompt timeout instead of the CLI's MCP default.
+		env = append(env, fmt.Sprintf("MCP_TOOL_TIMEOUT=%d", (req.Permission.Timeout+time.Minute).Milliseconds()))
+	}
+	return env
+}
+
+// processAttr makes the CLI run as the workspace's OS user, if it has one.
+func processAttr(req ClaudeRequest) *syscall.SysProcAttr {
+	if req.Workspace == nil {
+		return nil
+	}
+	return req.Workspace.SysProcAttr()
+}
 
-	return lastSessionID, nil
+// sandboxCommand moves the CLI into the workspace's sandbox, if it has one.
+// The returned func releases what was only needed to start the process.
+func sandboxCommand(cmd *exec.Cmd, req ClaudeRequest) (func(), error) {
+	if req.Workspace == nil || !req.Workspace.Sandboxed() {
+		return func() {}, nil
+	}
+	sandboxed, err := req.Workspace.SandboxCommand(SandboxProcess{
+		Path:        cmd.Path,
+		Args:        cmd.Args,
+		Env:         cmd.Env,
+		Dir:         cmd.Dir,
+		HostNetwork: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cmd.Path, cmd.Args, cmd.Env, cmd.SysProcAttr = sandboxed.Path, sandboxed.Args, sandboxed.Env, sandboxed.SysProcAttr
+	return sandboxed.Close, nil
 }
 
-// Cancel stops a running Claude process
+// Cancel stops a running Claude process, or the session's idle live process.
 func (s *ClaudeService) Cancel(sessionKey string) {
 	s.mu.RLock()
 	proc, exists := s.processes[sessionKey]
+	lp, live := s.live[sessionKey]
 	s.mu.RUnlock()
 
 	if exists {
 		proc.cancel()
+	} else if live {
+		s.reapLive(lp)
 	}
 }
 
@@ -150,3 +397,43 @@ func (s *ClaudeService) IsRunning(sessionKey string) bool {
 	_, exists := s.processes[sessionKey]
 	return exists
 }
+
+// Processes lists tracked runs, both running and waiting for a slot.
+func (s *ClaudeService) Processes() []ProcessInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]ProcessInfo, 0, len(s.processes))
+	for key, proc := range s.processes {
+		info := ProcessInfo{
+			SessionKey: key,
+			UserID:     proc.userID,
+			State:      "waiting",
+			StartedAt:  proc.startedAt,
+		}
+		if proc.cmd != nil && proc.cmd.Process != nil {
+			info.State = "running"
+			info.PID = proc.cmd.Process.Pid
+		}
+		list = append(list, info)
+	}
+	for key, lp := range s.live {
+		if _, busy := s.processes[key]; busy {
+			continue
+		}
+		list = append(list, ProcessInfo{
+			SessionKey: key,
+			UserID:     lp.userID,
+			State:      "idle",
+			PID:        lp.cmd.Process.Pid,
+			StartedAt:  lp.startedAt,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// SchedulerStats returns concurrency limits and current slot usage.
+func (s *ClaudeService) SchedulerStats() SchedulerStats {
+	return s.scheduler.Stats()
+}
@@ -0,0 +1,460 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrTranscriptNotFound = errors.New("claude transcript not found")
+
+var nonAlnum = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// ClaudeHistory reads and writes the CLI's own session transcripts, stored as
+// JSONL under <configDir>/projects/<encoded working dir>/<session id>.jsonl.
+type ClaudeHistory struct {
+	configDir string
+}
+
+func NewClaudeHistory(configDir string) *ClaudeHistory {
+	return &ClaudeHistory{configDir: configDir}
+}
+
+// ProjectDir is where the CLI keeps transcripts for a working directory
+// (every non-alphanumeric character of the path becomes "-").
+func (h *ClaudeHistory) ProjectDir(workingDir string) string {
+	if abs, err := filepath.Abs(workingDir); err == nil {
+		workingDir = abs
+	}
+	return filepath.Join(h.configDir, "projects", nonAlnum.ReplaceAllString(workingDir, "-"))
+}
+
+// TranscriptPath returns the JSONL file of a CLI session.
+func (h *ClaudeHistory) TranscriptPath(workingDir, sessionID string) string {
+	return filepath.Join(h.ProjectDir(workingDir), sessionID+".jsonl")
+}
+
+// transcriptLine holds the fields we inspect; the raw line is kept for rewriting.
+type transcriptLine struct {
+	Type        string    `json:"type"`
+	IsSidechain bool      `json:"isSidechain"`
+	IsMeta      bool      `json:"isMeta"`
+	Timestamp   time.Time `json:"timestamp"`
+	Message     struct {
+		Content json.RawMessage `json:"content"`
+	} `json:"message"`
+}
+
+// isPrompt reports whether the line is a prompt typed by the user, as opposed
+// to a tool result or an injected meta message.
+func (l *transcriptLine) isPrompt() bool {
+	if l.Type != "user" || l.IsSidechain || l.IsMeta || len(l.Message.Content) == 0 {
+		return false
+	}
+	var text string
+	if json.Unmarshal(l.Message.Content, &text) == nil {
+		return true
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(l.Message.Content, &blocks) != nil {
+		return false
+	}
+	for _, b := range blocks {
+		if b.Type == "tool_result" {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadTranscript returns the raw JSONL lines of a CLI session.
+func (h *ClaudeHistory) ReadTranscript(workingDir, sessionID string) ([][]byte, error) {
+	f, err := os.Open(h.TranscriptPath(workingDir, sessionID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrTranscriptNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// WriteTranscript stores lines as a new CLI session for workingDir, rewriting
+// their session ID. Returns the new session ID, which can be passed to --resume.
+func (h *ClaudeHistory) WriteTranscript(workingDir string, lines [][]byte) (string, error) {
+	dir := h.ProjectDir(workingDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	newID := uuid.NewString()
+	path := h.TranscriptPath(workingDir, newID)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, raw := range lines {
+		rewritten, err := withSessionID(raw, newID)
+		if err != nil {
+			continue // skip corrupt lines rather than failing the whole copy
+		}
+		w.Write(rewritten)
+		w.WriteByte('\n')
+	}
+
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write transcript: %w", err)
+	}
+	return newID, nil
+}
+
+// Fork copies a CLI session's transcript to a new session ID, keeping only the
+// first keepPrompts user prompts and everything Claude did in response to them
+// (keepPrompts < 0 keeps the whole transcript).
+func (h *ClaudeHistory) Fork(workingDir, sessionID string, keepPrompts int) (string, error) {
+	lines, err := h.ReadTranscript(workingDir, sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	if keepPrompts >= 0 {
+		prompts := 0
+		for i, raw := range lines {
+			var line transcriptLine
+			if json.Unmarshal(raw, &line) == nil && line.isPrompt() {
+				prompts++
+				if prompts > keepPrompts {
+					lines = lines[:i]
+					break
+				}
+			}
+		}
+	}
+	return h.WriteTranscript(workingDir, lines)
+}
+
+// CLISession summarizes a transcript found in the CLI's project directories.
+type CLISession struct {
+	SessionID  string    `json:"session_id"`
+	WorkingDir string    `json:"working_directory"`
+	Title      string    `json:"title"`
+	Prompts    int       `json:"prompts"`
+	Size       int64     `json:"size"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ListSessions scans every project directory for transcripts whose working
+// directory is root or below it, newest first. Transcripts without a single
+// prompt (e.g. aborted starts) are skipped.
+func (h *ClaudeHistory) ListSessions(root string) ([]CLISession, error) {
+	projects, err := os.ReadDir(filepath.Join(h.configDir, "projects"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []CLISession
+	for _, project := range projects {
+		if !project.IsDir() {
+			continue
+		}
+		dir := filepath.Join(h.configDir, "projects", project.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".jsonl") {
+				continue
+			}
+			session, err := summarizeTranscript(filepath.Join(dir, file.Name()))
+			if err != nil || session.Prompts == 0 || !IsWithinDir(root, session.WorkingDir) {
+				continue
+			}
+			sessions = append(sessions, *session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt) })
+	return sessions, nil
+}
+
+// FindSession looks up one session of ListSessions by ID, reading only its
+// own transcript.
+func (h *ClaudeHistory) FindSession(root, sessionID string) (*CLISession, error) {
+	if sessionID == "" || sessionID != filepath.Base(sessionID) || strings.HasPrefix(sessionID, ".") {
+		return nil, ErrTranscriptNotFound
+	}
+	projects, err := os.ReadDir(filepath.Join(h.configDir, "projects"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrTranscriptNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, project := range projects {
+		if !project.IsDir() {
+			continue
+		}
+		path := filepath.Join(h.configDir, "projects", project.Name(), sessionID+".jsonl")
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		session, err := summarizeTranscript(path)
+		if err != nil || session.Prompts == 0 || !IsWithinDir(root, session.WorkingDir) {
+			continue
+		}
+		return session, nil
+	}
+	return nil, ErrTranscriptNotFound
+}
+
+func summarizeTranscript(path string) (*CLISession, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &CLISession{
+		SessionID: strings.TrimSuffix(filepath.Base(path), ".jsonl"),
+		Size:      info.Size(),
+		UpdatedAt: info.ModTime(),
+	}
+	var firstPrompt string
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var line struct {
+			transcriptLine
+			Cwd     string `json:"cwd"`
+			Summary string `json:"summary"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		if session.WorkingDir == "" && line.Cwd != "" {
+			session.WorkingDir = line.Cwd
+		}
+		if line.Type == "summary" && line.Summary != "" {
+			session.Title = line.Summary
+		}
+		if line.isPrompt() {
+			session.Prompts++
+			if firstPrompt == "" {
+				firstPrompt = strings.Join(strings.Fields(promptText(line.Message.Content)), " ")
+			}
+		}
+	}
+	if session.Title == "" {
+		session.Title = firstPrompt
+	}
+	return session, scanner.Err()
+}
+
+// IsWithinDir reports whether path is dir or inside it (both cleaned;
+// "/work" does not contain "/workspace").
+func IsWithinDir(dir, path string) bool {
+	if dir == "" || path == "" {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// TranscriptTurn is a chat message rebuilt from (or rendered to) a CLI transcript.
+type TranscriptTurn struct {
+	Role      string // "user" | "assistant"
+	Content   string
+	ToolCalls []ToolCall
+	Timestamp time.Time
+}
+
+// ParseTranscript rebuilds the conversation of a CLI transcript: one user turn
+// per prompt, followed by one assistant turn with everything Claude said and
+// the tool calls it made. Sidechains (subagents) and meta lines are skipped.
+func ParseTranscript(lines [][]byte) []TranscriptTurn {
+	var turns []TranscriptTurn
+	var reply *Transcript
+	var replyAt time.Time
+
+	flush := func() {
+		if reply != nil && (reply.Text() != "" || len(reply.ToolCalls) > 0) {
+			turns = append(turns, TranscriptTurn{
+				Role:      "assistant",
+				Content:   reply.Text(),
+				ToolCalls: reply.ToolCalls,
+				Timestamp: replyAt,
+			})
+		}
+		reply = nil
+	}
+
+	for _, raw := range lines {
+		var line transcriptLine
+		if json.Unmarshal(raw, &line) != nil || line.IsSidechain || line.IsMeta {
+			continue
+		}
+
+		if line.isPrompt() {
+			flush()
+			turns = append(turns, TranscriptTurn{
+				Role:      "user",
+				Content:   promptText(line.Message.Content),
+				Timestamp: line.Timestamp,
+			})
+			continue
+		}
+
+		events, err := ParseStreamLine(raw)
+		if err != nil || len(events) == 0 {
+			continue
+		}
+		if reply == nil {
+			reply = NewTranscript()
+			replyAt = line.Timestamp
+		}
+		for _, ev := range events {
+			reply.Add(ev)
+		}
+	}
+	flush()
+	return turns
+}
+
+func promptText(content json.RawMessage) string {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	json.Unmarshal(content, &blocks)
+	var parts []string
+	for _, b := range blocks {
+		if b.Type == "text" && b.Text != "" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// BuildTranscript renders turns as CLI transcript lines, so a conversation
+// that only exists in our database can be exported or resumed by the CLI.
+func BuildTranscript(sessionID, cwd string, turns []TranscriptTurn) [][]byte {
+	var lines [][]byte
+	parent := ""
+
+	emit := func(typ string, ts time.Time, message any) {
+		id := uuid.NewString()
+		line := map[string]any{
+			"type":        typ,
+			"uuid":        id,
+			"parentUuid":  nil,
+			"sessionId":   sessionID,
+			"cwd":         cwd,
+			"isSidechain": false,
+			"userType":    "external",
+			"timestamp":   ts.UTC().Format(time.RFC3339Nano),
+			"message":     message,
+		}
+		if parent != "" {
+			line["parentUuid"] = parent
+		}
+		data, _ := json.Marshal(line)
+		lines = append(lines, data)
+		parent = id
+	}
+
+	for _, turn := range turns {
+		if turn.Role == "user" {
+			emit("user", turn.Timestamp, map[string]any{"role": "user", "content": turn.Content})
+			continue
+		}
+
+		var blocks []map[string]any
+		if turn.Content != "" {
+			blocks = append(blocks, map[string]any{"type": "text", "text": turn.Content})
+		}
+		for _, call := range turn.ToolCalls {
+			blocks = append(blocks, map[string]any{"type": "tool_use", "id": call.ID, "name": call.Name, "input": rawOrEmpty(call.Input)})
+		}
+		emit("assistant", turn.Timestamp, map[string]any{"role": "assistant", "content": blocks})
+
+		if len(turn.ToolCalls) > 0 {
+			var results []map[string]any
+			for _, call := range turn.ToolCalls {
+				results = append(results, map[string]any{
+					"type":        "tool_result",
+					"tool_use_id": call.ID,
+					"content":     rawOrEmpty(call.Output),
+					"is_error":    call.IsError,
+				})
+			}
+			emit("user", turn.Timestamp, map[string]any{"role": "user", "content": results})
+		}
+	}
+	return lines
+}
+
+func rawOrEmpty(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return json.RawMessage(`""`)
+	}
+	return raw
+}
+
+// withSessionID rewrites the sessionId field of a transcript line, leaving
+// every other field untouched.
+func withSessionID(raw []byte, sessionID string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["sessionId"]; ok {
+		id, _ := json.Marshal(sessionID)
+		fields["sessionId"] = id
+	}
+	return json.Marshal(fields)
+}
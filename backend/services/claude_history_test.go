@@ -0,0 +1,160 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Two prompts, the first answered via a tool call.
+var sampleTranscript = strings.Join([]string{
+	`{"type":"user","sessionId":"orig","uuid":"u1","message":{"role":"user","content":"first"}}`,
+	`{"type":"assistant","sessionId":"orig","uuid":"a1","message":{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"Read","input":{}}]}}`,
+	`{"type":"user","sessionId":"orig","uuid":"r1","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"ok"}]}}`,
+	`{"type":"assistant","sessionId":"orig","uuid":"a2","message":{"role":"assistant","content":[{"type":"text","text":"done"}]}}`,
+	`{"type":"user","sessionId":"orig","uuid":"u2","message":{"role":"user","content":[{"type":"text","text":"second"}]}}`,
+	`{"type":"assistant","sessionId":"orig","uuid":"a3","message":{"role":"assistant","content":[{"type":"text","text":"again"}]}}`,
+}, "\n") + "\n"
+
+func writeSampleTranscript(t *testing.T) (*ClaudeHistory, string) {
+	t.Helper()
+	h := NewClaudeHistory(t.TempDir())
+	workDir := "/home/nebulide/workspace/my.project"
+	require.NoError(t, os.MkdirAll(h.ProjectDir(workDir), 0755))
+	require.NoError(t, os.WriteFile(h.TranscriptPath(workDir, "orig"), []byte(sampleTranscript), 0600))
+	return h, workDir
+}
+
+func readTranscript(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var lines []map[string]any
+	for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(l), &m))
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestClaudeHistory_ProjectDir(t *testing.T) {
+	h := NewClaudeHistory("/root/.claude")
+	assert.Equal(t, filepath.Join("/root/.claude", "projects", "-home-nebulide-workspace-my-project"),
+		h.ProjectDir("/home/nebulide/workspace/my.project"))
+}
+
+func TestClaudeHistory_ForkKeepsFirstPrompts(t *testing.T) {
+	h, workDir := writeSampleTranscript(t)
+
+	newID, err := h.Fork(workDir, "orig", 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, "orig", newID)
+
+	lines := readTranscript(t, h.TranscriptPath(workDir, newID))
+	require.Len(t, lines, 4) // the first prompt, its tool round-trip and answer
+	for _, l := range lines {
+		assert.Equal(t, newID, l["sessionId"])
+	}
+	assert.Equal(t, "a2", lines[3]["uuid"])
+}
+
+func TestClaudeHistory_ForkAll(t *testing.T) {
+	h, workDir := writeSampleTranscript(t)
+
+	newID, err := h.Fork(workDir, "orig", -1)
+	require.NoError(t, err)
+	assert.Len(t, readTranscript(t, h.TranscriptPath(workDir, newID)), 6)
+
+	// The original is untouched.
+	assert.Len(t, readTranscript(t, h.TranscriptPath(workDir, "orig")), 6)
+	assert.Equal(t, "orig", readTranscript(t, h.TranscriptPath(workDir, "orig"))[0]["sessionId"])
+}
+
+func TestClaudeHistory_ForkMissingTranscript(t *testing.T) {
+	h := NewClaudeHistory(t.TempDir())
+	_, err := h.Fork("/nowhere", "missing", -1)
+	assert.ErrorIs(t, err, ErrTranscriptNotFound)
+}
+
+func TestParseTranscript(t *testing.T) {
+	h, workDir := writeSampleTranscript(t)
+	lines, err := h.ReadTranscript(workDir, "orig")
+	require.NoError(t, err)
+
+	turns := ParseTranscript(lines)
+	require.Len(t, turns, 4)
+	assert.Equal(t, TranscriptTurn{Role: "user", Content: "first"}, turns[0])
+	assert.Equal(t, "assistant", turns[1].Role)
+	assert.Equal(t, "done", turns[1].Content)
+	require.Len(t, turns[1].ToolCalls, 1)
+	assert.Equal(t, "Read", turns[1].ToolCalls[0].Name)
+	assert.JSONEq(t, `"ok"`, string(turns[1].ToolCalls[0].Output))
+	assert.Equal(t, "second", turns[2].Content)
+	assert.Equal(t, "again", turns[3].Content)
+}
+
+func TestBuildTranscriptRoundTrip(t *testing.T) {
+	h, workDir := writeSampleTranscript(t)
+	lines, err := h.ReadTranscript(workDir, "orig")
+	require.NoError(t, err)
+	turns := ParseTranscript(lines)
+
+	built := BuildTranscript("new", workDir, turns)
+	assert.Equal(t, turns, ParseTranscript(built))
+
+	var first map[string]any
+	require.NoError(t, json.Unmarshal(built[0], &first))
+	assert.Equal(t, "new", first["sessionId"])
+	assert.Nil(t, first["parentUuid"])
+}
+
+func TestClaudeHistory_ListSessions(t *testing.T) {
+	h := NewClaudeHistory(t.TempDir())
+	write := func(cwd, id, content string) {
+		require.NoError(t, os.MkdirAll(h.ProjectDir(cwd), 0755))
+		require.NoError(t, os.WriteFile(h.TranscriptPath(cwd, id), []byte(content), 0600))
+	}
+	prompt := func(cwd, text string) string {
+		return `{"type":"user","cwd":"` + cwd + `","message":{"role":"user","content":"` + text + `"}}` + "\n"
+	}
+
+	write("/ws/app", "s1", prompt("/ws/app", "hello   there")+prompt("/ws/app", "again"))
+	write("/ws", "s2", `{"type":"summary","summary":"Refactor"}`+"\n"+prompt("/ws", "x"))
+	write("/ws", "empty", `{"type":"summary","summary":"nothing"}`+"\n")
+	write("/wsx", "s3", prompt("/wsx", "outside"))
+
+	sessions, err := h.ListSessions("/ws")
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+
+	byID := map[string]CLISession{}
+	for _, s := range sessions {
+		byID[s.SessionID] = s
+	}
+	assert.Equal(t, "/ws/app", byID["s1"].WorkingDir)
+	assert.Equal(t, "hello there", byID["s1"].Title)
+	assert.Equal(t, 2, byID["s1"].Prompts)
+	assert.Equal(t, "Refactor", byID["s2"].Title)
+
+	found, err := h.FindSession("/ws", "s1")
+	require.NoError(t, err)
+	assert.Equal(t, byID["s1"], *found)
+	for _, id := range []string{"s3", "empty", "missing", "../app/s1", ""} {
+		_, err = h.FindSession("/ws", id)
+		assert.ErrorIs(t, err, ErrTranscriptNotFound, id)
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	assert.True(t, IsWithinDir("/ws", "/ws"))
+	assert.True(t, IsWithinDir("/ws", "/ws/a/../b"))
+	assert.False(t, IsWithinDir("/ws", "/wsx"))
+	assert.False(t, IsWithinDir("/ws", "/ws/../etc"))
+	assert.False(t, IsWithinDir("/ws", ""))
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Live processes: one long-lived CLI per session, fed over stdin ──
+//
+// With an idle timeout configured, a session's first message starts
+// `claude -p --input-format stream-json` and later messages are written to the
+// same process's stdin, skipping process startup and context reload. A turn
+// ends at the CLI's result event. Idle processes are reaped after the timeout,
+// or oldest first once a user or the server has more idle ones than allowed;
+// one that died or whose settings changed is replaced by a fresh process
+// started with --resume, so callers see the same behaviour either way.
+// Scheduler slots are held per turn, so idle processes don't count against
+// the concurrency limits.
+
+type liveProcess struct {
+	key         string
+	userID      string
+	fingerprint string // working dir + settings flags; a change forces a restart
+	cmd         *exec.Cmd
+	cancel      context.CancelFunc
+	stdin       io.WriteCloser
+	lines       chan string // stdout lines; closed once the process has exited
+	stderr      *tailBuffer
+	sessionID   string
+	startedAt   time.Time
+	busy        bool        // a turn is in progress; guarded by ClaudeService.mu
+	idleSince   time.Time   // when the last turn ended; guarded by ClaudeService.mu
+	idle        *time.Timer // reaps the process when it fires; guarded by ClaudeService.mu
+}
+
+// streamInputMessage is one user turn in the CLI's stream-json input format.
+type streamInputMessage struct {
+	Type    string `json:"type"`
+	Message struct {
+		Role    string              `json:"role"`
+		Content []map[string]string `json:"content"`
+	} `json:"message"`
+}
+
+func (s *ClaudeService) sendLive(ctx, cmdCtx context.Context, req ClaudeRequest, proc *ClaudeProcess, transcript *Transcript) (*Transcript, error) {
+	fingerprint := req.WorkingDir + "\x00" + strings.Join(s.settingsArgs(req), "\x00")
+	if req.Permission != nil {
+		fingerprint += "\x00" + req.Permission.URL
+	}
+	resumeID := req.ClaudeSessionID
+
+	lp, staleSessionID := s.takeLive(req.SessionKey, fingerprint)
+	if resumeID == "" {
+		resumeID = staleSessionID
+	}
+	reused := lp != nil
+	for {
+		if lp == nil {
+			var err error
+			if lp, err = s.startLive(req, fingerprint, resumeID); err != nil {
+				return transcript, err
+			}
+		}
+
+		s.mu.Lock()
+		proc.cmd = lp.cmd
+		proc.startedAt = time.Now()
+		s.mu.Unlock()
+
+		gotOutput, err := s.liveTurn(ctx, cmdCtx, req, lp, transcript)
+		if err == nil {
+			if transcript.SessionID != "" {
+				lp.sessionID = transcript.SessionID
+			} else {
+				transcript.SessionID = lp.sessionID
+			}
+			s.parkLive(lp)
+			return transcript, nil
+		}
+
+		s.dropLive(lp)
+		// A reused process that died before answering is replaced transparently.
+		if reused && !gotOutput && cmdCtx.Err() == nil {
+			log.Printf("[Claude] live process for %s died, restarting with --resume: %v", req.SessionKey, err)
+			if lp.sessionID != "" {
+				resumeID = lp.sessionID
+			}
+			lp, reused = nil, false
+			continue
+		}
+		return transcript, err
+	}
+}
+
+// takeLive returns the session's idle live process marked busy, or nil if
+// there is none usable (exited, or started with different settings). A
+// discarded process's Claude session ID is returned so it can be resumed.
+func (s *ClaudeService) takeLive(key, fingerprint string) (*liveProcess, string) {
+	s.mu.Lock()
+	lp, ok := s.live[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, ""
+	}
+	lp.stopIdle()
+
+	exited := false
+	select {
+	case _, open := <-lp.lines:
+		exited = !open // a stray line after the last result is dropped
+	default:
+	}
+	if exited || lp.fingerprint != fingerprint {
+		delete(s.live, key)
+		s.mu.Unlock()
+		lp.kill()
+		return nil, lp.sessionID
+	}
+	lp.busy = true
+	s.mu.Unlock()
+	return lp, ""
+}
+
+func (s *ClaudeService) startLive(req ClaudeRequest, fingerprint, resumeID string) (*liveProcess, error) {
+	args := []string{
+		"-p",
+		"--input-format", "stream-json",
+		"--output-format", "stream-json",
+		"--verbose",
+	}
+	if resumeID != "" {
+		args = append(args, "--resume", resumeID)
+	}
+	args = append(args, s.settingsArgs(req)...)
+	mcpArgs, removeConfig, err := permissionArgs(req)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, mcpArgs...)
+	running := false
+	defer func() {
+		if !running {
+			removeConfig()
+		}
+	}()
+
+	// The process outlives this request, so it gets its own context.
+	procCtx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(procCtx, "claude", args...)
+	cmd.Dir = req.WorkingDir
+	cmd.Env = processEnv(req)
+	cmd.SysProcAttr = processAttr(req)
+	started, err := sandboxCommand(cmd, req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to sandbox claude: %w", err)
+	}
+	defer started()
+
+	lp := &liveProcess{
+		key:         req.SessionKey,
+		userID:      req.UserID,
+		fingerprint: fingerprint,
+		cmd:         cmd,
+		cancel:      cancel,
+		lines:       make(chan string, 64),
+		stderr:      &tailBuffer{max: 16 * 1024},
+		sessionID:   resumeID,
+		startedAt:   time.Now(),
+		busy:        true,
+	}
+	cmd.Stderr = lp.stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to get stdin pipe: %w", err)
+	}
+	lp.stdin = stdin
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start claude: %w", err)
+	}
+	running = true
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 1024*1024), 1024*1024)
+		for scanner.Scan() {
+			lp.lines <- scanner.Text()
+		}
+		cmd.Wait()
+		removeConfig()
+		close(lp.lines)
+	}()
+
+	s.mu.Lock()
+	if old, ok := s.live[lp.key]; ok {
+		old.stopIdle()
+		defer old.kill()
+	}
+	s.live[lp.key] = lp
+	s.mu.Unlock()
+
+	return lp, nil
+}
+
+// liveTurn feeds one message to the process and streams output until the
+// result event. gotOutput reports whether the process produced anything.
+func (s *ClaudeService) liveTurn(ctx, cmdCtx context.Context, req ClaudeRequest, lp *liveProcess, transcript *Transcript) (gotOutput bool, err error) {
+	var in streamInputMessage
+	in.Type = "user"
+	in.Message.Role = "user"
+	in.Message.Content = []map[string]string{{"type": "text", "text": req.Message}}
+	data, _ := json.Marshal(in)
+
+	if _, err := lp.stdin.Write(append(data, '\n')); err != nil {
+		return false, fmt.Errorf("failed to write to claude: %w", err)
+	}
+
+	for {
+		select {
+		case line, ok := <-lp.lines:
+			if !ok {
+				if ctx.Err() != nil {
+					return gotOutput, ctx.Err()
+				}
+				return gotOutput, fmt.Errorf("claude exited unexpectedly, stderr: %s", lp.stderr)
+			}
+			if line == "" {
+				continue
+			}
+			gotOutput = true
+
+			events, err := ParseStreamLine([]byte(line))
+			if err != nil {
+				log.Printf("[Claude] unparsable stream line (key=%s): %v", req.SessionKey, err)
+			}
+			done := false
+			for _, ev := range events {
+				transcript.Add(ev)
+				done = done || ev.Type == EventResult
+			}
+
+			req.OnLine(line, events)
+			if done {
+				return gotOutput, nil
+			}
+		case <-cmdCtx.Done():
+			if ctx.Err() != nil {
+				return gotOutput, ctx.Err()
+			}
+			return gotOutput, fmt.Errorf("claude run cancelled: %w", cmdCtx.Err())
+		}
+	}
+}
+
+// parkLive marks the process idle, arms its reaper and reaps the oldest
+// idle processes over the limits.
+func (s *ClaudeService) parkLive(lp *liveProcess) {
+	s.mu.Lock()
+	lp.busy = false
+	lp.idleSince = time.Now()
+	if lp.idle == nil {
+		lp.idle = time.AfterFunc(s.liveOpts.IdleTimeout, func() { s.reapLive(lp) })
+	} else {
+		lp.idle.Reset(s.liveOpts.IdleTimeout)
+	}
+	var evicted []*liveProcess
+	if max := s.liveOpts.MaxIdlePerUser; max > 0 {
+		evicted = append(evicted, s.evictIdleLocked(max, func(o *liveProcess) bool { return o.userID == lp.userID })...)
+	}
+	if max := s.liveOpts.MaxIdle; max > 0 {
+		evicted = append(evicted, s.evictIdleLocked(max, func(*liveProcess) bool { return true })...)
+	}
+	s.mu.Unlock()
+
+	for _, old := range evicted {
+		log.Printf("[Claude] reaping idle live process for %s: too many idle processes", old.key)
+		old.kill()
+	}
+}
+
+// evictIdleLocked forgets the oldest idle processes matching match until at
+// most max are left, and returns them to be killed. Caller holds s.mu.
+func (s *ClaudeService) evictIdleLocked(max int, match func(*liveProcess) bool) []*liveProcess {
+	var idle []*liveProcess
+	for _, lp := range s.live {
+		if !lp.busy && match(lp) {
+			idle = append(idle, lp)
+		}
+	}
+	if len(idle) <= max {
+		return nil
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].idleSince.Before(idle[j].idleSince) })
+	evicted := idle[:len(idle)-max]
+	for _, lp := range evicted {
+		lp.stopIdle()
+		delete(s.live, lp.key)
+	}
+	return evicted
+}
+
+func (s *ClaudeService) reapLive(lp *liveProcess) {
+	s.mu.Lock()
+	if s.live[lp.key] != lp || lp.busy {
+		s.mu.Unlock()
+		return
+	}
+	lp.stopIdle()
+	delete(s.live, lp.key)
+	s.mu.Unlock()
+
+	log.Printf("[Claude] reaping idle live process for %s", lp.key)
+	lp.kill()
+}
+
+// dropLive forgets and kills a live process.
+func (s *ClaudeService) dropLive(lp *liveProcess) {
+	s.mu.Lock()
+	lp.stopIdle()
+	if s.live[lp.key] == lp {
+		delete(s.live, lp.key)
+	}
+	s.mu.Unlock()
+	lp.kill()
+}
+
+// stopIdle disarms the reaper. Caller holds ClaudeService.mu.
+func (lp *liveProcess) stopIdle() {
+	if lp.idle != nil {
+		lp.idle.Stop()
+	}
+}
+
+// kill stops the process. Its reaper must already be stopped.
+func (lp *liveProcess) kill() {
+	lp.stdin.Close()
+	lp.cancel()
+}
+
+// tailBuffer keeps the last max bytes written to it (stderr of a live process).
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
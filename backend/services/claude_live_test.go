@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClaude puts a `claude` script on PATH that logs its args and its PID,
+// then answers every stdin line with an init and a result event.
+func fakeClaude(t *testing.T) (argsLog string) {
+	t.Helper()
+	dir := t.TempDir()
+	argsLog = filepath.Join(dir, "args.log")
+
+	script := `#!/bin/sh
+echo "$$ $*" >> "` + argsLog + `"
+while read -r line; do
+  echo '{"type":"system","subtype":"init","session_id":"sess-1"}'
+  echo '{"type":"assistant","session_id":"sess-1","message":{"content":[{"type":"text","text":"pong"}]}}'
+  echo '{"type":"result","subtype":"success","is_error":false,"result":"pong","session_id":"sess-1"}'
+done
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "claude"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsLog
+}
+
+func spawnLog(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func liveRequest(t *testing.T, resumeID string) ClaudeRequest {
+	return ClaudeRequest{
+		UserID:          "u1",
+		SessionKey:      "s1:u1",
+		Message:         "ping",
+		WorkingDir:      t.TempDir(),
+		ClaudeSessionID: resumeID,
+		OnLine:          func(string, []ClaudeEvent) {},
+	}
+}
+
+func TestClaudeLive_ReusesProcessAcrossTurns(t *testing.T) {
+	argsLog := fakeClaude(t)
+	s := NewClaudeService("Read", NewProcessScheduler(0, 0), LiveOptions{IdleTimeout: time.Minute})
+	req := liveRequest(t, "")
+	t.Cleanup(func() { s.Cancel(req.SessionKey) })
+
+	for i := 0; i < 3; i++ {
+		tr, err := s.SendMessage(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", tr.Text())
+		assert.Equal(t, "sess-1", tr.SessionID)
+	}
+
+	spawns := spawnLog(t, argsLog)
+	require.Len(t, spawns, 1)
+	assert.Contains(t, spawns[0], "--input-format stream-json")
+	assert.Equal(t, "idle", s.Processes()[0].State)
+}
+
+func TestClaudeLive_RestartsWithResumeAfterReap(t *testing.T) {
+	argsLog := fakeClaude(t)
+	s := NewClaudeService("Read", NewProcessScheduler(0, 0), LiveOptions{IdleTimeout: 20 * time.Millisecond})
+	req := liveRequest(t, "")
+	t.Cleanup(func() { s.Cancel(req.SessionKey) })
+
+	_, err := s.SendMessage(context.Background(), req)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(s.Processes()) == 0 }, time.Second, 5*time.Millisecond)
+
+	req.ClaudeSessionID = "sess-1"
+	tr, err := s.SendMessage(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", tr.Text())
+
+	spawns := spawnLog(t, argsLog)
+	require.Len(t, spawns, 2)
+	assert.Contains(t, spawns[1], "--resume sess-1")
+}
+
+func TestClaudeLive_SettingsChangeRestarts(t *testing.T) {
+	argsLog := fakeClaude(t)
+	s := NewClaudeService("Read", NewProcessScheduler(0, 0), LiveOptions{IdleTimeout: time.Minute})
+	req := liveRequest(t, "")
+	t.Cleanup(func() { s.Cancel(req.SessionKey) })
+
+	_, err := s.SendMessage(context.Background(), req)
+	require.NoError(t, err)
+
+	req.Options.Model = "opus"
+	_, err = s.SendMessage(context.Background(), req)
+	require.NoError(t, err)
+
+	spawns := spawnLog(t, argsLog)
+	require.Len(t, spawns, 2)
+	assert.Contains(t, spawns[1], "--model opus")
+	assert.Contains(t, spawns[1], "--resume sess-1")
+}
+
+func TestClaudeLive_IdleLimitsReapOldestFirst(t *testing.T) {
+	argsLog := fakeClaude(t)
+	s := NewClaudeService("Read", NewProcessScheduler(0, 0), LiveOptions{IdleTimeout: time.Minute, MaxIdle: 2, MaxIdlePerUser: 1})
+	send := func(userID, session string) {
+		req := liveRequest(t, "")
+		req.UserID, req.SessionKey = userID, session+":"+userID
+		t.Cleanup(func() { s.Cancel(req.SessionKey) })
+		_, err := s.SendMessage(context.Background(), req)
+		require.NoError(t, err)
+	}
+	idle := func() []string {
+		var keys []string
+		for _, p := range s.Processes() {
+			keys = append(keys, p.SessionKey)
+		}
+		return keys
+	}
+
+	send("u1", "a")
+	send("u1", "b")
+	assert.Equal(t, []string{"b:u1"}, idle(), "one idle process per user")
+
+	send("u2", "c")
+	send("u3", "d")
+	assert.ElementsMatch(t, []string{"c:u2", "d:u3"}, idle(), "two in total")
+
+	// A reaped session just gets a fresh process.
+	send("u1", "b")
+	assert.ElementsMatch(t, []string{"d:u3", "b:u1"}, idle())
+	assert.Len(t, spawnLog(t, argsLog), 5)
+}
+
+func TestClaudeLive_PermissionTokenStaysOutOfArgs(t *testing.T) {
+	argsLog := fakeClaude(t)
+	s := NewClaudeService("Read", NewProcessScheduler(0, 0), LiveOptions{IdleTimeout: time.Minute})
+	req := liveRequest(t, "")
+	req.Permission = &PermissionPrompt{URL: "http://127.0.0.1:8080/internal/mcp/permissions/secret-token", Timeout: time.Minute}
+	t.Cleanup(func() { s.Cancel(req.SessionKey) })
+
+	for i := 0; i < 2; i++ {
+		_, err := s.SendMessage(context.Background(), req)
+		require.NoError(t, err)
+	}
+
+	spawns := spawnLog(t, argsLog)
+	require.Len(t, spawns, 1, "the config file's path doesn't restart the process")
+	assert.NotContains(t, spawns[0], "secret-token")
+	_, after, ok := strings.Cut(spawns[0], "--mcp-config ")
+	require.True(t, ok)
+	config, _, _ := strings.Cut(after, " ")
+
+	info, err := os.Stat(config)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := os.ReadFile(config)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), req.Permission.URL)
+
+	// Removed once the process is gone.
+	s.Cancel(req.SessionKey)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(config)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 20*time.Millisecond)
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Permission modes accepted by `claude --permission-mode`.
+var validPermissionModes = map[string]bool{
+	"default":           true,
+	"acceptEdits":       true,
+	"plan":              true,
+	"bypassPermissions": true,
+}
+
+var (
+	modelPattern = regexp.MustCompile(`^[A-Za-z0-9._\-\[\]]{1,100}$`)
+	// Tool names like "Read", "mcp__github__create_issue" or rules like "Bash(git diff:*)".
+	toolPattern = regexp.MustCompile(`^[A-Za-z0-9_\-]+(\([^(),]*\))?$`)
+)
+
+const (
+	maxToolRules          = 50
+	maxToolRuleLen        = 200
+	maxTurnsLimit         = 200
+	maxSystemPromptLength = 10000
+)
+
+// ClaudeOptions are per-session CLI settings. Zero values leave the CLI default
+// in place; AllowedTools == nil falls back to the service-wide allow-list.
+type ClaudeOptions struct {
+	Model              string
+	PermissionMode     string
+	AllowedTools       []string
+	DisallowedTools    []string
+	MaxTurns           int
+	AppendSystemPrompt string
+}
+
+// Validate checks the options before they are stored or turned into CLI args.
+func (o ClaudeOptions) Validate() error {
+	if o.Model != "" && !modelPattern.MatchString(o.Model) {
+		return fmt.Errorf("invalid model %q", o.Model)
+	}
+	if o.PermissionMode != "" && !validPermissionModes[o.PermissionMode] {
+		return fmt.Errorf("invalid permission mode %q (expected default, acceptEdits, plan or bypassPermissions)", o.PermissionMode)
+	}
+	if err := validateToolRules("allowed_tools", o.AllowedTools); err != nil {
+		return err
+	}
+	if err := validateToolRules("disallowed_tools", o.DisallowedTools); err != nil {
+		return err
+	}
+	if o.MaxTurns < 0 || o.MaxTurns > maxTurnsLimit {
+		return fmt.Errorf("max_turns must be between 0 and %d", maxTurnsLimit)
+	}
+	if len(o.AppendSystemPrompt) > maxSystemPromptLength {
+		return fmt.Errorf("system prompt too long (max %d characters)", maxSystemPromptLength)
+	}
+	return nil
+}
+
+func validateToolRules(field string, rules []string) error {
+	if len(rules) > maxToolRules {
+		return fmt.Errorf("%s: too many entries (max %d)", field, maxToolRules)
+	}
+	for _, r := range rules {
+		if len(r) > maxToolRuleLen || !toolPattern.MatchString(r) {
+			return fmt.Errorf("%s: invalid tool %q", field, r)
+		}
+	}
+	return nil
+}
+
+// Args translates the options into CLI flags. defaultAllowedTools is the
+// comma-separated service-wide allow-list used when AllowedTools is nil.
+func (o ClaudeOptions) Args(defaultAllowedTools string) []string {
+	var args []string
+
+	if o.Model != "" {
+		args = append(args, "--model", o.Model)
+	}
+	if o.PermissionMode != "" {
+		args = append(args, "--permission-mode", o.PermissionMode)
+	}
+
+	allowed := defaultAllowedTools
+	if o.AllowedTools != nil {
+		allowed = strings.Join(o.AllowedTools, ",")
+	}
+	if allowed != "" {
+		args = append(args, "--allowedTools", allowed)
+	}
+	if len(o.DisallowedTools) > 0 {
+		args = append(args, "--disallowedTools", strings.Join(o.DisallowedTools, ","))
+	}
+
+	if o.MaxTurns > 0 {
+		args = append(args, "--max-turns", strconv.Itoa(o.MaxTurns))
+	}
+	if o.AppendSystemPrompt != "" {
+		args = append(args, "--append-system-prompt", o.AppendSystemPrompt)
+	}
+	return args
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ── stream-json protocol: typed events decoded from `claude --output-format stream-json` ──
+
+const (
+	EventInit       = "init"        // system/init: session started, model and tools known
+	EventText       = "text"        // complete assistant text block
+	EventTextDelta  = "text_delta"  // partial assistant text (only with --include-partial-messages)
+	EventToolUse    = "tool_use"    // assistant requested a tool call
+	EventToolResult = "tool_result" // tool output fed back to the model
+	EventResult     = "result"      // final event of a run: result text, usage, cost
+)
+
+// ClaudeEvent is a single typed event decoded from one stream-json line.
+// One line may yield several events (an assistant message can hold text and tool_use blocks).
+type ClaudeEvent struct {
+	Type       string      `json:"type"`
+	SessionID  string      `json:"session_id,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	Init       *InitInfo   `json:"init,omitempty"`
+	ToolUse    *ToolUse    `json:"tool_use,omitempty"`
+	ToolResult *ToolResult `json:"tool_result,omitempty"`
+	Result     *RunResult  `json:"result,omitempty"`
+}
+
+type InitInfo struct {
+	Model          string   `json:"model"`
+	Cwd            string   `json:"cwd"`
+	Tools          []string `json:"tools"`
+	PermissionMode string   `json:"permission_mode"`
+}
+
+type ToolUse struct {
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+type ToolResult struct {
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error"`
+}
+
+type Usage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// Total returns all tokens billed for the run, including cache reads and writes.
+func (u Usage) Total() int {
+	return u.InputTokens + u.OutputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+type RunResult struct {
+	Subtype    string  `json:"subtype"` // "success" | "error_max_turns" | "error_during_execution"
+	IsError    bool    `json:"is_error"`
+	Text       string  `json:"text"`
+	DurationMs int64   `json:"duration_ms"`
+	NumTurns   int     `json:"num_turns"`
+	CostUSD    float64 `json:"cost_usd"`
+	Usage      Usage   `json:"usage"`
+}
+
+// rawStreamLine mirrors the subset of the CLI stream-json schema we care about.
+type rawStreamLine struct {
+	Type      string `json:"type"`
+	Subtype   string `json:"subtype"`
+	SessionID string `json:"session_id"`
+
+	// system/init
+	Model          string   `json:"model"`
+	Cwd            string   `json:"cwd"`
+	Tools          []string `json:"tools"`
+	PermissionMode string   `json:"permissionMode"`
+
+	// assistant / user
+	Message *struct {
+		Content json.RawMessage `json:"content"`
+	} `json:"message"`
+
+	// stream_event (partial messages)
+	Event *struct {
+		Type  string `json:"type"`
+		Delta *struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"delta"`
+	} `json:"event"`
+
+	// result
+	IsError      bool    `json:"is_error"`
+	Result       string  `json:"result"`
+	DurationMs   int64   `json:"duration_ms"`
+	NumTurns     int     `json:"num_turns"`
+	TotalCostUSD float64 `json:"total_cost_usd"`
+	CostUSD      float64 `json:"cost_usd"` // older CLI versions
+	Usage        *Usage  `json:"usage"`
+}
+
+type rawContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+// ParseStreamLine decodes one stream-json line into typed events.
+// Lines of unknown type decode to no events and no error.
+func ParseStreamLine(line []byte) ([]ClaudeEvent, error) {
+	var raw rawStreamLine
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, err
+	}
+
+	switch raw.Type {
+	case "system":
+		if raw.Subtype != "init" {
+			return nil, nil
+		}
+		return []ClaudeEvent{{
+			Type:      EventInit,
+			SessionID: raw.SessionID,
+			Init: &InitInfo{
+				Model:          raw.Model,
+				Cwd:            raw.Cwd,
+				Tools:          raw.Tools,
+				PermissionMode: raw.PermissionMode,
+			},
+		}}, nil
+
+	case "assistant", "user":
+		if raw.Message == nil {
+			return nil, nil
+		}
+		// User messages with plain string content are prompts echoed back — skip them.
+		var blocks []rawContentBlock
+		if err := json.Unmarshal(raw.Message.Content, &blocks); err != nil {
+			return nil, nil
+		}
+		var events []ClaudeEvent
+		for _, b := range blocks {
+			switch b.Type {
+			case "text":
+				if raw.Type == "assistant" && b.Text != "" {
+					events = append(events, ClaudeEvent{Type: EventText, SessionID: raw.SessionID, Text: b.Text})
+				}
+			case "tool_use":
+				events = append(events, ClaudeEvent{
+					Type:      EventToolUse,
+					SessionID: raw.SessionID,
+					ToolUse:   &ToolUse{ID: b.ID, Name: b.Name, Input: b.Input},
+				})
+			case "tool_result":
+				events = append(events, ClaudeEvent{
+					Type:       EventToolResult,
+					SessionID:  raw.SessionID,
+					ToolResult: &ToolResult{ToolUseID: b.ToolUseID, Content: b.Content, IsError: b.IsError},
+				})
+			}
+		}
+		return events, nil
+
+	case "stream_event":
+		if raw.Event == nil || raw.Event.Delta == nil || raw.Event.Delta.Type != "text_delta" {
+			return nil, nil
+		}
+		return []ClaudeEvent{{Type: EventTextDelta, SessionID: raw.SessionID, Text: raw.Event.Delta.Text}}, nil
+
+	case "result":
+		res := &RunResult{
+			Subtype:    raw.Subtype,
+			IsError:    raw.IsError,
+			Text:       raw.Result,
+			DurationMs: raw.DurationMs,
+			NumTurns:   raw.NumTurns,
+			CostUSD:    raw.TotalCostUSD,
+		}
+		if res.CostUSD == 0 {
+			res.CostUSD = raw.CostUSD
+		}
+		if raw.Usage != nil {
+			res.Usage = *raw.Usage
+		}
+		return []ClaudeEvent{{Type: EventResult, SessionID: raw.SessionID, Result: res}}, nil
+	}
+
+	return nil, nil
+}
+
+// ToolCall is a tool invocation paired with its result, as persisted in Message.ToolUse.
+type ToolCall struct {
+	ID      string          `json:"id"`
+	Name    string          `json:"name"`
+	Input   json.RawMessage `json:"input,omitempty"`
+	Output  json.RawMessage `json:"output,omitempty"`
+	IsError bool            `json:"is_error,omitempty"`
+}
+
+// Transcript accumulates the events of one Claude run into the final assistant message.
+type Transcript struct {
+	SessionID string
+	ToolCalls []ToolCall
+	Result    *RunResult
+
+	textParts []string
+	toolIndex map[string]int // tool_use id → index in ToolCalls
+}
+
+func NewTranscript() *Transcript {
+	return &Transcript{toolIndex: make(map[string]int)}
+}
+
+// Add folds a single event into the transcript.
+func (t *Transcript) Add(ev ClaudeEvent) {
+	if ev.SessionID != "" {
+		t.SessionID = ev.SessionID
+	}
+
+	switch ev.Type {
+	case EventText:
+		t.textParts = append(t.textParts, ev.Text)
+	case EventToolUse:
+		t.toolIndex[ev.ToolUse.ID] = len(t.ToolCalls)
+		t.ToolCalls = append(t.ToolCalls, ToolCall{
+			ID:    ev.ToolUse.ID,
+			Name:  ev.ToolUse.Name,
+			Input: ev.ToolUse.Input,
+		})
+	case EventToolResult:
+		if i, ok := t.toolIndex[ev.ToolResult.ToolUseID]; ok {
+			t.ToolCalls[i].Output = ev.ToolResult.Content
+			t.ToolCalls[i].IsError = ev.ToolResult.IsError
+		}
+	case EventResult:
+		t.Result = ev.Result
+	}
+}
+
+// Text returns the assistant text of the run: all text blocks joined by blank lines,
+// or the result text when the CLI produced no separate text blocks.
+func (t *Transcript) Text() string {
+	if len(t.textParts) > 0 {
+		return strings.Join(t.textParts, "\n\n")
+	}
+	if t.Result != nil {
+		return t.Result.Text
+	}
+	return ""
+}
+
+// Usage returns token usage reported by the result event (zero if the run didn't finish).
+func (t *Transcript) Usage() Usage {
+	if t.Result == nil {
+		return Usage{}
+	}
+	return t.Result.Usage
+}
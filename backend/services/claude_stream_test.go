@@ -0,0 +1,121 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStreamLine_SystemInit(t *testing.T) {
+	line := `{"type":"system","subtype":"init","session_id":"s1","model":"claude-sonnet","cwd":"/ws","tools":["Read","Bash"],"permissionMode":"default"}`
+
+	events, err := ParseStreamLine([]byte(line))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	assert.Equal(t, EventInit, events[0].Type)
+	assert.Equal(t, "s1", events[0].SessionID)
+	assert.Equal(t, "claude-sonnet", events[0].Init.Model)
+	assert.Equal(t, []string{"Read", "Bash"}, events[0].Init.Tools)
+}
+
+func TestParseStreamLine_AssistantTextAndToolUse(t *testing.T) {
+	line := `{"type":"assistant","session_id":"s1","message":{"content":[` +
+		`{"type":"text","text":"Reading the file."},` +
+		`{"type":"tool_use","id":"tu1","name":"Read","input":{"file_path":"main.go"}}]}}`
+
+	events, err := ParseStreamLine([]byte(line))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	assert.Equal(t, EventText, events[0].Type)
+	assert.Equal(t, "Reading the file.", events[0].Text)
+
+	assert.Equal(t, EventToolUse, events[1].Type)
+	assert.Equal(t, "tu1", events[1].ToolUse.ID)
+	assert.Equal(t, "Read", events[1].ToolUse.Name)
+	assert.JSONEq(t, `{"file_path":"main.go"}`, string(events[1].ToolUse.Input))
+}
+
+func TestParseStreamLine_ToolResult(t *testing.T) {
+	line := `{"type":"user","session_id":"s1","message":{"content":[{"type":"tool_result","tool_use_id":"tu1","content":"package main","is_error":false}]}}`
+
+	events, err := ParseStreamLine([]byte(line))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	assert.Equal(t, EventToolResult, events[0].Type)
+	assert.Equal(t, "tu1", events[0].ToolResult.ToolUseID)
+	assert.JSONEq(t, `"package main"`, string(events[0].ToolResult.Content))
+}
+
+func TestParseStreamLine_Result(t *testing.T) {
+	line := `{"type":"result","subtype":"success","is_error":false,"duration_ms":1200,"num_turns":2,` +
+		`"result":"Done.","session_id":"s1","total_cost_usd":0.0123,` +
+		`"usage":{"input_tokens":10,"output_tokens":20,"cache_creation_input_tokens":30,"cache_read_input_tokens":40}}`
+
+	events, err := ParseStreamLine([]byte(line))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	res := events[0].Result
+	require.NotNil(t, res)
+	assert.Equal(t, "success", res.Subtype)
+	assert.Equal(t, "Done.", res.Text)
+	assert.Equal(t, int64(1200), res.DurationMs)
+	assert.InDelta(t, 0.0123, res.CostUSD, 1e-9)
+	assert.Equal(t, 100, res.Usage.Total())
+}
+
+func TestParseStreamLine_TextDelta(t *testing.T) {
+	line := `{"type":"stream_event","session_id":"s1","event":{"type":"content_block_delta","delta":{"type":"text_delta","text":"Hel"}}}`
+
+	events, err := ParseStreamLine([]byte(line))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, EventTextDelta, events[0].Type)
+	assert.Equal(t, "Hel", events[0].Text)
+}
+
+func TestParseStreamLine_UnknownAndInvalid(t *testing.T) {
+	events, err := ParseStreamLine([]byte(`{"type":"system","subtype":"compact_boundary"}`))
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	_, err = ParseStreamLine([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestTranscript_CollectsTextToolCallsAndUsage(t *testing.T) {
+	lines := []string{
+		`{"type":"system","subtype":"init","session_id":"s1"}`,
+		`{"type":"assistant","session_id":"s1","message":{"content":[{"type":"text","text":"Let me check."},{"type":"tool_use","id":"tu1","name":"Bash","input":{"command":"ls"}}]}}`,
+		`{"type":"user","session_id":"s1","message":{"content":[{"type":"tool_result","tool_use_id":"tu1","content":"main.go","is_error":false}]}}`,
+		`{"type":"assistant","session_id":"s1","message":{"content":[{"type":"text","text":"There is one file."}]}}`,
+		`{"type":"result","subtype":"success","result":"There is one file.","session_id":"s1","usage":{"input_tokens":5,"output_tokens":7}}`,
+	}
+
+	tr := NewTranscript()
+	for _, l := range lines {
+		events, err := ParseStreamLine([]byte(l))
+		require.NoError(t, err)
+		for _, ev := range events {
+			tr.Add(ev)
+		}
+	}
+
+	assert.Equal(t, "s1", tr.SessionID)
+	assert.Equal(t, "Let me check.\n\nThere is one file.", tr.Text())
+	require.Len(t, tr.ToolCalls, 1)
+	assert.Equal(t, "Bash", tr.ToolCalls[0].Name)
+	assert.JSONEq(t, `"main.go"`, string(tr.ToolCalls[0].Output))
+	assert.Equal(t, 12, tr.Usage().Total())
+}
+
+func TestTranscript_FallsBackToResultText(t *testing.T) {
+	tr := NewTranscript()
+	tr.Add(ClaudeEvent{Type: EventResult, Result: &RunResult{Text: "only result"}})
+
+	assert.Equal(t, "only result", tr.Text())
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ── PermissionBroker: routes the CLI's tool-permission prompts to the user ──
+//
+// Each session gets a secret token, stable across runs so a long-lived CLI
+// process keeps a valid MCP URL between turns. The CLI calls our MCP
+// permission tool (see handlers/mcp.go) with that token whenever it wants a
+// tool outside its allow-list; the broker forwards the request to the chat
+// WebSocket and blocks until the user answers, the run ends or the timeout
+// expires.
+
+var (
+	ErrUnknownPermissionRun     = errors.New("unknown permission token")
+	ErrUnknownPermissionRequest = errors.New("unknown permission request")
+)
+
+const (
+	PermissionAllow = "allow"
+	PermissionDeny  = "deny"
+)
+
+type PermissionRequest struct {
+	ID        string          `json:"request_id"`
+	ToolName  string          `json:"tool_name"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+}
+
+type PermissionDecision struct {
+	Behavior string // PermissionAllow | PermissionDeny
+	Always   bool   // allow this tool for the rest of the session
+	Message  string // shown to Claude on deny
+}
+
+type permissionRun struct {
+	sessionKey string
+	onRequest  func(PermissionRequest)
+	allowed    map[string]bool // tools approved "always" while this run is active
+}
+
+type pendingPermission struct {
+	token      string
+	sessionKey string
+	toolName   string
+	answer     chan PermissionDecision
+}
+
+type PermissionBroker struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	runs    map[string]*permissionRun     // token → run in progress
+	tokens  map[string]string             // sessionKey → token
+	pending map[string]*pendingPermission // request ID → waiter
+}
+
+func NewPermissionBroker(timeout time.Duration) *PermissionBroker {
+	return &PermissionBroker{
+		timeout: timeout,
+		runs:    make(map[string]*permissionRun),
+		tokens:  make(map[string]string),
+		pending: make(map[string]*pendingPermission),
+	}
+}
+
+// Timeout is how long a prompt waits for the user before it is denied.
+func (b *PermissionBroker) Timeout() time.Duration {
+	return b.timeout
+}
+
+// OpenRun registers a run and returns the session's token the CLI must present.
+// onRequest is called (outside the broker lock) for every prompt that needs the user.
+func (b *PermissionBroker) OpenRun(sessionKey string, onRequest func(PermissionRequest)) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	token, ok := b.tokens[sessionKey]
+	if !ok {
+		buf := make([]byte, 32)
+		rand.Read(buf)
+		token = hex.EncodeToString(buf)
+		b.tokens[sessionKey] = token
+	}
+	b.runs[token] = &permissionRun{
+		sessionKey: sessionKey,
+		onRequest:  onRequest,
+		allowed:    make(map[string]bool),
+	}
+	return token
+}
+
+// CloseRun ends a run; prompts still waiting are denied. The token stays
+// reserved for the session's next run.
+func (b *PermissionBroker) CloseRun(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.runs, token)
+	for id, p := range b.pending {
+		if p.token == token {
+			delete(b.pending, id)
+			p.answer <- PermissionDecision{Behavior: PermissionDeny, Message: "Run ended"}
+		}
+	}
+}
+
+// Request asks the user whether the run identified by token may use a tool.
+// It blocks until answered, ctx is done or the broker timeout expires (deny).
+func (b *PermissionBroker) Request(ctx context.Context, token, toolName string, input json.RawMessage, toolUseID string) (PermissionDecision, error) {
+	b.mu.Lock()
+	run, ok := b.runs[token]
+	if !ok {
+		b.mu.Unlock()
+		return PermissionDecision{}, ErrUnknownPermissionRun
+	}
+	if run.allowed[toolName] {
+		b.mu.Unlock()
+		return PermissionDecision{Behavior: PermissionAllow}, nil
+	}
+
+	req := PermissionRequest{ID: uuid.NewString(), ToolName: toolName, Input: input, ToolUseID: toolUseID}
+	p := &pendingPermission{
+		token:      token,
+		sessionKey: run.sessionKey,
+		toolName:   toolName,
+		answer:     make(chan PermissionDecision, 1),
+	}
+	b.pending[req.ID] = p
+	onRequest := run.onRequest
+	b.mu.Unlock()
+
+	onRequest(req)
+
+	timer := time.NewTimer(b.timeout)
+	defer timer.Stop()
+
+	select {
+	case d := <-p.answer:
+		return d, nil
+	case <-timer.C:
+		b.drop(req.ID)
+		return PermissionDecision{Behavior: PermissionDeny, Message: "Permission request timed out"}, nil
+	case <-ctx.Done():
+		b.drop(req.ID)
+		return PermissionDecision{}, ctx.Err()
+	}
+}
+
+func (b *PermissionBroker) drop(requestID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, requestID)
+}
+
+// Answer resolves a pending prompt. sessionKey must match the run that asked,
+// so one session can't answer another's prompts. Returns the tool name asked about.
+func (b *PermissionBroker) Answer(sessionKey, requestID string, d PermissionDecision) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.pending[requestID]
+	if !ok || p.sessionKey != sessionKey {
+		return "", ErrUnknownPermissionRequest
+	}
+	delete(b.pending, requestID)
+
+	if d.Behavior == PermissionAllow && d.Always {
+		if run, ok := b.runs[p.token]; ok {
+			run.allowed[p.toolName] = true
+		}
+	}
+	p.answer <- d
+	return p.toolName, nil
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestRun registers a run whose prompts are delivered on the returned channel.
+func openTestRun(b *PermissionBroker, sessionKey string) (string, <-chan PermissionRequest) {
+	requests := make(chan PermissionRequest, 4)
+	token := b.OpenRun(sessionKey, func(req PermissionRequest) { requests <- req })
+	return token, requests
+}
+
+func requestAsync(b *PermissionBroker, token, tool string) <-chan PermissionDecision {
+	ch := make(chan PermissionDecision, 1)
+	go func() {
+		d, err := b.Request(context.Background(), token, tool, json.RawMessage(`{"command":"ls"}`), "toolu_1")
+		if err == nil {
+			ch <- d
+		}
+	}()
+	return ch
+}
+
+func TestPermissionBroker_AllowOnce(t *testing.T) {
+	b := NewPermissionBroker(time.Minute)
+	token, requests := openTestRun(b, "s1:u1")
+
+	result := requestAsync(b, token, "Bash")
+	req := <-requests
+	assert.Equal(t, "Bash", req.ToolName)
+	assert.JSONEq(t, `{"command":"ls"}`, string(req.Input))
+
+	tool, err := b.Answer("s1:u1", req.ID, PermissionDecision{Behavior: PermissionAllow})
+	require.NoError(t, err)
+	assert.Equal(t, "Bash", tool)
+	assert.Equal(t, PermissionAllow, (<-result).Behavior)
+
+	// Allow-once doesn't cover the next call.
+	requestAsync(b, token, "Bash")
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("expected a second prompt")
+	}
+}
+
+func TestPermissionBroker_AllowAlwaysSkipsLaterPrompts(t *testing.T) {
+	b := NewPermissionBroker(time.Minute)
+	token, requests := openTestRun(b, "s1:u1")
+
+	result := requestAsync(b, token, "WebFetch")
+	req := <-requests
+	_, err := b.Answer("s1:u1", req.ID, PermissionDecision{Behavior: PermissionAllow, Always: true})
+	require.NoError(t, err)
+	<-result
+
+	d, err := b.Request(context.Background(), token, "WebFetch", nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, PermissionAllow, d.Behavior)
+	assert.Empty(t, requests)
+}
+
+func TestPermissionBroker_WrongSessionCannotAnswer(t *testing.T) {
+	b := NewPermissionBroker(time.Minute)
+	token, requests := openTestRun(b, "s1:u1")
+
+	requestAsync(b, token, "Bash")
+	req := <-requests
+
+	_, err := b.Answer("s2:u2", req.ID, PermissionDecision{Behavior: PermissionAllow})
+	assert.ErrorIs(t, err, ErrUnknownPermissionRequest)
+}
+
+func TestPermissionBroker_TimeoutDenies(t *testing.T) {
+	b := NewPermissionBroker(20 * time.Millisecond)
+	token, _ := openTestRun(b, "s1:u1")
+
+	d, err := b.Request(context.Background(), token, "Bash", nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, PermissionDeny, d.Behavior)
+}
+
+func TestPermissionBroker_CloseRunDeniesPending(t *testing.T) {
+	b := NewPermissionBroker(time.Minute)
+	token, requests := openTestRun(b, "s1:u1")
+
+	result := requestAsync(b, token, "Bash")
+	<-requests
+	b.CloseRun(token)
+
+	assert.Equal(t, PermissionDeny, (<-result).Behavior)
+
+	_, err := b.Request(context.Background(), token, "Bash", nil, "")
+	assert.ErrorIs(t, err, ErrUnknownPermissionRun)
+}
+
+func TestPermissionBroker_TokenStablePerSession(t *testing.T) {
+	b := NewPermissionBroker(time.Minute)
+
+	first, _ := openTestRun(b, "s1:u1")
+	b.CloseRun(first)
+	second, _ := openTestRun(b, "s1:u1")
+	other, _ := openTestRun(b, "s2:u1")
+
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"syscall"
+
+	"nebulide/models"
+)
+
+// SandboxInitArg is the argument the server binary is re-executed with to
+// become the init process of a sandbox (see RunSandboxInit).
+const SandboxInitArg = "nebulide-sandbox-init"
+
+// sandboxSpecEnv carries the sandboxSpec from the server to the sandbox init.
+const sandboxSpecEnv = "NEBULIDE_SANDBOX"
+
+// SandboxOptions configures the process sandbox.
+type SandboxOptions struct {
+	CgroupRoot string        // cgroup v2 directory holding one group per user ("" = no limits)
+	Network    bool          // let terminals use the host network
+	Defaults   SandboxLimits // limits of users without overrides
+	UID, GID   int           // who processes run as when the workspace has no UID of its own; never root
+}
+
+// SandboxLimits caps all of one user's sandboxed processes together
+// (0 = unlimited).
+type SandboxLimits struct {
+	MemoryMB   int64 `json:"memory_mb"`
+	CPUPercent int   `json:"cpu_percent"` // 100 = one full core
+	Pids       int64 `json:"pids"`
+}
+
+// With applies a user's overrides to the limits.
+func (l SandboxLimits) With(o models.SandboxLimits) SandboxLimits {
+	if o.MemoryMB != nil {
+		l.MemoryMB = *o.MemoryMB
+	}
+	if o.CPUPercent != nil {
+		l.CPUPercent = *o.CPUPercent
+	}
+	if o.Pids != nil {
+		l.Pids = *o.Pids
+	}
+	return l
+}
+
+// Sandbox starts users' terminals and Claude processes in their own mount,
+// PID, IPC, UTS and (for terminals) network namespaces, inside a per-user
+// cgroup. The process is started through a re-exec of the server binary
+// that sets up the namespaces as root and then runs the real command as the
+// workspace's user, staying behind as its PID 1: when it exits, everything
+// left in the sandbox is killed with it.
+type Sandbox struct {
+	opts SandboxOptions
+}
+
+// Limits returns the effective limits of a user with the given overrides.
+func (s *Sandbox) Limits(o models.SandboxLimits) SandboxLimits {
+	return s.opts.Defaults.With(o)
+}
+
+// SandboxProcess describes a process to start in a workspace's sandbox.
+type SandboxProcess struct {
+	Path        string   // looked up in the sandbox's PATH unless absolute
+	Args        []string // including Args[0]
+	Env         []string
+	Dir         string
+	HostNetwork bool // always share the server's network (the Claude CLI has to reach the API)
+}
+
+// SandboxedCommand is a process rewritten to start through the sandbox
+// init. Copy its fields onto the exec.Cmd (or pty command) and call Close
+// once the process was started.
+type SandboxedCommand struct {
+	Path        string
+	Args        []string
+	Env         []string
+	SysProcAttr *syscall.SysProcAttr
+
+	// What SysProcAttr sets up, for starting the process elsewhere (the
+	// terminal daemon): the namespaces to create and the cgroup to start in.
+	Cloneflags uintptr
+	CgroupDir  string
+
+	release func() // closes the cgroup handle in SysProcAttr
+}
+
+// Close releases the handles only needed to start the process.
+func (c *SandboxedCommand) Close() {
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
+
+// sandboxSpec tells the sandbox init what to set up and run.
+type sandboxSpec struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args"`
+	Dir     string   `json:"dir"`
+	Hide    string   `json:"hide,omitempty"` // replaced by an empty tmpfs...
+	Keep    []string `json:"keep,omitempty"` // ...except for these directories below it
+	Network bool     `json:"network"`        // host network shared: don't set up loopback
+	UID     int      `json:"uid"`
+	GID     int      `json:"gid"`
+}
+
+// SandboxCommand rewrites a process to start in the user's sandbox. With
+// per-user workspaces, the other users' workspaces are hidden from it. The
+// shared workspace is everyone's, so there the sandbox hides nothing: it
+// only separates processes, network and resources. Processes of workspaces
+// without a UID of their own run as the sandbox's unprivileged UID, never
+// as root.
+func (w *Workspace) SandboxCommand(p SandboxProcess) (*SandboxedCommand, error) {
+	spec := sandboxSpec{
+		Path:    p.Path,
+		Args:    p.Args,
+		Dir:     p.Dir,
+		Network: p.HostNetwork || w.sandbox.opts.Network,
+	}
+	spec.UID, spec.GID = w.ProcessOwner()
+	if w.perUser {
+		spec.Hide = w.base
+		spec.Keep = []string{w.Dir}
+	}
+	return w.sandbox.command(w, spec, p.Env)
+}
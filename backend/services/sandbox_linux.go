@@ -0,0 +1,297 @@
+//go:build linux
+
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cgroup2Magic = 0x63677270
+	cpuPeriod    = 100000 // µs, the kernel's default cpu.max period
+)
+
+// Controllers the per-user cgroups use.
+var sandboxControllers = []string{"cpu", "memory", "pids"}
+
+// NewSandbox checks that the server can set up sandboxes and prepares the
+// cgroup root.
+func NewSandbox(opts SandboxOptions) (*Sandbox, error) {
+	if os.Geteuid() != 0 {
+		return nil, errors.New("the sandbox needs the server to run as root")
+	}
+	if opts.UID <= 0 || opts.GID <= 0 {
+		return nil, errors.New("the sandbox needs an unprivileged UID/GID to run processes as, not root")
+	}
+	if opts.CgroupRoot != "" {
+		if err := setupCgroupRoot(opts.CgroupRoot); err != nil {
+			return nil, fmt.Errorf("cgroup root %s: %w", opts.CgroupRoot, err)
+		}
+	}
+	return &Sandbox{opts: opts}, nil
+}
+
+// setupCgroupRoot creates the cgroup users' groups live in and lets them
+// use the cpu, memory and pids controllers.
+func setupCgroupRoot(root string) error {
+	parent := filepath.Dir(root)
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(parent, &st); err != nil {
+		return err
+	}
+	if st.Type != cgroup2Magic {
+		return fmt.Errorf("%s is not a cgroup v2 hierarchy", parent)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	for _, dir := range []string{parent, root} {
+		for _, c := range sandboxControllers {
+			err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+c), 0)
+			if errors.Is(err, syscall.EBUSY) {
+				return fmt.Errorf("enable %s in %s: the group has processes of its own, run the server in a child group", c, dir)
+			}
+			if err != nil {
+				return fmt.Errorf("enable %s in %s: %w", c, dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// cgroupLimitFiles maps the cgroup v2 interface files to their values for
+// the given limits.
+func cgroupLimitFiles(l SandboxLimits) map[string]string {
+	files := map[string]string{
+		"memory.max": "max",
+		"cpu.max":    fmt.Sprintf("max %d", cpuPeriod),
+		"pids.max":   "max",
+	}
+	if l.MemoryMB > 0 {
+		files["memory.max"] = strconv.FormatInt(l.MemoryMB*1024*1024, 10)
+	}
+	if l.CPUPercent > 0 {
+		files["cpu.max"] = fmt.Sprintf("%d %d", l.CPUPercent*cpuPeriod/100, cpuPeriod)
+	}
+	if l.Pids > 0 {
+		files["pids.max"] = strconv.FormatInt(l.Pids, 10)
+	}
+	return files
+}
+
+// userCgroup creates the user's cgroup and applies their current limits.
+func (s *Sandbox) userCgroup(w *Workspace) (string, error) {
+	dir := filepath.Join(s.opts.CgroupRoot, w.UserID.String())
+	if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", err
+	}
+	for name, value := range cgroupLimitFiles(w.limits) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0); err != nil {
+			return "", fmt.Errorf("set %s: %w", name, err)
+		}
+	}
+	return dir, nil
+}
+
+func (s *Sandbox) command(w *Workspace, spec sandboxSpec, env []string) (*SandboxedCommand, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	flags := syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !spec.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd := &SandboxedCommand{
+		Path:        "/proc/self/exe",
+		Args:        []string{os.Args[0], SandboxInitArg},
+		Env:         append(append([]string{}, env...), sandboxSpecEnv+"="+string(data)),
+		SysProcAttr: &syscall.SysProcAttr{},
+		Cloneflags:  uintptr(flags),
+	}
+	if s.opts.CgroupRoot != "" {
+		if cmd.CgroupDir, err = s.userCgroup(w); err != nil {
+			return nil, fmt.Errorf("sandbox cgroup: %w", err)
+		}
+	}
+	if cmd.release, err = sandboxAttr(cmd.SysProcAttr, cmd.Cloneflags, cmd.CgroupDir); err != nil {
+		return nil, fmt.Errorf("sandbox cgroup: %w", err)
+	}
+	return cmd, nil
+}
+
+// sandboxAttr makes a process start in new namespaces and, unless cgroupDir
+// is empty, straight in that cgroup. The returned func closes the cgroup
+// handle once the process was started.
+func sandboxAttr(attr *syscall.SysProcAttr, cloneflags uintptr, cgroupDir string) (func(), error) {
+	attr.Cloneflags = cloneflags
+	if cgroupDir == "" {
+		return func() {}, nil
+	}
+	f, err := os.Open(cgroupDir)
+	if err != nil {
+		return nil, err
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(f.Fd())
+	return func() { f.Close() }, nil
+}
+
+// RunSandboxInit is the sandbox's PID 1: it sets up the mounts and network
+// described by the server, runs the command as the workspace's user,
+// forwards termination signals to it and reaps orphans until it exits.
+// It never returns.
+func RunSandboxInit() {
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxSpecEnv)), &spec); err != nil {
+		sandboxFail("bad spec: %v", err)
+	}
+	os.Unsetenv(sandboxSpecEnv)
+
+	if err := spec.setup(); err != nil {
+		sandboxFail("%v", err)
+	}
+	path, err := exec.LookPath(spec.Path)
+	if err != nil {
+		sandboxFail("%v", err)
+	}
+
+	if spec.UID <= 0 || spec.GID <= 0 {
+		sandboxFail("refusing to run %s as root", spec.Path)
+	}
+	attr := &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(spec.UID), Gid: uint32(spec.GID), Groups: []uint32{}},
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	proc, err := os.StartProcess(path, spec.Args, &os.ProcAttr{
+		Dir:   spec.Dir,
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   attr,
+	})
+	if err != nil {
+		sandboxFail("%v", err)
+	}
+	go func() {
+		for sig := range signals {
+			proc.Signal(sig)
+		}
+	}()
+	os.Exit(reapUntil(proc.Pid))
+}
+
+func sandboxFail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "sandbox: "+format+"\n", args...)
+	os.Exit(126)
+}
+
+// setup runs in the fresh namespaces, still as root.
+func (spec *sandboxSpec) setup() error {
+	// Keep our mounts from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	if spec.Hide != "" {
+		if err := hideExcept(spec.Hide, spec.Keep); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+	if !spec.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bring up loopback: %w", err)
+		}
+	}
+	return nil
+}
+
+// hideExcept covers dir with an empty tmpfs and bind-mounts the keep
+// directories back into it. Missing ones are skipped.
+func hideExcept(dir string, keep []string) error {
+	// Once dir is covered they can't be reached by path, so open them first.
+	kept := make(map[string]*os.File)
+	for _, k := range keep {
+		f, err := os.Open(k)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		kept[k] = f
+	}
+
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=755,size=1m"); err != nil {
+		return fmt.Errorf("hide %s: %w", dir, err)
+	}
+	for k, f := range kept {
+		if err := os.MkdirAll(k, 0755); err != nil {
+			return err
+		}
+		src := fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+		if err := syscall.Mount(src, k, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// loopbackUp brings up lo in a new network namespace, where it starts down.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// reapUntil waits for any child until pid exits, and returns an exit code
+// for it the way a shell would.
+func reapUntil(pid int) int {
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 1
+		}
+		if wpid != pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The sandbox re-executes the running binary, which is the test binary here.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SandboxInitArg {
+		RunSandboxInit()
+	}
+	os.Exit(m.Run())
+}
+
+func runSandboxed(t *testing.T, ws *Workspace, script string) (string, error) {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Dir = ws.Dir
+	sandboxed, err := ws.SandboxCommand(SandboxProcess{Path: cmd.Path, Args: cmd.Args, Env: os.Environ(), Dir: cmd.Dir})
+	require.NoError(t, err)
+	defer sandboxed.Close()
+	cmd.Path, cmd.Args, cmd.Env, cmd.SysProcAttr = sandboxed.Path, sandboxed.Args, sandboxed.Env, sandboxed.SysProcAttr
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// traversableTempDir is a temp dir the unprivileged sandbox user can enter.
+func traversableTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(filepath.Dir(dir), 0755))
+	require.NoError(t, os.Chmod(dir, 0755))
+	return dir
+}
+
+func TestSandbox_IsolatesProcesses(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the sandbox needs root")
+	}
+	sandbox, err := NewSandbox(SandboxOptions{UID: 65534, GID: 65534})
+	require.NoError(t, err)
+
+	base := traversableTempDir(t)
+	alice, bob := filepath.Join(base, "alice"), filepath.Join(base, "bob")
+	require.NoError(t, os.MkdirAll(alice, 0700))
+	require.NoError(t, os.Chown(alice, 65534, 65534))
+	require.NoError(t, os.MkdirAll(bob, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(bob, "secret"), []byte("x"), 0600))
+	ws := &Workspace{UserID: uuid.New(), Dir: alice, UID: -1, GID: -1, perUser: true, base: base, sandbox: sandbox}
+
+	out, err := runSandboxed(t, ws, `ls -A `+base+`; echo "cwd=$(pwd)"; tail -n +3 /proc/net/dev | cut -d: -f1; tr '\0' ' ' < /proc/1/cmdline`)
+	if err != nil && strings.Contains(out, "operation not permitted") {
+		t.Skip("namespaces are not available here: " + out)
+	}
+	require.NoError(t, err, out)
+
+	// The shell sees just its own workspace, only loopback is up and the
+	// sandbox init is PID 1 of its own PID namespace.
+	lines := strings.Fields(out)
+	require.Len(t, lines, 5, out)
+	assert.Equal(t, []string{"alice", "cwd=" + alice, "lo"}, lines[:3])
+	assert.Equal(t, SandboxInitArg, lines[4])
+	_, err = os.Stat(filepath.Join(bob, "secret"))
+	assert.NoError(t, err, "hiding must not touch the host's mounts")
+}
+
+func TestSandbox_NeverRunsAsRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the sandbox needs root")
+	}
+	_, err := NewSandbox(SandboxOptions{})
+	assert.Error(t, err, "no fallback UID")
+	sandbox, err := NewSandbox(SandboxOptions{UID: 65534, GID: 65534})
+	require.NoError(t, err)
+
+	// A shared workspace has no UID of its own: its processes get the
+	// sandbox's unprivileged one instead of the server's root.
+	ws := &Workspace{UserID: uuid.New(), Dir: traversableTempDir(t), UID: -1, GID: -1, sandbox: sandbox}
+	out, err := runSandboxed(t, ws, `id -u; id -g`)
+	if err != nil && strings.Contains(out, "operation not permitted") {
+		t.Skip("namespaces are not available here: " + out)
+	}
+	require.NoError(t, err, out)
+	assert.Equal(t, []string{"65534", "65534"}, strings.Fields(out))
+}
+
+func TestSandbox_CgroupLimitFiles(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"memory.max": "536870912",
+		"cpu.max":    "150000 100000",
+		"pids.max":   "max",
+	}, cgroupLimitFiles(SandboxLimits{MemoryMB: 512, CPUPercent: 150}))
+
+	assert.Equal(t, map[string]string{
+		"memory.max": "max",
+		"cpu.max":    "max 100000",
+		"pids.max":   "64",
+	}, cgroupLimitFiles(SandboxLimits{Pids: 64}))
+}
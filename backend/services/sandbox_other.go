@@ -0,0 +1,30 @@
+//go:build !linux
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var errSandboxUnsupported = errors.New("the sandbox is only supported on Linux")
+
+func NewSandbox(opts SandboxOptions) (*Sandbox, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (s *Sandbox) command(w *Workspace, spec sandboxSpec, env []string) (*SandboxedCommand, error) {
+	return nil, errSandboxUnsupported
+}
+
+func sandboxAttr(attr *syscall.SysProcAttr, cloneflags uintptr, cgroupDir string) (func(), error) {
+	return nil, errSandboxUnsupported
+}
+
+// RunSandboxInit exists for main's sake; no sandbox is ever started here.
+func RunSandboxInit() {
+	fmt.Fprintln(os.Stderr, "sandbox:", errSandboxUnsupported)
+	os.Exit(126)
+}
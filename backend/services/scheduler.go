@@ -0,0 +1,271 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ── ProcessScheduler: caps concurrent Claude processes, globally and per user ──
+//
+// Waiting runs are dispatched round-robin across users, so one user queueing
+// many runs can't starve everyone else. Within a user, runs start in FIFO order.
+
+type ProcessScheduler struct {
+	maxGlobal  int
+	maxPerUser int
+
+	mu      sync.Mutex
+	running int
+	perUser map[string]int           // userID → running processes
+	waiting map[string][]*slotTicket // userID → FIFO of waiting runs
+	ring    []string                 // users with waiting runs, in round-robin order
+	next    int                      // ring index to serve first on the next dispatch
+}
+
+type slotTicket struct {
+	userID     string
+	sessionKey string
+	queuedAt   time.Time
+	ready      chan struct{}
+	onPosition func(position int)
+	position   int
+}
+
+// WaitingRun describes a run waiting for a process slot (for admin metrics).
+type WaitingRun struct {
+	UserID     string    `json:"user_id"`
+	SessionKey string    `json:"session_key"`
+	Position   int       `json:"position"`
+	QueuedAt   time.Time `json:"queued_at"`
+}
+
+type SchedulerStats struct {
+	MaxGlobal  int            `json:"max_global"`
+	MaxPerUser int            `json:"max_per_user"`
+	Running    int            `json:"running"`
+	Waiting    int            `json:"waiting"`
+	PerUser    map[string]int `json:"running_per_user"`
+	Queue      []WaitingRun   `json:"queue"`
+}
+
+// NewProcessScheduler creates a scheduler. A limit <= 0 means unlimited.
+func NewProcessScheduler(maxGlobal, maxPerUser int) *ProcessScheduler {
+	return &ProcessScheduler{
+		maxGlobal:  maxGlobal,
+		maxPerUser: maxPerUser,
+		perUser:    make(map[string]int),
+		waiting:    make(map[string][]*slotTicket),
+	}
+}
+
+// Acquire blocks until a process slot is free for the user or ctx is done.
+// While waiting, onPosition is called with the 1-based queue position each
+// time it changes. The returned release func must be called exactly once.
+func (s *ProcessScheduler) Acquire(ctx context.Context, userID, sessionKey string, onPosition func(position int)) (func(), error) {
+	s.mu.Lock()
+	if len(s.waiting[userID]) == 0 && s.canRunLocked(userID) {
+		s.startLocked(userID)
+		s.mu.Unlock()
+		return s.releaseFunc(userID), nil
+	}
+
+	t := &slotTicket{
+		userID:     userID,
+		sessionKey: sessionKey,
+		queuedAt:   time.Now(),
+		ready:      make(chan struct{}),
+		onPosition: onPosition,
+	}
+	if len(s.waiting[userID]) == 0 {
+		s.ring = append(s.ring, userID)
+	}
+	s.waiting[userID] = append(s.waiting[userID], t)
+	notify := s.positionsLocked()
+	s.mu.Unlock()
+	notify()
+
+	select {
+	case <-t.ready:
+		return s.releaseFunc(userID), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-t.ready:
+			// Dispatched concurrently with cancellation — give the slot back.
+			s.mu.Unlock()
+			s.releaseFunc(userID)()
+			return nil, ctx.Err()
+		default:
+		}
+		s.removeLocked(t)
+		notify := s.positionsLocked()
+		s.mu.Unlock()
+		notify()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *ProcessScheduler) releaseFunc(userID string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.running--
+			s.perUser[userID]--
+			if s.perUser[userID] <= 0 {
+				delete(s.perUser, userID)
+			}
+			s.dispatchLocked()
+			notify := s.positionsLocked()
+			s.mu.Unlock()
+			notify()
+		})
+	}
+}
+
+func (s *ProcessScheduler) canRunLocked(userID string) bool {
+	if s.maxGlobal > 0 && s.running >= s.maxGlobal {
+		return false
+	}
+	if s.maxPerUser > 0 && s.perUser[userID] >= s.maxPerUser {
+		return false
+	}
+	return true
+}
+
+func (s *ProcessScheduler) startLocked(userID string) {
+	s.running++
+	s.perUser[userID]++
+}
+
+// dispatchLocked hands free slots to waiting runs, one user at a time in ring order.
+func (s *ProcessScheduler) dispatchLocked() {
+	for len(s.ring) > 0 && (s.maxGlobal <= 0 || s.running < s.maxGlobal) {
+		served := false
+		for i := 0; i < len(s.ring); i++ {
+			idx := (s.next + i) % len(s.ring)
+			userID := s.ring[idx]
+			if !s.canRunLocked(userID) {
+				continue
+			}
+			t := s.waiting[userID][0]
+			s.removeLocked(t)
+			s.startLocked(userID)
+			close(t.ready)
+
+			// Continue after this user next time (removeLocked may have shrunk the ring).
+			if len(s.ring) > 0 {
+				if _, still := s.waiting[userID]; still {
+					s.next = (idx + 1) % len(s.ring)
+				} else {
+					s.next = idx % len(s.ring)
+				}
+			}
+			served = true
+			break
+		}
+		if !served {
+			return // every waiting user is at their per-user cap
+		}
+	}
+}
+
+func (s *ProcessScheduler) removeLocked(t *slotTicket) {
+	queue := s.waiting[t.userID]
+	for i, other := range queue {
+		if other == t {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		s.waiting[t.userID] = queue
+		return
+	}
+
+	delete(s.waiting, t.userID)
+	for i, u := range s.ring {
+		if u == t.userID {
+			s.ring = append(s.ring[:i], s.ring[i+1:]...)
+			if i < s.next {
+				s.next--
+			}
+			break
+		}
+	}
+	if len(s.ring) == 0 || s.next >= len(s.ring) {
+		s.next = 0
+	}
+}
+
+// orderLocked returns waiting tickets in the order they would be dispatched
+// (round-robin over users, ignoring per-user caps).
+func (s *ProcessScheduler) orderLocked() []*slotTicket {
+	var order []*slotTicket
+	depth := 0
+	for {
+		added := false
+		for i := 0; i < len(s.ring); i++ {
+			queue := s.waiting[s.ring[(s.next+i)%len(s.ring)]]
+			if depth < len(queue) {
+				order = append(order, queue[depth])
+				added = true
+			}
+		}
+		if !added {
+			return order
+		}
+		depth++
+	}
+}
+
+// positionsLocked recomputes queue positions and returns a func that delivers
+// changed positions to their callbacks. Call it after releasing the lock.
+func (s *ProcessScheduler) positionsLocked() func() {
+	type update struct {
+		fn  func(int)
+		pos int
+	}
+	var updates []update
+	for i, t := range s.orderLocked() {
+		if t.position != i+1 {
+			t.position = i + 1
+			if t.onPosition != nil {
+				updates = append(updates, update{t.onPosition, t.position})
+			}
+		}
+	}
+	return func() {
+		for _, u := range updates {
+			u.fn(u.pos)
+		}
+	}
+}
+
+// Stats returns a snapshot of running and waiting runs.
+func (s *ProcessScheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := SchedulerStats{
+		MaxGlobal:  s.maxGlobal,
+		MaxPerUser: s.maxPerUser,
+		Running:    s.running,
+		PerUser:    make(map[string]int, len(s.perUser)),
+		Queue:      []WaitingRun{},
+	}
+	for u, n := range s.perUser {
+		stats.PerUser[u] = n
+	}
+	for i, t := range s.orderLocked() {
+		stats.Queue = append(stats.Queue, WaitingRun{
+			UserID:     t.userID,
+			SessionKey: t.sessionKey,
+			Position:   i + 1,
+			QueuedAt:   t.queuedAt,
+		})
+	}
+	stats.Waiting = len(stats.Queue)
+	return stats
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func acquireAsync(s *ProcessScheduler, userID, key string) (<-chan func(), *[]int, *sync.Mutex) {
+	ch := make(chan func(), 1)
+	var mu sync.Mutex
+	positions := &[]int{}
+	go func() {
+		release, err := s.Acquire(context.Background(), userID, key, func(p int) {
+			mu.Lock()
+			*positions = append(*positions, p)
+			mu.Unlock()
+		})
+		if err == nil {
+			ch <- release
+		}
+	}()
+	return ch, positions, &mu
+}
+
+func waitForWaiting(t *testing.T, s *ProcessScheduler, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool { return s.Stats().Waiting == n }, time.Second, time.Millisecond)
+}
+
+func TestScheduler_PerUserCap(t *testing.T) {
+	s := NewProcessScheduler(10, 1)
+
+	release, err := s.Acquire(context.Background(), "alice", "a1", nil)
+	require.NoError(t, err)
+
+	second, _, _ := acquireAsync(s, "alice", "a2")
+	waitForWaiting(t, s, 1)
+
+	// Another user is not blocked by alice's cap
+	bobRelease, err := s.Acquire(context.Background(), "bob", "b1", nil)
+	require.NoError(t, err)
+	bobRelease()
+
+	release()
+	select {
+	case r := <-second:
+		r()
+	case <-time.After(time.Second):
+		t.Fatal("Queued run should start after release")
+	}
+	assert.Equal(t, 0, s.Stats().Running)
+}
+
+func TestScheduler_RoundRobinAcrossUsers(t *testing.T) {
+	s := NewProcessScheduler(1, 0)
+
+	release, err := s.Acquire(context.Background(), "alice", "a0", nil)
+	require.NoError(t, err)
+
+	a1, _, _ := acquireAsync(s, "alice", "a1")
+	waitForWaiting(t, s, 1)
+	a2, _, _ := acquireAsync(s, "alice", "a2")
+	waitForWaiting(t, s, 2)
+	b1, bobPositions, bobMu := acquireAsync(s, "bob", "b1")
+	waitForWaiting(t, s, 3)
+
+	// Bob is second in line, ahead of alice's second queued run
+	bobMu.Lock()
+	assert.Equal(t, []int{2}, *bobPositions)
+	bobMu.Unlock()
+
+	var order []string
+	next := func() {
+		select {
+		case r := <-a1:
+			order = append(order, "a1")
+			r()
+		case r := <-a2:
+			order = append(order, "a2")
+			r()
+		case r := <-b1:
+			order = append(order, "b1")
+			r()
+		case <-time.After(time.Second):
+			t.Fatal("Expected a run to start")
+		}
+	}
+	release()
+	next()
+	next()
+	next()
+
+	assert.Equal(t, []string{"a1", "b1", "a2"}, order)
+}
+
+func TestScheduler_CancelWhileWaiting(t *testing.T) {
+	s := NewProcessScheduler(1, 0)
+	release, err := s.Acquire(context.Background(), "alice", "a0", nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Acquire(ctx, "bob", "b1", nil)
+		done <- err
+	}()
+	waitForWaiting(t, s, 1)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Equal(t, 0, s.Stats().Waiting)
+
+	release()
+	assert.Equal(t, 0, s.Stats().Running)
+}
@@ -1,38 +1,83 @@
 package services
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	gopty "github.com/aymanbagabas/go-pty"
+	"github.com/google/uuid"
 )
 
 // ── multiWriter: broadcasts PTY output to all connected WebSocket clients ──
 
-const replayBufCap = 65536 // 64KB ring buffer for late joiners
+const (
+	replayBufCap = 65536 // 64KB ring buffer for late joiners
+
+	// Each client gets its own queue drained by its own goroutine, so a slow
+	// one can't hold up the shell or the other clients. Output is coalesced
+	// into one pending buffer; when it outgrows writerQueueCap, the backlog
+	// is dropped and the client is redrawn from the replay buffer instead.
+	writerQueueCap      = 4 * replayBufCap
+	writerQueueMessages = 16 // pending control messages; the oldest are dropped
+
+	// How long the last output may take to reach clients once the shell exits
+	writerDrainTimeout = 2 * time.Second
+)
+
+// resyncPrefix resets the client's terminal before it is redrawn from the
+// replay buffer (RIS: full reset).
+var resyncPrefix = []byte("\x1bc")
+
+// TerminalOutputStats counts what was held back from clients too slow to
+// keep up with a shell's output.
+type TerminalOutputStats struct {
+	DroppedBytes    int64 `json:"dropped_bytes"`    // output discarded from client queues
+	Resyncs         int64 `json:"resyncs"`          // clients redrawn from the replay buffer
+	DroppedMessages int64 `json:"dropped_messages"` // control messages discarded
+}
+
+type outputCounters struct {
+	droppedBytes, resyncs, droppedMessages atomic.Int64
+}
+
+func (c *outputCounters) snapshot() TerminalOutputStats {
+	return TerminalOutputStats{
+		DroppedBytes:    c.droppedBytes.Load(),
+		Resyncs:         c.resyncs.Load(),
+		DroppedMessages: c.droppedMessages.Load(),
+	}
+}
 
 type multiWriter struct {
 	mu      sync.Mutex
-	writers map[io.Writer]io.Closer
+	writers map[io.Writer]*writerQueue
 
 	// replayBuf stores the last N bytes of PTY output so that new
 	// connections see the current prompt / recent output.
 	replayBuf []byte
+
+	stats  outputCounters  // this shell's
+	totals *outputCounters // the service's, across all shells (may be nil)
 }
 
-func newMultiWriter() *multiWriter {
+func newMultiWriter(totals *outputCounters) *multiWriter {
 	return &multiWriter{
-		writers: make(map[io.Writer]io.Closer),
+		writers: make(map[io.Writer]*writerQueue),
+		totals:  totals,
 	}
 }
 
-// Write sends data to all connected writers and appends to the replay buffer.
-// Dead writers are removed automatically.
+// Write appends to the replay buffer and queues data for every writer.
+// It never blocks on a client.
 func (mw *multiWriter) Write(p []byte) (int, error) {
 	mw.mu.Lock()
 	defer mw.mu.Unlock()
@@ -43,55 +88,368 @@ func (mw *multiWriter) Write(p []byte) (int, error) {
 		mw.replayBuf = mw.replayBuf[len(mw.replayBuf)-replayBufCap:]
 	}
 
-	for w, closer := range mw.writers {
-		if _, err := w.Write(p); err != nil {
-			closer.Close()
-			delete(mw.writers, w)
+	for _, q := range mw.writers {
+		if dropped := q.push(p, mw.replayBuf); dropped > 0 {
+			mw.count(func(c *outputCounters) {
+				c.droppedBytes.Add(int64(dropped))
+				c.resyncs.Add(1)
+			})
 		}
 	}
 	return len(p), nil
 }
 
-// Add registers a new writer. Flushes the replay buffer to it so the client
-// sees the current terminal state (prompt, recent output).
+// Add registers a new writer. The replay buffer is queued to it first so the
+// client sees the current terminal state (prompt, recent output).
 func (mw *multiWriter) Add(w io.Writer, closer io.Closer) {
 	mw.mu.Lock()
 	defer mw.mu.Unlock()
 
-	// Replay recent output to the new connection
-	if len(mw.replayBuf) > 0 {
-		w.Write(mw.replayBuf)
+	if old, ok := mw.writers[w]; ok {
+		old.stop()
 	}
-
-	mw.writers[w] = closer
+	q := newWriterQueue(w, closer)
+	q.data = append(q.data, mw.replayBuf...)
+	mw.writers[w] = q
+	go q.run(mw)
+	q.signal()
 }
 
-// Remove unregisters a writer (called when WS disconnects).
+// Remove unregisters a writer (called when WS disconnects). Whatever is
+// still queued for it is discarded.
 func (mw *multiWriter) Remove(w io.Writer) {
 	mw.mu.Lock()
 	defer mw.mu.Unlock()
+	mw.removeLocked(w, nil)
+}
+
+// removeLocked unregisters w, if q (when given) is still its queue.
+func (mw *multiWriter) removeLocked(w io.Writer, q *writerQueue) {
+	current, ok := mw.writers[w]
+	if !ok || (q != nil && current != q) {
+		return
+	}
+	current.stop()
 	delete(mw.writers, w)
 }
 
+// JSONWriter is implemented by writers that also take JSON control messages
+// (status updates, notices) next to the raw terminal output.
+type JSONWriter interface {
+	WriteJSON(v any) error
+}
+
+// Notify queues a control message for every writer that is a JSONWriter.
+// Unlike output it isn't kept for replay.
+func (mw *multiWriter) Notify(msg any) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	for _, q := range mw.writers {
+		if q.jw == nil {
+			continue
+		}
+		if q.pushMessage(msg) {
+			mw.count(func(c *outputCounters) { c.droppedMessages.Add(1) })
+		}
+	}
+}
+
+// Len returns the number of attached writers.
+func (mw *multiWriter) Len() int {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return len(mw.writers)
+}
+
+// Drain waits (up to timeout) for everything queued so far to reach the
+// writers, then lets their goroutines exit. Called once the shell is gone.
+func (mw *multiWriter) Drain(timeout time.Duration) {
+	mw.mu.Lock()
+	queues := make([]*writerQueue, 0, len(mw.writers))
+	for _, q := range mw.writers {
+		q.finish()
+		queues = append(queues, q)
+	}
+	mw.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, q := range queues {
+		select {
+		case <-q.exited:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// Stats returns this shell's drop counters.
+func (mw *multiWriter) Stats() TerminalOutputStats {
+	return mw.stats.snapshot()
+}
+
+func (mw *multiWriter) count(f func(*outputCounters)) {
+	f(&mw.stats)
+	if mw.totals != nil {
+		f(mw.totals)
+	}
+}
+
+// writerQueue holds what is waiting to be sent to one writer.
+type writerQueue struct {
+	w      io.Writer
+	jw     JSONWriter // w, if it takes control messages
+	closer io.Closer
+
+	mu   sync.Mutex
+	data []byte // pending output, coalesced into one write
+	msgs []any  // pending control messages
+
+	wake       chan struct{} // something was queued
+	done       chan struct{} // stop: discard the rest
+	draining   chan struct{} // finish: send the rest, then stop
+	exited     chan struct{}
+	stopOnce   sync.Once
+	finishOnce sync.Once
+}
+
+func newWriterQueue(w io.Writer, closer io.Closer) *writerQueue {
+	q := &writerQueue{
+		w:        w,
+		closer:   closer,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		draining: make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	q.jw, _ = w.(JSONWriter)
+	return q
+}
+
+// push queues output. If the client is too far behind, its backlog is
+// replaced by a redraw from replay (which already ends with p) and the
+// number of bytes discarded is returned: the backlog, plus whatever part
+// of p didn't fit in replay.
+func (q *writerQueue) push(p, replay []byte) (dropped int) {
+	q.mu.Lock()
+	if len(q.data)+len(p) > writerQueueCap {
+		dropped = len(q.data) + max(0, len(p)-len(replay))
+		q.data = append(append(q.data[:0], resyncPrefix...), replay...)
+	} else {
+		q.data = append(q.data, p...)
+	}
+	q.mu.Unlock()
+	q.signal()
+	return dropped
+}
+
+// pushMessage queues a control message, replacing a status still waiting
+// to be sent. Returns true if a message had to be dropped to make room.
+func (q *writerQueue) pushMessage(msg any) (dropped bool) {
+	q.mu.Lock()
+	replaced := false
+	if _, ok := msg.(TerminalStatus); ok {
+		for i, m := range q.msgs {
+			if _, ok := m.(TerminalStatus); ok {
+				q.msgs[i] = msg
+				replaced = true
+				break
+			}
+		}
+	}
+	if !replaced {
+		if len(q.msgs) >= writerQueueMessages {
+			q.msgs = q.msgs[1:]
+			dropped = true
+		}
+		q.msgs = append(q.msgs, msg)
+	}
+	q.mu.Unlock()
+	q.signal()
+	return dropped
+}
+
+func (q *writerQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *writerQueue) stop() {
+	q.stopOnce.Do(func() { close(q.done) })
+}
+
+func (q *writerQueue) finish() {
+	q.finishOnce.Do(func() { close(q.draining) })
+}
+
+// run sends queued messages and output to the writer until the queue is
+// stopped. A failed write closes the client and unregisters it.
+func (q *writerQueue) run(mw *multiWriter) {
+	defer close(q.exited)
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.draining:
+			q.flush()
+			return
+		case <-q.wake:
+			if err := q.flush(); err != nil {
+				q.closer.Close()
+				mw.mu.Lock()
+				mw.removeLocked(q.w, q)
+				mw.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (q *writerQueue) flush() error {
+	for {
+		q.mu.Lock()
+		data, msgs := q.data, q.msgs
+		q.data, q.msgs = nil, nil
+		q.mu.Unlock()
+		if len(data) == 0 && len(msgs) == 0 {
+			return nil
+		}
+		for _, msg := range msgs {
+			if err := q.jw.WriteJSON(msg); err != nil {
+				return err
+			}
+		}
+		if len(data) > 0 {
+			if _, err := q.w.Write(data); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-q.done:
+			return nil
+		default:
+		}
+	}
+}
+
 // ── TerminalService ──
 
+// TerminalOptions configures resource sampling and reaping of shells.
+type TerminalOptions struct {
+	SampleInterval time.Duration // 0 = don't sample (and don't enforce Limits)
+	Limits         TerminalLimits
+	IdleTimeout    time.Duration         // close shells detached and silent this long (0 = never)
+	Daemon         *TerminalDaemonClient // hosts the shells so they outlive the server (nil = they are its children)
+}
+
+// maxReapInterval bounds how long an idle shell may outlive IdleTimeout.
+const maxReapInterval = 5 * time.Minute
+
 type TerminalService struct {
 	sessions map[string]*TerminalSession
 	mu       sync.RWMutex
+	opts     TerminalOptions
+
+	shares   map[string]*terminalShare // by token
+	sharesMu sync.Mutex                // taken before mu, never inside it
+
+	output outputCounters // drops across all shells since startup
 }
 
 type TerminalSession struct {
-	Pty  gopty.Pty
-	Cmd  *gopty.Cmd
-	Done chan struct{}
+	Done      chan struct{}
+	UserID    uuid.UUID
+	StartedAt time.Time
+
+	shell shellProcess
+	mw    *multiWriter // broadcasts PTY output to all attached WS connections
+
+	label      atomic.Pointer[string]
+	lastActive atomic.Int64  // unix nanos of the last output or attach/detach
+	winsize    atomic.Uint32 // rows<<16 | cols, 0 until the first resize
+
+	recordMu sync.Mutex // serializes starting and stopping recordings
+	recorder atomic.Pointer[castRecorder]
+
+	// Resource sampling state, guarded by statsMu
+	statsMu    sync.Mutex
+	status     *TerminalStatus // latest sample (nil before the first)
+	prevTicks  map[int]int64   // CPU ticks per process at the previous sample
+	cpuStrikes int             // samples in a row over the CPU limit
+}
 
-	mw *multiWriter // broadcasts PTY output to all attached WS connections
+// TerminalInfo describes one of a user's shells.
+type TerminalInfo struct {
+	InstanceID string              `json:"instance_id"`
+	Label      string              `json:"label"`
+	PID        int                 `json:"pid"`
+	StartedAt  time.Time           `json:"started_at"`
+	LastActive time.Time           `json:"last_active"`
+	Alive      bool                `json:"alive"`
+	Clients    int                 `json:"clients"`             // attached WebSocket connections
+	Recording  string              `json:"recording,omitempty"` // file being recorded to
+	Output     TerminalOutputStats `json:"output"`
+	Stats      *TerminalStats      `json:"stats"` // nil until first sampled
 }
 
-func NewTerminalService() *TerminalService {
+func newTerminalSession(shell shellProcess, userID uuid.UUID, startedAt time.Time, totals *outputCounters) *TerminalSession {
+	session := &TerminalSession{
+		Done:      make(chan struct{}),
+		UserID:    userID,
+		StartedAt: startedAt,
+		shell:     shell,
+		mw:        newMultiWriter(totals),
+	}
+	session.touch()
+	return session
+}
+
+func NewTerminalService(opts TerminalOptions) *TerminalService {
 	return &TerminalService{
 		sessions: make(map[string]*TerminalSession),
+		opts:     opts,
+		shares:   make(map[string]*terminalShare),
+	}
+}
+
+// TerminalServiceStats sums up the shells and their clients (for admin metrics).
+type TerminalServiceStats struct {
+	Sessions int                 `json:"sessions"`
+	Clients  int                 `json:"clients"`
+	Output   TerminalOutputStats `json:"output"` // since startup, including closed shells
+}
+
+// Stats returns the number of shells and clients and the output dropped
+// for slow clients.
+func (s *TerminalService) Stats() TerminalServiceStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := TerminalServiceStats{Sessions: len(s.sessions), Output: s.output.snapshot()}
+	for _, session := range s.sessions {
+		stats.Clients += session.mw.Len()
+	}
+	return stats
+}
+
+// TerminalKey identifies a user's terminal instance in the service.
+func TerminalKey(userID uuid.UUID, instanceID string) string {
+	return "term:" + userID.String() + ":" + instanceID
+}
+
+// parseTerminalKey returns the user a TerminalKey belongs to.
+func parseTerminalKey(key string) (uuid.UUID, bool) {
+	rest, ok := strings.CutPrefix(key, "term:")
+	if !ok {
+		return uuid.Nil, false
 	}
+	userID, _, ok := strings.Cut(rest, ":")
+	if !ok {
+		return uuid.Nil, false
+	}
+	id, err := uuid.Parse(userID)
+	return id, err == nil
 }
 
 func defaultShell() string {
@@ -120,7 +478,7 @@ func defaultShell() string {
 }
 
 // GetOrCreate returns an existing alive session or creates a new one.
-func (s *TerminalService) GetOrCreate(sessionKey string, workingDir string) (*TerminalSession, error) {
+func (s *TerminalService) GetOrCreate(sessionKey string, ws *Workspace) (*TerminalSession, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -141,11 +499,11 @@ func (s *TerminalService) GetOrCreate(sessionKey string, workingDir string) (*Te
 		log.Printf("[TerminalService] no existing session, creating new key=%s", sessionKey)
 	}
 
-	return s.createLocked(sessionKey, workingDir)
+	return s.createLocked(sessionKey, ws)
 }
 
 // Create always creates a new session, closing any existing one.
-func (s *TerminalService) Create(sessionKey string, workingDir string) (*TerminalSession, error) {
+func (s *TerminalService) Create(sessionKey string, ws *Workspace) (*TerminalSession, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -154,11 +512,14 @@ func (s *TerminalService) Create(sessionKey string, workingDir string) (*Termina
 		delete(s.sessions, sessionKey)
 	}
 
-	return s.createLocked(sessionKey, workingDir)
+	return s.createLocked(sessionKey, ws)
 }
 
-func (s *TerminalService) createLocked(sessionKey string, workingDir string) (*TerminalSession, error) {
+// createLocked starts a shell in the user's workspace, as the workspace's OS
+// user when it is isolated and inside the sandbox when there is one.
+func (s *TerminalService) createLocked(sessionKey string, ws *Workspace) (*TerminalSession, error) {
 	shell := defaultShell()
+	workingDir := ws.Dir
 	log.Printf("[TerminalService] createLocked shell=%s dir=%s key=%s", shell, workingDir, sessionKey)
 
 	// Verify working directory exists, fall back to /tmp
@@ -167,16 +528,8 @@ func (s *TerminalService) createLocked(sessionKey string, workingDir string) (*T
 		workingDir = os.TempDir()
 	}
 
-	p, err := gopty.New()
-	if err != nil {
-		return nil, err
-	}
-
-	cmd := p.Command(shell)
-	cmd.Dir = workingDir
-
 	// Build environment: ensure critical vars exist for shell init
-	env := os.Environ()
+	env := ws.Environ()
 	has := make(map[string]bool)
 	for _, e := range env {
 		if i := strings.IndexByte(e, '='); i > 0 {
@@ -196,38 +549,39 @@ func (s *TerminalService) createLocked(sessionKey string, workingDir string) (*T
 		env = append(env, "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
 	}
 	env = append(env, "TERM=xterm-256color", "COLORTERM=truecolor")
-	cmd.Env = env
 
-	if err := cmd.Start(); err != nil {
-		p.Close()
-		log.Printf("[TerminalService] cmd.Start failed: %v key=%s", err, sessionKey)
-		return nil, err
+	spec := shellSpec{Path: shell, Args: []string{shell}, Env: env, Dir: workingDir, UID: ws.UID, GID: ws.GID}
+	if ws.Sandboxed() {
+		sandboxed, err := ws.SandboxCommand(SandboxProcess{Path: shell, Args: spec.Args, Env: env, Dir: workingDir})
+		if err != nil {
+			return nil, err
+		}
+		sandboxed.Close() // started from the spec, which reopens the cgroup
+		spec = shellSpec{
+			Path: sandboxed.Path, Args: sandboxed.Args, Env: sandboxed.Env, Dir: workingDir, UID: -1, GID: -1,
+			Cloneflags: sandboxed.Cloneflags, CgroupDir: sandboxed.CgroupDir,
+		}
 	}
 
-	session := &TerminalSession{
-		Pty:  p,
-		Cmd:  cmd,
-		Done: make(chan struct{}),
-		mw:   newMultiWriter(),
+	var shellProc shellProcess
+	var err error
+	if s.opts.Daemon != nil {
+		shellProc, _, err = s.opts.Daemon.spawn(sessionKey, spec)
+	} else {
+		shellProc, err = startLocalShell(sessionKey, spec)
+	}
+	if err != nil {
+		log.Printf("[TerminalService] shell start failed: %v key=%s", err, sessionKey)
+		return nil, err
 	}
 
-	log.Printf("[TerminalService] shell started pid=%d key=%s", cmd.Process.Pid, sessionKey)
+	session := newTerminalSession(shellProc, ws.UserID, time.Now(), &s.output)
+	log.Printf("[TerminalService] shell started pid=%d key=%s", shellProc.Pid(), sessionKey)
 
 	// Single persistent PTY reader — survives WS reconnections.
 	// Writes to multiWriter which broadcasts to all attached clients.
 	go session.pumpOutput(sessionKey)
 
-	// Monitor process exit
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			log.Printf("[TerminalService] shell exited with error: %v (key=%s)", err, sessionKey)
-		} else {
-			log.Printf("[TerminalService] shell exited normally (key=%s)", sessionKey)
-		}
-		// Close PTY to unblock pumpOutput's Read()
-		p.Close()
-	}()
-
 	s.sessions[sessionKey] = session
 	log.Printf("[TerminalService] session stored key=%s totalSessions=%d", sessionKey, len(s.sessions))
 	return session, nil
@@ -240,7 +594,7 @@ func (ts *TerminalSession) pumpOutput(sessionKey string) {
 	log.Printf("[TerminalService] pumpOutput START key=%s", sessionKey)
 	buf := make([]byte, 4096)
 	for {
-		n, err := ts.Pty.Read(buf)
+		n, err := ts.shell.Read(buf)
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("[TerminalService] pumpOutput PTY read error: %v key=%s", err, sessionKey)
@@ -249,8 +603,14 @@ func (ts *TerminalSession) pumpOutput(sessionKey string) {
 		}
 		// Broadcast to all connected WebSocket clients (and buffer in replayBuf)
 		ts.mw.Write(buf[:n])
+		ts.record("o", buf[:n])
+		ts.touch()
 	}
 	log.Printf("[TerminalService] pumpOutput STOP key=%s", sessionKey)
+	ts.stopRecording()
+	// Let clients get the last output (and a closing notice) before Done
+	// makes their handlers hang up.
+	ts.mw.Drain(writerDrainTimeout)
 	close(ts.Done)
 }
 
@@ -270,6 +630,185 @@ func (s *TerminalService) Remove(sessionKey string) {
 	}
 }
 
+// List returns a user's shells, oldest first.
+func (s *TerminalService) List(userID uuid.UUID) []TerminalInfo {
+	prefix := TerminalKey(userID, "")
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := []TerminalInfo{}
+	for key, session := range s.sessions {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, session.info(strings.TrimPrefix(key, prefix)))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos
+}
+
+// SetLabel names one of a user's shells. Returns false if there is no such shell.
+func (s *TerminalService) SetLabel(userID uuid.UUID, instanceID, label string) (TerminalInfo, bool) {
+	key := TerminalKey(userID, instanceID)
+	session, ok := s.Get(key)
+	if !ok {
+		return TerminalInfo{}, false
+	}
+	session.label.Store(&label)
+	if s.opts.Daemon != nil {
+		// Kept by the daemon too, so the label survives restarts
+		if err := s.opts.Daemon.setLabel(key, label); err != nil {
+			log.Printf("[TerminalService] failed to store label in daemon: %v (key=%s)", err, key)
+		}
+	}
+	return session.info(instanceID), true
+}
+
+// Restore reattaches to the shells the terminal daemon kept running while
+// the server was down, with their recent output for replay.
+func (s *TerminalService) Restore() error {
+	if s.opts.Daemon == nil {
+		return nil
+	}
+	shells, err := s.opts.Daemon.list()
+	if err != nil {
+		return err
+	}
+	for _, listed := range shells {
+		userID, ok := parseTerminalKey(listed.Key)
+		if !ok {
+			continue
+		}
+		shell, info, err := s.opts.Daemon.attach(listed.Key)
+		if err != nil {
+			log.Printf("[TerminalService] failed to reattach: %v (key=%s)", err, listed.Key)
+			continue
+		}
+		session := newTerminalSession(shell, userID, info.StartedAt, &s.output)
+		if info.Label != "" {
+			session.label.Store(&info.Label)
+		}
+
+		s.mu.Lock()
+		s.sessions[info.Key] = session
+		s.mu.Unlock()
+		go session.pumpOutput(info.Key)
+	}
+	log.Printf("[TerminalService] restored %d shells from the daemon", len(shells))
+	return nil
+}
+
+// Kill closes one of a user's shells, telling attached clients why.
+// Returns false if there is no such shell.
+func (s *TerminalService) Kill(userID uuid.UUID, instanceID string) bool {
+	key := TerminalKey(userID, instanceID)
+	session, ok := s.Get(key)
+	if !ok {
+		return false
+	}
+	session.mw.Notify(TerminalNotice{Type: "notice", Message: "Terminal closed"})
+	session.killTree()
+	s.removeSession(key, session)
+	return true
+}
+
+// Run samples the resources of every shell's process tree each
+// SampleInterval until ctx is done, pushing the figures to attached clients
+// and killing shells that exceed the limits. It also closes shells that
+// have been idle for IdleTimeout.
+func (s *TerminalService) Run(ctx context.Context) {
+	var sample, reap <-chan time.Time
+	if s.opts.SampleInterval > 0 {
+		ticker := time.NewTicker(s.opts.SampleInterval)
+		defer ticker.Stop()
+		sample = ticker.C
+	}
+	if s.opts.IdleTimeout > 0 {
+		ticker := time.NewTicker(min(s.opts.IdleTimeout/4, maxReapInterval))
+		defer ticker.Stop()
+		reap = ticker.C
+	}
+	if sample == nil && reap == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sample:
+			s.sampleAll()
+		case now := <-reap:
+			s.reapIdle(now)
+		}
+	}
+}
+
+// reapIdle closes shells no client is attached to that have had no output
+// (nor clients) for IdleTimeout, and forgets shells that already exited.
+func (s *TerminalService) reapIdle(now time.Time) {
+	s.mu.Lock()
+	var idle []*TerminalSession
+	for key, session := range s.sessions {
+		if session.mw.Len() > 0 {
+			continue
+		}
+		if session.IsAlive() && now.Sub(session.LastActive()) < s.opts.IdleTimeout {
+			continue
+		}
+		log.Printf("[TerminalService] reaping idle shell key=%s", key)
+		delete(s.sessions, key)
+		idle = append(idle, session)
+	}
+	s.mu.Unlock()
+
+	for _, session := range idle {
+		session.Close()
+	}
+}
+
+func (s *TerminalService) sampleAll() {
+	s.mu.RLock()
+	sessions := make(map[string]*TerminalSession, len(s.sessions))
+	for key, session := range s.sessions {
+		sessions[key] = session
+	}
+	s.mu.RUnlock()
+	if len(sessions) == 0 {
+		return
+	}
+
+	procs, err := readProcTable()
+	if err != nil {
+		log.Printf("[TerminalService] sampling failed: %v", err)
+		return
+	}
+	now := time.Now()
+	for key, session := range sessions {
+		if !session.IsAlive() {
+			continue
+		}
+		status, reason := session.sample(procs, now, s.opts)
+		if reason != "" {
+			log.Printf("[TerminalService] killing shell over its limits: %s (key=%s)", reason, key)
+			session.mw.Notify(TerminalNotice{Type: "notice", Message: "Terminal killed: " + reason})
+			session.killTree()
+			s.removeSession(key, session)
+			continue
+		}
+		session.mw.Notify(status)
+	}
+}
+
+// removeSession closes session and forgets it, unless key was reused for a
+// new shell meanwhile.
+func (s *TerminalService) removeSession(key string, session *TerminalSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[key] == session {
+		delete(s.sessions, key)
+	}
+	session.Close()
+}
+
 func (s *TerminalService) Resize(sessionKey string, rows, cols uint16) error {
 	s.mu.RLock()
 	session, ok := s.sessions[sessionKey]
@@ -279,7 +818,9 @@ func (s *TerminalService) Resize(sessionKey string, rows, cols uint16) error {
 		return nil
 	}
 
-	return session.Pty.Resize(int(cols), int(rows))
+	session.winsize.Store(uint32(rows)<<16 | uint32(cols))
+	session.record("r", fmt.Appendf(nil, "%dx%d", cols, rows))
+	return session.shell.Resize(rows, cols)
 }
 
 // IsAlive returns true if the shell process is still running.
@@ -292,24 +833,133 @@ func (ts *TerminalSession) IsAlive() bool {
 	}
 }
 
+// sample records the shell's usage from a process table snapshot and checks
+// it against the limits. Returns the new status and, if the shell must be
+// killed, why.
+func (ts *TerminalSession) sample(procs map[int]procStat, now time.Time, opts TerminalOptions) (TerminalStatus, string) {
+	ts.statsMu.Lock()
+	defer ts.statsMu.Unlock()
+
+	deltaTicks, rssPages, count, ticks := treeUsage(procs, ts.shell.Pid(), ts.prevTicks)
+	stats := TerminalStats{
+		RSSBytes:  rssPages * int64(os.Getpagesize()),
+		Processes: count,
+		SampledAt: now,
+	}
+	if ts.status != nil {
+		if elapsed := now.Sub(ts.status.Stats.SampledAt).Seconds(); elapsed > 0 {
+			stats.CPUPercent = float64(deltaTicks) / clockTicks / elapsed * 100
+		}
+	}
+	ts.prevTicks = ticks
+	ts.status = &TerminalStatus{Type: "status", Stats: stats, Limits: opts.Limits}
+	return *ts.status, opts.Limits.exceeded(stats, &ts.cpuStrikes)
+}
+
+func (ts *TerminalSession) info(instanceID string) TerminalInfo {
+	info := TerminalInfo{
+		InstanceID: instanceID,
+		StartedAt:  ts.StartedAt,
+		LastActive: ts.LastActive(),
+		PID:        ts.shell.Pid(),
+		Alive:      ts.IsAlive(),
+		Clients:    ts.mw.Len(),
+		Output:     ts.mw.Stats(),
+	}
+	if label := ts.label.Load(); label != nil {
+		info.Label = *label
+	}
+	if rec := ts.recorder.Load(); rec != nil {
+		info.Recording = rec.name
+	}
+	if status, ok := ts.Status(); ok {
+		info.Stats = &status.Stats
+	}
+	return info
+}
+
+func (ts *TerminalSession) touch() {
+	ts.lastActive.Store(time.Now().UnixNano())
+}
+
+// LastActive is when the shell last produced output or a client attached
+// or detached.
+func (ts *TerminalSession) LastActive() time.Time {
+	return time.Unix(0, ts.lastActive.Load())
+}
+
+// killTree kills the shell and all its descendants, so background jobs
+// don't outlive it.
+func (ts *TerminalSession) killTree() {
+	procs, err := readProcTable()
+	if err != nil {
+		return
+	}
+	_, _, _, tree := treeUsage(procs, ts.shell.Pid(), nil)
+	for pid := range tree {
+		killProcess(pid)
+	}
+}
+
+// Status returns the latest sampled status, if the shell was sampled yet.
+func (ts *TerminalSession) Status() (TerminalStatus, bool) {
+	ts.statsMu.Lock()
+	defer ts.statsMu.Unlock()
+	if ts.status == nil {
+		return TerminalStatus{}, false
+	}
+	return *ts.status, true
+}
+
 // AddWriter registers a new WS connection to receive PTY output.
 // The replay buffer is flushed to the new writer so it sees current terminal state.
 func (ts *TerminalSession) AddWriter(w io.Writer, closer io.Closer) {
 	log.Printf("[TerminalService] AddWriter: registering %p", w)
 	ts.mw.Add(w, closer)
+	ts.touch()
 }
 
 // RemoveWriter unregisters a WS connection (called on disconnect).
 func (ts *TerminalSession) RemoveWriter(w io.Writer) {
 	log.Printf("[TerminalService] RemoveWriter: removing %p", w)
 	ts.mw.Remove(w)
+	ts.touch()
 }
 
-func (ts *TerminalSession) Close() {
-	if ts.Pty != nil {
-		ts.Pty.Close()
+// Write sends input to the shell.
+func (ts *TerminalSession) Write(p []byte) (int, error) {
+	ts.record("i", p)
+	return ts.shell.Write(p)
+}
+
+// size returns the terminal size last set by a client (80x24 before that).
+func (ts *TerminalSession) size() (rows, cols uint16) {
+	ws := ts.winsize.Load()
+	if ws == 0 {
+		return 24, 80
+	}
+	return uint16(ws >> 16), uint16(ws)
+}
+
+// record adds an event to the shell's recording, if it is being recorded.
+func (ts *TerminalSession) record(code string, p []byte) {
+	if rec := ts.recorder.Load(); rec != nil {
+		rec.event(code, p)
 	}
-	if ts.Cmd != nil && ts.Cmd.Process != nil {
-		ts.Cmd.Process.Kill()
+}
+
+// stopRecording ends the recording in progress and returns it (nil if none).
+func (ts *TerminalSession) stopRecording() *castRecorder {
+	ts.recordMu.Lock()
+	defer ts.recordMu.Unlock()
+	rec := ts.recorder.Swap(nil)
+	if rec != nil {
+		rec.Close()
 	}
+	return rec
+}
+
+func (ts *TerminalSession) Close() {
+	ts.shell.Kill()
+	ts.shell.Close()
 }
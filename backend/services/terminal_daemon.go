@@ -0,0 +1,525 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TerminalDaemonArg is the argument the server binary is run with (followed
+// by the socket path) to become the terminal daemon: a small supervisor
+// that holds the shells' PTYs so they survive restarts of the server, which
+// reattaches to them over the daemon's Unix socket.
+const TerminalDaemonArg = "terminal-daemon"
+
+// ── Protocol ──
+//
+// A connection starts with one JSON daemonRequest line, answered by one JSON
+// daemonResponse line. After a successful spawn or attach the connection
+// carries frames in both directions: a type byte, a big-endian uint32
+// payload length and the payload.
+//
+// Both sides send daemonProtocolVersion and refuse to talk to a different
+// one: the daemon outlives server upgrades, so a server may find a daemon
+// that was started by an older (or newer) binary.
+
+// daemonProtocolVersion is bumped on any incompatible change to the above.
+const daemonProtocolVersion = 1
+
+var errDaemonVersion = errors.New("terminal daemon protocol version mismatch")
+
+const (
+	frameData   byte = 'd' // PTY output, or input from the server
+	frameResize byte = 'r' // rows and cols as big-endian uint16s
+	frameKill   byte = 'k' // kill the shell
+	frameExit   byte = 'x' // the shell exited; nothing follows
+
+	maxFrameSize = 1 << 20
+
+	daemonDialTimeout      = 5 * time.Second
+	daemonHandshakeTimeout = 30 * time.Second
+)
+
+type daemonRequest struct {
+	Version int        `json:"version"` // daemonProtocolVersion
+	Op      string     `json:"op"`      // "list", "spawn", "attach" or "label"
+	Key     string     `json:"key,omitempty"`
+	Spec    *shellSpec `json:"spec,omitempty"`
+	Label   string     `json:"label,omitempty"`
+}
+
+type daemonResponse struct {
+	Version int               `json:"version"` // daemonProtocolVersion
+	Error   string            `json:"error,omitempty"`
+	Shell   *daemonShellInfo  `json:"shell,omitempty"`  // spawn, attach
+	Shells  []daemonShellInfo `json:"shells,omitempty"` // list
+}
+
+type daemonShellInfo struct {
+	Key       string    `json:"key"`
+	Label     string    `json:"label"`
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:5])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// ── Daemon ──
+
+// RunTerminalDaemon serves the terminal daemon on socket until it is killed.
+// It never returns.
+func RunTerminalDaemon(socket string) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		log.Fatalf("[TerminalDaemon] %v", err)
+	}
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		log.Fatalf("[TerminalDaemon] another daemon is listening on %s", socket)
+	}
+	// Left behind by a daemon that didn't exit cleanly
+	os.Remove(socket)
+
+	ln, err := listenPrivate(socket)
+	if err != nil {
+		log.Fatalf("[TerminalDaemon] %v", err)
+	}
+	log.Printf("[TerminalDaemon] listening on %s", socket)
+	err = newTerminalDaemon().serve(ln)
+	log.Fatalf("[TerminalDaemon] %v", err)
+}
+
+type terminalDaemon struct {
+	mu     sync.Mutex
+	shells map[string]*daemonShell
+}
+
+// daemonShell is a shell held by the daemon, with at most one server
+// connection attached to it.
+type daemonShell struct {
+	key       string
+	startedAt time.Time
+	proc      *localShell
+
+	mu     sync.Mutex // guards the fields below
+	label  string
+	replay []byte   // the last replayBufCap bytes of output, for reattaching
+	conn   net.Conn // nil while detached
+	exited bool
+}
+
+func newTerminalDaemon() *terminalDaemon {
+	return &terminalDaemon{shells: make(map[string]*daemonShell)}
+}
+
+func (d *terminalDaemon) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *terminalDaemon) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(daemonHandshakeTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	var req daemonRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		respond(conn, daemonResponse{Error: "bad request"})
+		conn.Close()
+		return
+	}
+	if req.Version != daemonProtocolVersion {
+		log.Printf("[TerminalDaemon] refusing a server speaking protocol %d (daemon: %d)", req.Version, daemonProtocolVersion)
+		respond(conn, daemonResponse{Error: fmt.Sprintf("daemon speaks protocol %d, server %d", daemonProtocolVersion, req.Version)})
+		conn.Close()
+		return
+	}
+
+	switch req.Op {
+	case "list":
+		respond(conn, daemonResponse{Shells: d.list()})
+	case "label":
+		if sh := d.get(req.Key); sh != nil {
+			sh.mu.Lock()
+			sh.label = req.Label
+			sh.mu.Unlock()
+		}
+		respond(conn, daemonResponse{})
+	case "spawn":
+		if req.Spec == nil || len(req.Spec.Args) == 0 {
+			respond(conn, daemonResponse{Error: "spawn needs a spec"})
+			break
+		}
+		sh, err := d.spawn(req.Key, *req.Spec)
+		if err != nil {
+			respond(conn, daemonResponse{Error: err.Error()})
+			break
+		}
+		sh.attach(conn, r)
+		return
+	case "attach":
+		sh := d.get(req.Key)
+		if sh == nil {
+			respond(conn, daemonResponse{Error: "no such shell"})
+			break
+		}
+		sh.attach(conn, r)
+		return
+	default:
+		respond(conn, daemonResponse{Error: "unknown op " + req.Op})
+	}
+	conn.Close()
+}
+
+func respond(w io.Writer, resp daemonResponse) error {
+	resp.Version = daemonProtocolVersion
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func (d *terminalDaemon) get(key string) *daemonShell {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.shells[key]
+}
+
+func (d *terminalDaemon) list() []daemonShellInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	infos := []daemonShellInfo{}
+	for _, sh := range d.shells {
+		infos = append(infos, sh.info())
+	}
+	return infos
+}
+
+// spawn starts a shell under key, killing the one it replaces.
+func (d *terminalDaemon) spawn(key string, spec shellSpec) (*daemonShell, error) {
+	proc, err := startLocalShell(key, spec)
+	if err != nil {
+		return nil, err
+	}
+	sh := &daemonShell{key: key, startedAt: time.Now(), proc: proc}
+
+	d.mu.Lock()
+	old := d.shells[key]
+	d.shells[key] = sh
+	d.mu.Unlock()
+	if old != nil {
+		old.proc.Kill()
+	}
+
+	go d.pump(sh)
+	log.Printf("[TerminalDaemon] shell started pid=%d key=%s", proc.Pid(), key)
+	return sh, nil
+}
+
+// pump reads the shell's output for its whole life, keeping the replay
+// buffer and passing it on to the attached server.
+func (d *terminalDaemon) pump(sh *daemonShell) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := sh.proc.Read(buf)
+		if err != nil {
+			break
+		}
+		sh.mu.Lock()
+		sh.replay = append(sh.replay, buf[:n]...)
+		if len(sh.replay) > replayBufCap {
+			sh.replay = sh.replay[len(sh.replay)-replayBufCap:]
+		}
+		if sh.conn != nil {
+			if err := writeFrame(sh.conn, frameData, buf[:n]); err != nil {
+				sh.conn.Close()
+				sh.conn = nil
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	sh.mu.Lock()
+	sh.exited = true
+	if sh.conn != nil {
+		writeFrame(sh.conn, frameExit, nil)
+		sh.conn.Close()
+		sh.conn = nil
+	}
+	sh.mu.Unlock()
+
+	d.mu.Lock()
+	if d.shells[sh.key] == sh {
+		delete(d.shells, sh.key)
+	}
+	d.mu.Unlock()
+	log.Printf("[TerminalDaemon] shell gone key=%s", sh.key)
+}
+
+func (sh *daemonShell) info() daemonShellInfo {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return daemonShellInfo{Key: sh.key, Label: sh.label, PID: sh.proc.Pid(), StartedAt: sh.startedAt}
+}
+
+// attach makes conn the shell's server connection, replacing (and closing)
+// any previous one, replays the recent output to it and then feeds the
+// shell the input conn sends until it is closed.
+func (sh *daemonShell) attach(conn net.Conn, r *bufio.Reader) {
+	info := sh.info()
+	sh.mu.Lock()
+	if sh.exited {
+		sh.mu.Unlock()
+		respond(conn, daemonResponse{Error: "shell exited"})
+		conn.Close()
+		return
+	}
+	if err := respond(conn, daemonResponse{Shell: &info}); err != nil {
+		sh.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if len(sh.replay) > 0 {
+		writeFrame(conn, frameData, sh.replay)
+	}
+	if sh.conn != nil {
+		sh.conn.Close()
+	}
+	sh.conn = conn
+	sh.mu.Unlock()
+
+	for {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			break
+		}
+		switch typ {
+		case frameData:
+			sh.proc.Write(payload)
+		case frameResize:
+			if len(payload) == 4 {
+				sh.proc.Resize(binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4]))
+			}
+		case frameKill:
+			sh.proc.Kill()
+		}
+	}
+
+	sh.mu.Lock()
+	if sh.conn == conn {
+		sh.conn = nil
+	}
+	sh.mu.Unlock()
+	conn.Close()
+}
+
+// ── Client ──
+
+// TerminalDaemonClient starts and reattaches to shells held by a terminal
+// daemon.
+type TerminalDaemonClient struct {
+	socket string
+}
+
+// ConnectTerminalDaemon returns a client of the daemon listening on socket.
+// If none answers and spawn is set, it first starts one: a copy of this
+// binary in its own session, which outlives the server. A daemon speaking
+// another protocol version is refused rather than restarted, as that would
+// end its users' shells.
+func ConnectTerminalDaemon(socket string, spawn bool) (*TerminalDaemonClient, error) {
+	c := &TerminalDaemonClient{socket: socket}
+	_, err := c.list()
+	if err == nil {
+		return c, nil
+	}
+	if errors.Is(err, errDaemonVersion) {
+		log.Printf("[TerminalDaemon] %v", err)
+		return nil, fmt.Errorf("%w: stop the daemon on %s (ending its shells) or set another TERMINAL_DAEMON_SOCKET", err, socket)
+	}
+	if !spawn {
+		return nil, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(socket+".log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(exe, TerminalDaemonArg, socket)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start terminal daemon: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }() // reaps it should it die before the server
+
+	deadline := time.After(daemonDialTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("terminal daemon exited: %v (see %s.log)", err, socket)
+		case <-deadline:
+			return nil, errors.New("terminal daemon did not come up")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err := c.list(); err == nil {
+			log.Printf("[TerminalDaemon] started pid=%d socket=%s", cmd.Process.Pid, socket)
+			return c, nil
+		}
+	}
+}
+
+// call sends a request and reads the response. The connection is returned
+// open only for a successful spawn or attach, which continue with frames.
+func (c *TerminalDaemonClient) call(req daemonRequest) (net.Conn, *bufio.Reader, daemonResponse, error) {
+	var resp daemonResponse
+	conn, err := net.DialTimeout("unix", c.socket, daemonDialTimeout)
+	if err != nil {
+		return nil, nil, resp, err
+	}
+	conn.SetDeadline(time.Now().Add(daemonHandshakeTimeout))
+	r := bufio.NewReader(conn)
+	req.Version = daemonProtocolVersion
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		conn.Close()
+		return nil, nil, resp, err
+	}
+	line, err := r.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &resp)
+	}
+	if err == nil && resp.Version != daemonProtocolVersion {
+		err = fmt.Errorf("%w: daemon speaks protocol %d, server %d", errDaemonVersion, resp.Version, daemonProtocolVersion)
+	}
+	if err == nil && resp.Error != "" {
+		err = errors.New(resp.Error)
+	}
+	if err != nil || resp.Shell == nil {
+		conn.Close()
+		return nil, nil, resp, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, resp, nil
+}
+
+func (c *TerminalDaemonClient) list() ([]daemonShellInfo, error) {
+	_, _, resp, err := c.call(daemonRequest{Op: "list"})
+	return resp.Shells, err
+}
+
+func (c *TerminalDaemonClient) spawn(key string, spec shellSpec) (*remoteShell, daemonShellInfo, error) {
+	return c.open(daemonRequest{Op: "spawn", Key: key, Spec: &spec})
+}
+
+func (c *TerminalDaemonClient) attach(key string) (*remoteShell, daemonShellInfo, error) {
+	return c.open(daemonRequest{Op: "attach", Key: key})
+}
+
+func (c *TerminalDaemonClient) open(req daemonRequest) (*remoteShell, daemonShellInfo, error) {
+	conn, r, resp, err := c.call(req)
+	if err != nil {
+		return nil, daemonShellInfo{}, err
+	}
+	return &remoteShell{conn: conn, r: r, pid: resp.Shell.PID}, *resp.Shell, nil
+}
+
+func (c *TerminalDaemonClient) setLabel(key, label string) error {
+	_, _, _, err := c.call(daemonRequest{Op: "label", Key: key, Label: label})
+	return err
+}
+
+// remoteShell is a shell held by the terminal daemon, reached through an
+// attached connection. Closing it only detaches; Kill ends the shell.
+type remoteShell struct {
+	conn net.Conn
+	r    *bufio.Reader
+	pid  int
+
+	pending []byte     // rest of a data frame not read yet
+	wmu     sync.Mutex // serializes frames to the daemon
+}
+
+func (s *remoteShell) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		typ, payload, err := readFrame(s.r)
+		if err != nil || typ == frameExit {
+			return 0, io.EOF
+		}
+		if typ == frameData {
+			s.pending = payload
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *remoteShell) Write(p []byte) (int, error) {
+	if err := s.send(frameData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *remoteShell) Resize(rows, cols uint16) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], rows)
+	binary.BigEndian.PutUint16(payload[2:4], cols)
+	return s.send(frameResize, payload)
+}
+
+func (s *remoteShell) Pid() int     { return s.pid }
+func (s *remoteShell) Kill() error  { return s.send(frameKill, nil) }
+func (s *remoteShell) Close() error { return s.conn.Close() }
+
+func (s *remoteShell) send(typ byte, payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return writeFrame(s.conn, typ, payload)
+}
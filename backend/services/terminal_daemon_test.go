@@ -0,0 +1,168 @@
+//go:build !windows
+
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// outputRecorder is an attached client that records terminal output.
+type outputRecorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *outputRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *outputRecorder) Close() error { return nil }
+
+func (r *outputRecorder) Contains(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Contains(r.buf.Bytes(), []byte(s))
+}
+
+func TestTerminalDaemon_ShellsSurviveServerRestart(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	socket := filepath.Join(t.TempDir(), "terminals.sock")
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer ln.Close()
+	go newTerminalDaemon().serve(ln)
+	daemon, err := ConnectTerminalDaemon(socket, false)
+	require.NoError(t, err)
+
+	ws := &Workspace{UserID: uuid.New(), Dir: t.TempDir(), UID: -1, GID: -1}
+	before := NewTerminalService(TerminalOptions{Daemon: daemon})
+	session, err := before.Create(TerminalKey(ws.UserID, "main"), ws)
+	require.NoError(t, err)
+	out := &outputRecorder{}
+	session.AddWriter(out, out)
+	_, err = session.Write([]byte("echo hello-$((40+2))\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return out.Contains("hello-42") }, 5*time.Second, 20*time.Millisecond)
+	_, ok := before.SetLabel(ws.UserID, "main", "build")
+	require.True(t, ok)
+	pid := session.shell.Pid()
+
+	// The server goes away: its connection drops, the shell stays.
+	session.shell.Close()
+	select {
+	case <-session.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still attached")
+	}
+
+	after := NewTerminalService(TerminalOptions{Daemon: daemon})
+	require.NoError(t, after.Restore())
+	infos := after.List(ws.UserID)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "main", infos[0].InstanceID)
+	assert.Equal(t, "build", infos[0].Label)
+	assert.Equal(t, pid, infos[0].PID)
+	assert.True(t, infos[0].Alive)
+
+	// Reattached clients get the output from before the restart, and the
+	// shell still takes input.
+	restored, ok := after.Get(TerminalKey(ws.UserID, "main"))
+	require.True(t, ok)
+	out = &outputRecorder{}
+	require.Eventually(t, func() bool {
+		restored.mw.mu.Lock()
+		defer restored.mw.mu.Unlock()
+		return bytes.Contains(restored.mw.replayBuf, []byte("hello-42"))
+	}, 5*time.Second, 20*time.Millisecond)
+	restored.AddWriter(out, out)
+	require.Eventually(t, func() bool { return out.Contains("hello-42") }, 5*time.Second, 20*time.Millisecond)
+	_, err = restored.Write([]byte("echo again-$((1+1))\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return out.Contains("again-2") }, 5*time.Second, 20*time.Millisecond)
+
+	// Killing it ends the shell in the daemon too.
+	require.True(t, after.Kill(ws.UserID, "main"))
+	require.Eventually(t, func() bool {
+		shells, err := daemon.list()
+		return err == nil && len(shells) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestParseTerminalKey(t *testing.T) {
+	userID := uuid.New()
+	got, ok := parseTerminalKey(TerminalKey(userID, "a:b"))
+	require.True(t, ok)
+	assert.Equal(t, userID, got)
+
+	for _, key := range []string{"", "term:", "term:not-a-uuid:x", "chat:" + userID.String() + ":x"} {
+		_, ok := parseTerminalKey(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestTerminalDaemon_RefusesOtherProtocolVersions(t *testing.T) {
+	// A daemon left running by an older server, which knows no versions.
+	socket := filepath.Join(t.TempDir(), "old.sock")
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadBytes('\n')
+			conn.Write([]byte(`{"shells":[]}` + "\n"))
+			conn.Close()
+		}
+	}()
+	_, err = ConnectTerminalDaemon(socket, true)
+	assert.ErrorIs(t, err, errDaemonVersion, "refused, not replaced by a new daemon")
+
+	// And a current daemon turns away servers speaking another version.
+	socket = filepath.Join(t.TempDir(), "new.sock")
+	ln2, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer ln2.Close()
+	go newTerminalDaemon().serve(ln2)
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte(`{"op":"list"}` + "\n"))
+	var resp daemonResponse
+	require.NoError(t, json.NewDecoder(conn).Decode(&resp))
+	assert.Equal(t, daemonProtocolVersion, resp.Version)
+	assert.Contains(t, resp.Error, "protocol")
+	assert.Nil(t, resp.Shells)
+}
+
+func TestTerminalDaemon_SocketIsPrivateFromTheStart(t *testing.T) {
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	socket := filepath.Join(t.TempDir(), "terminals.sock")
+	ln, err := listenPrivate(socket)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0), info.Mode().Perm()&0077)
+	assert.Equal(t, 0, syscall.Umask(0), "the process umask is restored")
+}
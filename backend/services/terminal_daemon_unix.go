@@ -0,0 +1,17 @@
+//go:build !windows
+
+package services
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate listens on a Unix socket that only the daemon's user can
+// connect to. The umask applies from the moment the socket is created, so
+// there's no window before a chmod in which anyone else could connect.
+func listenPrivate(socket string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", socket)
+}
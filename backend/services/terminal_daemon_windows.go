@@ -0,0 +1,9 @@
+package services
+
+import "net"
+
+// listenPrivate listens on a Unix socket. Windows has no umask; the socket
+// inherits the ACL of its directory.
+func listenPrivate(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
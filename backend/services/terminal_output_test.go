@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient is an attached client that can be made to stall.
+type fakeClient struct {
+	gate chan struct{} // writes block until it is closed (nil = never block)
+
+	mu   sync.Mutex
+	out  bytes.Buffer
+	msgs []any
+}
+
+func (c *fakeClient) Write(p []byte) (int, error) {
+	if c.gate != nil {
+		<-c.gate
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+
+func (c *fakeClient) WriteJSON(v any) error {
+	if c.gate != nil {
+		<-c.gate
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, v)
+	return nil
+}
+
+func (c *fakeClient) Close() error { return nil }
+
+func (c *fakeClient) output() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.String()
+}
+
+func (c *fakeClient) messages() []any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]any(nil), c.msgs...)
+}
+
+func TestMultiWriter_SlowClientDoesNotStallOthers(t *testing.T) {
+	var totals outputCounters
+	mw := newMultiWriter(&totals)
+	slow := &fakeClient{gate: make(chan struct{})}
+	fast := &fakeClient{}
+	mw.Add(slow, slow)
+	mw.Add(fast, fast)
+
+	chunk := []byte(strings.Repeat("x", 8191) + "\n")
+	total := 2 * writerQueueCap
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Paced so that the fast client keeps up with every chunk.
+		for n := 0; n < total; n += len(chunk) {
+			mw.Write(chunk)
+			for len(fast.output()) < n+len(chunk) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		mw.Write([]byte("last-line"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("output stalled behind a stalled client")
+	}
+	require.Eventually(t, func() bool { return strings.HasSuffix(fast.output(), "last-line") }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, total+len("last-line"), len(fast.output()))
+	assert.NotContains(t, fast.output(), string(resyncPrefix))
+
+	// The stalled client fell behind and is redrawn from the replay buffer.
+	close(slow.gate)
+	require.Eventually(t, func() bool { return strings.HasSuffix(slow.output(), "last-line") }, 5*time.Second, 10*time.Millisecond)
+	out := slow.output()
+	assert.Contains(t, out, string(resyncPrefix))
+	assert.Less(t, len(out), total)
+
+	stats := mw.Stats()
+	assert.Positive(t, stats.Resyncs)
+	assert.Positive(t, stats.DroppedBytes)
+	assert.Equal(t, stats, totals.snapshot())
+	assert.Equal(t, 2, mw.Len())
+}
+
+func TestWriterQueue_CoalescesStatusMessages(t *testing.T) {
+	client := &fakeClient{}
+	q := newWriterQueue(client, client)
+
+	for i := 1; i <= 5; i++ {
+		assert.False(t, q.pushMessage(TerminalStatus{Type: "status", Stats: TerminalStats{Processes: i}}))
+	}
+	require.Len(t, q.msgs, 1)
+	assert.Equal(t, 5, q.msgs[0].(TerminalStatus).Stats.Processes)
+
+	dropped := 0
+	for i := 0; i < writerQueueMessages+3; i++ {
+		if q.pushMessage(TerminalNotice{Type: "notice", Message: "n"}) {
+			dropped++
+		}
+	}
+	assert.Equal(t, 4, dropped)
+	require.Len(t, q.msgs, writerQueueMessages)
+	for _, msg := range q.msgs {
+		assert.IsType(t, TerminalNotice{}, msg, "the status was the oldest and went first")
+	}
+
+	require.NoError(t, q.flush())
+	assert.Len(t, client.messages(), writerQueueMessages)
+	assert.Empty(t, q.msgs)
+}
+
+func TestWriterQueue_CountsOnlyDiscardedBytes(t *testing.T) {
+	client := &fakeClient{}
+	q := newWriterQueue(client, client)
+	backlog := []byte(strings.Repeat("a", writerQueueCap-10))
+	require.Zero(t, q.push(backlog, backlog))
+
+	// The new chunk overflows the queue, but it is part of the redraw: only
+	// the backlog is lost.
+	p := []byte(strings.Repeat("b", 20))
+	replay := append([]byte(strings.Repeat("a", 100)), p...)
+	assert.Equal(t, len(backlog), q.push(p, replay))
+	assert.Equal(t, string(resyncPrefix)+string(replay), string(q.data))
+
+	// A chunk longer than the replay buffer loses what didn't fit into it,
+	// on top of the backlog.
+	q.data = q.data[:0]
+	q.push([]byte("queued"), nil)
+	p = []byte(strings.Repeat("c", writerQueueCap+1))
+	assert.Equal(t, len("queued")+len(p)-50, q.push(p, p[len(p)-50:]))
+}
+
+func TestMultiWriter_DrainDeliversFinalOutput(t *testing.T) {
+	mw := newMultiWriter(nil)
+	mw.Write([]byte("prompt$ "))
+	client := &fakeClient{gate: make(chan struct{})}
+	mw.Add(client, client)
+	mw.Write([]byte("bye"))
+	mw.Notify(TerminalNotice{Type: "notice", Message: "Terminal closed"})
+
+	time.AfterFunc(50*time.Millisecond, func() { close(client.gate) })
+	mw.Drain(5 * time.Second)
+	assert.Equal(t, "prompt$ bye", client.output())
+	assert.Equal(t, []any{TerminalNotice{Type: "notice", Message: "Terminal closed"}}, client.messages())
+}
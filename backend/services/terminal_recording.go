@@ -0,0 +1,425 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Terminal recordings are asciicast v2 files
+// (https://docs.asciinema.org/manual/asciicast/v2/): a JSON header line
+// followed by one JSON array per event.
+
+var (
+	// ErrTerminalNotFound is returned for a terminal instance the user doesn't have.
+	ErrTerminalNotFound = errors.New("terminal not found")
+	ErrNotRecording     = errors.New("terminal is not being recorded")
+	// ErrInvalidRecording is returned for a name that isn't a plain recording file name.
+	ErrInvalidRecording = errors.New("invalid recording name")
+)
+
+const (
+	castExt = ".cast"
+
+	maxCastLine = 1 << 20
+)
+
+// CastHeader is the first line of an asciicast v2 file.
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// CastEvent is one event of a recording, stored as [time, code, data].
+type CastEvent struct {
+	Time float64 // seconds since the recording started
+	Code string  // "o" output, "i" input, "r" resize ("COLSxROWS")
+	Data string
+}
+
+func (e CastEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time, e.Code, e.Data})
+}
+
+func (e *CastEvent) UnmarshalJSON(b []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("event has %d fields, want 3", len(fields))
+	}
+	if err := json.Unmarshal(fields[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields[1], &e.Code); err != nil {
+		return err
+	}
+	return json.Unmarshal(fields[2], &e.Data)
+}
+
+// RecordingInfo describes a recording in a user's recordings directory.
+type RecordingInfo struct {
+	Name       string    `json:"name"`
+	Title      string    `json:"title"`
+	Size       int64     `json:"size"`
+	StartedAt  time.Time `json:"started_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Active     bool      `json:"active"` // still being recorded
+}
+
+// RecordingsDir is where a user's terminal recordings are kept: a hidden
+// directory of their own workspace, or of their directory in the data dir
+// when the workspace is shared.
+func (w *Workspace) RecordingsDir() string {
+	return filepath.Join(w.privateDir(), ".terminal-recordings")
+}
+
+var recordingNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// RecordingPath returns the real path of a recording by name, rejecting
+// names that aren't plain recording file names. The recordings directory is
+// in the user's reach, so symlinks are resolved and must not lead out of
+// their workspace.
+func (w *Workspace) RecordingPath(name string) (string, error) {
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, castExt) {
+		return "", ErrInvalidRecording
+	}
+	dir := w.RecordingsDir()
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		// Not recorded yet: the directory it will be created in has to stay put.
+		if path, err = filepath.EvalSymlinks(dir); err == nil {
+			path = filepath.Join(path, name)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if !IsWithinDir(resolvedDir(w.privateDir()), path) {
+		return "", fmt.Errorf("recording %s is outside the workspace", name)
+	}
+	return path, nil
+}
+
+// castRecorder appends a shell's events to a recording.
+type castRecorder struct {
+	name  string
+	start time.Time
+	input bool // record keystrokes too (they can hold passwords)
+
+	mu      sync.Mutex
+	f       *os.File          // nil once closed
+	partial map[string][]byte // per event code, a UTF-8 sequence split by the last write
+}
+
+func newCastRecorder(path string, header CastHeader, input bool) (*castRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	header.Version = 2
+	header.Timestamp = start.Unix()
+	line, err := json.Marshal(header)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &castRecorder{name: filepath.Base(path), start: start, input: input, f: f, partial: make(map[string][]byte)}, nil
+}
+
+func (r *castRecorder) event(code string, p []byte) {
+	if code == "i" && !r.input {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return
+	}
+
+	// Event data is a JSON string: hold back a trailing UTF-8 sequence cut
+	// in half by the PTY read until the rest of it arrives.
+	data := append(r.partial[code], p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.partial[code] = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return
+	}
+
+	elapsed := math.Round(time.Since(r.start).Seconds()*1e6) / 1e6
+	line, _ := json.Marshal(CastEvent{Time: elapsed, Code: code, Data: string(data[:cut])})
+	if _, err := r.f.Write(append(line, '\n')); err != nil {
+		log.Printf("[TerminalService] recording %s failed: %v", r.name, err)
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+func (r *castRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// StartRecording records one of a user's shells (output and resizes, and
+// with input set what they type as well, like asciinema's --stdin) into a
+// new file in their recordings directory, or returns the recording already
+// in progress. Recording stops when the shell exits or the server restarts.
+func (s *TerminalService) StartRecording(ws *Workspace, instanceID string, input bool) (RecordingInfo, error) {
+	session, ok := s.Get(TerminalKey(ws.UserID, instanceID))
+	if !ok {
+		return RecordingInfo{}, ErrTerminalNotFound
+	}
+	session.recordMu.Lock()
+	defer session.recordMu.Unlock()
+	if rec := session.recorder.Load(); rec != nil {
+		return recordingInfo(ws, rec.name, true)
+	}
+
+	dir := ws.RecordingsDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return RecordingInfo{}, err
+	}
+
+	title := instanceID
+	if label := session.label.Load(); label != nil && *label != "" {
+		title = *label
+	}
+	name := recordingNameUnsafe.ReplaceAllString(instanceID, "_") + "-" + time.Now().Format("20060102-150405") + castExt
+	path, err := ws.RecordingPath(name)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	rows, cols := session.size()
+	rec, err := newCastRecorder(path, CastHeader{
+		Width:  int(cols),
+		Height: int(rows),
+		Title:  title,
+		Env:    map[string]string{"TERM": "xterm-256color"},
+	}, input)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	if ws.perUser {
+		// Recordings of users of the shared workspace stay the server's.
+		if err := ws.Own(dir); err != nil {
+			log.Printf("[TerminalService] failed to hand recording to %s: %v", ws.Username, err)
+		}
+	}
+	session.recorder.Store(rec)
+	log.Printf("[TerminalService] recording started file=%s", path)
+	return recordingInfo(ws, name, true)
+}
+
+// StopRecording stops recording one of a user's shells.
+func (s *TerminalService) StopRecording(ws *Workspace, instanceID string) (RecordingInfo, error) {
+	session, ok := s.Get(TerminalKey(ws.UserID, instanceID))
+	if !ok {
+		return RecordingInfo{}, ErrTerminalNotFound
+	}
+	rec := session.stopRecording()
+	if rec == nil {
+		return RecordingInfo{}, ErrNotRecording
+	}
+	return recordingInfo(ws, rec.name, false)
+}
+
+// Recordings lists a user's recordings, newest first.
+func (s *TerminalService) Recordings(ws *Workspace) ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(ws.RecordingsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return []RecordingInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	active := make(map[string]bool)
+	for _, info := range s.List(ws.UserID) {
+		if info.Recording != "" {
+			active[info.Recording] = true
+		}
+	}
+	recordings := []RecordingInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), castExt) {
+			continue
+		}
+		info, err := recordingInfo(ws, entry.Name(), active[entry.Name()])
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, info)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].StartedAt.After(recordings[j].StartedAt) })
+	return recordings, nil
+}
+
+func recordingInfo(ws *Workspace, name string, active bool) (RecordingInfo, error) {
+	path, err := ws.RecordingPath(name)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	header, _, err := readCastHeader(f)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	return RecordingInfo{
+		Name:       name,
+		Title:      header.Title,
+		Size:       stat.Size(),
+		StartedAt:  time.Unix(header.Timestamp, 0),
+		ModifiedAt: stat.ModTime(),
+		Active:     active,
+	}, nil
+}
+
+func readCastHeader(r io.Reader) (CastHeader, *bufio.Scanner, error) {
+	var header CastHeader
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCastLine)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, nil, err
+		}
+		return header, nil, io.ErrUnexpectedEOF
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, nil, err
+	}
+	if header.Version != 2 {
+		return header, nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+	return header, scanner, nil
+}
+
+// PlayCast reads a recording and hands its header and then its events to
+// the callbacks at the pace they were recorded, sped up by speed and with
+// pauses shortened to idleLimit (0 = kept). Stops early when ctx is done
+// or a callback fails.
+func PlayCast(ctx context.Context, r io.Reader, speed float64, idleLimit time.Duration, onHeader func(CastHeader) error, onEvent func(CastEvent) error) error {
+	if speed <= 0 {
+		speed = 1
+	}
+	header, scanner, err := readCastHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := onHeader(header); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	var last float64
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var event CastEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue // e.g. a line still being written to an active recording
+		}
+		delay := time.Duration((event.Time - last) * float64(time.Second))
+		last = event.Time
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		if delay = time.Duration(float64(delay) / speed); delay > 0 {
+			timer.Reset(delay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if err := onEvent(event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func resolvedDir(dir string) string {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		return resolved
+	}
+	return dir
+}
+
+// MigrateRecordings moves the recordings of users of the shared workspace
+// out of it, from the per-user directories of <workspace>/.terminal-recordings
+// where earlier versions kept them, so other users can't browse them.
+func (m *WorkspaceManager) MigrateRecordings() {
+	if m.opts.PerUser {
+		return
+	}
+	legacy := filepath.Join(m.opts.Base, ".terminal-recordings")
+	entries, _ := os.ReadDir(legacy)
+	for _, entry := range entries {
+		userID, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		dst := m.shared(userID).RecordingsDir()
+		if _, err := os.Lstat(dst); err == nil {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(dst), 0700)
+		if err == nil {
+			err = os.Rename(filepath.Join(legacy, entry.Name()), dst)
+		}
+		if err != nil {
+			log.Printf("[TerminalService] failed to move recordings of user %s: %v", userID, err)
+		}
+	}
+	os.Remove(legacy) // only once empty
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCastRecorder_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.cast")
+	rec, err := newCastRecorder(path, CastHeader{Width: 120, Height: 40, Title: "build"}, true)
+	require.NoError(t, err)
+
+	// "é" split across two PTY reads must not be mangled.
+	e := []byte("é")
+	rec.event("o", append([]byte("caf"), e[0]))
+	rec.event("o", e[1:])
+	rec.event("i", []byte("ls\r"))
+	time.Sleep(20 * time.Millisecond)
+	rec.event("r", []byte("100x30"))
+	require.NoError(t, rec.Close())
+	rec.event("o", []byte("after close"))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var header CastHeader
+	var events []CastEvent
+	start := time.Now()
+	err = PlayCast(context.Background(), f, 1, 0,
+		func(h CastHeader) error { header = h; return nil },
+		func(e CastEvent) error { events = append(events, e); return nil })
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, 120, header.Width)
+	assert.Equal(t, 40, header.Height)
+	assert.Equal(t, "build", header.Title)
+	assert.Positive(t, header.Timestamp)
+	require.Len(t, events, 4)
+	assert.Equal(t, CastEvent{Time: events[0].Time, Code: "o", Data: "caf"}, events[0])
+	assert.Equal(t, "é", events[1].Data)
+	assert.Equal(t, "i", events[2].Code)
+	assert.Equal(t, "r", events[3].Code)
+	assert.Equal(t, "100x30", events[3].Data)
+	assert.GreaterOrEqual(t, events[3].Time, 0.02)
+	// Played back at the recorded pace.
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
+
+func TestPlayCast_SpeedAndIdleLimit(t *testing.T) {
+	cast := `{"version": 2, "width": 80, "height": 24}
+[0.5, "o", "a"]
+[60.5, "o", "b"]
+`
+	var got []string
+	start := time.Now()
+	err := PlayCast(context.Background(), strings.NewReader(cast), 10, 100*time.Millisecond,
+		func(CastHeader) error { return nil },
+		func(e CastEvent) error { got = append(got, e.Data); return nil })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, got)
+	// 0.5s/10 + min(60s, 100ms)/10
+	assert.Less(t, time.Since(start), time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = PlayCast(ctx, strings.NewReader(cast), 1, 0,
+		func(CastHeader) error { return nil },
+		func(CastEvent) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+
+	err = PlayCast(context.Background(), strings.NewReader(`{"version": 1}`+"\n"), 1, 0,
+		func(CastHeader) error { return nil },
+		func(CastEvent) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestCastRecorder_InputIsOptIn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.cast")
+	rec, err := newCastRecorder(path, CastHeader{Width: 80, Height: 24}, false)
+	require.NoError(t, err)
+	rec.event("i", []byte("hunter2\r"))
+	rec.event("o", []byte("$ "))
+	require.NoError(t, rec.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+	assert.Contains(t, string(data), `"o","$ "`)
+}
+
+func TestWorkspace_RecordingPath(t *testing.T) {
+	dir := resolvedDir(t.TempDir())
+	ws := &Workspace{Dir: dir, perUser: true}
+	require.NoError(t, os.MkdirAll(ws.RecordingsDir(), 0700))
+	path, err := ws.RecordingPath("main-20260101-120000.cast")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, ".terminal-recordings", "main-20260101-120000.cast"), path)
+
+	for _, name := range []string{"../x.cast", ".hidden.cast", "notes.txt", "a/b.cast", ""} {
+		_, err := ws.RecordingPath(name)
+		assert.ErrorIs(t, err, ErrInvalidRecording, name)
+	}
+
+	// Symlinks planted in the workspace can't lead out of it, whether to an
+	// existing file or a directory a recording would be created in.
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0600))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(ws.RecordingsDir(), "leak.cast")))
+	_, err = ws.RecordingPath("leak.cast")
+	assert.Error(t, err)
+	require.NoError(t, os.RemoveAll(ws.RecordingsDir()))
+	require.NoError(t, os.Symlink(outside, ws.RecordingsDir()))
+	_, err = ws.RecordingPath("new.cast")
+	assert.Error(t, err)
+}
+
+func TestWorkspace_SharedRecordingsStayOutOfTheWorkspace(t *testing.T) {
+	base, data := t.TempDir(), t.TempDir()
+	m := NewWorkspaceManager(nil, WorkspaceOptions{Base: base, DataDir: data})
+	userID := uuid.New()
+	legacy := filepath.Join(base, ".terminal-recordings", userID.String())
+	require.NoError(t, os.MkdirAll(legacy, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(legacy, "main.cast"), []byte("{}\n"), 0600))
+
+	m.MigrateRecordings()
+
+	ws, err := m.For(userID)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(data, "users", userID.String(), ".terminal-recordings"), ws.RecordingsDir())
+	assert.FileExists(t, filepath.Join(ws.RecordingsDir(), "main.cast"))
+	assert.NoDirExists(t, filepath.Join(base, ".terminal-recordings"))
+}
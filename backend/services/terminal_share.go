@@ -0,0 +1,188 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrShareNotFound is returned for unknown, revoked or expired share
+	// tokens, and for shares of shells that are gone.
+	ErrShareNotFound = errors.New("share not found")
+	// ErrShareNeedsLogin is returned to anonymous viewers of a share that
+	// only admits signed-in users.
+	ErrShareNeedsLogin = errors.New("share requires sign-in")
+)
+
+// TerminalShare is a read-only link to one of a user's shells.
+type TerminalShare struct {
+	ID         string           `json:"id"`
+	Token      string           `json:"token"`
+	InstanceID string           `json:"instance_id"`
+	Anonymous  bool             `json:"anonymous"` // viewers needn't sign in
+	CreatedAt  time.Time        `json:"created_at"`
+	ExpiresAt  time.Time        `json:"expires_at"`
+	Viewers    []TerminalViewer `json:"viewers"`
+}
+
+// TerminalViewer is someone watching a shared shell.
+type TerminalViewer struct {
+	UserID      *uuid.UUID `json:"user_id,omitempty"` // nil for anonymous viewers
+	Username    string     `json:"username,omitempty"`
+	RemoteAddr  string     `json:"remote_addr"`
+	ConnectedAt time.Time  `json:"connected_at"`
+}
+
+// terminalShare is a share as the service keeps it; guarded by sharesMu.
+type terminalShare struct {
+	TerminalShare
+	ownerID uuid.UUID
+	session *TerminalSession // the shell it was minted for, not a later one under the same key
+	viewers map[io.Writer]*shareViewer
+}
+
+type shareViewer struct {
+	TerminalViewer
+	closer io.Closer
+	expiry *time.Timer
+}
+
+// ShareTerminal mints a read-only share of one of a user's shells that is
+// valid for ttl.
+func (s *TerminalService) ShareTerminal(userID uuid.UUID, instanceID string, ttl time.Duration, anonymous bool) (TerminalShare, error) {
+	session, ok := s.Get(TerminalKey(userID, instanceID))
+	if !ok {
+		return TerminalShare{}, ErrTerminalNotFound
+	}
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	now := time.Now()
+	share := &terminalShare{
+		TerminalShare: TerminalShare{
+			ID:         uuid.NewString(),
+			Token:      hex.EncodeToString(buf),
+			InstanceID: instanceID,
+			Anonymous:  anonymous,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(ttl),
+		},
+		ownerID: userID,
+		session: session,
+		viewers: make(map[io.Writer]*shareViewer),
+	}
+
+	s.sharesMu.Lock()
+	defer s.sharesMu.Unlock()
+	s.pruneSharesLocked(now)
+	s.shares[share.Token] = share
+	return share.snapshot(), nil
+}
+
+// Shares lists the live shares of one of a user's shells with their
+// current viewers, oldest first.
+func (s *TerminalService) Shares(userID uuid.UUID, instanceID string) ([]TerminalShare, error) {
+	if _, ok := s.Get(TerminalKey(userID, instanceID)); !ok {
+		return nil, ErrTerminalNotFound
+	}
+	s.sharesMu.Lock()
+	defer s.sharesMu.Unlock()
+	s.pruneSharesLocked(time.Now())
+	shares := []TerminalShare{}
+	for _, share := range s.shares {
+		if share.ownerID == userID && share.InstanceID == instanceID {
+			shares = append(shares, share.snapshot())
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].CreatedAt.Before(shares[j].CreatedAt) })
+	return shares, nil
+}
+
+// RevokeShare invalidates a share and disconnects its viewers. Returns
+// false if the user has no such share.
+func (s *TerminalService) RevokeShare(userID uuid.UUID, instanceID, shareID string) bool {
+	s.sharesMu.Lock()
+	defer s.sharesMu.Unlock()
+	for token, share := range s.shares {
+		if share.ownerID == userID && share.InstanceID == instanceID && share.ID == shareID {
+			s.dropShareLocked(token, share)
+			return true
+		}
+	}
+	return false
+}
+
+// ViewShare attaches w to a shared shell as a read-only viewer until the
+// share expires or is revoked, when closer is closed. The returned func
+// detaches it. viewer.UserID is nil for viewers who aren't signed in.
+func (s *TerminalService) ViewShare(token string, viewer TerminalViewer, w io.Writer, closer io.Closer) (*TerminalSession, func(), error) {
+	s.sharesMu.Lock()
+	share, ok := s.shares[token]
+	if !ok || !share.live(s, time.Now()) {
+		s.sharesMu.Unlock()
+		return nil, nil, ErrShareNotFound
+	}
+	if viewer.UserID == nil && !share.Anonymous {
+		s.sharesMu.Unlock()
+		return nil, nil, ErrShareNeedsLogin
+	}
+	viewer.ConnectedAt = time.Now()
+	v := &shareViewer{TerminalViewer: viewer, closer: closer}
+	v.expiry = time.AfterFunc(time.Until(share.ExpiresAt), func() { closer.Close() })
+	share.viewers[w] = v
+	session := share.session
+	s.sharesMu.Unlock()
+
+	session.AddWriter(w, closer)
+	detach := func() {
+		session.RemoveWriter(w)
+		v.expiry.Stop()
+		s.sharesMu.Lock()
+		delete(share.viewers, w)
+		s.sharesMu.Unlock()
+	}
+	return session, detach, nil
+}
+
+// live reports whether the share is unexpired and its shell still running.
+func (sh *terminalShare) live(s *TerminalService, now time.Time) bool {
+	if now.After(sh.ExpiresAt) || !sh.session.IsAlive() {
+		return false
+	}
+	current, ok := s.Get(TerminalKey(sh.ownerID, sh.InstanceID))
+	return ok && current == sh.session
+}
+
+func (sh *terminalShare) snapshot() TerminalShare {
+	out := sh.TerminalShare
+	out.Viewers = []TerminalViewer{}
+	for _, v := range sh.viewers {
+		out.Viewers = append(out.Viewers, v.TerminalViewer)
+	}
+	sort.Slice(out.Viewers, func(i, j int) bool { return out.Viewers[i].ConnectedAt.Before(out.Viewers[j].ConnectedAt) })
+	return out
+}
+
+// pruneSharesLocked forgets shares that can no longer be used.
+func (s *TerminalService) pruneSharesLocked(now time.Time) {
+	for token, share := range s.shares {
+		if !share.live(s, now) {
+			s.dropShareLocked(token, share)
+		}
+	}
+}
+
+func (s *TerminalService) dropShareLocked(token string, share *terminalShare) {
+	delete(s.shares, token)
+	for w, v := range share.viewers {
+		v.expiry.Stop()
+		share.session.RemoveWriter(w)
+		v.closer.Close()
+	}
+	share.viewers = map[io.Writer]*shareViewer{}
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"io"
+	"log"
+	"sync"
+
+	gopty "github.com/aymanbagabas/go-pty"
+)
+
+// shellProcess is a running shell: on a PTY of this process, or held by the
+// terminal daemon.
+type shellProcess interface {
+	io.ReadWriter // PTY output and input; Read returns io.EOF once the shell is gone
+	Resize(rows, cols uint16) error
+	Pid() int
+	Kill() error
+	Close() error
+}
+
+// shellSpec describes a shell to start. It is plain data so that it can be
+// handed to the terminal daemon.
+type shellSpec struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"` // including Args[0]
+	Env  []string `json:"env"`
+	Dir  string   `json:"dir"`
+	UID  int      `json:"uid"` // -1: run as the starting process's user
+	GID  int      `json:"gid"`
+
+	// Sandbox namespaces to create and cgroup to start in (see SandboxedCommand)
+	Cloneflags uintptr `json:"cloneflags,omitempty"`
+	CgroupDir  string  `json:"cgroup_dir,omitempty"`
+}
+
+// localShell is a shell on a PTY of this process.
+type localShell struct {
+	pty       gopty.Pty
+	cmd       *gopty.Cmd
+	closeOnce sync.Once // go-pty's Close isn't safe to call concurrently
+}
+
+func startLocalShell(key string, spec shellSpec) (*localShell, error) {
+	p, err := gopty.New()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := p.Command(spec.Path, spec.Args[1:]...)
+	cmd.Dir = spec.Dir
+	cmd.Env = spec.Env
+	attr, release, err := spec.sysProcAttr()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	defer release()
+	cmd.SysProcAttr = attr
+
+	if err := cmd.Start(); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	shell := &localShell{pty: p, cmd: cmd}
+
+	// Monitor process exit
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("[TerminalService] shell exited with error: %v (key=%s)", err, key)
+		} else {
+			log.Printf("[TerminalService] shell exited normally (key=%s)", key)
+		}
+		// Close PTY to unblock the output reader
+		shell.Close()
+	}()
+
+	return shell, nil
+}
+
+func (s *localShell) Read(p []byte) (int, error)  { return s.pty.Read(p) }
+func (s *localShell) Write(p []byte) (int, error) { return s.pty.Write(p) }
+func (s *localShell) Pid() int                    { return s.cmd.Process.Pid }
+func (s *localShell) Kill() error                 { return s.cmd.Process.Kill() }
+
+func (s *localShell) Close() error {
+	var err error
+	s.closeOnce.Do(func() { err = s.pty.Close() })
+	return err
+}
+
+func (s *localShell) Resize(rows, cols uint16) error {
+	return s.pty.Resize(int(cols), int(rows))
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package services
+
+import "syscall"
+
+// sysProcAttr sets up the user and sandbox the shell runs in. The returned
+// func releases what was only needed to start it.
+func (s shellSpec) sysProcAttr() (*syscall.SysProcAttr, func(), error) {
+	attr := &syscall.SysProcAttr{}
+	if s.UID >= 0 {
+		attr.Credential = &syscall.Credential{Uid: uint32(s.UID), Gid: uint32(s.GID), Groups: []uint32{}}
+	}
+	if s.Cloneflags == 0 && s.CgroupDir == "" {
+		return attr, func() {}, nil
+	}
+	release, err := sandboxAttr(attr, s.Cloneflags, s.CgroupDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attr, release, nil
+}
+
+// detachedProcAttr starts the terminal daemon in its own session, so it
+// isn't signalled along with the server's process group.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
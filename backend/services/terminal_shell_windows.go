@@ -0,0 +1,13 @@
+package services
+
+import "syscall"
+
+// sysProcAttr is always nil on Windows: shells are never isolated or
+// sandboxed there.
+func (s shellSpec) sysProcAttr() (*syscall.SysProcAttr, func(), error) {
+	return nil, func() {}, nil
+}
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat. It is
+// 100 on every Linux platform the server runs on.
+const clockTicks = 100
+
+// cpuStrikes is how many samples in a row a shell must spend over its CPU
+// limit before it is killed, so a short compile burst is tolerated.
+const cpuStrikes = 3
+
+// TerminalStats is the resource usage of a shell and all its descendants.
+type TerminalStats struct {
+	CPUPercent float64   `json:"cpu_percent"` // since the previous sample; 100 = one full core
+	RSSBytes   int64     `json:"rss_bytes"`
+	Processes  int       `json:"processes"` // the shell included
+	SampledAt  time.Time `json:"sampled_at"`
+}
+
+// TerminalLimits caps each shell's process tree (0 = unlimited).
+type TerminalLimits struct {
+	MemoryMB   int64   `json:"memory_mb"`
+	CPUPercent float64 `json:"cpu_percent"` // sustained over a few samples
+	Processes  int     `json:"processes"`
+}
+
+// TerminalStatus is pushed to attached clients after each sample.
+type TerminalStatus struct {
+	Type   string         `json:"type"` // "status"
+	Stats  TerminalStats  `json:"stats"`
+	Limits TerminalLimits `json:"limits"`
+}
+
+// TerminalNotice tells attached clients something happened to their shell.
+type TerminalNotice struct {
+	Type    string `json:"type"` // "notice"
+	Message string `json:"message"`
+}
+
+// procStat is what the sampler needs from one /proc/<pid>/stat.
+type procStat struct {
+	ppid     int
+	cpuTicks int64 // user + system time
+	rssPages int64
+}
+
+// treeUsage sums the usage of root and its descendants. prevTicks holds
+// each process's CPU ticks at the previous sample; processes not in it are
+// new, so all of their ticks count. Returns the ticks to remember for the
+// next sample.
+func treeUsage(procs map[int]procStat, root int, prevTicks map[int]int64) (deltaTicks, rssPages int64, count int, ticks map[int]int64) {
+	children := make(map[int][]int)
+	for pid, p := range procs {
+		children[p.ppid] = append(children[p.ppid], pid)
+	}
+
+	ticks = make(map[int]int64)
+	queue := []int{root}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		p, ok := procs[pid]
+		if !ok {
+			continue
+		}
+		count++
+		rssPages += p.rssPages
+		ticks[pid] = p.cpuTicks
+		if delta := p.cpuTicks - prevTicks[pid]; delta > 0 {
+			deltaTicks += delta
+		}
+		queue = append(queue, children[pid]...)
+	}
+	return deltaTicks, rssPages, count, ticks
+}
+
+// exceeded returns why stats break the limits, or "" if they don't.
+// strikes counts the samples in a row spent over the CPU limit.
+func (l TerminalLimits) exceeded(stats TerminalStats, strikes *int) string {
+	if l.MemoryMB > 0 && stats.RSSBytes > l.MemoryMB*1024*1024 {
+		return fmt.Sprintf("memory use of %d MB is over the %d MB limit", stats.RSSBytes/(1024*1024), l.MemoryMB)
+	}
+	if l.Processes > 0 && stats.Processes > l.Processes {
+		return fmt.Sprintf("%d processes is over the limit of %d", stats.Processes, l.Processes)
+	}
+	if l.CPUPercent > 0 && stats.CPUPercent > l.CPUPercent {
+		*strikes++
+		if *strikes >= cpuStrikes {
+			return fmt.Sprintf("CPU use of %.0f%% stayed over the %.0f%% limit", stats.CPUPercent, l.CPUPercent)
+		}
+	} else {
+		*strikes = 0
+	}
+	return ""
+}
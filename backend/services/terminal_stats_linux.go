@@ -0,0 +1,63 @@
+//go:build linux
+
+package services
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readProcTable reads the parent, CPU time and RSS of every process.
+func readProcTable() (map[int]procStat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[int]procStat, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue // exited meanwhile
+		}
+		if p, err := parseProcStat(data); err == nil {
+			procs[pid] = p
+		}
+	}
+	return procs, nil
+}
+
+// parseProcStat parses /proc/<pid>/stat. The command name comes in
+// parentheses and may contain anything, so fields are counted from the
+// last closing one.
+func parseProcStat(data []byte) (procStat, error) {
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return procStat{}, errors.New("malformed stat")
+	}
+	// Fields from 3 (state) on; ppid is 4, utime 14, stime 15, rss 24.
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return procStat{}, errors.New("short stat")
+	}
+	num := func(i int) int64 {
+		n, _ := strconv.ParseInt(fields[i-3], 10, 64)
+		return n
+	}
+	return procStat{
+		ppid:     int(num(4)),
+		cpuTicks: num(14) + num(15),
+		rssPages: num(24),
+	}, nil
+}
+
+func killProcess(pid int) {
+	syscall.Kill(pid, syscall.SIGKILL)
+}
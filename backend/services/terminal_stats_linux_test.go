@@ -0,0 +1,120 @@
+package services
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcStat(t *testing.T) {
+	// The command name may hold spaces and parentheses.
+	line := "4242 (my (odd) cmd) S 17 4242 4242 0 -1 4194560 100 0 0 0 25 12 0 0 20 0 1 0 12345 10485760 640 18446744073709551615"
+	p, err := parseProcStat([]byte(line))
+	require.NoError(t, err)
+	assert.Equal(t, procStat{ppid: 17, cpuTicks: 37, rssPages: 640}, p)
+
+	_, err = parseProcStat([]byte("4242 (cmd) S 17"))
+	assert.Error(t, err)
+}
+
+// jsonRecorder is an attached client that records control messages.
+type jsonRecorder struct {
+	mu   sync.Mutex
+	msgs []any
+}
+
+func (r *jsonRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (r *jsonRecorder) Close() error                { return nil }
+func (r *jsonRecorder) WriteJSON(v any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, v)
+	return nil
+}
+
+func TestTerminalService_SamplesAndKillsOverLimit(t *testing.T) {
+	// A "shell" that forks a few background jobs.
+	shell := filepath.Join(t.TempDir(), "shell")
+	require.NoError(t, os.WriteFile(shell, []byte("#!/bin/sh\nfor i in 1 2 3 4 5 6 7 8; do sleep 60 & done\nwait\n"), 0755))
+	t.Setenv("SHELL", shell)
+
+	s := NewTerminalService(TerminalOptions{SampleInterval: time.Second})
+	ws := &Workspace{UserID: uuid.New(), Dir: t.TempDir(), UID: -1, GID: -1}
+	key := TerminalKey(ws.UserID, "main")
+	session, err := s.Create(key, ws)
+	require.NoError(t, err)
+	defer session.Close()
+	client := &jsonRecorder{}
+	session.AddWriter(client, client)
+
+	// Wait for the shell to have started.
+	var infos []TerminalInfo
+	require.Eventually(t, func() bool {
+		s.sampleAll()
+		infos = s.List(ws.UserID)
+		return len(infos) == 1 && infos[0].Stats != nil && infos[0].Stats.RSSBytes > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "main", infos[0].InstanceID)
+	assert.GreaterOrEqual(t, infos[0].Stats.Processes, 1)
+	assert.Empty(t, s.List(uuid.New()))
+
+	// Once it's over the limit, a sample kills it and tells the client.
+	s.opts.Limits = TerminalLimits{Processes: 5}
+	require.Eventually(t, func() bool {
+		s.sampleAll()
+		_, ok := s.Get(key)
+		return !ok
+	}, 5*time.Second, 100*time.Millisecond)
+
+	select {
+	case <-session.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell still running")
+	}
+	// Background jobs die with it.
+	out, _ := exec.Command("pgrep", "-f", "^sleep 60$").Output()
+	assert.Empty(t, strings.TrimSpace(string(out)))
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	require.NotEmpty(t, client.msgs)
+	assert.IsType(t, TerminalStatus{}, client.msgs[0])
+	notice, ok := client.msgs[len(client.msgs)-1].(TerminalNotice)
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(notice.Message, "Terminal killed: "), notice.Message)
+}
+
+func TestTerminalService_ReapsIdleShells(t *testing.T) {
+	s := NewTerminalService(TerminalOptions{IdleTimeout: time.Hour})
+	ws := &Workspace{UserID: uuid.New(), Dir: t.TempDir(), UID: -1, GID: -1}
+
+	attached, err := s.Create(TerminalKey(ws.UserID, "attached"), ws)
+	require.NoError(t, err)
+	defer attached.Close()
+	client := &jsonRecorder{}
+	attached.AddWriter(client, client)
+	detached, err := s.Create(TerminalKey(ws.UserID, "detached"), ws)
+	require.NoError(t, err)
+	defer detached.Close()
+
+	s.reapIdle(time.Now())
+	assert.Len(t, s.List(ws.UserID), 2, "nothing is idle yet")
+
+	s.reapIdle(time.Now().Add(2 * time.Hour))
+	infos := s.List(ws.UserID)
+	require.Len(t, infos, 1, "only the detached shell is reaped")
+	assert.Equal(t, "attached", infos[0].InstanceID)
+	select {
+	case <-detached.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaped shell still running")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package services
+
+import "errors"
+
+func readProcTable() (map[int]procStat, error) {
+	return nil, errors.New("terminal resource sampling needs /proc")
+}
+
+func killProcess(pid int) {}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeUsage_SumsDescendantsOnly(t *testing.T) {
+	procs := map[int]procStat{
+		1:  {ppid: 0, cpuTicks: 1000, rssPages: 100}, // not part of the tree
+		10: {ppid: 1, cpuTicks: 50, rssPages: 10},    // the shell
+		11: {ppid: 10, cpuTicks: 30, rssPages: 20},
+		12: {ppid: 11, cpuTicks: 20, rssPages: 30},
+		13: {ppid: 1, cpuTicks: 5, rssPages: 40}, // a sibling of the shell
+	}
+
+	delta, rss, count, ticks := treeUsage(procs, 10, nil)
+	assert.Equal(t, int64(100), delta)
+	assert.Equal(t, int64(60), rss)
+	assert.Equal(t, 3, count)
+
+	// Only the ticks spent since the previous sample count; a process that
+	// went away doesn't make the total go negative.
+	procs[10] = procStat{ppid: 1, cpuTicks: 60, rssPages: 10}
+	delete(procs, 12)
+	delta, _, count, _ = treeUsage(procs, 10, ticks)
+	assert.Equal(t, int64(10), delta)
+	assert.Equal(t, 2, count)
+}
+
+func TestTerminalLimits_Exceeded(t *testing.T) {
+	limits := TerminalLimits{MemoryMB: 100, CPUPercent: 150, Processes: 5}
+	strikes := 0
+	stats := func(cpu float64, rssMB int64, procs int) TerminalStats {
+		return TerminalStats{CPUPercent: cpu, RSSBytes: rssMB * 1024 * 1024, Processes: procs, SampledAt: time.Now()}
+	}
+
+	assert.Empty(t, limits.exceeded(stats(10, 50, 2), &strikes))
+	assert.Contains(t, limits.exceeded(stats(10, 101, 2), &strikes), "memory")
+	assert.Contains(t, limits.exceeded(stats(10, 50, 6), &strikes), "processes")
+
+	// CPU has to stay over the limit for cpuStrikes samples in a row.
+	assert.Empty(t, limits.exceeded(stats(200, 50, 2), &strikes))
+	assert.Empty(t, limits.exceeded(stats(10, 50, 2), &strikes))
+	assert.Empty(t, limits.exceeded(stats(200, 50, 2), &strikes))
+	assert.Empty(t, limits.exceeded(stats(200, 50, 2), &strikes))
+	assert.Contains(t, limits.exceeded(stats(200, 50, 2), &strikes), "CPU")
+
+	assert.Empty(t, TerminalLimits{}.exceeded(stats(1000, 1<<20, 1000), &strikes))
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nebulide/models"
+)
+
+const (
+	titleMaxRunes = 60
+
+	// Conversation text sent per title/summary call; older messages are dropped first.
+	titlePromptBudget    = 8000
+	titleMessageMaxRunes = 2000
+)
+
+var ErrNothingToSummarize = errors.New("session has no messages")
+
+// SessionTitler names and summarizes chat sessions with a cheap one-shot
+// Claude call. The summary is a running one: each update folds the messages
+// added since the previous summary into it, so a call never needs the whole
+// conversation.
+type SessionTitler struct {
+	db         *gorm.DB
+	claude     *ClaudeService
+	usage      *UsageService
+	workspaces *WorkspaceManager
+	model      string
+
+	mu   sync.Mutex
+	busy map[uuid.UUID]bool // sessions with an update in flight
+}
+
+func NewSessionTitler(db *gorm.DB, claude *ClaudeService, usage *UsageService, workspaces *WorkspaceManager, model string) *SessionTitler {
+	return &SessionTitler{
+		db:         db,
+		claude:     claude,
+		usage:      usage,
+		workspaces: workspaces,
+		model:      model,
+		busy:       make(map[uuid.UUID]bool),
+	}
+}
+
+// Update folds new messages into the session's summary and, after the first
+// exchange of a session the user hasn't renamed, replaces its placeholder
+// title. Returns nil without error when there is nothing to do, including
+// when an update for the session is already running: the next one catches up.
+func (t *SessionTitler) Update(ctx context.Context, sessionID uuid.UUID) (*models.ChatSession, error) {
+	if !t.begin(sessionID) {
+		return nil, nil
+	}
+	defer t.end(sessionID)
+
+	var session models.ChatSession
+	if err := t.db.First(&session, "id = ?", sessionID).Error; err != nil {
+		return nil, err
+	}
+
+	query := t.db.Where("session_id = ?", sessionID).Order("created_at ASC")
+	if session.SummarizedAt != nil {
+		query = query.Where("created_at > ?", *session.SummarizedAt)
+	}
+	var messages []models.Message
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	wantTitle := !session.TitleLocked && session.SummarizedAt == nil
+	reply, err := t.generate(ctx, &session, titlePrompt(session.Summary, messages, wantTitle, true))
+	if err != nil {
+		return nil, err
+	}
+
+	last := messages[len(messages)-1].CreatedAt
+	updates := map[string]any{"summarized_at": last}
+	if reply.Summary != "" {
+		updates["summary"] = reply.Summary
+	}
+	if err := t.db.Model(&session).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	if wantTitle && reply.Title != "" {
+		// Don't overwrite a rename that happened while Claude was thinking.
+		t.db.Model(&models.ChatSession{}).
+			Where("id = ? AND title_locked = ?", sessionID, false).
+			Update("title", reply.Title)
+	}
+
+	err = t.db.First(&session, "id = ?", sessionID).Error
+	return &session, err
+}
+
+// Regenerate replaces the session's title with one generated from the whole
+// conversation and turns automatic titles back on.
+func (t *SessionTitler) Regenerate(ctx context.Context, sessionID uuid.UUID) (*models.ChatSession, error) {
+	var session models.ChatSession
+	if err := t.db.First(&session, "id = ?", sessionID).Error; err != nil {
+		return nil, err
+	}
+
+	var messages []models.Message
+	if err := t.db.Where("session_id = ?", sessionID).Order("created_at ASC").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrNothingToSummarize
+	}
+
+	reply, err := t.generate(ctx, &session, titlePrompt(session.Summary, messages, true, false))
+	if err != nil {
+		return nil, err
+	}
+	if reply.Title == "" {
+		return nil, errors.New("claude did not return a title")
+	}
+
+	if err := t.db.Model(&session).Updates(map[string]any{"title": reply.Title, "title_locked": false}).Error; err != nil {
+		return nil, err
+	}
+	session.Title, session.TitleLocked = reply.Title, false
+	return &session, nil
+}
+
+func (t *SessionTitler) generate(ctx context.Context, session *models.ChatSession, prompt string) (*titleReply, error) {
+	if t.usage != nil {
+		if err := t.usage.CheckQuota(session.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	ws, err := t.workspaces.For(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.claude.Complete(ctx, ws, prompt, t.model)
+	if res != nil && t.usage != nil {
+		if rerr := t.usage.Record(session.UserID, session.ID, nil, res); rerr != nil {
+			log.Printf("[Titles] failed to record usage: %v", rerr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseTitleReply(res.Text)
+}
+
+func (t *SessionTitler) begin(sessionID uuid.UUID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busy[sessionID] {
+		return false
+	}
+	t.busy[sessionID] = true
+	return true
+}
+
+func (t *SessionTitler) end(sessionID uuid.UUID) {
+	t.mu.Lock()
+	delete(t.busy, sessionID)
+	t.mu.Unlock()
+}
+
+// titlePrompt asks for a JSON object with the requested fields. The previous
+// summary stands in for everything before messages.
+func titlePrompt(summary string, messages []models.Message, wantTitle, wantSummary bool) string {
+	var b strings.Builder
+	b.WriteString("You label conversations between a user and an AI coding assistant.\n")
+	b.WriteString("Reply with a single JSON object and nothing else, with these fields:\n")
+	if wantTitle {
+		b.WriteString(`- "title": a concise title of at most 6 words, in the language the user writes in, without quotes or trailing punctuation` + "\n")
+	}
+	if wantSummary {
+		b.WriteString(`- "summary": 2 to 4 sentences on what the user is trying to do, what has been done and what is still open; merge the earlier summary in rather than repeating it` + "\n")
+	}
+	if summary != "" {
+		b.WriteString("\n<earlier_summary>\n" + summary + "\n</earlier_summary>\n")
+	}
+	b.WriteString("\n<conversation>\n" + conversationText(messages, titlePromptBudget) + "</conversation>\n")
+	return b.String()
+}
+
+// conversationText renders messages within a rune budget, keeping the first
+// message (it usually states the task) and as many of the latest as fit.
+func conversationText(messages []models.Message, budget int) string {
+	render := func(m models.Message) string {
+		role := "User"
+		if m.Role == "assistant" {
+			role = "Assistant"
+		}
+		content := strings.TrimSpace(m.Content)
+		if runes := []rune(content); len(runes) > titleMessageMaxRunes {
+			content = string(runes[:titleMessageMaxRunes]) + " [...]"
+		}
+		return role + ": " + content + "\n\n"
+	}
+
+	if len(messages) == 0 {
+		return ""
+	}
+	first := render(messages[0])
+	used := utf8.RuneCountInString(first)
+
+	var tail []string
+	for i := len(messages) - 1; i > 0; i-- {
+		text := render(messages[i])
+		n := utf8.RuneCountInString(text)
+		if used+n > budget {
+			tail = append(tail, "[earlier messages omitted]\n\n")
+			break
+		}
+		used += n
+		tail = append(tail, text)
+	}
+
+	var b strings.Builder
+	b.WriteString(first)
+	for i := len(tail) - 1; i >= 0; i-- {
+		b.WriteString(tail[i])
+	}
+	return b.String()
+}
+
+type titleReply struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// parseTitleReply extracts the JSON object from Claude's answer, tolerating
+// code fences or prose around it.
+func parseTitleReply(text string) (*titleReply, error) {
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON object in reply: %.100q", text)
+	}
+	var reply titleReply
+	if err := json.Unmarshal([]byte(text[start:end+1]), &reply); err != nil {
+		return nil, fmt.Errorf("invalid JSON in reply: %w", err)
+	}
+
+	title := strings.Trim(strings.TrimSpace(reply.Title), "\"'`«»“”")
+	title = strings.TrimRight(title, ".!;:")
+	reply.Title = TruncateTitle(title, titleMaxRunes)
+	reply.Summary = strings.TrimSpace(reply.Summary)
+	return &reply, nil
+}
+
+// TruncateTitle collapses whitespace and cuts s to at most max runes
+// (plus "..."), never splitting a multi-byte character.
+func TruncateTitle(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > max {
+		return strings.TrimSpace(string(runes[:max])) + "..."
+	}
+	return s
+}
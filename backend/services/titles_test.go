@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"nebulide/models"
+)
+
+func TestTruncateTitle_RuneSafe(t *testing.T) {
+	title := TruncateTitle(strings.Repeat("Привет ", 20), 50)
+	assert.True(t, strings.HasSuffix(title, "..."))
+	assert.Equal(t, 53, len([]rune(title)))
+	assert.NotContains(t, title, "�")
+
+	assert.Equal(t, "fix the build", TruncateTitle("fix\n  the build", 50))
+	assert.Equal(t, "short", TruncateTitle("  short ", 50))
+}
+
+func TestParseTitleReply(t *testing.T) {
+	reply, err := parseTitleReply("Sure!\n```json\n{\"title\": \"\\\"Fix flaky tests.\\\"\", \"summary\": \" Tests fixed. \"}\n```")
+	require.NoError(t, err)
+	assert.Equal(t, "Fix flaky tests", reply.Title)
+	assert.Equal(t, "Tests fixed.", reply.Summary)
+
+	_, err = parseTitleReply("no json here")
+	assert.Error(t, err)
+}
+
+func TestConversationText_KeepsFirstAndLatest(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	messages := []models.Message{
+		{Role: "user", Content: "the task"},
+		{Role: "assistant", Content: long},
+		{Role: "user", Content: long},
+		{Role: "assistant", Content: "latest"},
+	}
+
+	text := conversationText(messages, 400)
+	assert.True(t, strings.HasPrefix(text, "User: the task\n\n"))
+	assert.Contains(t, text, "[earlier messages omitted]")
+	assert.True(t, strings.HasSuffix(text, "Assistant: latest\n\n"))
+	assert.Equal(t, 1, strings.Count(text, long))
+}
+
+func TestClaudeComplete(t *testing.T) {
+	dir := t.TempDir()
+	argsLog := filepath.Join(dir, "args.log")
+	script := `#!/bin/sh
+echo "$*" > "` + argsLog + `"
+env > "` + argsLog + `.env"
+echo '{"type":"result","subtype":"success","is_error":false,"result":"hi there","usage":{"input_tokens":5,"output_tokens":2}}'
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "claude"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := NewClaudeService("Read", NewProcessScheduler(0, 0), LiveOptions{})
+	t.Setenv("JWT_SECRET", "server-only")
+	ws := &Workspace{UserID: uuid.New(), Username: "u1", Dir: dir, UID: -1, GID: -1, perUser: true}
+	res, err := s.Complete(context.Background(), ws, "say hi", "haiku")
+	require.NoError(t, err)
+	assert.Equal(t, "hi there", res.Text)
+	assert.Equal(t, 2, res.Usage.OutputTokens)
+
+	args, err := os.ReadFile(argsLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "--model haiku")
+	assert.Contains(t, string(args), "--max-turns 1")
+	assert.Contains(t, string(args), "--tools  --strict-mcp-config", "tools are off")
+
+	// The CLI gets the user's environment, not the server's.
+	env, err := os.ReadFile(argsLog + ".env")
+	require.NoError(t, err)
+	assert.NotContains(t, string(env), "JWT_SECRET")
+	assert.Contains(t, string(env), "HOME="+dir)
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nebulide/models"
+)
+
+// How often expired sessions are looked for.
+const trashPurgeInterval = time.Hour
+
+// SessionTrash implements soft deletion of chat sessions. Trashed sessions
+// stay restorable for the retention period, then Run purges them for good.
+type SessionTrash struct {
+	db        *gorm.DB
+	claude    *ClaudeService // nil in tests
+	queue     *ChatQueue     // nil in tests
+	streams   *ChatStreamHub // nil in tests
+	retention time.Duration  // 0 keeps trashed sessions until purged by hand
+	onPurge   func(models.ChatSession)
+}
+
+// NewSessionTrash creates the trash. onPurge removes what a purged session
+// owns outside the database (e.g. its attachment files).
+func NewSessionTrash(db *gorm.DB, claude *ClaudeService, queue *ChatQueue, streams *ChatStreamHub, retention time.Duration, onPurge func(models.ChatSession)) *SessionTrash {
+	return &SessionTrash{db: db, claude: claude, queue: queue, streams: streams, retention: retention, onPurge: onPurge}
+}
+
+// PurgeAt returns when a trashed session will be purged (nil = never).
+func (t *SessionTrash) PurgeAt(session *models.ChatSession) *time.Time {
+	if t.retention <= 0 || !session.DeletedAt.Valid {
+		return nil
+	}
+	at := session.DeletedAt.Time.Add(t.retention)
+	return &at
+}
+
+// Trash soft-deletes a session and stops its queued and running prompts.
+func (t *SessionTrash) Trash(session *models.ChatSession) error {
+	if err := t.db.Delete(session).Error; err != nil {
+		return err
+	}
+	if !session.DeletedAt.Valid {
+		session.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	}
+	t.stop(session)
+	return nil
+}
+
+// Restore brings a trashed session of userID back. Returns gorm.ErrRecordNotFound
+// when there is no such session in the trash.
+func (t *SessionTrash) Restore(sessionID, userID uuid.UUID) (*models.ChatSession, error) {
+	var session models.ChatSession
+	if err := t.db.Unscoped().
+		Where("id = ? AND user_id = ? AND deleted_at IS NOT NULL", sessionID, userID).
+		First(&session).Error; err != nil {
+		return nil, err
+	}
+	if err := t.db.Unscoped().Model(&session).Update("deleted_at", nil).Error; err != nil {
+		return nil, err
+	}
+	session.DeletedAt = gorm.DeletedAt{}
+	return &session, nil
+}
+
+// Purge permanently deletes sessions (trashed or not) with their messages.
+// Usage records are kept: they are the ledger quotas are computed from.
+func (t *SessionTrash) Purge(sessions ...models.ChatSession) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(sessions))
+	for i := range sessions {
+		ids[i] = sessions[i].ID
+		t.stop(&sessions[i])
+	}
+
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id IN ?", ids).Delete(&models.Message{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("id IN ?", ids).Delete(&models.ChatSession{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if t.onPurge != nil {
+		for _, s := range sessions {
+			t.onPurge(s)
+		}
+	}
+	return nil
+}
+
+// PurgeExpired purges every session that has been in the trash longer than
+// the retention period and returns how many there were.
+func (t *SessionTrash) PurgeExpired() (int, error) {
+	if t.retention <= 0 {
+		return 0, nil
+	}
+	var expired []models.ChatSession
+	if err := t.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-t.retention)).
+		Find(&expired).Error; err != nil {
+		return 0, err
+	}
+	return len(expired), t.Purge(expired...)
+}
+
+// Run purges expired sessions periodically until ctx is done.
+func (t *SessionTrash) Run(ctx context.Context) {
+	if t.retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := t.PurgeExpired(); err != nil {
+			log.Printf("[Trash] purge failed: %v", err)
+		} else if n > 0 {
+			log.Printf("[Trash] purged %d expired session(s)", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop drops the session's queued prompts, cancels its Claude process and
+// disconnects its clients, releasing the stream buffered for them.
+func (t *SessionTrash) stop(session *models.ChatSession) {
+	sessionKey := session.ID.String() + ":" + session.UserID.String()
+	if t.queue != nil {
+		if err := t.queue.Clear(context.Background(), sessionKey); err != nil {
+			log.Printf("[Trash] failed to clear queue (key=%s): %v", sessionKey, err)
+		}
+	}
+	if t.claude != nil {
+		t.claude.Cancel(sessionKey)
+	}
+	if t.streams != nil {
+		t.streams.Remove(sessionKey)
+	}
+}
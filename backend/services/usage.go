@@ -0,0 +1,203 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nebulide/models"
+)
+
+var ErrQuotaExceeded = errors.New("usage quota exceeded")
+
+// UsageQuota holds per-user limits. Zero means unlimited.
+type UsageQuota struct {
+	DailyTokens    int64
+	MonthlyTokens  int64
+	DailyCostUSD   float64
+	MonthlyCostUSD float64
+}
+
+// UsageTotals is an aggregate over a set of usage records.
+type UsageTotals struct {
+	Runs                int64   `json:"runs"`
+	InputTokens         int64   `json:"input_tokens"`
+	OutputTokens        int64   `json:"output_tokens"`
+	CacheCreationTokens int64   `json:"cache_creation_tokens"`
+	CacheReadTokens     int64   `json:"cache_read_tokens"`
+	CostUSD             float64 `json:"cost_usd"`
+	DurationMs          int64   `json:"duration_ms"`
+}
+
+// Tokens returns all tokens in the aggregate, the unit quotas are measured in.
+func (t UsageTotals) Tokens() int64 {
+	return t.InputTokens + t.OutputTokens + t.CacheCreationTokens + t.CacheReadTokens
+}
+
+func (t *UsageTotals) add(r models.UsageRecord) {
+	t.Runs++
+	t.InputTokens += int64(r.InputTokens)
+	t.OutputTokens += int64(r.OutputTokens)
+	t.CacheCreationTokens += int64(r.CacheCreationTokens)
+	t.CacheReadTokens += int64(r.CacheReadTokens)
+	t.CostUSD += r.CostUSD
+	t.DurationMs += r.DurationMs
+}
+
+type SessionUsage struct {
+	SessionID uuid.UUID `json:"session_id"`
+	UsageTotals
+}
+
+type DailyUsage struct {
+	Day string `json:"day"` // YYYY-MM-DD, UTC
+	UsageTotals
+}
+
+type UserUsage struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	UsageTotals
+}
+
+const usageSumColumns = "COUNT(*) AS runs, " +
+	"COALESCE(SUM(input_tokens), 0) AS input_tokens, " +
+	"COALESCE(SUM(output_tokens), 0) AS output_tokens, " +
+	"COALESCE(SUM(cache_creation_tokens), 0) AS cache_creation_tokens, " +
+	"COALESCE(SUM(cache_read_tokens), 0) AS cache_read_tokens, " +
+	"COALESCE(SUM(cost_usd), 0) AS cost_usd, " +
+	"COALESCE(SUM(duration_ms), 0) AS duration_ms"
+
+// UsageService is the Claude usage ledger: it records every run and enforces quotas.
+type UsageService struct {
+	db    *gorm.DB
+	quota UsageQuota
+}
+
+func NewUsageService(db *gorm.DB, quota UsageQuota) *UsageService {
+	return &UsageService{db: db, quota: quota}
+}
+
+func (s *UsageService) Quota() UsageQuota {
+	return s.quota
+}
+
+// Record stores the usage of a finished run. messageID may be nil when the run failed.
+func (s *UsageService) Record(userID, sessionID uuid.UUID, messageID *uuid.UUID, res *RunResult) error {
+	rec := models.UsageRecord{
+		UserID:              userID,
+		SessionID:           sessionID,
+		MessageID:           messageID,
+		InputTokens:         res.Usage.InputTokens,
+		OutputTokens:        res.Usage.OutputTokens,
+		CacheCreationTokens: res.Usage.CacheCreationInputTokens,
+		CacheReadTokens:     res.Usage.CacheReadInputTokens,
+		CostUSD:             res.CostUSD,
+		DurationMs:          res.DurationMs,
+	}
+	return s.db.Create(&rec).Error
+}
+
+// CheckQuota returns an error wrapping ErrQuotaExceeded if the user has used up
+// any of the configured daily or monthly limits.
+func (s *UsageService) CheckQuota(userID uuid.UUID) error {
+	q := s.quota
+	if q.DailyTokens == 0 && q.DailyCostUSD == 0 && q.MonthlyTokens == 0 && q.MonthlyCostUSD == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+
+	day, err := s.Totals(userID, DayStart(now), now)
+	if err != nil {
+		return err
+	}
+	if q.DailyTokens > 0 && day.Tokens() >= q.DailyTokens {
+		return fmt.Errorf("%w: daily limit of %d tokens reached", ErrQuotaExceeded, q.DailyTokens)
+	}
+	if q.DailyCostUSD > 0 && day.CostUSD >= q.DailyCostUSD {
+		return fmt.Errorf("%w: daily limit of $%.2f reached", ErrQuotaExceeded, q.DailyCostUSD)
+	}
+
+	month, err := s.Totals(userID, MonthStart(now), now)
+	if err != nil {
+		return err
+	}
+	if q.MonthlyTokens > 0 && month.Tokens() >= q.MonthlyTokens {
+		return fmt.Errorf("%w: monthly limit of %d tokens reached", ErrQuotaExceeded, q.MonthlyTokens)
+	}
+	if q.MonthlyCostUSD > 0 && month.CostUSD >= q.MonthlyCostUSD {
+		return fmt.Errorf("%w: monthly limit of $%.2f reached", ErrQuotaExceeded, q.MonthlyCostUSD)
+	}
+
+	return nil
+}
+
+// Totals aggregates a user's usage in [from, to).
+func (s *UsageService) Totals(userID uuid.UUID, from, to time.Time) (UsageTotals, error) {
+	var totals UsageTotals
+	err := s.db.Model(&models.UsageRecord{}).
+		Select(usageSumColumns).
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, to).
+		Scan(&totals).Error
+	return totals, err
+}
+
+// BySession aggregates a user's usage in [from, to) per chat session, most expensive first.
+func (s *UsageService) BySession(userID uuid.UUID, from, to time.Time) ([]SessionUsage, error) {
+	rows := []SessionUsage{}
+	err := s.db.Model(&models.UsageRecord{}).
+		Select("session_id, "+usageSumColumns).
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, to).
+		Group("session_id").
+		Order("cost_usd DESC").
+		Scan(&rows).Error
+	return rows, err
+}
+
+// ByDay aggregates a user's usage in [from, to) per UTC calendar day.
+// Grouping happens in Go so the query stays portable across PostgreSQL and SQLite.
+func (s *UsageService) ByDay(userID uuid.UUID, from, to time.Time) ([]DailyUsage, error) {
+	var records []models.UsageRecord
+	if err := s.db.Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, to).
+		Order("created_at ASC").
+		Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	days := []DailyUsage{}
+	for _, r := range records {
+		day := r.CreatedAt.UTC().Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Day != day {
+			days = append(days, DailyUsage{Day: day})
+		}
+		days[len(days)-1].add(r)
+	}
+	return days, nil
+}
+
+// ByUser aggregates usage of all users in [from, to), most expensive first (admin report).
+func (s *UsageService) ByUser(from, to time.Time) ([]UserUsage, error) {
+	rows := []UserUsage{}
+	err := s.db.Table("usage_records").
+		Select("usage_records.user_id, users.username, "+usageSumColumns).
+		Joins("JOIN users ON users.id = usage_records.user_id").
+		Where("usage_records.created_at >= ? AND usage_records.created_at < ?", from, to).
+		Group("usage_records.user_id, users.username").
+		Order("cost_usd DESC").
+		Scan(&rows).Error
+	return rows, err
+}
+
+// DayStart is midnight UTC of t's day; daily quotas and reports count from it.
+func DayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// MonthStart is midnight UTC on the first of t's month.
+func MonthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,435 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nebulide/models"
+)
+
+// Working directory errors. Their messages are meant to be shown to users.
+var (
+	ErrWorkingDirOutside  = errors.New("working directory is outside your workspace")
+	ErrWorkingDirNotFound = errors.New("working directory does not exist")
+	ErrWorkingDirNotDir   = errors.New("working directory is not a directory")
+)
+
+// ErrWorkspaceTaken is returned when a user's workspace path already exists
+// but isn't theirs.
+var ErrWorkspaceTaken = errors.New("workspace path exists and belongs to someone else")
+
+// ResolveWorkingDir validates dir as the working directory of a Claude
+// process. Relative paths are taken relative to the first root. The
+// directory must exist and, with symlinks resolved, lie within one of roots.
+// Returns the cleaned absolute path (symlinks kept, as the user wrote it).
+func ResolveWorkingDir(roots []string, dir string) (string, error) {
+	if len(roots) == 0 {
+		return "", ErrWorkingDirOutside
+	}
+	cleaned := filepath.Clean(dir)
+	if !filepath.IsAbs(cleaned) {
+		cleaned = filepath.Join(roots[0], cleaned)
+	}
+	abs, err := filepath.Abs(cleaned)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrWorkingDirNotFound, dir)
+	}
+	if !withinRoots(roots, abs, false) {
+		return "", fmt.Errorf("%w: %s", ErrWorkingDirOutside, dir)
+	}
+
+	// Check again with symlinks resolved, so a link can't lead outside.
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrWorkingDirNotFound, dir)
+		}
+		return "", err
+	}
+	if !withinRoots(roots, resolved, true) {
+		return "", fmt.Errorf("%w: %s", ErrWorkingDirOutside, dir)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%w: %s", ErrWorkingDirNotDir, dir)
+	}
+	return abs, nil
+}
+
+// withinRoots reports whether the absolute path lies within one of roots,
+// comparing against the roots' real paths when resolve is set.
+func withinRoots(roots []string, path string, resolve bool) bool {
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if resolve {
+			if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+				abs = resolved
+			}
+		}
+		if IsWithinDir(abs, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Project is a directory offered as a chat working directory.
+type Project struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Root string `json:"root"`
+	Git  bool   `json:"git"`
+}
+
+// ListProjects returns every root followed by its non-hidden subdirectories,
+// sorted by name. Roots that don't exist are skipped.
+func ListProjects(roots []string) []Project {
+	projects := []Project{}
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		projects = append(projects, Project{Name: filepath.Base(root), Path: root, Root: root, Git: isGitRepo(root)})
+
+		var children []Project
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(root, entry.Name())
+			// Follow symlinks, but only to directories that stay inside the root.
+			if _, err := ResolveWorkingDir([]string{root}, path); err != nil {
+				continue
+			}
+			children = append(children, Project{Name: entry.Name(), Path: path, Root: root, Git: isGitRepo(path)})
+		}
+		sort.Slice(children, func(i, j int) bool {
+			return strings.ToLower(children[i].Name) < strings.ToLower(children[j].Name)
+		})
+		projects = append(projects, children...)
+	}
+	return projects
+}
+
+func isGitRepo(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// usernameDir matches usernames that are safe to use as a directory name.
+var usernameDir = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// IsSafeUsername reports whether a username can name a workspace directory.
+func IsSafeUsername(username string) bool {
+	return usernameDir.MatchString(username)
+}
+
+// WorkspaceOptions configures where users' files live and which OS user
+// their processes run as.
+type WorkspaceOptions struct {
+	Base            string   // the shared workspace, or the parent of per-user ones
+	ExtraRoots      []string // further directories every user's sessions may run in
+	ClaudeConfigDir string   // the CLI's state dir for the shared workspace
+	DataDir         string   // server-private files of users of the shared workspace (uploads, recordings)
+	PerUser         bool     // give every user their own <Base>/<username>
+	UIDBase         int      // first UID/GID handed out to users (0 = run as the server's user)
+	Sandbox         *Sandbox // start users' processes in the sandbox (nil = directly on the host)
+}
+
+// Workspace is a user's root directory and the OS identity their terminal
+// and Claude processes run as.
+type Workspace struct {
+	UserID          uuid.UUID
+	Username        string
+	Dir             string   // default working directory (and HOME when per-user)
+	Roots           []string // directories sessions may run in, Dir first
+	ClaudeConfigDir string   // where the CLI keeps this user's transcripts
+	UID, GID        int      // -1: processes run as the server's own user
+
+	perUser bool
+	base    string        // WorkspaceOptions.Base
+	dataDir string        // WorkspaceOptions.DataDir
+	sandbox *Sandbox      // nil: processes start directly on the host
+	limits  SandboxLimits // the user's share of the sandbox
+}
+
+// Isolated reports whether the user's processes run under their own UID.
+func (w *Workspace) Isolated() bool {
+	return w.UID >= 0
+}
+
+// ProcessOwner returns the UID/GID the user's processes run as (-1: the
+// server's own user).
+func (w *Workspace) ProcessOwner() (uid, gid int) {
+	if !w.Isolated() && w.Sandboxed() {
+		return w.sandbox.opts.UID, w.sandbox.opts.GID
+	}
+	return w.UID, w.GID
+}
+
+// Sandboxed reports whether the user's processes start in the sandbox.
+func (w *Workspace) Sandboxed() bool {
+	return w.sandbox != nil
+}
+
+// privateDir holds files the server keeps for the user: their workspace
+// when it's their own, else a directory of theirs in the data dir, out of
+// reach of the shared workspace's file browser.
+func (w *Workspace) privateDir() string {
+	if w.perUser {
+		return w.Dir
+	}
+	return filepath.Join(w.dataDir, "users", w.UserID.String())
+}
+
+// AttachmentsDir is where the uploads of one of the user's chat sessions live.
+func (w *Workspace) AttachmentsDir(sessionID uuid.UUID) string {
+	return filepath.Join(w.privateDir(), ".attachments", sessionID.String())
+}
+
+// History gives access to the user's CLI transcripts.
+func (w *Workspace) History() *ClaudeHistory {
+	return NewClaudeHistory(w.ClaudeConfigDir)
+}
+
+// Environ returns the environment for the user's processes. Per-user
+// workspaces get an allowlisted copy of the server's environment, so secrets
+// such as JWT_SECRET or DB_PASSWORD never reach a user's shell, pointed at
+// the user's home and CLI state dir.
+func (w *Workspace) Environ() []string {
+	if !w.perUser {
+		return os.Environ()
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if userEnvKeys[key] || strings.HasPrefix(key, "LC_") ||
+			strings.HasPrefix(key, "ANTHROPIC_") || strings.HasPrefix(key, "CLAUDE_CODE_") {
+			env = append(env, kv)
+		}
+	}
+	return append(env,
+		"HOME="+w.Dir,
+		"USER="+w.Username,
+		"LOGNAME="+w.Username,
+		"CLAUDE_CONFIG_DIR="+w.ClaudeConfigDir,
+	)
+}
+
+// Server environment variables passed on to per-user processes.
+var userEnvKeys = map[string]bool{
+	"PATH": true, "LANG": true, "LANGUAGE": true, "TZ": true, "TMPDIR": true, "SHELL": true,
+	"HTTP_PROXY": true, "HTTPS_PROXY": true, "NO_PROXY": true,
+	"http_proxy": true, "https_proxy": true, "no_proxy": true,
+}
+
+// Own hands path, everything below it and its parents up to Dir over to the
+// user, so files the server creates on their behalf stay usable from their
+// shell. No-op unless the workspace is isolated.
+func (w *Workspace) Own(path string) error {
+	if !w.Isolated() {
+		return nil
+	}
+	if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	err := filepath.WalkDir(path, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, w.UID, w.GID)
+	})
+	if err != nil {
+		return err
+	}
+	for dir := filepath.Dir(path); IsWithinDir(w.Dir, dir) && dir != w.Dir; dir = filepath.Dir(dir) {
+		if err := os.Lchown(dir, w.UID, w.GID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WorkspaceManager hands out users' workspaces, creating per-user directories
+// and allocating UIDs on first use.
+type WorkspaceManager struct {
+	db   *gorm.DB
+	opts WorkspaceOptions
+
+	mu sync.Mutex // serializes UID allocation and directory setup
+}
+
+func NewWorkspaceManager(db *gorm.DB, opts WorkspaceOptions) *WorkspaceManager {
+	if opts.UIDBase > 0 && (!opts.PerUser || os.Geteuid() != 0) {
+		log.Printf("[Workspace] per-user UIDs disabled: they need per-user workspaces and a server running as root")
+		opts.UIDBase = 0
+	}
+	return &WorkspaceManager{db: db, opts: opts}
+}
+
+// For returns the workspace of a user.
+func (m *WorkspaceManager) For(userID uuid.UUID) (*Workspace, error) {
+	if !m.opts.PerUser && m.opts.Sandbox == nil {
+		return m.shared(userID), nil
+	}
+
+	var user models.User
+	if err := m.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+	if !m.opts.PerUser {
+		ws := m.shared(userID)
+		ws.Username = user.Username
+		ws.limits = m.opts.Sandbox.Limits(user.Sandbox)
+		return ws, nil
+	}
+
+	name := user.Username
+	if !IsSafeUsername(name) {
+		name = user.ID.String()
+	}
+	dir := filepath.Join(m.opts.Base, name)
+	ws := &Workspace{
+		UserID:          user.ID,
+		Username:        user.Username,
+		Dir:             dir,
+		Roots:           append([]string{dir}, m.opts.ExtraRoots...),
+		ClaudeConfigDir: filepath.Join(dir, ".claude"),
+		UID:             -1,
+		GID:             -1,
+		perUser:         true,
+		base:            m.opts.Base,
+		dataDir:         m.opts.DataDir,
+		sandbox:         m.opts.Sandbox,
+	}
+	if ws.sandbox != nil {
+		ws.limits = ws.sandbox.Limits(user.Sandbox)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.opts.UIDBase > 0 {
+		uid, err := m.unixUID(&user)
+		if err != nil {
+			return nil, fmt.Errorf("allocate uid for %s: %w", user.Username, err)
+		}
+		ws.UID, ws.GID = uid, uid
+	}
+	if err := m.prepare(ws, &user); err != nil {
+		return nil, fmt.Errorf("prepare workspace %s: %w", dir, err)
+	}
+	return ws, nil
+}
+
+// shared is the workspace every user gets without per-user workspaces.
+func (m *WorkspaceManager) shared(userID uuid.UUID) *Workspace {
+	return &Workspace{
+		UserID:          userID,
+		Dir:             m.opts.Base,
+		Roots:           append([]string{m.opts.Base}, m.opts.ExtraRoots...),
+		ClaudeConfigDir: m.opts.ClaudeConfigDir,
+		UID:             -1,
+		GID:             -1,
+		base:            m.opts.Base,
+		dataDir:         m.opts.DataDir,
+		sandbox:         m.opts.Sandbox,
+	}
+}
+
+// unixUID returns the user's UID, allocating the next free one the first time.
+func (m *WorkspaceManager) unixUID(user *models.User) (int, error) {
+	if user.UnixUID != nil {
+		return *user.UnixUID, nil
+	}
+	var highest sql.NullInt64
+	if err := m.db.Model(&models.User{}).Select("MAX(unix_uid)").Scan(&highest).Error; err != nil {
+		return 0, err
+	}
+	uid := m.opts.UIDBase
+	if highest.Valid && int(highest.Int64) >= uid {
+		uid = int(highest.Int64) + 1
+	}
+	if err := m.db.Model(user).Update("unix_uid", uid).Error; err != nil {
+		return 0, err
+	}
+	user.UnixUID = &uid
+	return uid, nil
+}
+
+// prepare creates the workspace directory, private to its user, and records
+// it as theirs. A directory that already exists is only taken as the
+// workspace if it was recorded for the user, or an admin has handed it over
+// to their UID: a username may well match a project folder under the shared
+// base, which must not be handed over (or locked away from everyone else).
+func (m *WorkspaceManager) prepare(ws *Workspace, user *models.User) error {
+	if err := os.MkdirAll(filepath.Dir(ws.Dir), 0755); err != nil {
+		return err
+	}
+	err := os.Mkdir(ws.Dir, 0700)
+	if err == nil {
+		if err := ws.Own(ws.Dir); err != nil {
+			os.Remove(ws.Dir)
+			return err
+		}
+		if err := m.recordWorkspace(user, ws.Dir); err != nil {
+			os.Remove(ws.Dir)
+			return err
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	info, err := os.Lstat(ws.Dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrWorkspaceTaken, ws.Dir)
+	}
+	ownedByUser := ws.Isolated() && fileUID(info) == ws.UID
+	if user.WorkspaceDir != ws.Dir {
+		if !ownedByUser {
+			return fmt.Errorf("%w: %s was not created for %s", ErrWorkspaceTaken, ws.Dir, user.Username)
+		}
+		// Only root can have given it to the user's UID: an admin handed it over.
+		return m.recordWorkspace(user, ws.Dir)
+	}
+	if ws.Isolated() && !ownedByUser {
+		// E.g. created before UIDs were turned on: an admin has to hand it
+		// over (chown -R UID:GID) after checking it is the user's.
+		return fmt.Errorf("%w: %s is not owned by uid %d", ErrWorkspaceTaken, ws.Dir, ws.UID)
+	}
+	return nil
+}
+
+// recordWorkspace remembers dir as the user's workspace.
+func (m *WorkspaceManager) recordWorkspace(user *models.User, dir string) error {
+	if err := m.db.Model(user).Update("workspace_dir", dir).Error; err != nil {
+		return err
+	}
+	user.WorkspaceDir = dir
+	return nil
+}
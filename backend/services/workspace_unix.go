@@ -0,0 +1,26 @@
+//go:build !windows
+
+package services
+
+import (
+	"os"
+	"syscall"
+)
+
+// SysProcAttr makes a process run as the workspace's user. Nil when the
+// workspace isn't isolated.
+func (w *Workspace) SysProcAttr() *syscall.SysProcAttr {
+	if !w.Isolated() {
+		return nil
+	}
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(w.UID), Gid: uint32(w.GID), Groups: []uint32{}},
+	}
+}
+
+func fileUID(info os.FileInfo) int {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid)
+	}
+	return -1
+}
@@ -0,0 +1,16 @@
+package services
+
+import (
+	"os"
+	"syscall"
+)
+
+// SysProcAttr is always nil on Windows: workspaces are never isolated there
+// (os.Geteuid reports -1, so per-user UIDs stay disabled).
+func (w *Workspace) SysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func fileUID(info os.FileInfo) int {
+	return -1
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
@@ -16,6 +17,7 @@ import (
 	"nebulide/database"
 	"nebulide/middleware"
 	"nebulide/models"
+	"nebulide/services"
 	"nebulide/utils"
 )
 
@@ -35,6 +37,7 @@ func SetupTestDB() *gorm.DB {
 	dsn := fmt.Sprintf("file:memdb%d?mode=memory&cache=shared", n)
 	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
 	})
 	if err != nil {
 		panic("failed to connect to test database: " + err.Error())
@@ -46,10 +49,16 @@ func SetupTestDB() *gorm.DB {
 		&models.ChatSession{},
 		&models.Message{},
 		&models.RefreshToken{},
+		&models.UsageRecord{},
 	)
 	if err != nil {
 		panic("failed to run migrations: " + err.Error())
 	}
+	for _, stmt := range database.UniqueIndexes {
+		if err := db.Exec(stmt).Error; err != nil {
+			panic("failed to create index: " + err.Error())
+		}
+	}
 
 	// Set the global DB variable used by handlers
 	database.DB = db
@@ -66,11 +75,23 @@ func TestConfig() *config.Config {
 		JWTRefreshExpiry:   168 * time.Hour,
 		ClaudeAllowedTools: "Read,Write",
 		ClaudeWorkingDir:   "/tmp/nebulide-test",
+		DataDir:            "/tmp/nebulide-test-data",
 		AdminUsername:      "admin",
 		AdminPassword:      "admin123",
 	}
 }
 
+// TestLockout returns a LoginLockout backed by an unreachable Redis client.
+// Every Redis call fails fast, so lockout checks behave as "not locked".
+func TestLockout() *services.LoginLockout {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:        "127.0.0.1:1",
+		DialTimeout: 100 * time.Millisecond,
+		MaxRetries:  -1,
+	})
+	return services.NewLoginLockout(rdb)
+}
+
 // SetupTestRouter creates a Gin router in test mode with auth middleware configured.
 func SetupTestRouter(cfg *config.Config) *gin.Engine {
 	gin.SetMode(gin.TestMode)
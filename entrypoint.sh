@@ -46,7 +46,12 @@ fi
 # Symlink nebulide user SSH → root SSH (same keys, avoids duplication)
 ln -sfn "$SSH_TARGET" /home/nebulide/.ssh
 
-# Ensure workspace ownership (volume mount may override)
-chown -R nebulide:nebulide /home/nebulide/workspace 2>/dev/null || true
+# Ensure workspace ownership (volume mount may override). Per-user workspaces
+# with their own UIDs belong to their users, so only the base is ours then.
+if [ "$WORKSPACE_PER_USER" = "true" ] && [ "${WORKSPACE_UID_BASE:-0}" != "0" ]; then
+  chown nebulide:nebulide "$WORKSPACE" 2>/dev/null || true
+else
+  chown -R nebulide:nebulide "$WORKSPACE" 2>/dev/null || true
+fi
 
 exec "$@"
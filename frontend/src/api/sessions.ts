@@ -5,10 +5,31 @@ export interface ChatSession {
   title: string;
   claude_session_id: string;
   working_directory: string;
+  pinned: boolean;
+  archived: boolean;
+  tags: string[] | null;
   created_at: string;
   updated_at: string;
 }
 
+export interface SessionPage {
+  sessions: ChatSession[];
+  next_cursor: string;
+}
+
+export interface SessionListParams {
+  tag?: string[];
+  archived?: 'true' | 'false' | 'all';
+  pinned?: boolean;
+  working_directory?: string;
+  from?: string;
+  to?: string;
+  sort?: 'updated_at' | 'created_at' | 'title';
+  order?: 'asc' | 'desc';
+  limit?: number;
+  cursor?: string;
+}
+
 export interface Message {
   id: string;
   session_id: string;
@@ -19,8 +40,8 @@ export interface Message {
   created_at: string;
 }
 
-export const getSessions = () =>
-  api.get<ChatSession[]>('/sessions');
+export const getSessions = (params?: SessionListParams) =>
+  api.get<SessionPage>('/sessions', { params, paramsSerializer: { indexes: null } });
 
 export const createSession = (title?: string, workingDirectory?: string) =>
   api.post<ChatSession>('/sessions', { title, working_directory: workingDirectory });
@@ -28,7 +49,10 @@ export const createSession = (title?: string, workingDirectory?: string) =>
 export const deleteSession = (id: string) =>
   api.delete(`/sessions/${id}`);
 
-export const updateSession = (id: string, data: { title?: string; working_directory?: string }) =>
+export const updateSession = (
+  id: string,
+  data: { title?: string; working_directory?: string; pinned?: boolean; archived?: boolean; tags?: string[] },
+) =>
   api.put<ChatSession>(`/sessions/${id}`, data);
 
 export const getMessages = (sessionId: string) =>
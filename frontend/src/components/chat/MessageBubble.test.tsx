@@ -57,6 +57,13 @@ describe('MessageBubble', () => {
     expect(screen.getByTestId('markdown')).toHaveTextContent('**bold text**');
   });
 
+  it('renders stored assistant replies that look like JSON unchanged', () => {
+    const content = '{\n  "name": "nebulide",\n  "private": true\n}';
+    render(<MessageBubble role="assistant" content={content} />);
+
+    expect(screen.getByTestId('markdown').textContent).toBe(content);
+  });
+
   it('shows streaming cursor when isStreaming is true for assistant', () => {
     const { container } = render(
       <MessageBubble role="assistant" content="Streaming content..." isStreaming={true} />
@@ -14,7 +14,6 @@ interface MessageBubbleProps {
 
 export default function MessageBubble({ role, content, isStreaming, onContextMenu }: MessageBubbleProps) {
   const isUser = role === 'user';
-  const displayContent = role === 'assistant' ? parseAssistantContent(content) : content;
 
   const { handlers: longPressHandlers } = useLongPress({
     onLongPress: (x, y) => onContextMenu?.(x, y),
@@ -52,7 +51,7 @@ export default function MessageBubble({ role, content, isStreaming, onContextMen
         {...longPressHandlers}
       >
         {isUser ? (
-          <p className="whitespace-pre-wrap">{displayContent}</p>
+          <p className="whitespace-pre-wrap">{content}</p>
         ) : (
           <div className="prose prose-invert prose-sm max-w-none">
             <ReactMarkdown
@@ -93,7 +92,7 @@ export default function MessageBubble({ role, content, isStreaming, onContextMen
                 },
               }}
             >
-              {displayContent}
+              {content}
             </ReactMarkdown>
             {isStreaming && (
               <span
@@ -107,29 +106,3 @@ export default function MessageBubble({ role, content, isStreaming, onContextMen
     </div>
   );
 }
-
-export function parseAssistantContent(raw: string): string {
-  const lines = raw.split('\n').filter(Boolean);
-  const textParts: string[] = [];
-
-  for (const line of lines) {
-    try {
-      const event = JSON.parse(line);
-
-      if (event.type === 'assistant' && event.message?.content) {
-        for (const block of event.message.content) {
-          if (block.type === 'text') textParts.push(block.text);
-          if (block.type === 'tool_use') {
-            textParts.push(`\n\`\`\`\nTool: ${block.name}\nInput: ${JSON.stringify(block.input, null, 2)}\n\`\`\`\n`);
-          }
-        }
-      } else if (event.type === 'result') {
-        if (event.result) textParts.push(event.result);
-      }
-    } catch {
-      textParts.push(line);
-    }
-  }
-
-  return textParts.join('') || raw;
-}
@@ -1,5 +1,5 @@
 import { useEffect, useRef, useState, useCallback } from 'react';
-import MessageBubble, { parseAssistantContent } from './MessageBubble';
+import MessageBubble from './MessageBubble';
 import ContextMenu, { type ContextMenuItem } from '../files/ContextMenu';
 import type { Message } from '../../api/sessions';
 import toast from 'react-hot-toast';
@@ -43,19 +43,13 @@ export default function MessageList({ messages, streamContent, isStreaming }: Me
 
     switch (action) {
       case 'copy': {
-        const text = message.role === 'assistant'
-          ? parseAssistantContent(message.content)
-          : message.content;
-        navigator.clipboard.writeText(text)
+        navigator.clipboard.writeText(message.content)
           .then(() => toast.success('Copied'))
           .catch(() => toast.error('Failed to copy'));
         break;
       }
       case 'copy-md': {
-        const raw = message.role === 'assistant'
-          ? parseAssistantContent(message.content)
-          : message.content;
-        navigator.clipboard.writeText(raw)
+        navigator.clipboard.writeText(message.content)
           .then(() => toast.success('Copied as Markdown'))
           .catch(() => toast.error('Failed to copy'));
         break;
@@ -37,6 +37,12 @@ function getSavedFontSize(): number {
 // Module-level Map — survives any React remount (layout changes, tab switches).
 // Each terminal instance (identified by instanceId) has its own xterm + WebSocket.
 
+/** Resource usage of the shell's process tree, pushed by the backend after each sample. */
+interface TerminalStatus {
+  stats: { cpu_percent: number; rss_bytes: number; processes: number; sampled_at: string };
+  limits: { memory_mb: number; cpu_percent: number; processes: number };
+}
+
 interface TermSession {
   xterm: XTerm;
   fitAddon: FitAddon;
@@ -46,6 +52,7 @@ interface TermSession {
   reconnectTimer: number | null;
   reconnectAttempts: number;
   notifyRerender: (() => void) | null;
+  status: TerminalStatus | null;
 }
 
 const sessions = new Map<string, TermSession>();
@@ -76,6 +83,7 @@ function createXterm(instanceId: string): TermSession {
     reconnectTimer: null,
     reconnectAttempts: 0,
     notifyRerender: null,
+    status: null,
   };
 
   const xterm = new XTerm({
@@ -138,6 +146,28 @@ const _green = (s: string) => `\x1b[38;2;74;222;128m${s}\x1b[0m`;
 const _yellow = (s: string) => `\x1b[38;2;251;191;36m${s}\x1b[0m`;
 const _red = (s: string) => `\x1b[38;2;248;113;113m${s}\x1b[0m`;
 
+/** Text frames are JSON control messages; anything else is written as-is. */
+function handleControlMessage(session: TermSession, data: string) {
+  let msg: { type?: string; message?: string } & Partial<TerminalStatus>;
+  try {
+    msg = JSON.parse(data);
+  } catch {
+    session.xterm.write(data);
+    return;
+  }
+  switch (msg.type) {
+    case 'status':
+      session.status = { stats: msg.stats!, limits: msg.limits! };
+      break;
+    case 'notice':
+      session.xterm.write('\r\n' + _yellow(`[${msg.message}]`) + '\r\n');
+      break;
+    case 'error':
+      session.xterm.write(_red(`[${msg.message}]`) + '\r\n');
+      break;
+  }
+}
+
 async function connectWs(instanceId: string): Promise<void> {
   const session = sessions.get(instanceId);
   if (!session) return;
@@ -211,7 +241,7 @@ async function connectWs(instanceId: string): Promise<void> {
     if (event.data instanceof ArrayBuffer) {
       session.xterm.write(new Uint8Array(event.data));
     } else {
-      session.xterm.write(event.data);
+      handleControlMessage(session, event.data);
     }
   };
 
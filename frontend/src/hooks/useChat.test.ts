@@ -0,0 +1,25 @@
+import { describe, it, expect } from 'vitest';
+import { parseAssistantContent } from './useChat';
+
+describe('parseAssistantContent', () => {
+  it('extracts the reply from stream-json lines', () => {
+    const raw = [
+      '{"type":"system","subtype":"init","session_id":"s1"}',
+      '{"type":"assistant","message":{"content":[{"type":"text","text":"Hello"}]}}',
+      '{"type":"result","subtype":"success","result":"Hello"}',
+      '',
+    ].join('\n');
+
+    expect(parseAssistantContent(raw)).toBe('Hello');
+  });
+
+  it('falls back to the result when no text was streamed', () => {
+    expect(parseAssistantContent('{"type":"result","result":"Done"}\n')).toBe('Done');
+  });
+
+  it('keeps the line breaks of lines that are not events', () => {
+    const raw = '{"type":"assistant","message":{"content":[{"type":"text","text":"A"}]}}\nplain one\nplain two\n';
+
+    expect(parseAssistantContent(raw)).toBe('Aplain one\nplain two\n');
+  });
+});
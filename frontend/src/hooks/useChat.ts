@@ -78,7 +78,7 @@ export function useChat(sessionId: string | null) {
             id: crypto.randomUUID(),
             session_id: sessionId || '',
             role: 'assistant',
-            content: streamContentRef.current,
+            content: parseAssistantContent(streamContentRef.current),
             tokens_used: 0,
             created_at: new Date().toISOString(),
           };
@@ -134,3 +134,33 @@ export function useChat(sessionId: string | null) {
     disconnect,
   };
 }
+
+// parseAssistantContent turns a live stream buffer (one stream-json event per
+// line) into the text of the assistant's reply.
+export function parseAssistantContent(raw: string): string {
+  const lines = raw.split('\n').filter(Boolean);
+  const textParts: string[] = [];
+  let result = '';
+
+  for (const line of lines) {
+    try {
+      const event = JSON.parse(line);
+
+      if (event.type === 'assistant' && event.message?.content) {
+        for (const block of event.message.content) {
+          if (block.type === 'text') textParts.push(block.text);
+          if (block.type === 'tool_use') {
+            textParts.push(`\n\`\`\`\nTool: ${block.name}\nInput: ${JSON.stringify(block.input, null, 2)}\n\`\`\`\n`);
+          }
+        }
+      } else if (event.type === 'result') {
+        if (event.result) result = event.result;
+      }
+    } catch {
+      textParts.push(line + '\n');
+    }
+  }
+
+  // The result repeats the final text; it only stands in when nothing else came.
+  return textParts.join('') || result || raw;
+}